@@ -12,6 +12,7 @@ import (
 	serviceserial "github.com/BertoldVdb/go-ble/bleatt/service/serial"
 	hcidrivers "github.com/BertoldVdb/go-ble/hci/drivers"
 	"github.com/BertoldVdb/go-ble/hci/drivers/btsnoop"
+	"github.com/BertoldVdb/go-ble/hci/drivers/pcapng"
 	bleutil "github.com/BertoldVdb/go-ble/util"
 	bleutilparam "github.com/BertoldVdb/go-ble/util/param"
 	"github.com/BertoldVdb/go-misc/logrusconfig"
@@ -63,6 +64,8 @@ func main() {
 	rdUUIDString := flag.String("rduuid", "", "Read UUID to use")
 	wrUUIDString := flag.String("wruuid", "", "Write UUID to use")
 	logfile := flag.String("btsnoop", "", "Write btsnoop file to path")
+	pcapfile := flag.String("pcapng", "", "Write pcapng file to path")
+	pcappipe := flag.String("pcapng-pipe", "", "Stream pcapng to a named pipe at path, for wireshark -k -i path")
 	bleutilparam.Init()
 	logrusconfig.InitParam()
 	flag.Parse()
@@ -91,6 +94,20 @@ func main() {
 		}
 	}
 
+	if *pcapfile != "" {
+		dev, err = pcapng.WrapFile(dev, *pcapfile, nil)
+		if err != nil {
+			logger.Fatalln(err)
+		}
+	}
+
+	if *pcappipe != "" {
+		dev, err = pcapng.WrapPipe(dev, *pcappipe, nil)
+		if err != nil {
+			logger.Fatalln(err)
+		}
+	}
+
 	config := ble.DefaultConfig()
 	config.HCIControllerConfig.PrivacyConnect = false
 	config.BLEScannerUse = false
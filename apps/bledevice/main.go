@@ -10,6 +10,7 @@ import (
 	attperipheral "github.com/BertoldVdb/go-ble/bleatt/helpers/peripheral"
 	hcidrivers "github.com/BertoldVdb/go-ble/hci/drivers"
 	"github.com/BertoldVdb/go-ble/hci/drivers/btsnoop"
+	"github.com/BertoldVdb/go-ble/hci/drivers/pcapng"
 	bleutil "github.com/BertoldVdb/go-ble/util"
 	bleutilparam "github.com/BertoldVdb/go-ble/util/param"
 	"github.com/BertoldVdb/go-misc/logrusconfig"
@@ -27,6 +28,8 @@ func main() {
 	destination := flag.String("destination", "", "Address to connect to. When unset, return received data")
 	multiple := flag.Bool("multi", false, "Try to accept multiple connections")
 	logfile := flag.String("btsnoop", "", "Write btsnoop file to path")
+	pcapfile := flag.String("pcapng", "", "Write pcapng file to path")
+	pcappipe := flag.String("pcapng-pipe", "", "Stream pcapng to a named pipe at path, for wireshark -k -i path")
 
 	logrusconfig.InitParam()
 	bleutilparam.Init()
@@ -57,6 +60,20 @@ func main() {
 		}
 	}
 
+	if *pcapfile != "" {
+		dev, err = pcapng.WrapFile(dev, *pcapfile, nil)
+		if err != nil {
+			logger.Fatalln(err)
+		}
+	}
+
+	if *pcappipe != "" {
+		dev, err = pcapng.WrapPipe(dev, *pcappipe, nil)
+		if err != nil {
+			logger.Fatalln(err)
+		}
+	}
+
 	m := multirun.MultiRun{}
 	m.HandleSIGTERM()
 
@@ -26,6 +26,15 @@ type BLEAdvertiser struct {
 
 	legacyAdvertisingSlots    []*LegacyAdvertisingSlot
 	legacyAdvertisingBaseSlot *LegacyAdvertisingSlot
+
+	extendedMode                  int32 /* Set by Run, read atomically */
+	extendedNumSets               int
+	extendedMaxDataLength         int
+	extendedAdvertisingMutex      sync.Mutex
+	extendedAdvertisingSets       []*ExtendedAdvertisingSet
+	extendedAdvertisingUpdateChan chan (int)
+
+	addressBlockedChan chan (struct{})
 }
 
 type BLEAdvertiserConfig struct {
@@ -56,7 +65,9 @@ func New(logger *logrus.Entry, ctrl *hci.Controller, config *BLEAdvertiserConfig
 		ctrl:   ctrl,
 		config: config,
 
-		legacyAdvertisingUpdateChan: make(chan (int), 1),
+		legacyAdvertisingUpdateChan:   make(chan (int), 1),
+		extendedAdvertisingUpdateChan: make(chan (int), 1),
+		addressBlockedChan:            make(chan (struct{}), 1),
 	}
 
 	return a
@@ -65,6 +76,13 @@ func New(logger *logrus.Entry, ctrl *hci.Controller, config *BLEAdvertiserConfig
 func (a *BLEAdvertiser) Run() error {
 	defer a.Close()
 
+	handle := a.ctrl.AddRandomAddressHandler(a.randomAddressChanged)
+	defer a.ctrl.RemoveRandomAddressHandler(handle)
+
+	if err := a.extendedAdvertisingInit(); err != nil {
+		return err
+	}
+
 	return a.legacyAdvertisingManager()
 }
 
@@ -72,10 +90,27 @@ func (a *BLEAdvertiser) Close() error {
 	return a.closeflag.Close()
 }
 
+/* Sets using the random address need to pick up a new one, a refused one may be caused by legacy advertising */
+func (a *BLEAdvertiser) randomAddressChanged(addr bleutil.MacAddr, err error) {
+	if err == nil {
+		a.StateChanged()
+		return
+	}
+
+	select {
+	case a.addressBlockedChan <- struct{}{}:
+	default:
+	}
+}
+
 func (a *BLEAdvertiser) StateChanged() error {
 	select {
 	case a.legacyAdvertisingUpdateChan <- -1:
 	default:
 	}
+	select {
+	case a.extendedAdvertisingUpdateChan <- -1:
+	default:
+	}
 	return nil
 }
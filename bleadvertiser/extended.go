@@ -0,0 +1,652 @@
+package bleadvertiser
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	hcicommands "github.com/BertoldVdb/go-ble/hci/commands"
+	deviceinfo "github.com/BertoldVdb/go-ble/hci/information"
+	bleutil "github.com/BertoldVdb/go-ble/util"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	ErrorNoAdvertisingSet       = errors.New("No free advertising set is available in the controller")
+	ErrorExtendedPayloadTooLong = errors.New("Advertising payload exceeds the extended advertising limit")
+	ErrorPeriodicUnsupported    = errors.New("Controller does not support periodic advertising")
+	ErrorPeriodicNotAllowed     = errors.New("Periodic advertising requires a non-connectable, non-scannable extended set")
+)
+
+const (
+	extendedAdvertisingMaxData  = 1650
+	extendedAdvertisingFragment = 251
+
+	/* Handle 0 is used to run the legacy slots when the controller is in extended mode */
+	extendedAdvertisingLegacyHandle = 0
+)
+
+type ExtendedAdvertisingProperties uint16
+
+const (
+	ExtendedAdvertisingConnectable      ExtendedAdvertisingProperties = 0x01
+	ExtendedAdvertisingScannable        ExtendedAdvertisingProperties = 0x02
+	ExtendedAdvertisingDirected         ExtendedAdvertisingProperties = 0x04
+	ExtendedAdvertisingHighDutyDirected ExtendedAdvertisingProperties = 0x08
+	ExtendedAdvertisingLegacy           ExtendedAdvertisingProperties = 0x10
+	ExtendedAdvertisingAnonymous        ExtendedAdvertisingProperties = 0x20
+	ExtendedAdvertisingIncludeTxPower   ExtendedAdvertisingProperties = 0x40
+)
+
+type AdvertisingPHY uint8
+
+const (
+	AdvertisingPHY1M    AdvertisingPHY = 1
+	AdvertisingPHY2M    AdvertisingPHY = 2
+	AdvertisingPHYCoded AdvertisingPHY = 3
+)
+
+type ExtendedAdvertisingData struct {
+	Active       bool
+	Data         []byte
+	ScanData     []byte
+	Properties   ExtendedAdvertisingProperties
+	PeerAddr     bleutil.BLEAddr
+	IntervalMin  uint32
+	IntervalMax  uint32
+	PrimaryPHY   AdvertisingPHY
+	SecondaryPHY AdvertisingPHY
+	SID          uint8
+	UseTxPower   bool
+	TxPower      int8
+	UseAllowlist bool
+	AddrType     bleutil.MacAddrType
+
+	/* When not zero the set stops advertising this long after the data was replaced */
+	Lifetime time.Duration
+
+	/* Periodic advertising train carried by this set, intervals are in units of 1.25ms */
+	Periodic               bool
+	PeriodicData           []byte
+	PeriodicIntervalMin    uint16
+	PeriodicIntervalMax    uint16
+	PeriodicIncludeTxPower bool
+
+	version uint64
+}
+
+type ExtendedAdvertisingSet struct {
+	parent *BLEAdvertiser
+	valid  bool
+	index  int
+	data   ExtendedAdvertisingData
+
+	/* Only used by the manager goroutine */
+	handle          uint8
+	enabled         bool
+	periodicEnabled bool
+	configured      bool
+	appliedVersion  uint64
+	appliedAddr     bleutil.MacAddr
+	expires         time.Time
+	expiresVersion  uint64
+	legacySlot      *LegacyAdvertisingSlot
+}
+
+func (s *ExtendedAdvertisingSet) notify() {
+	select {
+	case s.parent.extendedAdvertisingUpdateChan <- s.index:
+	default:
+	}
+}
+
+func (s *ExtendedAdvertisingSet) Close() {
+	s.parent.extendedAdvertisingMutex.Lock()
+	defer s.parent.extendedAdvertisingMutex.Unlock()
+
+	s.valid = false
+	s.notify()
+}
+
+func (s *ExtendedAdvertisingSet) GetData() (ExtendedAdvertisingData, error) {
+	s.parent.extendedAdvertisingMutex.Lock()
+	defer s.parent.extendedAdvertisingMutex.Unlock()
+
+	return s.data, nil
+}
+
+func (s *ExtendedAdvertisingSet) ReplaceData(force bool, new ExtendedAdvertisingData) (ExtendedAdvertisingData, error) {
+	if len(new.Data) > extendedAdvertisingMaxData || len(new.ScanData) > extendedAdvertisingMaxData || len(new.PeriodicData) > extendedAdvertisingMaxData {
+		return new, ErrorExtendedPayloadTooLong
+	}
+
+	if new.Periodic && new.Properties&(ExtendedAdvertisingConnectable|ExtendedAdvertisingScannable|ExtendedAdvertisingLegacy|ExtendedAdvertisingAnonymous) > 0 {
+		return new, ErrorPeriodicNotAllowed
+	}
+
+	s.parent.extendedAdvertisingMutex.Lock()
+	defer s.parent.extendedAdvertisingMutex.Unlock()
+
+	old := s.data
+
+	if !force && new.version > 0 && new.version < old.version {
+		return new, ErrorExpired
+	}
+
+	new.version = old.version + 1
+	s.data = new
+	s.notify()
+
+	return new, nil
+}
+
+func (a *BLEAdvertiser) ExtendedAdvertisingGetSet() *ExtendedAdvertisingSet {
+	a.extendedAdvertisingMutex.Lock()
+	defer a.extendedAdvertisingMutex.Unlock()
+
+	/* Sets are reused only once the manager has removed them from the controller */
+	for i, m := range a.extendedAdvertisingSets {
+		if !m.valid && !m.configured && m.legacySlot == nil {
+			m.index = i
+			m.valid = true
+			m.data = ExtendedAdvertisingData{version: m.data.version}
+			return m
+		}
+	}
+
+	set := &ExtendedAdvertisingSet{
+		parent: a,
+		valid:  true,
+		index:  len(a.extendedAdvertisingSets),
+		handle: uint8(len(a.extendedAdvertisingSets) + 1),
+	}
+	a.extendedAdvertisingSets = append(a.extendedAdvertisingSets, set)
+
+	return set
+}
+
+/* Returns true if the controller is driven with the extended advertising commands */
+func (a *BLEAdvertiser) ExtendedAdvertisingSupported() bool {
+	return atomic.LoadInt32(&a.extendedMode) != 0
+}
+
+// PeriodicAdvertisingSupported returns true if sets can carry a periodic advertising train
+func (a *BLEAdvertiser) PeriodicAdvertisingSupported() bool {
+	return a.ExtendedAdvertisingSupported() && a.ctrl.Info.LEFeatureSupported(deviceinfo.LEFeaturePeriodicAdvertising)
+}
+
+/* The scanner and connecter follow the same decision, so there is no falling back to legacy */
+func (a *BLEAdvertiser) extendedAdvertisingInit() error {
+	if !a.ctrl.UseExtendedAdvertising() {
+		a.logger.Info("Using legacy advertising")
+		return nil
+	}
+
+	sets, err := a.ctrl.Cmds.LEReadNumberofSupportedAdvertisingSetsSync(nil)
+	if err != nil {
+		return err
+	}
+
+	maxLen, err := a.ctrl.Cmds.LEReadMaximumAdvertisingDataLengthSync(nil)
+	if err != nil {
+		return err
+	}
+
+	/* Start from a known state */
+	a.ctrl.Cmds.LEClearAdvertisingSetsSync()
+
+	a.extendedNumSets = int(sets.NumSupportedAdvertisingSets)
+	a.extendedMaxDataLength = int(maxLen.MaxAdvertisingDataLength)
+	atomic.StoreInt32(&a.extendedMode, 1)
+
+	a.logger.WithFields(logrus.Fields{
+		"0sets":      a.extendedNumSets,
+		"1maxLength": a.extendedMaxDataLength,
+	}).Info("Using extended advertising")
+	return nil
+}
+
+func extendedAdvertisingFragments(data []byte) []hcicommands.LESetExtendedAdvertisingDataInput {
+	if len(data) <= extendedAdvertisingFragment {
+		return []hcicommands.LESetExtendedAdvertisingDataInput{{
+			Operation:             3, /* Complete data */
+			FragmentPreference:    1,
+			AdvertisingDataLength: uint8(len(data)),
+			AdvertisingData:       data,
+		}}
+	}
+
+	var result []hcicommands.LESetExtendedAdvertisingDataInput
+	for offset := 0; offset < len(data); offset += extendedAdvertisingFragment {
+		end := offset + extendedAdvertisingFragment
+		op := uint8(0) /* Intermediate fragment */
+		if offset == 0 {
+			op = 1
+		}
+		if end >= len(data) {
+			end = len(data)
+			op = 2
+		}
+
+		result = append(result, hcicommands.LESetExtendedAdvertisingDataInput{
+			Operation:             op,
+			FragmentPreference:    1,
+			AdvertisingDataLength: uint8(end - offset),
+			AdvertisingData:       data[offset:end],
+		})
+	}
+
+	return result
+}
+
+func (a *BLEAdvertiser) extendedAdvertisingSetData(handle uint8, data []byte, scan bool) error {
+	if len(data) > a.extendedMaxDataLength {
+		return ErrorExtendedPayloadTooLong
+	}
+
+	for _, m := range extendedAdvertisingFragments(data) {
+		var err error
+		m.AdvertisingHandle = handle
+		if scan {
+			err = a.ctrl.Cmds.LESetExtendedScanResponseDataSync(hcicommands.LESetExtendedScanResponseDataInput{
+				AdvertisingHandle:      m.AdvertisingHandle,
+				Operation:              m.Operation,
+				FragmentPreference:     m.FragmentPreference,
+				ScanResponseDataLength: m.AdvertisingDataLength,
+				ScanResponseData:       m.AdvertisingData,
+			})
+		} else {
+			err = a.ctrl.Cmds.LESetExtendedAdvertisingDataSync(m)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (a *BLEAdvertiser) extendedAdvertisingEnable(handle uint8, enable bool) error {
+	value := uint8(0)
+	if enable {
+		value = 1
+	}
+
+	return a.ctrl.Cmds.LESetExtendedAdvertisingEnableSync(hcicommands.LESetExtendedAdvertisingEnableInput{
+		Enable:                       value,
+		NumSets:                      1,
+		AdvertisingHandle:            []uint8{handle},
+		Duration:                     []uint16{0},
+		MaxExtendedAdvertisingEvents: []uint8{0},
+	})
+}
+
+func (a *BLEAdvertiser) periodicAdvertisingEnable(handle uint8, enable bool) error {
+	value := uint8(0)
+	if enable {
+		value = 1
+	}
+
+	return a.ctrl.Cmds.LESetPeriodicAdvertisingEnableSync(hcicommands.LESetPeriodicAdvertisingEnableInput{
+		Enable:            value,
+		AdvertisingHandle: handle,
+	})
+}
+
+func (a *BLEAdvertiser) periodicAdvertisingConfigure(handle uint8, data *ExtendedAdvertisingData) error {
+	if data.PeriodicIntervalMin > data.PeriodicIntervalMax {
+		data.PeriodicIntervalMin = data.PeriodicIntervalMax
+	}
+
+	if data.PeriodicIntervalMin < 6 {
+		data.PeriodicIntervalMin = 0x50
+		data.PeriodicIntervalMax = 0x50
+	}
+
+	props := uint16(0)
+	if data.PeriodicIncludeTxPower {
+		props |= 0x40
+	}
+
+	err := a.ctrl.Cmds.LESetPeriodicAdvertisingParametersSync(hcicommands.LESetPeriodicAdvertisingParametersInput{
+		AdvertisingHandle:              handle,
+		PeriodicAdvertisingIntervalMin: data.PeriodicIntervalMin,
+		PeriodicAdvertisingIntervalMax: data.PeriodicIntervalMax,
+		PeriodicAdvertisingProperties:  props,
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(data.PeriodicData) > a.extendedMaxDataLength {
+		return ErrorExtendedPayloadTooLong
+	}
+
+	/* The periodic data command uses the same operation codes, but has no fragment preference */
+	for _, m := range extendedAdvertisingFragments(data.PeriodicData) {
+		err = a.ctrl.Cmds.LESetPeriodicAdvertisingDataSync(hcicommands.LESetPeriodicAdvertisingDataInput{
+			AdvertisingHandle:     handle,
+			Operation:             m.Operation,
+			AdvertisingDataLength: m.AdvertisingDataLength,
+			AdvertisingData:       m.AdvertisingData,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return a.periodicAdvertisingEnable(handle, true)
+}
+
+func (a *BLEAdvertiser) extendedAdvertisingConfigure(handle uint8, data *ExtendedAdvertisingData) error {
+	filterPolicy := uint8(0)
+	if data.UseAllowlist {
+		filterPolicy = 2
+	}
+
+	if data.IntervalMin > data.IntervalMax {
+		data.IntervalMin = data.IntervalMax
+	}
+
+	if data.IntervalMin == 0 {
+		data.IntervalMin = 0x30
+		data.IntervalMax = 0x60
+	}
+
+	primaryPHY := data.PrimaryPHY
+	if primaryPHY != AdvertisingPHYCoded {
+		primaryPHY = AdvertisingPHY1M
+	}
+
+	secondaryPHY := data.SecondaryPHY
+	if secondaryPHY == 0 {
+		secondaryPHY = AdvertisingPHY1M
+	}
+
+	txPower := uint8(0x7F) /* No preference */
+	if data.UseTxPower {
+		txPower = uint8(data.TxPower)
+	}
+
+	_, err := a.ctrl.Cmds.LESetExtendedAdvertisingParametersSync(hcicommands.LESetExtendedAdvertisingParametersInput{
+		AdvertisingHandle:             handle,
+		AdvertisingEventProperties:    uint16(data.Properties),
+		PrimaryAdvertisingIntervalMin: data.IntervalMin,
+		PrimaryAdvertisingIntervalMax: data.IntervalMax,
+		PrimaryAdvertisingChannelMap:  7,
+		OwnAddressType:                data.AddrType,
+		PeerAddressType:               data.PeerAddr.MacAddrType,
+		PeerAddress:                   data.PeerAddr.MacAddr,
+		AdvertisingFilterPolicy:       filterPolicy,
+		AdvertisingTXPower:            txPower,
+		PrimaryAdvertisingPHY:         uint8(primaryPHY),
+		SecondaryAdvertisingPHY:       uint8(secondaryPHY),
+		AdvertisingSID:                data.SID & 0xF,
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	if data.AddrType == bleutil.MacAddrRandom {
+		err = a.ctrl.Cmds.LESetAdvertisingSetRandomAddressSync(hcicommands.LESetAdvertisingSetRandomAddressInput{
+			AdvertisingHandle:        handle,
+			AdvertisingRandomAddress: a.ctrl.GetOwnAddress(bleutil.MacAddrRandom).MacAddr,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	err = a.extendedAdvertisingSetData(handle, data.Data, false)
+	if err != nil {
+		return err
+	}
+
+	if data.Properties&ExtendedAdvertisingScannable > 0 {
+		err = a.extendedAdvertisingSetData(handle, data.ScanData, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	/* The train starts as soon as the set itself is enabled */
+	if data.Periodic {
+		err = a.periodicAdvertisingConfigure(handle, data)
+		if err != nil {
+			return err
+		}
+	}
+
+	return a.extendedAdvertisingEnable(handle, true)
+}
+
+func extendedPropertiesFromLegacy(t LegacyAdvertisementType) ExtendedAdvertisingProperties {
+	props := ExtendedAdvertisingLegacy
+	switch t {
+	case LegacyAdvertisementTypeInd:
+		props |= ExtendedAdvertisingConnectable | ExtendedAdvertisingScannable
+	case LegacyAdvertisementTypeDirectInd:
+		props |= ExtendedAdvertisingConnectable | ExtendedAdvertisingDirected | ExtendedAdvertisingHighDutyDirected
+	case LegacyAdvertisementTypeDirectIndLowDuty:
+		props |= ExtendedAdvertisingConnectable | ExtendedAdvertisingDirected
+	case LegacyAdvertisementTypeScanInd:
+		props |= ExtendedAdvertisingScannable
+	}
+	return props
+}
+
+func legacyTypeFromExtendedProperties(props ExtendedAdvertisingProperties) LegacyAdvertisementType {
+	if props&ExtendedAdvertisingConnectable > 0 {
+		if props&ExtendedAdvertisingDirected > 0 {
+			if props&ExtendedAdvertisingHighDutyDirected > 0 {
+				return LegacyAdvertisementTypeDirectInd
+			}
+			return LegacyAdvertisementTypeDirectIndLowDuty
+		}
+		/* Legacy advertising cannot be connectable without being scannable */
+		return LegacyAdvertisementTypeInd
+	}
+	if props&ExtendedAdvertisingScannable > 0 {
+		return LegacyAdvertisementTypeScanInd
+	}
+	return LegacyAdvertisementTypeNonConnInd
+}
+
+/* Used by the legacy slot rotation when the controller only accepts extended commands */
+func (a *BLEAdvertiser) legacyAdvertisingConfigureExtended(data *LegacyAdvertisingData) error {
+	/* Disabling an already disabled set is harmless */
+	err := a.extendedAdvertisingEnable(extendedAdvertisingLegacyHandle, false)
+	if err != nil || data == nil {
+		return err
+	}
+
+	if len(data.BeaconPacket) > 31 || len(data.ScanPacket) > 31 {
+		return ErrorPayloadTooLong
+	}
+
+	return a.extendedAdvertisingConfigure(extendedAdvertisingLegacyHandle, &ExtendedAdvertisingData{
+		Data:         data.BeaconPacket,
+		ScanData:     data.ScanPacket,
+		Properties:   extendedPropertiesFromLegacy(data.Type),
+		PeerAddr:     data.PeerAddr,
+		IntervalMin:  uint32(data.IntervalMin),
+		IntervalMax:  uint32(data.IntervalMax),
+		UseAllowlist: data.UseAllowlist,
+		AddrType:     data.AddrType,
+	})
+}
+
+func (a *BLEAdvertiser) extendedAdvertisingApply(s *ExtendedAdvertisingSet, active bool, refresh bool) error {
+	if !active {
+		/* The controller refuses to remove a set that still has periodic advertising enabled */
+		if s.periodicEnabled {
+			s.periodicEnabled = false
+			err := a.periodicAdvertisingEnable(s.handle, false)
+			if err != nil {
+				return err
+			}
+		}
+		if s.enabled {
+			s.enabled = false
+			err := a.extendedAdvertisingEnable(s.handle, false)
+			if err != nil {
+				return err
+			}
+		}
+		if !s.valid && s.configured {
+			s.configured = false
+			return a.ctrl.Cmds.LERemoveAdvertisingSetSync(hcicommands.LERemoveAdvertisingSetInput{
+				AdvertisingHandle: s.handle,
+			})
+		}
+		return nil
+	}
+
+	/* The set keeps the address it was configured with, so a rotated one means configuring it again */
+	var addr bleutil.MacAddr
+	if s.data.AddrType == bleutil.MacAddrRandom {
+		addr = a.ctrl.GetOwnAddress(bleutil.MacAddrRandom).MacAddr
+	}
+
+	if s.enabled && s.appliedVersion == s.data.version && s.appliedAddr == addr {
+		/* The controller stops connectable sets on its own when a connection is made */
+		if refresh && s.data.Properties&ExtendedAdvertisingConnectable > 0 {
+			return a.extendedAdvertisingEnable(s.handle, true)
+		}
+		return nil
+	}
+
+	if int(s.handle) >= a.extendedNumSets {
+		return ErrorNoAdvertisingSet
+	}
+
+	if s.data.Periodic && !a.PeriodicAdvertisingSupported() {
+		return ErrorPeriodicUnsupported
+	}
+
+	if s.periodicEnabled {
+		s.periodicEnabled = false
+		err := a.periodicAdvertisingEnable(s.handle, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.enabled {
+		s.enabled = false
+		err := a.extendedAdvertisingEnable(s.handle, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	s.configured = true
+	s.periodicEnabled = s.data.Periodic
+	err := a.extendedAdvertisingConfigure(s.handle, &s.data)
+	if err != nil {
+		return err
+	}
+
+	s.enabled = true
+	s.appliedVersion = s.data.version
+	s.appliedAddr = addr
+	return nil
+}
+
+/* Without controller support the set is mapped on a legacy slot, which only works if it fits */
+func (a *BLEAdvertiser) extendedAdvertisingApplyLegacy(s *ExtendedAdvertisingSet, active bool) error {
+	if !active {
+		if s.legacySlot != nil {
+			s.legacySlot.Close()
+			s.legacySlot = nil
+		}
+		return nil
+	}
+
+	if s.legacySlot != nil && s.appliedVersion == s.data.version {
+		return nil
+	}
+
+	if s.data.Periodic {
+		return ErrorPeriodicUnsupported
+	}
+
+	if len(s.data.Data) > 31 || len(s.data.ScanData) > 31 {
+		if s.legacySlot != nil {
+			s.legacySlot.Close()
+			s.legacySlot = nil
+		}
+		return ErrorPayloadTooLong
+	}
+
+	intervalMin := s.data.IntervalMin
+	intervalMax := s.data.IntervalMax
+	if intervalMax > 0x4000 {
+		intervalMax = 0x4000
+	}
+	if intervalMin > intervalMax {
+		intervalMin = intervalMax
+	}
+
+	if s.legacySlot == nil {
+		s.legacySlot = a.LegacyAdvertisingGetSlot()
+	}
+
+	s.appliedVersion = s.data.version
+	_, err := s.legacySlot.ReplaceData(true, LegacyAdvertisingData{
+		Active:       true,
+		BeaconPacket: s.data.Data,
+		ScanPacket:   s.data.ScanData,
+		PeerAddr:     s.data.PeerAddr,
+		Type:         legacyTypeFromExtendedProperties(s.data.Properties),
+		IntervalMin:  uint16(intervalMin),
+		IntervalMax:  uint16(intervalMax),
+		UseAllowlist: s.data.UseAllowlist,
+		AddrType:     s.data.AddrType,
+	})
+	return err
+}
+
+// Brings the controller in line with the configured sets. The returned channel fires when the
+// lifetime of a set ends
+func (a *BLEAdvertiser) extendedAdvertisingUpdate(refresh bool) <-chan time.Time {
+	a.extendedAdvertisingMutex.Lock()
+	defer a.extendedAdvertisingMutex.Unlock()
+
+	now := time.Now()
+	var next time.Time
+
+	for _, m := range a.extendedAdvertisingSets {
+		active := m.valid && m.data.Active
+
+		if active && m.data.Lifetime > 0 {
+			if m.expiresVersion != m.data.version {
+				m.expiresVersion = m.data.version
+				m.expires = now.Add(m.data.Lifetime)
+			}
+
+			if !now.Before(m.expires) {
+				active = false
+			} else if next.IsZero() || m.expires.Before(next) {
+				next = m.expires
+			}
+		}
+
+		var err error
+		if a.ExtendedAdvertisingSupported() {
+			err = a.extendedAdvertisingApply(m, active, refresh)
+		} else {
+			err = a.extendedAdvertisingApplyLegacy(m, active)
+		}
+
+		if err != nil {
+			a.logger.WithError(err).WithField("0set", m.index).Warn("Failed to configure advertising set")
+		}
+	}
+
+	if next.IsZero() {
+		return nil
+	}
+
+	return time.After(time.Until(next))
+}
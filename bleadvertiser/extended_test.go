@@ -0,0 +1,177 @@
+package bleadvertiser
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func newTestAdvertiser() *BLEAdvertiser {
+	l := logrus.New()
+	l.Out = io.Discard
+	return &BLEAdvertiser{
+		logger:                        logrus.NewEntry(l),
+		config:                        DefaultConfig(),
+		legacyAdvertisingUpdateChan:   make(chan int, 1),
+		extendedAdvertisingUpdateChan: make(chan int, 1),
+	}
+}
+
+// Data longer than one HCI command is split in first/intermediate/last
+// fragments that together cover the input.
+func TestExtendedAdvertisingFragments(t *testing.T) {
+	small := extendedAdvertisingFragments([]byte{1, 2, 3})
+	if len(small) != 1 || small[0].Operation != 3 || small[0].AdvertisingDataLength != 3 {
+		t.Fatalf("small payload: %+v", small)
+	}
+
+	empty := extendedAdvertisingFragments(nil)
+	if len(empty) != 1 || empty[0].Operation != 3 || empty[0].AdvertisingDataLength != 0 {
+		t.Fatalf("empty payload: %+v", empty)
+	}
+
+	data := make([]byte, extendedAdvertisingMaxData)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	frags := extendedAdvertisingFragments(data)
+	if len(frags) != 7 {
+		t.Fatalf("fragments: got %d want 7", len(frags))
+	}
+
+	var joined []byte
+	for i, m := range frags {
+		want := uint8(0)
+		if i == 0 {
+			want = 1
+		} else if i == len(frags)-1 {
+			want = 2
+		}
+		if m.Operation != want {
+			t.Errorf("fragment %d: operation %d want %d", i, m.Operation, want)
+		}
+		if int(m.AdvertisingDataLength) != len(m.AdvertisingData) {
+			t.Errorf("fragment %d: length mismatch", i)
+		}
+		joined = append(joined, m.AdvertisingData...)
+	}
+
+	if !bytes.Equal(joined, data) {
+		t.Error("fragments do not reassemble to the input")
+	}
+}
+
+func TestExtendedAdvertisingPayloadLimit(t *testing.T) {
+	a := newTestAdvertiser()
+	set := a.ExtendedAdvertisingGetSet()
+
+	_, err := set.ReplaceData(true, ExtendedAdvertisingData{Data: make([]byte, extendedAdvertisingMaxData+1)})
+	if err != ErrorExtendedPayloadTooLong {
+		t.Fatalf("got %v want %v", err, ErrorExtendedPayloadTooLong)
+	}
+
+	if _, err := set.ReplaceData(true, ExtendedAdvertisingData{Data: make([]byte, extendedAdvertisingMaxData)}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExtendedLegacyPropertyMapping(t *testing.T) {
+	for _, m := range []LegacyAdvertisementType{
+		LegacyAdvertisementTypeInd,
+		LegacyAdvertisementTypeDirectInd,
+		LegacyAdvertisementTypeScanInd,
+		LegacyAdvertisementTypeNonConnInd,
+		LegacyAdvertisementTypeDirectIndLowDuty,
+	} {
+		props := extendedPropertiesFromLegacy(m)
+		if props&ExtendedAdvertisingLegacy == 0 {
+			t.Errorf("%v: legacy bit missing", m)
+		}
+		if got := legacyTypeFromExtendedProperties(props); got != m {
+			t.Errorf("%v: round trip gave %v", m, got)
+		}
+	}
+}
+
+// Without controller support, sets that fit in a legacy PDU are run on a
+// legacy slot and removed again once their lifetime ends.
+func TestExtendedAdvertisingFallback(t *testing.T) {
+	a := newTestAdvertiser()
+
+	set := a.ExtendedAdvertisingGetSet()
+	set.ReplaceData(true, ExtendedAdvertisingData{
+		Active:     true,
+		Data:       []byte{2, 1, 6},
+		Properties: ExtendedAdvertisingScannable,
+		Lifetime:   time.Hour,
+	})
+
+	big := a.ExtendedAdvertisingGetSet()
+	big.ReplaceData(true, ExtendedAdvertisingData{
+		Active: true,
+		Data:   make([]byte, 100),
+	})
+
+	if expiry := a.extendedAdvertisingUpdate(false); expiry == nil {
+		t.Error("expected an expiry timer for the set with a lifetime")
+	}
+
+	if set.legacySlot == nil {
+		t.Fatal("set was not mapped on a legacy slot")
+	}
+	if big.legacySlot != nil {
+		t.Error("oversized set must not be mapped on a legacy slot")
+	}
+
+	data, _ := set.legacySlot.GetData()
+	if !data.Active || data.Type != LegacyAdvertisementTypeScanInd || !bytes.Equal(data.BeaconPacket, []byte{2, 1, 6}) {
+		t.Errorf("legacy slot data: %+v", data)
+	}
+
+	set.expires = time.Now().Add(-time.Second)
+	a.extendedAdvertisingUpdate(false)
+	if set.legacySlot != nil {
+		t.Error("expired set still occupies a legacy slot")
+	}
+
+	set.Close()
+	a.extendedAdvertisingUpdate(false)
+	if reused := a.ExtendedAdvertisingGetSet(); reused != set {
+		t.Error("closed set was not reused")
+	}
+}
+
+// Periodic advertising is only accepted on sets that cannot be connected
+// or scanned, and cannot be emulated with legacy advertising.
+func TestPeriodicAdvertisingRestrictions(t *testing.T) {
+	a := newTestAdvertiser()
+	set := a.ExtendedAdvertisingGetSet()
+
+	_, err := set.ReplaceData(true, ExtendedAdvertisingData{
+		Active:     true,
+		Properties: ExtendedAdvertisingConnectable,
+		Periodic:   true,
+	})
+	if err != ErrorPeriodicNotAllowed {
+		t.Fatalf("got %v want %v", err, ErrorPeriodicNotAllowed)
+	}
+
+	if _, err := set.ReplaceData(true, ExtendedAdvertisingData{
+		Active:       true,
+		Periodic:     true,
+		PeriodicData: []byte{2, 1, 6},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.extendedAdvertisingApplyLegacy(set, true); err != ErrorPeriodicUnsupported {
+		t.Fatalf("got %v want %v", err, ErrorPeriodicUnsupported)
+	}
+	if set.legacySlot != nil {
+		t.Fatal("periodic set was mapped on a legacy slot")
+	}
+}
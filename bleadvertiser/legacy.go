@@ -46,6 +46,10 @@ type LegacyAdvertisingData struct {
 }
 
 func (a *BLEAdvertiser) legacyAdvertisingConfigure(data *LegacyAdvertisingData) error {
+	if a.ExtendedAdvertisingSupported() {
+		return a.legacyAdvertisingConfigureExtended(data)
+	}
+
 	var advParams hcicommands.LESetAdvertisingParametersInput
 	if data != nil {
 		filterPolicy := uint8(0)
@@ -301,6 +305,7 @@ func (a *BLEAdvertiser) legacyAdvertisingManager() error {
 
 	advIndex := 0
 	var advTick *time.Ticker
+	var expiryChan <-chan (time.Time)
 
 	setupNextAdv := func() error {
 		a.legacyAdvertisingMutex.Lock()
@@ -362,6 +367,25 @@ loop:
 				advIndex = index
 			}
 
+			setupNextAdv()
+		case index, ok := <-a.extendedAdvertisingUpdateChan:
+			if !ok {
+				break loop
+			}
+			expiryChan = a.extendedAdvertisingUpdate(index < 0)
+		case <-expiryChan:
+			expiryChan = a.extendedAdvertisingUpdate(false)
+		case <-a.addressBlockedChan:
+			/* Sets have their own address in extended mode, so only legacy advertising blocks the rotation */
+			if a.ExtendedAdvertisingSupported() {
+				break
+			}
+
+			a.legacyAdvertisingConfigure(nil)
+			err := a.ctrl.RotateResolvablePrivateAddress()
+			if err != nil {
+				a.logger.WithError(err).Warn("Failed to rotate random address while advertising")
+			}
 			setupNextAdv()
 		}
 	}
@@ -1,11 +1,13 @@
 package bleatt
 
 import (
+	"bytes"
 	"context"
 	"encoding/binary"
 	"encoding/hex"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	attstructure "github.com/BertoldVdb/go-ble/bleatt/structure"
@@ -27,11 +29,14 @@ type attClient struct {
 	parent *gattDeviceConn
 	cmdmgr *slotset.SlotSet
 
-	// 	dbHashRequest sync.Once
-	// 	dbHash        []byte
-
 	timeoutTimerMutex sync.Mutex
 	timeoutTimer      *time.Timer
+
+	/* The prepare queue of the server is shared by all writes on this bearer */
+	writeQueueMutex sync.Mutex
+
+	/* Set when the server does not know Read Multiple Variable Length */
+	readMultipleFixed int32
 }
 
 func (a *attClient) init(parent *gattDeviceConn) error {
@@ -334,6 +339,11 @@ func (a *attClient) writeHandle(ctx context.Context, handle uint16, value []byte
 retry:
 	mtu := a.parent.getMTU()
 
+	/* Long values are queued on the server */
+	if withRsp && len(value) > mtu-3 {
+		atterr, err := a.writeQueued(ctx, []ClientWriteValue{{Handle: handle, Value: value}})
+		return len(value), atterr, err
+	}
 	if len(value) > mtu-3 {
 		value = value[:mtu-3]
 	}
@@ -365,6 +375,91 @@ retry:
 	return len(value), 0, err
 }
 
+// writeQueued writes the values with prepare and execute write requests. The server echoes every
+// part, if the echo differs the queue is cancelled and nothing is written.
+func (a *attClient) writeQueued(ctx context.Context, values []ClientWriteValue) (ATTError, error) {
+	a.writeQueueMutex.Lock()
+	defer a.writeQueueMutex.Unlock()
+
+	chunk := a.parent.getMTUBlocking() - 5
+
+	for _, m := range values {
+		for offset := 0; offset == 0 || offset < len(m.Value); offset += chunk {
+			part := m.Value[offset:]
+			if len(part) > chunk {
+				part = part[:chunk]
+			}
+
+			atterr, err := a.prepareWrite(ctx, m.Handle, uint16(offset), part)
+			if err != nil || atterr != 0 {
+				/* The original error is more useful than that of the cancellation */
+				a.executeWrite(ctx, false)
+				return atterr, err
+			}
+		}
+	}
+
+	return a.executeWrite(ctx, true)
+}
+
+func (a *attClient) prepareWrite(ctx context.Context, handle uint16, offset uint16, value []byte) (ATTError, error) {
+	first := true
+
+retry:
+	buf := bleutil.GetBuffer(5 + len(value))
+	buf.Buf()[0] = byte(ATTPrepareWriteReq)
+	binary.LittleEndian.PutUint16(buf.Buf()[1:], handle)
+	binary.LittleEndian.PutUint16(buf.Buf()[3:], offset)
+	copy(buf.Buf()[5:], value)
+
+	cmd, response, atterr, err := a.sendCommandErrRsp(ctx, buf)
+	defer bleutil.ReleaseBuffer(response)
+
+	if first && err == nil && (atterr == ATTErrorInsufficientEncryption || atterr == ATTErrorInsufficientAuthentication) {
+		_, err := a.parent.parent.smpConn.GoSecure(ctx, true)
+		if err != nil {
+			return atterr, err
+		}
+		first = false
+		goto retry
+	}
+
+	if err != nil || atterr != 0 {
+		return atterr, err
+	}
+
+	if cmd != ATTPrepareWriteRsp {
+		return 0, ErrorProtocolViolation
+	}
+
+	echo := response.Buf()
+	if len(echo) != 4+len(value) || binary.LittleEndian.Uint16(echo) != handle ||
+		binary.LittleEndian.Uint16(echo[2:]) != offset || !bytes.Equal(echo[4:], value) {
+		return 0, ErrorWriteMismatch
+	}
+
+	return 0, nil
+}
+
+func (a *attClient) executeWrite(ctx context.Context, commit bool) (ATTError, error) {
+	buf := bleutil.GetBuffer(2)
+	buf.Buf()[0] = byte(ATTExecuteWriteReq)
+	if commit {
+		buf.Buf()[1] = 1
+	}
+
+	cmd, response, atterr, err := a.sendCommandErrRsp(ctx, buf)
+	bleutil.ReleaseBuffer(response)
+	if err != nil || atterr != 0 {
+		return atterr, err
+	}
+
+	if cmd != ATTExecuteWriteRsp {
+		return 0, ErrorProtocolViolation
+	}
+	return 0, nil
+}
+
 func (a *attClient) readHandle(ctx context.Context, handle uint16, result []byte) ([]byte, ATTError, error) {
 	first := true
 
@@ -436,13 +531,13 @@ retry:
 func (a *attClient) readHandleAll(ctx context.Context, handle uint16, result []byte) ([]byte, ATTError, error) {
 	mtu := a.parent.getMTUBlocking()
 	result, at, err := a.readHandle(ctx, handle, result)
-	if err != nil || at > 0 || (len(result) <= mtu-1) {
+	if err != nil || at > 0 || (len(result) < mtu-1) {
 		return result, at, err
 	}
 
 	for {
 		l1 := len(result)
-		result, at, err := a.readHandleBlob(ctx, handle, result)
+		result, at, err = a.readHandleBlob(ctx, handle, result)
 		if err != nil || at > 0 || len(result) == l1 {
 			/* If this is not a long element, ignore this error as the read was succesful */
 			if at == ATTErrorAttributeNotLong {
@@ -453,14 +548,231 @@ func (a *attClient) readHandleAll(ctx context.Context, handle uint16, result []b
 	}
 }
 
+// readMultiple reads the values of several handles in as few requests as possible. Read Multiple
+// Variable Length is used when the server supports it, otherwise the fixed Read Multiple request.
+func (a *attClient) readMultiple(ctx context.Context, handles []uint16) ([][]byte, ATTError, error) {
+	if atomic.LoadInt32(&a.readMultipleFixed) == 0 {
+		result, atterr, err := a.readMultipleVariable(ctx, handles)
+		if err != nil || atterr != ATTErrorRequestNotSupported {
+			return result, atterr, err
+		}
+
+		atomic.StoreInt32(&a.readMultipleFixed, 1)
+	}
+
+	return a.readMultipleFixedLength(ctx, handles)
+}
+
+func (a *attClient) readMultipleRequest(ctx context.Context, method ATTCommand, handles []uint16) (*pdu.PDU, ATTError, error) {
+	first := true
+
+retry:
+	buf := bleutil.GetBuffer(1 + 2*len(handles))
+	buf.Buf()[0] = byte(method)
+	for i, m := range handles {
+		binary.LittleEndian.PutUint16(buf.Buf()[1+2*i:], m)
+	}
+
+	cmd, response, atterr, err := a.sendCommandErrRsp(ctx, buf)
+	if first && err == nil && (atterr == ATTErrorInsufficientEncryption || atterr == ATTErrorInsufficientAuthentication) {
+		_, err := a.parent.parent.smpConn.GoSecure(ctx, true)
+		if err != nil {
+			return nil, atterr, err
+		}
+		first = false
+		goto retry
+	}
+
+	if err != nil || atterr != 0 {
+		bleutil.ReleaseBuffer(response)
+		return nil, atterr, err
+	}
+
+	if cmd != method+1 {
+		bleutil.ReleaseBuffer(response)
+		return nil, 0, ErrorProtocolViolation
+	}
+
+	return response, 0, nil
+}
+
+func (a *attClient) readMultipleVariable(ctx context.Context, handles []uint16) ([][]byte, ATTError, error) {
+	mtu := a.parent.getMTUBlocking()
+	result := make([][]byte, len(handles))
+
+	for done := 0; done < len(handles); {
+		batch := handles[done:]
+		if len(batch) > (mtu-1)/2 {
+			batch = batch[:(mtu-1)/2]
+		}
+
+		/* The request needs at least two handles */
+		if len(batch) == 1 {
+			value, atterr, err := a.readHandleAll(ctx, batch[0], nil)
+			if err != nil || atterr != 0 {
+				return nil, atterr, err
+			}
+			result[done] = value
+			done++
+			continue
+		}
+
+		response, atterr, err := a.readMultipleRequest(ctx, ATTReadMultipleValueReq, batch)
+		if err != nil || atterr != 0 {
+			return nil, atterr, err
+		}
+
+		n := 0
+		for ; n < len(batch) && response.Len() >= 2; n++ {
+			length := int(binary.LittleEndian.Uint16(response.DropLeft(2)))
+			value := response.DropLeft(length)
+			if value != nil {
+				result[done+n] = append([]byte{}, value...)
+				continue
+			}
+
+			/* The response was full, the value is read on its own */
+			response.Reset()
+			result[done+n], atterr, err = a.readHandleAll(ctx, batch[n], nil)
+			if err != nil || atterr != 0 {
+				bleutil.ReleaseBuffer(response)
+				return nil, atterr, err
+			}
+		}
+		bleutil.ReleaseBuffer(response)
+
+		if n == 0 {
+			return nil, 0, ErrorProtocolViolation
+		}
+		done += n
+	}
+
+	return result, 0, nil
+}
+
+// fixedValueLength returns the length of the value at handle if the type of the attribute, as
+// found during discovery, defines it
+func (d *gattDeviceConn) fixedValueLength(handle uint16) (int, bool) {
+	d.parent.connsMutex.Lock()
+	s := d.parent.clientStructure
+	d.parent.connsMutex.Unlock()
+	if s == nil {
+		return 0, false
+	}
+
+	for _, svc := range s.GetServices() {
+		for _, c := range svc.GetCharacteristics() {
+			if c.ValueHandle == nil {
+				continue
+			}
+			if c.ValueHandle.Info.Handle == handle {
+				return attstructure.FixedValueLength(c.ValueHandle.Info.UUID)
+			}
+			if c.ValueHandle.CCCHandle != nil && c.ValueHandle.CCCHandle.Info.Handle == handle {
+				return attstructure.FixedValueLength(c.ValueHandle.CCCHandle.Info.UUID)
+			}
+			for _, m := range c.GetDescriptors() {
+				if m.Handle != nil && m.Handle.Info.Handle == handle {
+					return attstructure.FixedValueLength(m.Handle.Info.UUID)
+				}
+			}
+		}
+	}
+
+	return 0, false
+}
+
+// readMultipleFixedLength uses the fixed Read Multiple request, which returns the values without
+// their lengths. Only values with a length that is fixed by the type of the attribute can be
+// split again, the others are read one by one.
+func (a *attClient) readMultipleFixedLength(ctx context.Context, handles []uint16) ([][]byte, ATTError, error) {
+	mtu := a.parent.getMTUBlocking()
+	result := make([][]byte, len(handles))
+
+	readSingle := func(i int) (ATTError, error) {
+		value, atterr, err := a.readHandleAll(ctx, handles[i], nil)
+		if err != nil || atterr != 0 {
+			return atterr, err
+		}
+		result[i] = value
+		return 0, nil
+	}
+
+	var batch []int
+	var lengths []int
+	batchLen := 0
+
+	flush := func() (ATTError, error) {
+		defer func() {
+			batch = batch[:0]
+			lengths = lengths[:0]
+			batchLen = 0
+		}()
+
+		if len(batch) == 1 {
+			return readSingle(batch[0])
+		}
+
+		request := make([]uint16, len(batch))
+		for i, m := range batch {
+			request[i] = handles[m]
+		}
+
+		response, atterr, err := a.readMultipleRequest(ctx, ATTReadMultipleReq, request)
+		if err != nil || atterr != 0 {
+			return atterr, err
+		}
+		defer bleutil.ReleaseBuffer(response)
+
+		if response.Len() != batchLen {
+			return 0, ErrorProtocolViolation
+		}
+		for i, m := range batch {
+			result[m] = append([]byte{}, response.DropLeft(lengths[i])...)
+		}
+		return 0, nil
+	}
+
+	for i, m := range handles {
+		length, ok := a.parent.fixedValueLength(m)
+		if !ok || length > mtu-1 {
+			atterr, err := readSingle(i)
+			if err != nil || atterr != 0 {
+				return nil, atterr, err
+			}
+			continue
+		}
+
+		if len(batch) > 0 && (batchLen+length > mtu-1 || 1+2*(len(batch)+1) > mtu) {
+			atterr, err := flush()
+			if err != nil || atterr != 0 {
+				return nil, atterr, err
+			}
+		}
+
+		batch = append(batch, i)
+		lengths = append(lengths, length)
+		batchLen += length
+	}
+
+	if len(batch) > 0 {
+		atterr, err := flush()
+		if err != nil || atterr != 0 {
+			return nil, atterr, err
+		}
+	}
+
+	return result, 0, nil
+}
+
 func (a *attClient) readByUUID(ctx context.Context, uuid bleutil.UUID, result []byte) ([]byte, ATTError, error) {
 	ub := uuid.UUIDToBytes()
 
 	buf := bleutil.GetBuffer(5 + len(ub))
 	buf.Buf()[0] = byte(ATTReadByTypeReq)
 	binary.LittleEndian.PutUint16(buf.Buf()[1:], 0x1)
-	binary.LittleEndian.PutUint16(buf.Buf()[3:], 0xFF)
-	copy(buf.Buf()[4:], ub)
+	binary.LittleEndian.PutUint16(buf.Buf()[3:], 0xFFFF)
+	copy(buf.Buf()[5:], ub)
 
 	cmd, response, aterr, err := a.sendCommandErrRsp(ctx, buf)
 	defer bleutil.ReleaseBuffer(response)
@@ -487,7 +799,28 @@ func attErrorToError(atterr ATTError) error {
 	return fmt.Errorf("ATT Error: %d", atterr)
 }
 
-func (a *attClient) discoverRemoteDeviceStructure() (*attstructure.Structure, error) {
+// cacheValid compares the hash of the cached handles to the database hash of the peer. Peers
+// without a database hash cannot be checked, their cache is trusted
+func (a *attClient) cacheValid(ctx context.Context, gattHandles []*attstructure.GATTHandle) bool {
+	remote, atterr, err := a.readByUUID(ctx, attstructure.UUIDDatabaseHash, nil)
+	if err != nil || atterr != 0 || len(remote) != 16 {
+		a.parent.logger.WithError(err).WithField("0atterr", atterr).Debug("Peer has no database hash, using cache")
+		return true
+	}
+
+	local := DatabaseHash(gattHandles)
+	if !bytes.Equal(remote, local[:]) {
+		a.parent.logger.WithFields(logrus.Fields{
+			"0remote": hex.EncodeToString(remote),
+			"1cache":  hex.EncodeToString(local[:]),
+		}).Info("Discovery cache is outdated")
+		return false
+	}
+
+	return true
+}
+
+func (a *attClient) discoverRemoteDeviceStructure(ctx context.Context) (*attstructure.Structure, error) {
 	/* With a high MTU this goes so much faster */
 	a.parent.getMTUBlocking()
 
@@ -495,11 +828,12 @@ func (a *attClient) discoverRemoteDeviceStructure() (*attstructure.Structure, er
 	if a.parent.parent.config.DiscoveryCacheGet != nil {
 		gattHandles = a.parent.parent.config.DiscoveryCacheGet(a.parent.parent)
 	}
+	if gattHandles != nil && !a.cacheValid(ctx, gattHandles) {
+		gattHandles = nil
+	}
 
 	cacheStr := ""
 	if gattHandles == nil {
-		ctx := context.Background()
-
 		handles, err := a.findInformationAll(ctx, 1, 0xFFFF)
 		if err != nil {
 			return nil, err
@@ -0,0 +1,116 @@
+package bleatt
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	attstructure "github.com/BertoldVdb/go-ble/bleatt/structure"
+	bleutil "github.com/BertoldVdb/go-ble/util"
+)
+
+func buildWriteTest(t *testing.T) (*GattDevice, *pipeConn, *pipeConn, []*attstructure.Characteristic) {
+	t.Helper()
+
+	external := attstructure.NewStructure()
+	svc := external.AddPrimaryService(bleutil.UUIDFromStringPanic("180a"))
+	var chars []*attstructure.Characteristic
+	for _, m := range []string{"2a30", "2a31"} {
+		chars = append(chars, svc.AddCharacteristic(bleutil.UUIDFromStringPanic(m),
+			attstructure.CharacteristicRead|attstructure.CharacteristicWriteAck,
+			attstructure.ValueConfig{LengthMax: 200}))
+	}
+
+	config := &GattDeviceConfig{MTU: 23, DeviceName: "test"}
+	server := NewGattDevice(external, config)
+	client := NewGattDevice(attstructure.NewStructure(), config)
+
+	serverConn, clientConn := newPipeConns()
+	server.AddConn(serverConn)
+	client.AddConn(clientConn)
+	t.Cleanup(func() {
+		server.CloseConn(serverConn)
+		client.CloseConn(clientConn)
+	})
+
+	return client, clientConn, serverConn, chars
+}
+
+func TestClientWriteLong(t *testing.T) {
+	client, conn, _, chars := buildWriteTest(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	value := bytes.Repeat([]byte("0123456789"), 10)
+	if n, err := client.ClientWrite(ctx, chars[0].ValueHandle.Info.Handle, value, true); err != nil || n != len(value) {
+		t.Fatalf("wrote %d bytes: %v", n, err)
+	}
+
+	if got, _ := chars[0].GetValue(ctx, nil); !bytes.Equal(got, value) {
+		t.Errorf("server value %q", got)
+	}
+	if conn.count(ATTPrepareWriteReq) != 6 || conn.count(ATTExecuteWriteReq) != 1 {
+		t.Errorf("used %d prepare and %d execute requests", conn.count(ATTPrepareWriteReq), conn.count(ATTExecuteWriteReq))
+	}
+}
+
+func TestClientWriteAtomic(t *testing.T) {
+	client, _, _, chars := buildWriteTest(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := client.ClientWriteAtomic(ctx, []ClientWriteValue{
+		{Handle: chars[0].ValueHandle.Info.Handle, Value: []byte("first")},
+		{Handle: chars[1].ValueHandle.Info.Handle, Value: bytes.Repeat([]byte{0x55}, 40)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, _ := chars[0].GetValue(ctx, nil); string(got) != "first" {
+		t.Errorf("first value %q", got)
+	}
+	if got, _ := chars[1].GetValue(ctx, nil); !bytes.Equal(got, bytes.Repeat([]byte{0x55}, 40)) {
+		t.Errorf("second value %x", got)
+	}
+
+	/* A value that is too long for the server cancels the whole write */
+	err = client.ClientWriteAtomic(ctx, []ClientWriteValue{
+		{Handle: chars[0].ValueHandle.Info.Handle, Value: []byte("changed")},
+		{Handle: chars[1].ValueHandle.Info.Handle, Value: make([]byte, 201)},
+	})
+	if err == nil {
+		t.Fatal("oversized write succeeded")
+	}
+	if got, _ := chars[0].GetValue(ctx, nil); string(got) != "first" {
+		t.Errorf("cancelled write changed the value to %q", got)
+	}
+}
+
+// A corrupted echo of a queued part cancels the write.
+func TestClientWriteEchoMismatch(t *testing.T) {
+	client, conn, serverConn, chars := buildWriteTest(t)
+
+	serverConn.modify = func(buf []byte) {
+		if ATTCommand(buf[0]) == ATTPrepareWriteRsp && len(buf) > 5 {
+			buf[len(buf)-1] ^= 0xFF
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := client.ClientWrite(ctx, chars[0].ValueHandle.Info.Handle, bytes.Repeat([]byte{1}, 30), true)
+	if err != ErrorWriteMismatch {
+		t.Fatalf("unexpected result %v", err)
+	}
+	if got, _ := chars[0].GetValue(ctx, nil); len(got) != 0 {
+		t.Errorf("value was written: %x", got)
+	}
+	if conn.count(ATTPrepareWriteReq) != 1 || conn.count(ATTExecuteWriteReq) != 1 {
+		t.Errorf("used %d prepare and %d execute requests", conn.count(ATTPrepareWriteReq), conn.count(ATTExecuteWriteReq))
+	}
+}
@@ -6,6 +6,8 @@ import (
 
 var (
 	ErrorProtocolViolation = errors.New("Protocal violation detected")
+	ErrorNoConnection      = errors.New("No ATT bearer is connected")
+	ErrorWriteMismatch     = errors.New("Queued write was not echoed correctly")
 )
 
 type ATTCommand uint8
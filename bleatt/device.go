@@ -33,6 +33,8 @@ type GattDevice struct {
 	clientDiscoveryOnce once.Once
 	clientStructure     *attstructure.Structure
 
+	serviceChanged *attstructure.Characteristic
+
 	smpConn *blesmp.SMPConn
 
 	bleConn *bleconnecter.BLEConnection
@@ -53,9 +55,71 @@ type gattDeviceConn struct {
 	smpConn    *blesmp.SMPConn
 	writeQueue []attServerWriteQueueEntry
 
+	/* Every client has its own copy of the client characteristic configuration
+	   descriptors, protected by the structure lock */
+	cccHandles map[*attstructure.GATTHandle]*attstructure.GATTHandle
+
+	/* EATT bearers share the state of the unenhanced bearer of the same peer, primary is
+	   protected by the connsMutex of the parent */
+	eatt    bool
+	primary *gattDeviceConn
+	pending int32
+
+	/* Set once the state of a bonded client was restored */
+	bondRestored int32
+
 	client attClient
 }
 
+// eattBearer is implemented by enhanced credit based L2CAP channels
+type eattBearer interface {
+	IsEnhanced() bool
+	GetMTU() (uint16, uint16)
+	ParentConn() hciconnmgr.BufferConn
+}
+
+type parentConn interface {
+	ParentConn() hciconnmgr.BufferConn
+}
+
+func getParentConn(conn hciconnmgr.BufferConn) hciconnmgr.BufferConn {
+	p, ok := conn.(parentConn)
+	if !ok {
+		return conn
+	}
+	return p.ParentConn()
+}
+
+// Returns the connection holding the per client state. EATT bearers are linked to the
+// unenhanced bearer of the same peer when it is first needed, as it can be added after them
+func (d *gattDeviceConn) owner() *gattDeviceConn {
+	if !d.eatt {
+		return d
+	}
+
+	d.parent.connsMutex.Lock()
+	defer d.parent.connsMutex.Unlock()
+
+	return d.ownerLocked()
+}
+
+func (d *gattDeviceConn) ownerLocked() *gattDeviceConn {
+	if d.primary == nil {
+		parent := getParentConn(d.conn)
+		for _, m := range d.parent.conns {
+			if !m.eatt && getParentConn(m.conn) == parent {
+				d.primary = m
+				break
+			}
+		}
+	}
+
+	if d.primary != nil {
+		return d.primary
+	}
+	return d
+}
+
 type GattDeviceConfig struct {
 	ConnCb                  func(numConnections int)
 	DeviceName              string
@@ -65,6 +129,18 @@ type GattDeviceConfig struct {
 
 	DiscoveryCacheGet func(dev *GattDevice) []*attstructure.GATTHandle
 	DiscoveryCacheSet func(dev *GattDevice, handles []*attstructure.GATTHandle)
+
+	/* Advertise EATT support in the server supported features characteristic. The helpers
+	   then accept EATT bearers and open EATTBearers of them to peers that support it. */
+	EATT        bool
+	EATTBearers int
+
+	/* Keep the client characteristic configurations of bonded clients across connections */
+	BondStateGet func(dev *GattDevice, peer bleutil.BLEAddr) (GattBondState, bool)
+	BondStateSet func(dev *GattDevice, peer bleutil.BLEAddr, state GattBondState)
+
+	/* Asked for every read and write of a client, after the AuthorizeCb of the attribute */
+	AuthorizeCb func(dev *GattDevice, req attstructure.AccessRequest) bool
 }
 
 func DefaultConfig() *GattDeviceConfig {
@@ -108,7 +184,24 @@ func NewGattDevice(externalStructure *attstructure.Structure, config *GattDevice
 	var apBuf [2]byte
 	binary.LittleEndian.PutUint16(apBuf[:], config.Appearance)
 	pble.AddCharacteristicReadOnly(bleutil.UUIDFromStringPanic("2a01"), apBuf[:]) /* Appearance: Generic network device */
-	gattStructure.AddPrimaryService(bleutil.UUIDFromStringPanic("1801"))          /* Empty */
+	pgatt := gattStructure.AddPrimaryService(attstructure.UUIDGenericAttribute)
+	dev.serviceChanged = pgatt.AddCharacteristic(attstructure.UUIDServiceChanged, attstructure.CharacteristicIndicate, attstructure.ValueConfig{
+		LengthFixed: true,
+		LengthMax:   4,
+	})
+	if config.EATT {
+		pgatt.AddCharacteristicReadOnly(attstructure.UUIDServerSupportedFeatures, []byte{1}) /* EATT */
+	}
+	pgatt.AddCharacteristic(attstructure.UUIDDatabaseHash, attstructure.CharacteristicRead, attstructure.ValueConfig{
+		LengthFixed: true,
+		LengthMax:   16,
+		ValueBeforeReadCb: func(h *attstructure.GATTHandle, offset int) error {
+			/* Called with the structure locked */
+			hash := dev.server.databaseHash()
+			copy(h.Value, hash[:])
+			return nil
+		},
+	})
 
 	exportedStructure := &attstructure.ExportedStructure{}
 	exportedStructure.Append(gattStructure)
@@ -164,6 +257,8 @@ func (d *gattDeviceConn) handlePDU(buf *pdu.PDU) (bool, error) {
 
 	buf.DropLeft(1)
 
+	d.parent.server.restoreBondState(d)
+
 	if isForServer {
 		return d.parent.server.handlePDU(d, method, isAuthenticated, buf)
 	}
@@ -203,8 +298,19 @@ func (g *GattDevice) CloseConn(conn hciconnmgr.BufferConn) error {
 	}
 
 	delete(g.conns, conn)
-	if g.config.ConnCb != nil {
-		g.config.ConnCb(len(g.conns))
+
+	/* EATT bearers can't outlive the unenhanced bearer of the same peer */
+	var bearers []hciconnmgr.BufferConn
+	if !d.eatt {
+		parent := getParentConn(conn)
+		for k, m := range g.conns {
+			if m.eatt && getParentConn(k) == parent {
+				bearers = append(bearers, k)
+			}
+		}
+		if g.config.ConnCb != nil {
+			g.config.ConnCb(g.numConnsLocked())
+		}
 	}
 
 	/* If we just closed the connection that ClientRead/ClientWrite
@@ -218,9 +324,12 @@ func (g *GattDevice) CloseConn(conn hciconnmgr.BufferConn) error {
 		g.initialConn = nil
 		g.initialConnValid = make(chan struct{})
 
-		// Promote any other live conn to initialConn so client calls
-		// can resume without waiting for AddConn.
+		// Promote another live unenhanced conn to initialConn so client
+		// calls can resume without waiting for AddConn.
 		for _, other := range g.conns {
+			if other.eatt {
+				continue
+			}
 			g.initialConn = other
 			close(g.initialConnValid)
 			break
@@ -239,10 +348,25 @@ func (g *GattDevice) CloseConn(conn hciconnmgr.BufferConn) error {
 		d.cancel()
 	}
 
+	for _, m := range bearers {
+		g.CloseConn(m)
+	}
+
 	conn.UseDone()
 	return conn.Close()
 }
 
+// numConnsLocked counts the peers, EATT bearers are not counted. The connsMutex must be held
+func (g *GattDevice) numConnsLocked() int {
+	count := 0
+	for _, m := range g.conns {
+		if !m.eatt {
+			count++
+		}
+	}
+	return count
+}
+
 func (g *GattDevice) AddConn(conn hciconnmgr.BufferConn) error {
 	return g.addConnInternal(conn, g.smpConn)
 }
@@ -264,16 +388,27 @@ func (g *GattDevice) addConnInternal(conn hciconnmgr.BufferConn, smp *blesmp.SMP
 	conn.UseStart()
 	d.client.init(d)
 
+	/* The MTU of an EATT bearer is that of the L2CAP channel, it cannot be exchanged */
+	if bearer, ok := conn.(eattBearer); ok && bearer.IsEnhanced() {
+		local, remote := bearer.GetMTU()
+		if remote < local {
+			local = remote
+		}
+		d.eatt = true
+		d.mtu = uint32(normalizeATTMTU(local))
+		d.mtuRequest.Do(func() {})
+	}
+
 	g.connsMutex.Lock()
 	initial := false
-	if g.initialConn == nil { //This is the connection that is always present
+	if g.initialConn == nil && !d.eatt { //This is the connection that is always present
 		g.initialConn = d
 		close(g.initialConnValid)
 		initial = true
 	}
 	g.conns[conn] = d
-	if g.config.ConnCb != nil {
-		g.config.ConnCb(len(g.conns))
+	if g.config.ConnCb != nil && !d.eatt {
+		g.config.ConnCb(g.numConnsLocked())
 	}
 	g.connsMutex.Unlock()
 
@@ -341,23 +476,19 @@ func (d *gattDeviceConn) setMTU(new uint16) int {
 	}
 }
 
-func (d *GattDevice) getConnWithHighestMTU() *gattDeviceConn {
+func (d *GattDevice) getConns() []*gattDeviceConn {
 	d.connsMutex.Lock()
-	var conn *gattDeviceConn
-	var maxMTU int
+	defer d.connsMutex.Unlock()
+
+	conns := make([]*gattDeviceConn, 0, len(d.conns))
 	for _, m := range d.conns {
-		cmtu := m.getMTU()
-		if cmtu > maxMTU {
-			maxMTU = cmtu
-			conn = m
-		}
+		conns = append(conns, m)
 	}
-	d.connsMutex.Unlock()
-	return conn
+	return conns
 }
 
 func (d *GattDevice) clientDiscover(conn *gattDeviceConn) {
-	s, err := conn.client.discoverRemoteDeviceStructure()
+	s, err := conn.client.discoverRemoteDeviceStructure(conn.ctx)
 
 	if err != nil {
 		conn.logger.WithError(err).Warn("Failed to parse remote GATT definition")
@@ -368,7 +499,9 @@ func (d *GattDevice) clientDiscover(conn *gattDeviceConn) {
 		}
 	}
 
+	d.connsMutex.Lock()
 	d.clientStructure = s
+	d.connsMutex.Unlock()
 }
 
 func (d *GattDevice) ClientGetStructure(ctx context.Context) *attstructure.Structure {
@@ -380,14 +513,47 @@ func (d *GattDevice) ClientGetStructure(ctx context.Context) *attstructure.Struc
 	return d.clientStructure
 }
 
-func (d *GattDevice) ClientRead(ctx context.Context, handle uint16, buf []byte) ([]byte, error) {
-	//TODO: Allow using another connection for client requests
+// Client requests are spread over the EATT bearers of the peer, so they run in parallel
+func (d *GattDevice) clientConn(ctx context.Context) (*gattDeviceConn, error) {
+	d.connsMutex.Lock()
+	valid := d.initialConnValid
+	d.connsMutex.Unlock()
+
 	select {
 	case <-ctx.Done():
 		return nil, ctx.Err()
-	case <-d.initialConnValid:
+	case <-valid:
 	}
-	conn := d.initialConn
+
+	d.connsMutex.Lock()
+	defer d.connsMutex.Unlock()
+
+	best := d.initialConn
+	if best == nil {
+		return nil, ErrorNoConnection
+	}
+
+	owner := best.ownerLocked()
+	for _, m := range d.conns {
+		if m.ownerLocked() == owner && atomic.LoadInt32(&m.pending) < atomic.LoadInt32(&best.pending) {
+			best = m
+		}
+	}
+
+	atomic.AddInt32(&best.pending, 1)
+	return best, nil
+}
+
+func (d *gattDeviceConn) clientDone() {
+	atomic.AddInt32(&d.pending, -1)
+}
+
+func (d *GattDevice) ClientRead(ctx context.Context, handle uint16, buf []byte) ([]byte, error) {
+	conn, err := d.clientConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.clientDone()
 
 	result, atterr, err := conn.client.readHandleAll(ctx, handle, buf)
 	if err != nil {
@@ -397,13 +563,37 @@ func (d *GattDevice) ClientRead(ctx context.Context, handle uint16, buf []byte)
 	return result, err
 }
 
+// ClientReadMultiple reads the values of several handles, using as few round trips as the server
+// allows. The values are returned in the order of handles.
+func (d *GattDevice) ClientReadMultiple(ctx context.Context, handles []uint16) ([][]byte, error) {
+	conn, err := d.clientConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.clientDone()
+
+	result, atterr, err := conn.client.readMultiple(ctx, handles)
+	if err != nil {
+		return nil, err
+	}
+	err = attErrorToError(atterr)
+	return result, err
+}
+
 func (d *GattDevice) ClientWrite(ctx context.Context, handle uint16, buf []byte, withRsp bool) (int, error) {
-	select {
-	case <-ctx.Done():
-		return 0, ctx.Err()
-	case <-d.initialConnValid:
+	conn, err := d.clientConn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.clientDone()
+
+	/* Without a signing key the write is sent unsigned */
+	if !withRsp && conn.useSignedWrite(handle) {
+		l, err := conn.client.writeHandleSigned(ctx, handle, buf)
+		if err != blesmp.ErrorNoSigningKey {
+			return l, err
+		}
 	}
-	conn := d.initialConn
 
 	l, atterr, err := conn.client.writeHandle(ctx, handle, buf, withRsp)
 	if err != nil {
@@ -413,15 +603,56 @@ func (d *GattDevice) ClientWrite(ctx context.Context, handle uint16, buf []byte,
 	return l, err
 }
 
-/* Note that this is just an indication, the real MTU may be different */
+// ClientWriteValue is one of the values written by ClientWriteAtomic
+type ClientWriteValue struct {
+	Handle uint16
+	Value  []byte
+}
+
+// ClientWriteAtomic writes several values at once using queued writes. The server applies all of
+// them or none, and every queued part is compared to the copy echoed by the server.
+func (d *GattDevice) ClientWriteAtomic(ctx context.Context, values []ClientWriteValue) error {
+	conn, err := d.clientConn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.clientDone()
+
+	atterr, err := conn.client.writeQueued(ctx, values)
+	if err != nil {
+		return err
+	}
+	return attErrorToError(atterr)
+}
+
+// Note that this is just an indication, the real MTU may be different. The lowest MTU of all
+// subscribed connections is returned so that a value of this size reaches every client
 func (d *GattDevice) ServerGetNotifyMTU(characteristic *attstructure.Characteristic) int {
-	conn := d.getConnWithHighestMTU()
+	var ccc *attstructure.GATTHandle
+	if characteristic != nil && characteristic.ValueHandle != nil {
+		ccc = characteristic.ValueHandle.CCCHandle
+	}
+
+	mtu := 0
+	for _, m := range d.getConns() {
+		if m.owner() != m {
+			continue
+		}
+		if ccc != nil && d.server.getCCC(m, ccc) == 0 {
+			continue
+		}
+
+		cmtu := m.getMTUBlocking()
+		if mtu == 0 || cmtu < mtu {
+			mtu = cmtu
+		}
+	}
 
-	if conn == nil {
+	if mtu == 0 {
 		return 23
 	}
 
-	return conn.getMTUBlocking()
+	return mtu
 }
 
 func (d *GattDevice) HasConnections() bool {
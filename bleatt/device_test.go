@@ -2,12 +2,14 @@ package bleatt
 
 import (
 	"context"
+	"encoding/binary"
 	"io"
 	"sync"
 	"testing"
 
 	attstructure "github.com/BertoldVdb/go-ble/bleatt/structure"
 	hciconnmgr "github.com/BertoldVdb/go-ble/hci/connmgr"
+	bleutil "github.com/BertoldVdb/go-ble/util"
 	pdu "github.com/BertoldVdb/go-misc/pdubuf"
 	"github.com/sirupsen/logrus"
 )
@@ -168,3 +170,158 @@ func TestSetMTUConcurrent(t *testing.T) {
 		t.Fatalf("post-stress shrink leaked through: got %d", d.getMTU())
 	}
 }
+
+// fakeChannel is an L2CAP channel on top of a shared link. Enhanced channels
+// carry EATT bearers.
+type fakeChannel struct {
+	*fakeConn
+	parent   hciconnmgr.BufferConn
+	enhanced bool
+	mtu      uint16
+}
+
+func (f *fakeChannel) ParentConn() hciconnmgr.BufferConn { return f.parent }
+func (f *fakeChannel) IsEnhanced() bool                  { return f.enhanced }
+func (f *fakeChannel) GetMTU() (uint16, uint16)          { return f.mtu, f.mtu }
+
+// EATT bearers take their MTU from the channel, share the client
+// configuration of the unenhanced bearer and are used for parallel
+// client requests.
+func TestEATTBearers(t *testing.T) {
+	external := attstructure.NewStructure()
+	svc := external.AddPrimaryService(bleutil.UUIDFromStringPanic("180a"))
+	char := svc.AddCharacteristic(
+		bleutil.UUIDFromStringPanic("2a31"),
+		attstructure.CharacteristicRead|attstructure.CharacteristicNotify,
+		attstructure.ValueConfig{},
+	)
+
+	dev := NewGattDevice(external, &GattDeviceConfig{MTU: 247, DeviceName: "test", EATT: true})
+
+	link := newATTFakeConn()
+	primary := &fakeChannel{fakeConn: newFakeConn(), parent: link}
+	bearerA := &fakeChannel{fakeConn: newFakeConn(), parent: link, enhanced: true, mtu: 100}
+	bearerB := &fakeChannel{fakeConn: newFakeConn(), parent: link, enhanced: true, mtu: 100}
+	for _, m := range []hciconnmgr.BufferConn{primary, bearerA, bearerB} {
+		dev.AddConn(m)
+	}
+
+	connPrimary := dev.conns[primary]
+	connA := dev.conns[bearerA]
+	/* Abort the MTU exchange, the fake peer never answers */
+	connPrimary.cancel()
+	if connA.owner() != connPrimary || connA.getMTUBlocking() != 100 {
+		t.Fatalf("bearer not attached: primary %p, MTU %d", connA.primary, connA.getMTU())
+	}
+
+	/* Every outstanding request goes to a different bearer */
+	used := make(map[*gattDeviceConn]bool)
+	for i := 0; i < 3; i++ {
+		c, err := dev.clientConn(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		used[c] = true
+	}
+	if len(used) != 3 {
+		t.Fatalf("requests used %d bearers, want 3", len(used))
+	}
+
+	/* Subscribing on an EATT bearer notifies the peer once */
+	body := &pdu.PDU{}
+	binary.LittleEndian.PutUint16(body.ExtendRight(2), char.ValueHandle.CCCHandle.Info.Handle)
+	body.Append(0x01, 0x00)
+	if _, err := dev.server.handleWriteReq(connA, ATTWriteReq, body); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := char.SetValueResults(context.Background(), []byte{1, 2, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Conn != primary {
+		t.Fatalf("unexpected notifications %+v", results)
+	}
+}
+
+// An EATT bearer added before the unenhanced bearer of the same peer still
+// shares its client configuration.
+func TestEATTBearerBeforeUnenhanced(t *testing.T) {
+	external := attstructure.NewStructure()
+	svc := external.AddPrimaryService(bleutil.UUIDFromStringPanic("180a"))
+	char := svc.AddCharacteristic(
+		bleutil.UUIDFromStringPanic("2a31"),
+		attstructure.CharacteristicRead|attstructure.CharacteristicNotify,
+		attstructure.ValueConfig{},
+	)
+
+	dev := NewGattDevice(external, &GattDeviceConfig{MTU: 247, DeviceName: "test", EATT: true})
+
+	link := newATTFakeConn()
+	bearer := &fakeChannel{fakeConn: newFakeConn(), parent: link, enhanced: true, mtu: 100}
+	primary := &fakeChannel{fakeConn: newFakeConn(), parent: link}
+	dev.AddConn(bearer)
+	dev.AddConn(primary)
+
+	connBearer := dev.conns[bearer]
+	connPrimary := dev.conns[primary]
+	connPrimary.cancel()
+	if connBearer.owner() != connPrimary {
+		t.Fatal("bearer not attached to the unenhanced bearer")
+	}
+
+	body := &pdu.PDU{}
+	binary.LittleEndian.PutUint16(body.ExtendRight(2), char.ValueHandle.CCCHandle.Info.Handle)
+	body.Append(0x01, 0x00)
+	if _, err := dev.server.handleWriteReq(connBearer, ATTWriteReq, body); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := char.SetValueResults(context.Background(), []byte{1, 2, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Conn != primary {
+		t.Fatalf("unexpected notifications %+v", results)
+	}
+}
+
+// Only unenhanced bearers are counted as connections. Closing one closes the
+// EATT bearers of the same peer, and they never become the client bearer.
+func TestEATTBearersClosedWithUnenhanced(t *testing.T) {
+	var counts []int
+	dev := NewGattDevice(attstructure.NewStructure(), &GattDeviceConfig{
+		MTU:        247,
+		DeviceName: "test",
+		EATT:       true,
+		ConnCb: func(numConnections int) {
+			counts = append(counts, numConnections)
+		},
+	})
+
+	link := newATTFakeConn()
+	primary := &fakeChannel{fakeConn: newFakeConn(), parent: link}
+	bearerA := &fakeChannel{fakeConn: newFakeConn(), parent: link, enhanced: true, mtu: 100}
+	bearerB := &fakeChannel{fakeConn: newFakeConn(), parent: link, enhanced: true, mtu: 100}
+	for _, m := range []hciconnmgr.BufferConn{primary, bearerA, bearerB} {
+		dev.AddConn(m)
+	}
+	dev.conns[primary].cancel()
+
+	if len(counts) != 1 || counts[0] != 1 {
+		t.Errorf("connection counts %v, want [1]", counts)
+	}
+
+	if err := dev.CloseConn(primary); err != nil {
+		t.Fatal(err)
+	}
+	if len(dev.conns) != 0 || !bearerA.closed || !bearerB.closed {
+		t.Errorf("bearers left open: %d", len(dev.conns))
+	}
+	if dev.initialConn != nil {
+		t.Error("closed bearer promoted to client bearer")
+	}
+	if len(counts) != 2 || counts[1] != 0 {
+		t.Errorf("connection counts %v, want [1 0]", counts)
+	}
+}
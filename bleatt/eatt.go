@@ -0,0 +1,77 @@
+package bleatt
+
+import (
+	"context"
+	"errors"
+
+	attstructure "github.com/BertoldVdb/go-ble/bleatt/structure"
+	blel2cap "github.com/BertoldVdb/go-ble/l2cap"
+)
+
+var ErrorEATTUnsupported = errors.New("Peer does not support EATT")
+
+const defaultEATTBearers = 2
+
+// ListenEATT accepts EATT bearers opened by the peer until the L2CAP connection is closed. EATT
+// requires an encrypted link, bearers are refused before that
+func (g *GattDevice) ListenEATT(l2 *blel2cap.L2CAP) error {
+	ln, err := l2.ListenSecurity(blel2cap.LEPSMEATT, blel2cap.SecurityEncrypted)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		defer ln.Close()
+
+		for {
+			conn, err := ln.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			g.AddConn(conn)
+		}
+	}()
+
+	return nil
+}
+
+// DialEATT opens the configured number of EATT bearers if the discovered server supported
+// features of the peer include EATT
+func (g *GattDevice) DialEATT(ctx context.Context, l2 *blel2cap.L2CAP) error {
+	s := g.ClientGetStructure(ctx)
+	if s == nil {
+		return ErrorEATTUnsupported
+	}
+
+	svc := s.GetService(attstructure.UUIDGenericAttribute)
+	if svc == nil {
+		return ErrorEATTUnsupported
+	}
+	c := svc.GetCharacteristic(attstructure.UUIDServerSupportedFeatures)
+	if c == nil {
+		return ErrorEATTUnsupported
+	}
+
+	value, err := c.GetValue(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if len(value) < 1 || value[0]&1 == 0 {
+		return ErrorEATTUnsupported
+	}
+
+	count := g.config.EATTBearers
+	if count <= 0 {
+		count = defaultEATTBearers
+	}
+
+	conns, err := l2.DialEnhanced(ctx, blel2cap.LEPSMEATT, count)
+	if err != nil {
+		return err
+	}
+	for _, m := range conns {
+		g.AddConn(m)
+	}
+
+	return nil
+}
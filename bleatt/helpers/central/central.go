@@ -213,19 +213,32 @@ func (p *CentralHelper) handleConn(conn *bleconnecter.BLEConnection, peer *Peer,
 	dev := bleatt.NewGattDeviceWithConn(conn, attstructure.NewStructure(), p.config.GATTConfig)
 
 	var smpConn *blesmp.SMPConn
-	l2 := blel2cap.New(conn, p.config.L2CAPConfig, func(psm blel2cap.PSMType, accept blel2cap.L2CAPConnAccepter) {
+	var l2 *blel2cap.L2CAP
+	l2 = blel2cap.New(conn, p.config.L2CAPConfig, func(psm blel2cap.PSMType, accept blel2cap.L2CAPConnAccepter) {
 		switch psm {
 		case blel2cap.PSMTypeATT:
 			dev.AddConnWithSMP(accept(), smpConn)
 		case blel2cap.PSMTypeSecurityManager:
 			smpConn = p.stack.SMP.AddConn(accept(), p.config.SMPConnConfig)
 			dev.SetSMP(smpConn)
+			if smpConn != nil {
+				l2.SetSecurity(smpConn)
+			}
 		}
 	})
 
 	ctx, cancel := context.WithCancel(p.ctx)
 	defer cancel()
 
+	if p.config.GATTConfig != nil && p.config.GATTConfig.EATT {
+		dev.ListenEATT(l2)
+		go func() {
+			if err := dev.DialEATT(ctx, l2); err != nil {
+				conn.GetLogger().WithError(err).Debug("Not using EATT")
+			}
+		}()
+	}
+
 	go func() {
 		handler(ctx, dev)
 		conn.Close()
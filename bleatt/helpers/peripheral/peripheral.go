@@ -63,6 +63,7 @@ func (p *PeripheralHelper) handleConn(conn hciconnmgr.BufferConn, remoteAddr net
 	gattConfig.DeviceName = p.config.DeviceName
 	gattConfig.Appearance = p.config.Appearance
 	gattConfig.DiscoverRemoteOnConnect = false
+	gattConfig.EATT = p.config.EATT
 
 	dev := bleatt.NewGattDevice(structure, gattConfig)
 
@@ -84,15 +85,22 @@ func (p *PeripheralHelper) handleConn(conn hciconnmgr.BufferConn, remoteAddr net
 
 	if err == nil {
 		var smpConn *blesmp.SMPConn
-		l2 := blel2cap.New(conn, nil, func(psm blel2cap.PSMType, accept blel2cap.L2CAPConnAccepter) {
+		var l2 *blel2cap.L2CAP
+		l2 = blel2cap.New(conn, nil, func(psm blel2cap.PSMType, accept blel2cap.L2CAPConnAccepter) {
 			switch psm {
 			case blel2cap.PSMTypeATT:
 				dev.AddConnWithSMP(accept(), smpConn)
 			case blel2cap.PSMTypeSecurityManager:
 				smpConn = p.stack.SMP.AddConn(accept(), nil)
 				dev.SetSMP(smpConn)
+				if smpConn != nil {
+					l2.SetSecurity(smpConn)
+				}
 			}
 		})
+		if p.config.EATT {
+			dev.ListenEATT(l2)
+		}
 		go func() {
 			l2.Run()
 			cf.Close()
@@ -118,6 +126,9 @@ type PeripheralHelperConfig struct {
 	AcceptMultipleConnections bool
 	DeviceName                string
 	Appearance                uint16
+
+	/* Accept EATT bearers from the central */
+	EATT bool
 }
 
 func DefaultConfig() PeripheralHelperConfig {
@@ -0,0 +1,224 @@
+package bleatt
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	attstructure "github.com/BertoldVdb/go-ble/bleatt/structure"
+	hciconnmgr "github.com/BertoldVdb/go-ble/hci/connmgr"
+	bleutil "github.com/BertoldVdb/go-ble/util"
+	pdu "github.com/BertoldVdb/go-misc/pdubuf"
+	"github.com/sirupsen/logrus"
+)
+
+// pipeConn connects two GATT devices. Requests with an opcode in reject
+// are answered with Request Not Supported instead of being delivered,
+// modify can change a PDU before it is delivered.
+type pipeConn struct {
+	peer   *pipeConn
+	rx     chan *pdu.PDU
+	logger *logrus.Entry
+
+	mu       sync.Mutex
+	reject   map[ATTCommand]bool
+	modify   func(buf []byte)
+	requests map[ATTCommand]int
+}
+
+func newPipeConns() (*pipeConn, *pipeConn) {
+	a := &pipeConn{rx: make(chan *pdu.PDU, 16), logger: newTestLogger(), requests: make(map[ATTCommand]int)}
+	b := &pipeConn{rx: make(chan *pdu.PDU, 16), logger: newTestLogger(), requests: make(map[ATTCommand]int)}
+	a.peer, b.peer = b, a
+	return a, b
+}
+
+func (p *pipeConn) IsOpen() bool { return true }
+func (p *pipeConn) Close() error { return nil }
+func (p *pipeConn) ReadBuffer(ctx context.Context) (*pdu.PDU, error) {
+	select {
+	case buf := <-p.rx:
+		return buf, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+func (p *pipeConn) WriteBuffer(buf *pdu.PDU) error {
+	method := ATTCommand(buf.Buf()[0])
+
+	p.mu.Lock()
+	p.requests[method]++
+	reject := p.reject[method]
+	modify := p.modify
+	p.mu.Unlock()
+
+	if reject {
+		bleutil.ReleaseBuffer(buf)
+		rsp := bleutil.GetBuffer(5)
+		copy(rsp.Buf(), []byte{byte(ATTErrorRsp), byte(method), 0, 0, byte(ATTErrorRequestNotSupported)})
+		p.rx <- rsp
+		return nil
+	}
+
+	if modify != nil {
+		modify(buf.Buf())
+	}
+	p.peer.rx <- buf
+	return nil
+}
+func (p *pipeConn) GetLogger() *logrus.Entry { return p.logger }
+func (p *pipeConn) UseStart()                {}
+func (p *pipeConn) UseDone()                 {}
+
+func (p *pipeConn) count(method ATTCommand) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.requests[method]
+}
+
+var _ hciconnmgr.BufferConn = (*pipeConn)(nil)
+
+func buildReadMultipleTest(t *testing.T, mtu uint16) (*GattDevice, *pipeConn, []uint16, [][]byte) {
+	t.Helper()
+
+	values := [][]byte{
+		{1},
+		[]byte("variable"),
+		{},
+		bytes.Repeat([]byte{0xAA}, 60),
+		{2, 3},
+	}
+
+	var uuids []bleutil.UUID
+	for i := range values {
+		uuids = append(uuids, bleutil.UUIDFromStringPanic(fmt.Sprintf("%04x", 0x2b00+i)))
+	}
+
+	client, conn, handles := buildReadMultipleDevices(t, &GattDeviceConfig{MTU: mtu, DeviceName: "test"}, uuids, values)
+	return client, conn, handles, values
+}
+
+func buildReadMultipleDevices(t *testing.T, config *GattDeviceConfig, uuids []bleutil.UUID, values [][]byte) (*GattDevice, *pipeConn, []uint16) {
+	t.Helper()
+
+	external := attstructure.NewStructure()
+	svc := external.AddPrimaryService(bleutil.UUIDFromStringPanic("181a"))
+	var chars []*attstructure.Characteristic
+	for i, m := range values {
+		chars = append(chars, svc.AddCharacteristicReadOnly(uuids[i], m))
+	}
+
+	server := NewGattDevice(external, config)
+
+	var handles []uint16
+	for _, m := range chars {
+		handles = append(handles, m.ValueHandle.Info.Handle)
+	}
+	client := NewGattDevice(attstructure.NewStructure(), config)
+
+	serverConn, clientConn := newPipeConns()
+	server.AddConn(serverConn)
+	client.AddConn(clientConn)
+	t.Cleanup(func() {
+		server.CloseConn(serverConn)
+		client.CloseConn(clientConn)
+	})
+
+	return client, clientConn, handles
+}
+
+func TestClientReadMultipleVariable(t *testing.T) {
+	client, conn, handles, values := buildReadMultipleTest(t, 50)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := client.ClientReadMultiple(ctx, handles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range values {
+		if !bytes.Equal(result[i], values[i]) {
+			t.Errorf("value %d: %x, want %x", i, result[i], values[i])
+		}
+	}
+
+	/* The long value did not fit and was read separately */
+	if conn.count(ATTReadMultipleValueReq) != 1 || conn.count(ATTReadBlobReq) == 0 || conn.count(ATTReadMultipleReq) != 0 {
+		t.Errorf("used %d variable, %d fixed and %d blob requests", conn.count(ATTReadMultipleValueReq),
+			conn.count(ATTReadMultipleReq), conn.count(ATTReadBlobReq))
+	}
+}
+
+// Without Read Multiple Variable Length only values with a length fixed by
+// their type are combined in one request, the others are read on their own.
+func TestClientReadMultipleFallback(t *testing.T) {
+	uuids := []bleutil.UUID{
+		bleutil.UUIDFromStringPanic("2a19"),
+		bleutil.UUIDFromStringPanic("2a29"),
+		bleutil.UUIDFromStringPanic("2a6e"),
+		bleutil.UUIDFromStringPanic("2a6f"),
+	}
+	values := [][]byte{{100}, []byte("variable"), {1, 2}, {3, 4}}
+
+	config := &GattDeviceConfig{MTU: 100, DeviceName: "test", DiscoverRemoteOnConnect: true}
+	client, conn, handles := buildReadMultipleDevices(t, config, uuids, values)
+	conn.reject = map[ATTCommand]bool{ATTReadMultipleValueReq: true}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if client.ClientGetStructure(ctx) == nil {
+		t.Fatal("discovery failed")
+	}
+	reads := conn.count(ATTReadReq)
+
+	result, err := client.ClientReadMultiple(ctx, handles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range values {
+		if !bytes.Equal(result[i], values[i]) {
+			t.Errorf("value %d: %x, want %x", i, result[i], values[i])
+		}
+	}
+
+	if conn.count(ATTReadMultipleValueReq) != 1 || conn.count(ATTReadMultipleReq) != 1 || conn.count(ATTReadReq)-reads != 1 {
+		t.Errorf("used %d variable, %d fixed and %d single requests", conn.count(ATTReadMultipleValueReq),
+			conn.count(ATTReadMultipleReq), conn.count(ATTReadReq)-reads)
+	}
+}
+
+// The server cuts the variable length response off at the MTU, but keeps
+// the full length of the last value.
+func TestServerReadMultipleVariable(t *testing.T) {
+	srv, conn, fc := buildTestServer(t)
+	conn.mtu = 23
+
+	var handles []uint16
+	for _, h := range srv.localStructure.Handles {
+		if h.Info.UUID == bleutil.UUIDFromStringPanic("2a29") {
+			handles = append(handles, h.Info.Handle, h.Info.Handle)
+		}
+	}
+
+	body := &pdu.PDU{}
+	for _, m := range handles {
+		binary.LittleEndian.PutUint16(body.ExtendRight(2), m)
+	}
+	if _, err := srv.handleReadReqMultiple(conn, ATTReadMultipleValueReq, body); err != nil {
+		t.Fatal(err)
+	}
+
+	tx := fc.takeTx()
+	want := append([]byte{byte(ATTReadMultipleValueRsp), 12, 0}, "manufacturer"...)
+	want = append(want, 12, 0)
+	want = append(want, "manufacture"[:23-len(want)]...)
+	if len(tx) != 1 || !bytes.Equal(tx[0].Buf(), want) {
+		t.Errorf("response %x, want %x", tx[0].Buf(), want)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/binary"
+	"sync"
 
 	attstructure "github.com/BertoldVdb/go-ble/bleatt/structure"
 	bleutil "github.com/BertoldVdb/go-ble/util"
@@ -34,6 +35,10 @@ type attServer struct {
 	parent *GattDevice
 
 	localStructure *attstructure.ExportedStructure
+
+	/* Protected by the structure lock */
+	dbHash      [16]byte
+	dbHashValid bool
 }
 
 func normalizeATTMTU(mtu uint16) uint16 {
@@ -50,9 +55,11 @@ func (a *attServer) init(parent *GattDevice, localStructure *attstructure.Export
 	a.parent = parent
 	a.localStructure = localStructure
 
-	localStructure.HandleSet = func(c *attstructure.Characteristic, value []byte) (int, error) {
-		return a.characteristicNotify(context.Background(), c, value)
-
+	localStructure.HandleSet = func(ctx context.Context, c *attstructure.Characteristic, value []byte) ([]attstructure.NotifyResult, error) {
+		return a.characteristicNotify(ctx, c, value)
+	}
+	localStructure.HandlesChanged = func(ctx context.Context, start uint16, end uint16) error {
+		return a.parent.ServiceChanged(ctx, start, end)
 	}
 
 	return nil
@@ -145,6 +152,7 @@ func (a *attServer) handleDiscovery(conn *gattDeviceConn, method ATTCommand, buf
 		}
 
 		uuid = bleutil.UUIDFromBytes(buf.Buf()[4:6])
+		checkUUID = true
 		checkValue = buf.Buf()[6:]
 		/* Cap the value-to-match length: the spec only requires up to
 		   the negotiated MTU but we don't actually serve attributes
@@ -160,7 +168,7 @@ func (a *attServer) handleDiscovery(conn *gattDeviceConn, method ATTCommand, buf
 	hasResults := false
 	header := byte(0)
 
-	for _, m := range a.localStructure.Handles {
+	for _, m := range a.localStructure.GetHandles() {
 		if m.Info.Handle > endHandle {
 			break
 		}
@@ -169,6 +177,10 @@ func (a *attServer) handleDiscovery(conn *gattDeviceConn, method ATTCommand, buf
 			continue
 		}
 
+		a.localStructure.Lock()
+		m = a.connHandle(conn, m)
+		a.localStructure.Unlock()
+
 		if checkUUID && m.Info.UUID != uuid {
 			continue
 		}
@@ -208,7 +220,7 @@ func (a *attServer) handleDiscovery(conn *gattDeviceConn, method ATTCommand, buf
 		   read-encryption-required attributes by guess-and-check. */
 		needSecCheck := addValue || (method == ATTFindByTypeValueReq)
 		if needSecCheck {
-			secErr := a.checkSecurity(conn, true, m.Info.Flags)
+			secErr := a.checkSecurity(conn, true, m)
 			if secErr != ATTErrorNone {
 				return false, sendError(conn, method, m.Info.Handle, secErr)
 			}
@@ -271,16 +283,60 @@ func (a *attServer) handleDiscovery(conn *gattDeviceConn, method ATTCommand, buf
 	return false, sendError(conn, method, startHandle, ATTErrorAttributeNotFound)
 }
 
-func (a *attServer) findHandle(handle uint16) *attstructure.GATTHandle {
-	for i, m := range a.localStructure.Handles {
+func (a *attServer) findHandle(conn *gattDeviceConn, handle uint16) *attstructure.GATTHandle {
+	for _, m := range a.localStructure.GetHandles() {
 		if m.Info.Handle == handle {
-			return a.localStructure.Handles[i]
+			a.localStructure.Lock()
+			defer a.localStructure.Unlock()
+			return a.connHandle(conn, m)
 		}
 	}
 	return nil
 }
 
-func (a *attServer) checkSecurity(conn *gattDeviceConn, isRead bool, flags attstructure.CharacteristicFlag) ATTError {
+// The client characteristic configuration is different for every client, so the handle
+// is replaced by a private copy belonging to the connection. The structure must be locked
+func (a *attServer) connHandle(conn *gattDeviceConn, handle *attstructure.GATTHandle) *attstructure.GATTHandle {
+	if handle.Info.UUID != attstructure.UUIDCharacteristicClientConfiguration {
+		return handle
+	}
+
+	conn = conn.owner()
+
+	if conn.cccHandles == nil {
+		conn.cccHandles = make(map[*attstructure.GATTHandle]*attstructure.GATTHandle)
+	}
+
+	h, ok := conn.cccHandles[handle]
+	if !ok {
+		h = &attstructure.GATTHandle{
+			Info:        handle.Info,
+			Value:       append([]byte{}, handle.Value...),
+			ValueConfig: handle.ValueConfig,
+		}
+		conn.cccHandles[handle] = h
+	}
+
+	return h
+}
+
+func (a *attServer) getCCC(conn *gattDeviceConn, ccc *attstructure.GATTHandle) uint16 {
+	a.localStructure.Lock()
+	defer a.localStructure.Unlock()
+
+	value := a.connHandle(conn, ccc).Value
+	switch len(value) {
+	case 0:
+		return 0
+	case 1:
+		return uint16(value[0])
+	}
+	return binary.LittleEndian.Uint16(value)
+}
+
+func (a *attServer) checkSecurity(conn *gattDeviceConn, isRead bool, handle *attstructure.GATTHandle) ATTError {
+	flags := handle.Info.Flags
+
 	if isRead && flags&attstructure.CharacteristicRead == 0 {
 		return ATTErrorReadNotPermitted
 	}
@@ -318,21 +374,58 @@ func (a *attServer) checkSecurity(conn *gattDeviceConn, isRead bool, flags attst
 		}
 	}
 
+	if !a.authorize(conn, !isRead, handle) {
+		return ATTErrorInsufficientAuthorization
+	}
+
 	return ATTErrorNone
 }
 
+// authorize asks the application if the client may access the handle
+func isDeclaration(handle *attstructure.GATTHandle) bool {
+	uuid := handle.Info.UUID
+	return uuid == attstructure.UUIDPrimaryService || uuid == attstructure.UUIDSecondaryService ||
+		uuid == attstructure.UUIDIncludedService || uuid == attstructure.UUIDCharacteristic
+}
+
+func (a *attServer) authorize(conn *gattDeviceConn, write bool, handle *attstructure.GATTHandle) bool {
+	handleCb := handle.ValueConfig.AuthorizeCb
+	deviceCb := a.parent.config.AuthorizeCb
+	if isDeclaration(handle) {
+		/* Declarations only describe the structure, they carry no value */
+		deviceCb = nil
+	}
+	if handleCb == nil && deviceCb == nil {
+		return true
+	}
+
+	req := attstructure.AccessRequest{
+		Handle: handle,
+		Write:  write,
+	}
+	if conn.smpConn != nil {
+		req.Peer = conn.smpConn.RemoteIdentity()
+		req.Encrypted, req.Authenticated, req.Bonded = conn.smpConn.GetSecurity()
+	}
+
+	if handleCb != nil && !handleCb(req) {
+		return false
+	}
+	return deviceCb == nil || deviceCb(a.parent, req)
+}
+
 func (a *attServer) handleReadReq(conn *gattDeviceConn, method ATTCommand, buf *pdu.PDU) (bool, error) {
 	if (method == ATTReadReq && buf.Len() != 2) || (method == ATTReadBlobReq && buf.Len() != 4) {
 		return false, ErrorProtocolViolation
 	}
 
 	idx := binary.LittleEndian.Uint16(buf.DropLeft(2))
-	handle := a.findHandle(idx)
+	handle := a.findHandle(conn, idx)
 	if handle == nil {
 		return false, sendError(conn, method, idx, ATTErrorInvalidHandle)
 	}
 
-	secErr := a.checkSecurity(conn, true, handle.Info.Flags)
+	secErr := a.checkSecurity(conn, true, handle)
 	if secErr != ATTErrorNone {
 		return false, sendError(conn, method, idx, secErr)
 	}
@@ -377,41 +470,52 @@ func (a *attServer) handleReadReqMultiple(conn *gattDeviceConn, method ATTComman
 		return false, sendError(conn, method, 0, ATTErrorInvalidPDU)
 	}
 
-	resp := bleutil.GetBuffer(1)
-	resp.Buf()[0] = byte(method + 1)
-
-	addLen := method == ATTReadMultipleValueReq
-
-	for {
-		if buf.Len() < 2 {
-			break
-		}
+	/* All handles are checked before anything is read */
+	var handles []*attstructure.GATTHandle
+	for buf.Len() >= 2 {
 		idx := binary.LittleEndian.Uint16(buf.DropLeft(2))
-		handle := a.findHandle(idx)
+		handle := a.findHandle(conn, idx)
 		if handle == nil {
-			bleutil.ReleaseBuffer(resp)
 			return false, sendError(conn, method, idx, ATTErrorInvalidHandle)
 		}
 
-		secErr := a.checkSecurity(conn, true, handle.Info.Flags)
+		secErr := a.checkSecurity(conn, true, handle)
 		if secErr != ATTErrorNone {
-			bleutil.ReleaseBuffer(resp)
 			return false, sendError(conn, method, idx, secErr)
 		}
 
-		if addLen {
-			if resp.Len()+2 > conn.getMTU() {
-				break
-			}
+		handles = append(handles, handle)
+	}
+
+	resp := bleutil.GetBuffer(1)
+	resp.Buf()[0] = byte(method + 1)
+
+	/* The variable length response gives the full length of every value, the
+	   response is cut off at the MTU */
+	addLen := method == ATTReadMultipleValueReq
 
+	a.localStructure.Lock()
+	for _, handle := range handles {
+		if addLen && resp.Len()+2 > conn.getMTU() {
+			break
+		}
+
+		if handle.ValueConfig.ValueBeforeReadCb != nil {
+			handle.ValueConfig.ValueBeforeReadCb(handle, 0)
+		}
+		if addLen {
 			binary.LittleEndian.PutUint16(resp.ExtendRight(2), uint16(len(handle.Value)))
 		}
 
-		full, _ := a.addPayload(conn, resp, handle.Value)
+		full, bytes := a.addPayload(conn, resp, handle.Value)
+		if handle.ValueConfig.ValueAfterReadCb != nil {
+			handle.ValueConfig.ValueAfterReadCb(handle, 0, bytes)
+		}
 		if full {
 			break
 		}
 	}
+	a.localStructure.Unlock()
 
 	return false, a.write(conn, resp)
 }
@@ -422,12 +526,12 @@ func (a *attServer) handleWriteReq(conn *gattDeviceConn, method ATTCommand, buf
 	}
 
 	idx := binary.LittleEndian.Uint16(buf.DropLeft(2))
-	handle := a.findHandle(idx)
+	handle := a.findHandle(conn, idx)
 	if handle == nil {
 		return false, sendError(conn, method, idx, ATTErrorInvalidHandle)
 	}
 
-	secErr := a.checkSecurity(conn, false, handle.Info.Flags)
+	secErr := a.checkSecurity(conn, false, handle)
 	if secErr != ATTErrorNone {
 		return false, sendError(conn, method, idx, secErr)
 	}
@@ -450,24 +554,34 @@ func (a *attServer) handleWriteReq(conn *gattDeviceConn, method ATTCommand, buf
 		return false, nil
 	}
 
+	a.writeValue(conn, idx, handle, buf.Buf())
+
+	if method == ATTWriteReq {
+		buf.Reset()
+		buf.Append(byte(ATTWriteRsp))
+		return true, a.write(conn, buf)
+	}
+
+	return false, nil
+}
+
+func (a *attServer) writeValue(conn *gattDeviceConn, idx uint16, handle *attstructure.GATTHandle, value []byte) {
 	a.localStructure.Lock()
 	if handle.ValueConfig.LengthFixed {
-		copy(handle.Value, buf.Buf())
+		copy(handle.Value, value)
 	} else {
-		handle.Value = append(handle.Value[:0], buf.Buf()...)
+		handle.Value = append(handle.Value[:0], value...)
 	}
 	if handle.ValueConfig.ValueWriteCb != nil {
 		handle.ValueConfig.ValueWriteCb(handle)
 	}
 	a.localStructure.Unlock()
 
-	if method == ATTWriteReq {
-		buf.Reset()
-		buf.Append(byte(ATTWriteRsp))
-		return true, a.write(conn, buf)
+	if a.isServiceChangedCCC(idx) {
+		a.saveBondState(conn, a.parent.DatabaseHash())
+	} else if handle.Info.UUID == attstructure.UUIDCharacteristicClientConfiguration {
+		a.saveBondCCC(conn)
 	}
-
-	return false, nil
 }
 
 func (a *attServer) handlePrepateWriteReq(conn *gattDeviceConn, buf *pdu.PDU) (bool, error) {
@@ -476,12 +590,12 @@ func (a *attServer) handlePrepateWriteReq(conn *gattDeviceConn, buf *pdu.PDU) (b
 	}
 
 	idx := binary.LittleEndian.Uint16(buf.Buf())
-	handle := a.findHandle(idx)
+	handle := a.findHandle(conn, idx)
 	if handle == nil {
 		return false, sendError(conn, ATTPrepareWriteReq, idx, ATTErrorInvalidHandle)
 	}
 
-	secErr := a.checkSecurity(conn, false, handle.Info.Flags)
+	secErr := a.checkSecurity(conn, false, handle)
 	if secErr != ATTErrorNone {
 		return false, sendError(conn, ATTPrepareWriteReq, idx, secErr)
 	}
@@ -639,7 +753,7 @@ func (a *attServer) handlePDU(conn *gattDeviceConn, method ATTCommand, isAuthent
 	case ATTWriteCMD:
 		return a.handleWriteReq(conn, method, buf)
 	case ATTSignedWriteCMD:
-		return false, nil
+		return a.handleSignedWriteCmd(conn, buf)
 
 	/* Transaction write */
 	case ATTPrepareWriteReq:
@@ -664,38 +778,74 @@ func (a *attServer) handlePDU(conn *gattDeviceConn, method ATTCommand, isAuthent
 	return false, sendError(conn, method, 0, ATTErrorRequestNotSupported)
 }
 
-func (a *attServer) characteristicNotify(ctx context.Context, characteristic *attstructure.Characteristic, value []byte) (int, error) {
+func (a *attServer) characteristicNotify(ctx context.Context, characteristic *attstructure.Characteristic, value []byte) ([]attstructure.NotifyResult, error) {
 	handle := characteristic.ValueHandle
 
-	ccc := handle.CCCHandle
-	idx := handle.Info.Handle
+	conns := a.parent.getConns()
+	if len(conns) == 0 {
+		/* Without a connection we can't notify */
+		return nil, nil
+	}
+
+	results := []attstructure.NotifyResult{}
 
 	/* If there is no client config descriptor we can't notify */
+	ccc := handle.CCCHandle
 	if ccc == nil {
-		return 0, nil
+		return results, nil
 	}
 
-	a.localStructure.Lock()
-	flags := ccc.Value[0]
-	a.localStructure.Unlock()
+	var wg sync.WaitGroup
+	var resultsMutex sync.Mutex
 
-	cmd := ATTCommand(0)
-	if (flags&2 > 0) && (handle.Info.Flags&attstructure.CharacteristicIndicate > 0) {
-		//Indication
-		cmd = ATTHandleValueIND
-	} else if (flags&1 > 0) && (handle.Info.Flags&attstructure.CharacteristicNotify > 0) {
-		//Notification
-		cmd = ATTHandleValueNTF
-	} else {
-		return 0, nil
-	}
+	for _, conn := range conns {
+		/* The peer is notified on its unenhanced bearer only */
+		if conn.owner() != conn {
+			continue
+		}
 
-	conn := a.parent.getConnWithHighestMTU()
-	if conn == nil {
-		/* Without a connection we can't notify either */
-		return -1, nil
+		/* A peer that may not read the value doesn't get it pushed either */
+		if !a.authorize(conn, false, handle) {
+			continue
+		}
+
+		flags := a.getCCC(conn, ccc)
+
+		cmd := ATTCommand(0)
+		if (flags&2 > 0) && (handle.Info.Flags&attstructure.CharacteristicIndicate > 0) {
+			//Indication
+			cmd = ATTHandleValueIND
+		} else if (flags&1 > 0) && (handle.Info.Flags&attstructure.CharacteristicNotify > 0) {
+			//Notification
+			cmd = ATTHandleValueNTF
+		} else {
+			continue
+		}
+
+		/* Indications block until the peer confirms, so every link is served in parallel */
+		wg.Add(1)
+		go func(conn *gattDeviceConn, cmd ATTCommand) {
+			defer wg.Done()
+
+			bytes, err := a.notifyConn(ctx, conn, cmd, handle.Info.Handle, value)
+
+			resultsMutex.Lock()
+			results = append(results, attstructure.NotifyResult{
+				Conn:       conn.conn,
+				Indication: cmd == ATTHandleValueIND,
+				Bytes:      bytes,
+				Err:        err,
+			})
+			resultsMutex.Unlock()
+		}(conn, cmd)
 	}
 
+	wg.Wait()
+
+	return results, nil
+}
+
+func (a *attServer) notifyConn(ctx context.Context, conn *gattDeviceConn, cmd ATTCommand, idx uint16, value []byte) (int, error) {
 	/* Before we can do any indication MTU negotiation must be finished (otherwise the receiver doesn't know the fragment size) */
 	conn.getMTUBlocking()
 
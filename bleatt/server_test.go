@@ -1,6 +1,7 @@
 package bleatt
 
 import (
+	"bytes"
 	"context"
 	"encoding/binary"
 	"io"
@@ -496,3 +497,380 @@ func TestServerFindByTypeValueDiscoversService(t *testing.T) {
 		t.Errorf("expected ATTFindByTypeValueRsp, got %#x", got)
 	}
 }
+
+// Notifications fan out to every connection that enabled them in its own
+// CCCD, truncated to that connection's MTU.
+func TestServerNotifyFanOut(t *testing.T) {
+	external := attstructure.NewStructure()
+	svc := external.AddPrimaryService(bleutil.UUIDFromStringPanic("180a"))
+	char := svc.AddCharacteristic(
+		bleutil.UUIDFromStringPanic("2a31"),
+		attstructure.CharacteristicRead|attstructure.CharacteristicNotify,
+		attstructure.ValueConfig{},
+	)
+
+	dev := NewGattDevice(external, &GattDeviceConfig{
+		MTU:                     247,
+		DeviceName:              "test",
+		DiscoverRemoteOnConnect: false,
+	})
+
+	addConn := func(mtu uint32) (*gattDeviceConn, *fakeConn) {
+		fc := newFakeConn()
+		gconn := &gattDeviceConn{
+			parent: dev,
+			conn:   fc,
+			logger: bleutil.LogWithPrefix(fc.GetLogger(), "att-test"),
+			mtu:    mtu,
+		}
+		gconn.client.init(gconn)
+		gconn.mtuRequest.Do(func() {})
+		dev.conns[fc] = gconn
+		return gconn, fc
+	}
+
+	connA, fcA := addConn(23)
+	connB, fcB := addConn(247)
+	_, fcC := addConn(247)
+
+	cccHandle := char.ValueHandle.CCCHandle.Info.Handle
+	for _, c := range []*gattDeviceConn{connA, connB} {
+		body := &pdu.PDU{}
+		binary.LittleEndian.PutUint16(body.ExtendRight(2), cccHandle)
+		body.Append(0x01, 0x00)
+		if _, err := dev.server.handleWriteReq(c, ATTWriteReq, body); err != nil {
+			t.Fatal(err)
+		}
+		c.conn.(*fakeConn).takeTx()
+	}
+
+	value := make([]byte, 100)
+	results, err := char.SetValueResults(context.Background(), value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("results: got %d want 2", len(results))
+	}
+	for _, r := range results {
+		want := 100
+		if r.Conn == fcA {
+			want = 20
+		}
+		if r.Bytes != want || r.Err != nil || r.Indication {
+			t.Errorf("result %+v: want %d bytes", r, want)
+		}
+	}
+
+	if got := len(fcA.takeTx()); got != 1 {
+		t.Errorf("conn A: got %d PDUs want 1", got)
+	}
+	if got := len(fcB.takeTx()); got != 1 {
+		t.Errorf("conn B: got %d PDUs want 1", got)
+	}
+	if got := len(fcC.takeTx()); got != 0 {
+		t.Errorf("unsubscribed conn C: got %d PDUs want 0", got)
+	}
+
+	if n, err := char.SetValue(context.Background(), value); n != 20 || err != nil {
+		t.Errorf("SetValue: got %d, %v want 20", n, err)
+	}
+	if got := dev.ServerGetNotifyMTU(char); got != 23 {
+		t.Errorf("ServerGetNotifyMTU: got %d want 23", got)
+	}
+}
+
+// Included services are found with ReadByType on the include declaration.
+func TestServerReadByTypeIncludedService(t *testing.T) {
+	external := attstructure.NewStructure()
+	primary := external.AddPrimaryService(bleutil.UUIDFromStringPanic("1812"))
+	secondary := external.AddSecondaryService(bleutil.UUIDFromStringPanic("180f"))
+	secondary.AddCharacteristicReadOnly(bleutil.UUIDFromStringPanic("2a19"), []byte{100})
+	primary.Include(secondary)
+
+	dev := NewGattDevice(external, &GattDeviceConfig{
+		MTU:                     247,
+		DeviceName:              "test",
+		DiscoverRemoteOnConnect: false,
+	})
+	fc := newFakeConn()
+	conn := &gattDeviceConn{
+		parent: dev,
+		conn:   fc,
+		logger: bleutil.LogWithPrefix(fc.GetLogger(), "att-test"),
+		mtu:    247,
+	}
+
+	body := &pdu.PDU{}
+	binary.LittleEndian.PutUint16(body.ExtendRight(2), 1)
+	binary.LittleEndian.PutUint16(body.ExtendRight(2), 0xFFFF)
+	binary.LittleEndian.PutUint16(body.ExtendRight(2), 0x2802)
+	if _, err := dev.server.handleDiscovery(conn, ATTReadByTypeReq, body); err != nil {
+		t.Fatal(err)
+	}
+
+	tx := fc.takeTx()
+	if len(tx) != 1 {
+		t.Fatalf("got %d PDUs", len(tx))
+	}
+	rsp := tx[0].Buf()
+	if rsp[0] != byte(ATTReadByTypeRsp) || rsp[1] != 8 || len(rsp) != 10 {
+		t.Fatalf("unexpected response %x", rsp)
+	}
+
+	start := binary.LittleEndian.Uint16(rsp[4:])
+	end := binary.LittleEndian.Uint16(rsp[6:])
+	if end != start+2 || binary.LittleEndian.Uint16(rsp[8:]) != 0x180f {
+		t.Errorf("unexpected include %x", rsp[2:])
+	}
+}
+
+// Descriptors are read and written like any other attribute, using their
+// own permissions.
+func TestServerDescriptorAccess(t *testing.T) {
+	external := attstructure.NewStructure()
+	svc := external.AddPrimaryService(bleutil.UUIDFromStringPanic("180a"))
+	c := svc.AddCharacteristic(bleutil.UUIDFromStringPanic("2a30"), attstructure.CharacteristicRead, attstructure.ValueConfig{})
+	desc := c.AddUserDescription("Counter")
+
+	written := 0
+	vendor, err := c.AddDescriptor(bleutil.UUIDFromStringPanic("6e400010-b5a3-f393-e0a9-e50e24dcca9e"),
+		attstructure.CharacteristicRead|attstructure.CharacteristicWriteAck, nil,
+		attstructure.ValueConfig{LengthMax: 8, ValueWriteCb: func(h *attstructure.GATTHandle) error {
+			written++
+			return nil
+		}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dev := NewGattDevice(external, &GattDeviceConfig{
+		MTU:                     247,
+		DeviceName:              "test",
+		DiscoverRemoteOnConnect: false,
+	})
+	srv := &dev.server
+
+	fc := newFakeConn()
+	conn := &gattDeviceConn{
+		parent: dev,
+		conn:   fc,
+		logger: bleutil.LogWithPrefix(fc.GetLogger(), "att-test"),
+		mtu:    247,
+	}
+	conn.client.init(conn)
+
+	read := func(handle uint16) []byte {
+		body := &pdu.PDU{}
+		binary.LittleEndian.PutUint16(body.ExtendRight(2), handle)
+		if _, err := srv.handleReadReq(conn, ATTReadReq, body); err != nil {
+			t.Fatal(err)
+		}
+		tx := fc.takeTx()
+		return append([]byte{}, tx[len(tx)-1].Buf()...)
+	}
+	write := func(handle uint16, value ...byte) byte {
+		body := &pdu.PDU{}
+		binary.LittleEndian.PutUint16(body.ExtendRight(2), handle)
+		body.Append(value...)
+		if _, err := srv.handleWriteReq(conn, ATTWriteReq, body); err != nil {
+			t.Fatal(err)
+		}
+		return lastTxOpcode(t, fc)
+	}
+
+	if rsp := read(desc.Handle.Info.Handle); rsp[0] != byte(ATTReadRsp) || string(rsp[1:]) != "Counter" {
+		t.Errorf("user description read: %x", rsp)
+	}
+	if got := write(desc.Handle.Info.Handle, 'x'); got != byte(ATTErrorRsp) {
+		t.Errorf("read only descriptor was written: %#x", got)
+	}
+
+	if got := write(vendor.Handle.Info.Handle, 1, 2); got != byte(ATTWriteRsp) || written != 1 {
+		t.Fatalf("descriptor write: %#x, callback called %d times", got, written)
+	}
+	if value, _ := vendor.GetValue(context.Background(), nil); !bytes.Equal(value, []byte{1, 2}) {
+		t.Errorf("descriptor value %x", value)
+	}
+	if rsp := read(vendor.Handle.Info.Handle); !bytes.Equal(rsp, []byte{byte(ATTReadRsp), 1, 2}) {
+		t.Errorf("descriptor read: %x", rsp)
+	}
+}
+
+// Signed writes are commands: when they cannot be verified they are
+// dropped without a response.
+func TestServerSignedWriteDropped(t *testing.T) {
+	srv, conn, fc := buildTestServer(t)
+
+	var target *attstructure.GATTHandle
+	for _, h := range srv.localStructure.Handles {
+		if h.Info.UUID == bleutil.UUIDFromStringPanic("2a30") {
+			target = h
+		}
+	}
+
+	body := &pdu.PDU{}
+	binary.LittleEndian.PutUint16(body.ExtendRight(2), target.Info.Handle)
+	body.Append('x')
+	body.ExtendRight(attSignatureLen)
+	if _, err := srv.handlePDU(conn, ATTSignedWriteCMD, true, body); err != nil {
+		t.Fatal(err)
+	}
+	if tx := fc.takeTx(); len(tx) != 0 {
+		t.Errorf("signed write was answered: %x", tx[0].Buf())
+	}
+	if len(target.Value) != 0 {
+		t.Errorf("unverified value was written: %x", target.Value)
+	}
+
+	if _, err := srv.handlePDU(conn, ATTSignedWriteCMD, true, makePDU(1, 0, 'x')); err != ErrorProtocolViolation {
+		t.Errorf("short signed write: %v", err)
+	}
+}
+
+// Reads and writes are refused with an authorization error when the
+// callback of the attribute or of the device says no.
+func TestServerAuthorization(t *testing.T) {
+	external := attstructure.NewStructure()
+	svc := external.AddPrimaryService(bleutil.UUIDFromStringPanic("180a"))
+
+	var requests []attstructure.AccessRequest
+	config := svc.AddCharacteristic(bleutil.UUIDFromStringPanic("2a30"),
+		attstructure.CharacteristicRead|attstructure.CharacteristicWriteAck,
+		attstructure.ValueConfig{LengthMax: 8, AuthorizeCb: func(req attstructure.AccessRequest) bool {
+			requests = append(requests, req)
+			return !req.Write
+		}})
+	open := svc.AddCharacteristicReadOnly(bleutil.UUIDFromStringPanic("2a29"), []byte("open"))
+
+	deviceAllowed := true
+	dev := NewGattDevice(external, &GattDeviceConfig{
+		MTU:        247,
+		DeviceName: "test",
+		AuthorizeCb: func(dev *GattDevice, req attstructure.AccessRequest) bool {
+			return deviceAllowed
+		},
+	})
+	srv := &dev.server
+
+	fc := newFakeConn()
+	conn := &gattDeviceConn{
+		parent: dev,
+		conn:   fc,
+		logger: bleutil.LogWithPrefix(fc.GetLogger(), "att-test"),
+		mtu:    247,
+	}
+	conn.client.init(conn)
+
+	request := func(method ATTCommand, handle uint16, value ...byte) []byte {
+		body := &pdu.PDU{}
+		binary.LittleEndian.PutUint16(body.ExtendRight(2), handle)
+		body.Append(value...)
+		if method == ATTReadReq {
+			srv.handleReadReq(conn, method, body)
+		} else {
+			srv.handleWriteReq(conn, method, body)
+		}
+		tx := fc.takeTx()
+		return append([]byte{}, tx[len(tx)-1].Buf()...)
+	}
+
+	handle := config.ValueHandle.Info.Handle
+	if rsp := request(ATTReadReq, handle); rsp[0] != byte(ATTReadRsp) {
+		t.Errorf("read refused: %x", rsp)
+	}
+	if rsp := request(ATTWriteReq, handle, 1); rsp[0] != byte(ATTErrorRsp) || rsp[4] != byte(ATTErrorInsufficientAuthorization) {
+		t.Errorf("write allowed: %x", rsp)
+	}
+	if len(requests) != 2 || requests[0].Write || !requests[1].Write || requests[1].Handle != config.ValueHandle {
+		t.Errorf("unexpected requests %+v", requests)
+	}
+
+	deviceAllowed = false
+	if rsp := request(ATTReadReq, open.ValueHandle.Info.Handle); rsp[0] != byte(ATTErrorRsp) || rsp[4] != byte(ATTErrorInsufficientAuthorization) {
+		t.Errorf("device callback ignored: %x", rsp)
+	}
+}
+
+// The characteristic's callback also guards its CCCD and notifications, the
+// device callback is not asked about discovery declarations.
+func TestServerAuthorizationCCC(t *testing.T) {
+	external := attstructure.NewStructure()
+	svc := external.AddPrimaryService(bleutil.UUIDFromStringPanic("180a"))
+
+	allowed := false
+	char := svc.AddCharacteristic(bleutil.UUIDFromStringPanic("2a31"),
+		attstructure.CharacteristicRead|attstructure.CharacteristicNotify,
+		attstructure.ValueConfig{AuthorizeCb: func(req attstructure.AccessRequest) bool {
+			return allowed
+		}})
+
+	var deviceRequests []attstructure.AccessRequest
+	dev := NewGattDevice(external, &GattDeviceConfig{
+		MTU:        247,
+		DeviceName: "test",
+		AuthorizeCb: func(dev *GattDevice, req attstructure.AccessRequest) bool {
+			deviceRequests = append(deviceRequests, req)
+			return true
+		},
+	})
+	srv := &dev.server
+
+	fc := newFakeConn()
+	conn := &gattDeviceConn{
+		parent: dev,
+		conn:   fc,
+		logger: bleutil.LogWithPrefix(fc.GetLogger(), "att-test"),
+		mtu:    247,
+	}
+	conn.client.init(conn)
+	conn.mtuRequest.Do(func() {})
+	dev.conns[fc] = conn
+
+	subscribe := func() []byte {
+		body := &pdu.PDU{}
+		binary.LittleEndian.PutUint16(body.ExtendRight(2), char.ValueHandle.CCCHandle.Info.Handle)
+		body.Append(0x01, 0x00)
+		srv.handleWriteReq(conn, ATTWriteReq, body)
+		tx := fc.takeTx()
+		return append([]byte{}, tx[len(tx)-1].Buf()...)
+	}
+
+	if rsp := subscribe(); rsp[0] != byte(ATTErrorRsp) || rsp[4] != byte(ATTErrorInsufficientAuthorization) {
+		t.Errorf("unauthorized subscription allowed: %x", rsp)
+	}
+
+	allowed = true
+	if rsp := subscribe(); rsp[0] != byte(ATTWriteRsp) {
+		t.Errorf("subscription refused: %x", rsp)
+	}
+
+	allowed = false
+	if results, err := char.SetValueResults(context.Background(), []byte{1}); err != nil || len(results) != 0 {
+		t.Errorf("unauthorized notification: %+v, %v", results, err)
+	}
+	if got := len(fc.takeTx()); got != 0 {
+		t.Errorf("got %d PDUs want 0", got)
+	}
+
+	allowed = true
+	if results, err := char.SetValueResults(context.Background(), []byte{2}); err != nil || len(results) != 1 {
+		t.Errorf("notification: %+v, %v", results, err)
+	}
+	fc.takeTx()
+
+	deviceRequests = nil
+	body := &pdu.PDU{}
+	binary.LittleEndian.PutUint16(body.ExtendRight(2), 1)
+	binary.LittleEndian.PutUint16(body.ExtendRight(2), 0xFFFF)
+	binary.LittleEndian.PutUint16(body.ExtendRight(2), 0x2803)
+	if _, err := srv.handleDiscovery(conn, ATTReadByTypeReq, body); err != nil {
+		t.Fatal(err)
+	}
+	if tx := fc.takeTx(); len(tx) != 1 || tx[0].Buf()[0] != byte(ATTReadByTypeRsp) {
+		t.Errorf("discovery failed")
+	}
+	if len(deviceRequests) != 0 {
+		t.Errorf("device callback asked for declarations: %+v", deviceRequests)
+	}
+}
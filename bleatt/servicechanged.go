@@ -0,0 +1,233 @@
+package bleatt
+
+import (
+	"context"
+	"encoding/binary"
+	"sync/atomic"
+
+	attstructure "github.com/BertoldVdb/go-ble/bleatt/structure"
+	"github.com/BertoldVdb/go-ble/blesmp"
+	bleutil "github.com/BertoldVdb/go-ble/util"
+	"github.com/sirupsen/logrus"
+)
+
+// GattBondState is the server state of a bonded client that has to survive
+// the connection: its Service Changed configuration, the database hash
+// it was last told about and the configuration of the other client
+// characteristic configuration descriptors, by handle.
+type GattBondState struct {
+	ServiceChanged uint16
+	DatabaseHash   [16]byte
+	CCC            map[uint16]uint16
+}
+
+// DatabaseHash calculates the GATT database hash over a list of attributes
+// sorted by handle. The result is in the byte order of the Database Hash
+// characteristic.
+func DatabaseHash(handles []*attstructure.GATTHandle) [16]byte {
+	var msg []byte
+
+	for _, m := range handles {
+		include := isPartOfGATTDatabase(m.Info.UUID)
+		if include == 0 {
+			continue
+		}
+
+		msg = binary.LittleEndian.AppendUint16(msg, m.Info.Handle)
+		msg = append(msg, m.Info.UUID.UUIDToBytes()...)
+		if include == 2 {
+			msg = append(msg, m.Value...)
+		}
+	}
+
+	hash := blesmp.CryptoAESCMAC([16]byte{}, msg)
+	for i, j := 0, len(hash)-1; i < j; i, j = i+1, j-1 {
+		hash[i], hash[j] = hash[j], hash[i]
+	}
+	return hash
+}
+
+// The structure must be locked
+func (a *attServer) databaseHash() [16]byte {
+	if !a.dbHashValid {
+		a.dbHash = DatabaseHash(a.localStructure.Handles)
+		a.dbHashValid = true
+	}
+	return a.dbHash
+}
+
+// DatabaseHash returns the hash of the local GATT database
+func (d *GattDevice) DatabaseHash() [16]byte {
+	d.server.localStructure.Lock()
+	defer d.server.localStructure.Unlock()
+
+	return d.server.databaseHash()
+}
+
+// ServiceChanged tells clients that the attributes between start and end were modified. Subscribed
+// clients are indicated right away, bonded clients that are not connected when they reconnect
+func (d *GattDevice) ServiceChanged(ctx context.Context, start uint16, end uint16) error {
+	d.server.localStructure.Lock()
+	d.server.dbHashValid = false
+	hash := d.server.databaseHash()
+	d.server.localStructure.Unlock()
+
+	var value [4]byte
+	binary.LittleEndian.PutUint16(value[0:], start)
+	binary.LittleEndian.PutUint16(value[2:], end)
+
+	results, err := d.serviceChanged.SetValueResults(ctx, value[:])
+	if err != nil {
+		return err
+	}
+
+	for _, m := range results {
+		if m.Err != nil {
+			if err == nil {
+				err = m.Err
+			}
+			continue
+		}
+
+		d.connsMutex.Lock()
+		conn := d.conns[m.Conn]
+		d.connsMutex.Unlock()
+
+		if conn != nil {
+			d.server.saveBondState(conn, hash)
+		}
+	}
+
+	return err
+}
+
+func (a *attServer) isServiceChangedCCC(idx uint16) bool {
+	sc := a.parent.serviceChanged
+	return sc != nil && sc.ValueHandle != nil && sc.ValueHandle.CCCHandle != nil && sc.ValueHandle.CCCHandle.Info.Handle == idx
+}
+
+func (d *gattDeviceConn) bondedPeer() (bleutil.BLEAddr, bool) {
+	if d.smpConn == nil {
+		return bleutil.BLEAddr{}, false
+	}
+
+	_, _, bonded := d.smpConn.GetSecurity()
+	return d.smpConn.RemoteIdentity(), bonded
+}
+
+// saveBondState records the Service Changed configuration of a bonded client together with the
+// database hash it knows about
+func (a *attServer) saveBondState(conn *gattDeviceConn, hash [16]byte) {
+	set := a.parent.config.BondStateSet
+	if set == nil {
+		return
+	}
+
+	conn = conn.owner()
+	peer, bonded := conn.bondedPeer()
+	if !bonded {
+		return
+	}
+
+	set(a.parent, peer, GattBondState{
+		ServiceChanged: a.getCCC(conn, a.parent.serviceChanged.ValueHandle.CCCHandle),
+		DatabaseHash:   hash,
+		CCC:            a.cccValues(conn),
+	})
+}
+
+// saveBondCCC records a changed client characteristic configuration of a bonded client. The
+// database hash the client knows about stays the same
+func (a *attServer) saveBondCCC(conn *gattDeviceConn) {
+	hash := a.parent.DatabaseHash()
+	if get := a.parent.config.BondStateGet; get != nil {
+		if peer, bonded := conn.owner().bondedPeer(); bonded {
+			if state, ok := get(a.parent, peer); ok {
+				hash = state.DatabaseHash
+			}
+		}
+	}
+
+	a.saveBondState(conn, hash)
+}
+
+// cccValues returns the client characteristic configurations of a client that are not zero
+func (a *attServer) cccValues(conn *gattDeviceConn) map[uint16]uint16 {
+	a.localStructure.Lock()
+	defer a.localStructure.Unlock()
+
+	values := make(map[uint16]uint16)
+	for _, m := range conn.owner().cccHandles {
+		if len(m.Value) == 2 && (m.Value[0] != 0 || m.Value[1] != 0) {
+			values[m.Info.Handle] = binary.LittleEndian.Uint16(m.Value)
+		}
+	}
+	return values
+}
+
+// restoreCCC sets the client characteristic configurations of a client. Handles that are no
+// longer a configuration descriptor are skipped. The structure must be locked
+func (a *attServer) restoreCCC(conn *gattDeviceConn, values map[uint16]uint16) {
+	for _, m := range a.localStructure.Handles {
+		value, ok := values[m.Info.Handle]
+		if !ok || m.Info.UUID != attstructure.UUIDCharacteristicClientConfiguration {
+			continue
+		}
+
+		ccc := a.connHandle(conn, m)
+		if len(ccc.Value) == 2 {
+			binary.LittleEndian.PutUint16(ccc.Value, value)
+		}
+	}
+}
+
+// restoreBondState runs once the link to a bonded client is encrypted. The Service Changed
+// configuration is restored, and if the database changed since the last connection the client
+// is asked to discover everything again. The other configurations are only restored when the
+// database did not change, otherwise the handles may refer to other attributes
+func (a *attServer) restoreBondState(conn *gattDeviceConn) {
+	get := a.parent.config.BondStateGet
+	if get == nil || a.parent.serviceChanged == nil {
+		return
+	}
+
+	conn = conn.owner()
+	if atomic.LoadInt32(&conn.bondRestored) != 0 {
+		return
+	}
+
+	peer, bonded := conn.bondedPeer()
+	if !bonded || !atomic.CompareAndSwapInt32(&conn.bondRestored, 0, 1) {
+		return
+	}
+
+	state, ok := get(a.parent, peer)
+	if !ok {
+		return
+	}
+
+	a.localStructure.Lock()
+	ccc := a.connHandle(conn, a.parent.serviceChanged.ValueHandle.CCCHandle)
+	binary.LittleEndian.PutUint16(ccc.Value, state.ServiceChanged)
+	hash := a.databaseHash()
+	if state.DatabaseHash == hash {
+		a.restoreCCC(conn, state.CCC)
+	}
+	a.localStructure.Unlock()
+
+	if state.ServiceChanged&2 == 0 || state.DatabaseHash == hash {
+		return
+	}
+
+	go func() {
+		value := []byte{0x01, 0x00, 0xFF, 0xFF}
+		_, err := a.notifyConn(conn.ctx, conn, ATTHandleValueIND, a.parent.serviceChanged.ValueHandle.Info.Handle, value)
+		conn.logger.WithError(err).WithFields(logrus.Fields{
+			"0peer": peer,
+		}).Debug("Indicated database change to bonded client")
+
+		if err == nil {
+			a.saveBondState(conn, hash)
+		}
+	}()
+}
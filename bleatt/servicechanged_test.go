@@ -0,0 +1,324 @@
+package bleatt
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	attstructure "github.com/BertoldVdb/go-ble/bleatt/structure"
+	bleutil "github.com/BertoldVdb/go-ble/util"
+	pdu "github.com/BertoldVdb/go-misc/pdubuf"
+)
+
+// The Database Hash characteristic is served through ReadByType, the way
+// clients look it up.
+func TestServerDatabaseHashRead(t *testing.T) {
+	srv, conn, fc := buildTestServer(t)
+
+	body := &pdu.PDU{}
+	binary.LittleEndian.PutUint16(body.ExtendRight(2), 1)
+	binary.LittleEndian.PutUint16(body.ExtendRight(2), 0xFFFF)
+	body.Append(attstructure.UUIDDatabaseHash.UUIDToBytes()...)
+	if _, err := srv.handleDiscovery(conn, ATTReadByTypeReq, body); err != nil {
+		t.Fatal(err)
+	}
+
+	tx := fc.takeTx()
+	if len(tx) != 1 {
+		t.Fatalf("got %d PDUs", len(tx))
+	}
+	rsp := tx[0].Buf()
+	if rsp[0] != byte(ATTReadByTypeRsp) || rsp[1] != 18 {
+		t.Fatalf("unexpected response %x", rsp)
+	}
+
+	hash := srv.parent.DatabaseHash()
+	if !bytes.Equal(rsp[4:], hash[:]) || hash == [16]byte{} {
+		t.Errorf("served hash %x, want %x", rsp[4:], hash)
+	}
+}
+
+// A client only reads the values of the attributes that make up the hash.
+// The hash of what it discovered must match the hash of the server.
+func TestDatabaseHashOfDiscoveredHandles(t *testing.T) {
+	srv, _, _ := buildTestServer(t)
+
+	var discovered []*attstructure.GATTHandle
+	for _, m := range srv.localStructure.Handles {
+		h := &attstructure.GATTHandle{Info: attstructure.HandleInfo{
+			Handle:    m.Info.Handle,
+			UUID:      m.Info.UUID,
+			UUIDWidth: m.Info.UUIDWidth,
+		}}
+		if isPartOfGATTDatabase(m.Info.UUID) > 0 {
+			h.Value = m.Value
+		}
+		discovered = append(discovered, h)
+	}
+
+	if DatabaseHash(discovered) != srv.parent.DatabaseHash() {
+		t.Error("hash of discovered handles differs")
+	}
+
+	/* Changing a characteristic declaration changes the hash */
+	for _, m := range discovered {
+		if m.Info.UUID == attstructure.UUIDCharacteristic {
+			m.Value = append([]byte{}, m.Value...)
+			m.Value[0] ^= byte(attstructure.CharacteristicNotify)
+			break
+		}
+	}
+	if DatabaseHash(discovered) == srv.parent.DatabaseHash() {
+		t.Error("hash did not change")
+	}
+}
+
+// Subscribed clients receive the changed range as an indication.
+func TestServiceChangedIndication(t *testing.T) {
+	srv, conn, fc := buildTestServer(t)
+	dev := srv.parent
+	conn.mtuRequest.Do(func() {})
+	dev.conns[fc] = conn
+
+	ccc := dev.serviceChanged.ValueHandle.CCCHandle.Info.Handle
+	body := &pdu.PDU{}
+	binary.LittleEndian.PutUint16(body.ExtendRight(2), ccc)
+	body.Append(0x02, 0x00)
+	if _, err := srv.handleWriteReq(conn, ATTWriteReq, body); err != nil {
+		t.Fatal(err)
+	}
+	fc.takeTx()
+
+	/* Confirm the indication once it was sent */
+	go func() {
+		for {
+			if tx := fc.takeTx(); len(tx) > 0 {
+				want := []byte{byte(ATTHandleValueIND), 0, 0, 0x10, 0x00, 0x20, 0x00}
+				binary.LittleEndian.PutUint16(want[1:], dev.serviceChanged.ValueHandle.Info.Handle)
+				if !bytes.Equal(tx[0].Buf(), want) {
+					t.Errorf("indication %x, want %x", tx[0].Buf(), want)
+				}
+				cnf := bleutil.GetBuffer(1)
+				cnf.Buf()[0] = byte(ATTHandleValueCNF)
+				conn.handlePDU(cnf)
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := dev.ServiceChanged(ctx, 0x10, 0x20); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Example database of the Core specification (Vol 3, Part G, Appendix B).
+func TestDatabaseHashExample(t *testing.T) {
+	attributes := []struct {
+		handle uint16
+		uuid   string
+		value  []byte
+	}{
+		{0x0001, "2800", []byte{0x00, 0x18}},
+		{0x0002, "2803", []byte{0x0A, 0x03, 0x00, 0x00, 0x2A}},
+		{0x0003, "2a00", []byte("Example")},
+		{0x0004, "2803", []byte{0x02, 0x05, 0x00, 0x01, 0x2A}},
+		{0x0005, "2a01", []byte{0x00, 0x00}},
+		{0x0006, "2800", []byte{0x01, 0x18}},
+		{0x0007, "2803", []byte{0x20, 0x08, 0x00, 0x05, 0x2A}},
+		{0x0008, "2a05", nil},
+		{0x0009, "2902", []byte{0x00, 0x00}},
+		{0x000A, "2803", []byte{0x0A, 0x0B, 0x00, 0x29, 0x2B}},
+		{0x000B, "2b29", []byte{0x00}},
+		{0x000C, "2803", []byte{0x02, 0x0D, 0x00, 0x2A, 0x2B}},
+		{0x000D, "2b2a", nil},
+		{0x000E, "2800", []byte{0x08, 0x18}},
+		{0x000F, "2802", []byte{0x14, 0x00, 0x16, 0x00, 0x0F, 0x18}},
+		{0x0010, "2803", []byte{0xA2, 0x11, 0x00, 0x18, 0x2A}},
+		{0x0011, "2a18", nil},
+		{0x0012, "2902", []byte{0x00, 0x00}},
+		{0x0013, "2900", []byte{0x00, 0x00}},
+		{0x0014, "2801", []byte{0x0F, 0x18}},
+		{0x0015, "2803", []byte{0x02, 0x16, 0x00, 0x19, 0x2A}},
+		{0x0016, "2a19", []byte{0x64}},
+	}
+
+	var handles []*attstructure.GATTHandle
+	for _, m := range attributes {
+		handles = append(handles, &attstructure.GATTHandle{
+			Info:  attstructure.HandleInfo{Handle: m.handle, UUID: bleutil.UUIDFromStringPanic(m.uuid)},
+			Value: m.value,
+		})
+	}
+
+	/* The specification writes the hash most significant byte first */
+	want := []byte{0xF1, 0xCA, 0x2D, 0x48, 0xEC, 0xF5, 0x8B, 0xAC, 0x8A, 0x88, 0x30, 0xBB, 0xB9, 0xFB, 0xA9, 0x90}
+	got := DatabaseHash(handles)
+	for i, j := 0, len(got)-1; i < j; i, j = i+1, j-1 {
+		got[i], got[j] = got[j], got[i]
+	}
+	if !bytes.Equal(got[:], want) {
+		t.Errorf("hash %x, want %x", got, want)
+	}
+}
+
+// The hash follows the local structure.
+func TestDatabaseHashDiffers(t *testing.T) {
+	srv, _, _ := buildTestServer(t)
+
+	external := attstructure.NewStructure()
+	external.AddPrimaryService(bleutil.UUIDFromStringPanic("180a"))
+	other := NewGattDevice(external, DefaultConfig())
+
+	if srv.parent.DatabaseHash() == other.DatabaseHash() {
+		t.Error("different structures have the same hash")
+	}
+}
+
+// Removing a service from a live device takes effect immediately and
+// subscribed clients are told about the affected range.
+func TestRuntimeStructureUpdate(t *testing.T) {
+	external := attstructure.NewStructure()
+	svc := external.AddPrimaryService(bleutil.UUIDFromStringPanic("180a"))
+	svc.AddCharacteristicReadOnly(bleutil.UUIDFromStringPanic("2a29"), []byte("manufacturer"))
+
+	dev := NewGattDevice(external, &GattDeviceConfig{
+		MTU:                     247,
+		DeviceName:              "test",
+		DiscoverRemoteOnConnect: false,
+	})
+	srv := &dev.server
+
+	fc := newFakeConn()
+	conn := &gattDeviceConn{
+		parent: dev,
+		conn:   fc,
+		logger: bleutil.LogWithPrefix(fc.GetLogger(), "att-test"),
+		mtu:    247,
+	}
+	conn.client.init(conn)
+	conn.mtuRequest.Do(func() {})
+	dev.conns[fc] = conn
+
+	findInformation := func(start uint16) byte {
+		body := &pdu.PDU{}
+		binary.LittleEndian.PutUint16(body.ExtendRight(2), start)
+		binary.LittleEndian.PutUint16(body.ExtendRight(2), 0xFFFF)
+		srv.handleDiscovery(conn, ATTFindInformationReq, body)
+		return lastTxOpcode(t, fc)
+	}
+
+	start := svc.GetCharacteristics()[0].ValueHandle.Info.Handle - 2
+	if got := findInformation(start); got != byte(ATTFindInformationRsp) {
+		t.Fatalf("service not found before removal: %#x", got)
+	}
+	oldHash := dev.DatabaseHash()
+
+	body := &pdu.PDU{}
+	binary.LittleEndian.PutUint16(body.ExtendRight(2), dev.serviceChanged.ValueHandle.CCCHandle.Info.Handle)
+	body.Append(0x02, 0x00)
+	srv.handleWriteReq(conn, ATTWriteReq, body)
+	fc.takeTx()
+
+	indication := make(chan []byte, 1)
+	go func() {
+		for {
+			if tx := fc.takeTx(); len(tx) > 0 {
+				indication <- append([]byte{}, tx[0].Buf()...)
+				cnf := bleutil.GetBuffer(1)
+				cnf.Buf()[0] = byte(ATTHandleValueCNF)
+				conn.handlePDU(cnf)
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	external.RemoveService(svc)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := external.Update(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	ind := <-indication
+	if binary.LittleEndian.Uint16(ind[3:]) != start || binary.LittleEndian.Uint16(ind[5:]) != start+2 {
+		t.Errorf("indicated range %x", ind[3:])
+	}
+	if got := findInformation(start); got != byte(ATTErrorRsp) {
+		t.Errorf("removed service still discovered: %#x", got)
+	}
+	if dev.DatabaseHash() == oldHash {
+		t.Error("database hash did not change")
+	}
+}
+
+// The client characteristic configurations saved for a bonded client are
+// given to its next connection, so it keeps receiving notifications.
+func TestBondStateCCC(t *testing.T) {
+	external := attstructure.NewStructure()
+	svc := external.AddPrimaryService(bleutil.UUIDFromStringPanic("180a"))
+	char := svc.AddCharacteristic(bleutil.UUIDFromStringPanic("2a31"),
+		attstructure.CharacteristicRead|attstructure.CharacteristicNotify, attstructure.ValueConfig{})
+
+	dev := NewGattDevice(external, &GattDeviceConfig{
+		MTU:                     247,
+		DeviceName:              "test",
+		DiscoverRemoteOnConnect: false,
+	})
+	srv := &dev.server
+
+	addConn := func() (*gattDeviceConn, *fakeConn) {
+		fc := newFakeConn()
+		conn := &gattDeviceConn{
+			parent: dev,
+			conn:   fc,
+			logger: bleutil.LogWithPrefix(fc.GetLogger(), "att-test"),
+			mtu:    247,
+		}
+		conn.client.init(conn)
+		conn.mtuRequest.Do(func() {})
+		dev.conns[fc] = conn
+		return conn, fc
+	}
+
+	first, fc := addConn()
+	ccc := char.ValueHandle.CCCHandle.Info.Handle
+	body := &pdu.PDU{}
+	binary.LittleEndian.PutUint16(body.ExtendRight(2), ccc)
+	body.Append(0x01, 0x00)
+	if _, err := srv.handleWriteReq(first, ATTWriteReq, body); err != nil {
+		t.Fatal(err)
+	}
+	fc.takeTx()
+
+	values := srv.cccValues(first)
+	if len(values) != 1 || values[ccc] != 1 {
+		t.Fatalf("saved %v", values)
+	}
+	delete(dev.conns, fc)
+
+	/* The value handle is not a configuration descriptor and is ignored */
+	values[char.ValueHandle.Info.Handle] = 1
+
+	second, fc := addConn()
+	srv.localStructure.Lock()
+	srv.restoreCCC(second, values)
+	srv.localStructure.Unlock()
+
+	if got := srv.getCCC(second, char.ValueHandle.CCCHandle); got != 1 {
+		t.Errorf("restored %d, want 1", got)
+	}
+	if value := srv.findHandle(second, char.ValueHandle.Info.Handle).Value; len(value) != 0 {
+		t.Errorf("value handle changed to %x", value)
+	}
+
+	results, err := char.SetValueResults(context.Background(), []byte{1})
+	if err != nil || len(results) != 1 || results[0].Conn != fc {
+		t.Errorf("notification: %+v, %v", results, err)
+	}
+}
@@ -0,0 +1,110 @@
+package bleatt
+
+import (
+	"context"
+	"encoding/binary"
+
+	attstructure "github.com/BertoldVdb/go-ble/bleatt/structure"
+	bleutil "github.com/BertoldVdb/go-ble/util"
+	pdu "github.com/BertoldVdb/go-misc/pdubuf"
+	"github.com/sirupsen/logrus"
+)
+
+const attSignatureLen = 12
+
+// useSignedWrite tells if a write command to handle should be signed. This is the case when the
+// remote characteristic allows signed writes and the link is not encrypted, otherwise a normal
+// write command is used.
+func (d *gattDeviceConn) useSignedWrite(handle uint16) bool {
+	if d.smpConn == nil {
+		return false
+	}
+	if encrypted, _, _ := d.smpConn.GetSecurity(); encrypted {
+		return false
+	}
+
+	d.parent.connsMutex.Lock()
+	s := d.parent.clientStructure
+	d.parent.connsMutex.Unlock()
+	if s == nil {
+		return false
+	}
+
+	for _, svc := range s.GetServices() {
+		for _, c := range svc.GetCharacteristics() {
+			if c.ValueHandle != nil && c.ValueHandle.Info.Handle == handle {
+				return c.GetFlags()&attstructure.CharacteristicSignedWrite > 0
+			}
+		}
+	}
+
+	return false
+}
+
+func (a *attClient) writeHandleSigned(ctx context.Context, handle uint16, value []byte) (int, error) {
+	mtu := a.parent.getMTU()
+
+	if len(value) > mtu-3-attSignatureLen {
+		value = value[:mtu-3-attSignatureLen]
+	}
+
+	buf := bleutil.GetBuffer(3 + len(value) + attSignatureLen)
+	buf.Buf()[0] = byte(ATTSignedWriteCMD)
+	binary.LittleEndian.PutUint16(buf.Buf()[1:], handle)
+	copy(buf.Buf()[3:], value)
+
+	signature, err := a.parent.smpConn.SignData(buf.Buf()[:3+len(value)])
+	if err != nil {
+		bleutil.ReleaseBuffer(buf)
+		return 0, err
+	}
+	copy(buf.Buf()[3+len(value):], signature[:])
+
+	_, _, err = a.sendCommand(ctx, buf, false)
+	return len(value), err
+}
+
+// handleSignedWriteCmd processes a signed write command. Like every command it is never answered,
+// writes that are not allowed or carry a bad signature are dropped.
+func (a *attServer) handleSignedWriteCmd(conn *gattDeviceConn, buf *pdu.PDU) (bool, error) {
+	if buf.Len() < 2+attSignatureLen {
+		return false, ErrorProtocolViolation
+	}
+	if conn.smpConn == nil {
+		return false, nil
+	}
+
+	var signature [attSignatureLen]byte
+	copy(signature[:], buf.DropRight(attSignatureLen))
+
+	idx := binary.LittleEndian.Uint16(buf.Buf())
+	handle := a.findHandle(conn, idx)
+	if handle == nil || handle.Info.Flags&attstructure.CharacteristicSignedWrite == 0 {
+		return false, nil
+	}
+
+	value := buf.Buf()[2:]
+	if handle.ValueConfig.LengthFixed && len(value) != len(handle.Value) {
+		return false, nil
+	}
+	if handle.ValueConfig.LengthMax > 0 && len(value) > int(handle.ValueConfig.LengthMax) {
+		return false, nil
+	}
+
+	/* The signature covers the complete PDU, including the opcode */
+	msg := append([]byte{byte(ATTSignedWriteCMD)}, buf.Buf()...)
+	authenticated, err := conn.smpConn.VerifySignedData(msg, signature)
+	if err != nil || (!authenticated && handle.Info.Flags&attstructure.CharacteristicWriteNeedsAuthentication > 0) {
+		conn.logger.WithError(err).WithFields(logrus.Fields{
+			"0handle":        idx,
+			"1authenticated": authenticated,
+		}).Debug("Dropped signed write")
+		return false, nil
+	}
+	if !a.authorize(conn, true, handle) {
+		return false, nil
+	}
+
+	a.writeValue(conn, idx, handle, value)
+	return false, nil
+}
@@ -0,0 +1,262 @@
+package attstructure
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"unicode/utf8"
+)
+
+var (
+	errorCodecLength = errors.New("Value has the wrong length")
+	errorCodecRange  = errors.New("Value is out of range")
+)
+
+// Codec converts between a Go value and the bytes of an attribute
+type Codec[T any] interface {
+	Encode(value T) ([]byte, error)
+	Decode(data []byte) (T, error)
+}
+
+// Codecs for the formats of the Characteristic Presentation Format descriptor. Multi-byte values
+// are little endian.
+var (
+	CodecBoolean = BoolCodec{}
+	CodecUint8   = UintCodec[uint8]{Size: 1}
+	CodecUint16  = UintCodec[uint16]{Size: 2}
+	CodecUint24  = UintCodec[uint32]{Size: 3}
+	CodecUint32  = UintCodec[uint32]{Size: 4}
+	CodecUint48  = UintCodec[uint64]{Size: 6}
+	CodecUint64  = UintCodec[uint64]{Size: 8}
+	CodecSint8   = SintCodec[int8]{Size: 1}
+	CodecSint16  = SintCodec[int16]{Size: 2}
+	CodecSint24  = SintCodec[int32]{Size: 3}
+	CodecSint32  = SintCodec[int32]{Size: 4}
+	CodecSint48  = SintCodec[int64]{Size: 6}
+	CodecSint64  = SintCodec[int64]{Size: 8}
+	CodecFloat32 = Float32Codec{}
+	CodecFloat64 = Float64Codec{}
+	CodecSFloat  = MedFloatCodec{Size: 2}
+	CodecFloat   = MedFloatCodec{Size: 4}
+	CodecUTF8    = UTF8Codec{}
+)
+
+func putUint(b []byte, value uint64) {
+	for i := range b {
+		b[i] = byte(value >> (8 * i))
+	}
+}
+
+func getUint(b []byte) uint64 {
+	var value uint64
+	for i := range b {
+		value |= uint64(b[i]) << (8 * i)
+	}
+	return value
+}
+
+func encodeUint(value uint64, size int) ([]byte, error) {
+	if size < 8 && value>>(8*size) != 0 {
+		return nil, errorCodecRange
+	}
+
+	b := make([]byte, size)
+	putUint(b, value)
+	return b, nil
+}
+
+func encodeSint(value int64, size int) ([]byte, error) {
+	if size < 8 {
+		limit := int64(1) << (8*size - 1)
+		if value < -limit || value >= limit {
+			return nil, errorCodecRange
+		}
+	}
+
+	b := make([]byte, size)
+	putUint(b, uint64(value))
+	return b, nil
+}
+
+func decodeSint(b []byte) int64 {
+	shift := 64 - 8*len(b)
+	return int64(getUint(b)<<shift) >> shift
+}
+
+// UintCodec encodes unsigned integers in Size bytes, which allows formats like uint24 and uint48
+type UintCodec[T ~uint8 | ~uint16 | ~uint32 | ~uint64] struct {
+	Size int
+}
+
+func (c UintCodec[T]) Encode(value T) ([]byte, error) {
+	return encodeUint(uint64(value), c.Size)
+}
+
+func (c UintCodec[T]) Decode(data []byte) (T, error) {
+	if len(data) != c.Size {
+		return 0, errorCodecLength
+	}
+	return T(getUint(data)), nil
+}
+
+// SintCodec encodes two's complement signed integers in Size bytes
+type SintCodec[T ~int8 | ~int16 | ~int32 | ~int64] struct {
+	Size int
+}
+
+func (c SintCodec[T]) Encode(value T) ([]byte, error) {
+	return encodeSint(int64(value), c.Size)
+}
+
+func (c SintCodec[T]) Decode(data []byte) (T, error) {
+	if len(data) != c.Size {
+		return 0, errorCodecLength
+	}
+	return T(decodeSint(data)), nil
+}
+
+type BoolCodec struct{}
+
+func (BoolCodec) Encode(value bool) ([]byte, error) {
+	if value {
+		return []byte{1}, nil
+	}
+	return []byte{0}, nil
+}
+
+func (BoolCodec) Decode(data []byte) (bool, error) {
+	if len(data) != 1 {
+		return false, errorCodecLength
+	}
+	return data[0] != 0, nil
+}
+
+type Float32Codec struct{}
+
+func (Float32Codec) Encode(value float32) ([]byte, error) {
+	return binary.LittleEndian.AppendUint32(nil, math.Float32bits(value)), nil
+}
+
+func (Float32Codec) Decode(data []byte) (float32, error) {
+	if len(data) != 4 {
+		return 0, errorCodecLength
+	}
+	return math.Float32frombits(binary.LittleEndian.Uint32(data)), nil
+}
+
+type Float64Codec struct{}
+
+func (Float64Codec) Encode(value float64) ([]byte, error) {
+	return binary.LittleEndian.AppendUint64(nil, math.Float64bits(value)), nil
+}
+
+func (Float64Codec) Decode(data []byte) (float64, error) {
+	if len(data) != 8 {
+		return 0, errorCodecLength
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(data)), nil
+}
+
+// UTF8Codec uses the whole value as an UTF-8 string
+type UTF8Codec struct{}
+
+func (UTF8Codec) Encode(value string) ([]byte, error) {
+	return []byte(value), nil
+}
+
+func (UTF8Codec) Decode(data []byte) (string, error) {
+	if !utf8.Valid(data) {
+		return "", errors.New("Value is not valid UTF-8")
+	}
+	return string(data), nil
+}
+
+// MedFloatCodec implements the IEEE-11073 floats used by medical profiles: SFLOAT with a Size of
+// 2 and FLOAT with a Size of 4. The value is a mantissa with a decimal exponent. Encoding picks the
+// smallest exponent that fits, so the value keeps as many digits as possible.
+type MedFloatCodec struct {
+	Size int
+}
+
+func (c MedFloatCodec) bits() (uint, uint) {
+	if c.Size == 2 {
+		return 12, 4
+	}
+	return 24, 8
+}
+
+func (c MedFloatCodec) Encode(value float64) ([]byte, error) {
+	mantissaBits, exponentBits := c.bits()
+	max := int64(1)<<(mantissaBits-1) - 1
+
+	/* Special values use exponent zero and the largest mantissas */
+	mantissa, exponent := int64(0), int64(0)
+	switch {
+	case math.IsNaN(value):
+		mantissa = max
+	case math.IsInf(value, 1):
+		mantissa = max - 1
+	case math.IsInf(value, -1):
+		mantissa = -(max - 1)
+	default:
+		minExponent := -(int64(1) << (exponentBits - 1))
+		found := false
+		for exponent = minExponent; exponent < -minExponent; exponent++ {
+			mantissa = int64(math.Round(scaleDecimal(value, -int(exponent))))
+
+			limit := max
+			if exponent == 0 {
+				limit = max - 2
+			}
+			if mantissa <= limit && mantissa >= -limit {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, errorCodecRange
+		}
+	}
+
+	raw := uint64(exponent)<<mantissaBits | uint64(mantissa)&(1<<mantissaBits-1)
+	b := make([]byte, c.Size)
+	putUint(b, raw)
+	return b, nil
+}
+
+func (c MedFloatCodec) Decode(data []byte) (float64, error) {
+	if len(data) != c.Size {
+		return 0, errorCodecLength
+	}
+
+	mantissaBits, _ := c.bits()
+	max := int64(1)<<(mantissaBits-1) - 1
+
+	raw := getUint(data)
+	shift := 64 - mantissaBits
+	mantissa := int64(raw<<shift) >> shift
+	exponent := decodeSint(data) >> mantissaBits
+
+	if exponent == 0 {
+		switch {
+		case mantissa == max-1:
+			return math.Inf(1), nil
+		case mantissa == -(max - 1):
+			return math.Inf(-1), nil
+		case mantissa == max || mantissa < -(max-1):
+			/* NaN, NRes and the reserved value */
+			return math.NaN(), nil
+		}
+	}
+
+	return scaleDecimal(float64(mantissa), int(exponent)), nil
+}
+
+// scaleDecimal returns value * 10^exponent. Dividing for negative exponents keeps values like 36.6
+// exact, 0.1 has no exact binary representation.
+func scaleDecimal(value float64, exponent int) float64 {
+	if exponent < 0 {
+		return value / math.Pow10(-exponent)
+	}
+	return value * math.Pow10(exponent)
+}
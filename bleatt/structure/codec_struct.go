@@ -0,0 +1,243 @@
+package attstructure
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"unicode/utf8"
+)
+
+// StructCodec packs the exported fields of a struct in order. The gatt tag selects the format of
+// a field by the name of a presentation format, like uint24, sint16, SFLOAT or utf8s. Without a
+// tag the format follows the Go type. Strings and byte slices take the rest of the value, so they
+// have to be the last field. Fields tagged "-" are skipped.
+type StructCodec[T any] struct {
+	fields []structField
+}
+
+type structField struct {
+	index  int
+	name   string
+	format Format
+}
+
+func formatByName(name string) (Format, bool) {
+	for format, info := range formats {
+		if strings.EqualFold(info.name, name) {
+			return format, true
+		}
+	}
+	return 0, false
+}
+
+func defaultFormat(t reflect.Type) (Format, bool) {
+	switch t.Kind() {
+	case reflect.Bool:
+		return FormatBoolean, true
+	case reflect.Uint8:
+		return FormatUint8, true
+	case reflect.Uint16:
+		return FormatUint16, true
+	case reflect.Uint32:
+		return FormatUint32, true
+	case reflect.Uint64, reflect.Uint:
+		return FormatUint64, true
+	case reflect.Int8:
+		return FormatSint8, true
+	case reflect.Int16:
+		return FormatSint16, true
+	case reflect.Int32:
+		return FormatSint32, true
+	case reflect.Int64, reflect.Int:
+		return FormatSint64, true
+	case reflect.Float32:
+		return FormatFloat32, true
+	case reflect.Float64:
+		return FormatFloat64, true
+	case reflect.String:
+		return FormatUTF8, true
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return FormatStruct, true
+		}
+	}
+	return 0, false
+}
+
+func formatFits(format Format, t reflect.Type) bool {
+	kind := t.Kind()
+	isInt := kind >= reflect.Int && kind <= reflect.Uint64
+
+	switch {
+	case format == FormatBoolean:
+		return kind == reflect.Bool
+	case format.isInteger():
+		return isInt
+	case format == FormatFloat32 || format == FormatFloat64 || format == FormatSFloat || format == FormatFloat:
+		return kind == reflect.Float32 || kind == reflect.Float64
+	case format == FormatUTF8:
+		return kind == reflect.String
+	case format == FormatStruct:
+		return kind == reflect.Slice && t.Elem().Kind() == reflect.Uint8
+	}
+	return false
+}
+
+func NewStructCodec[T any]() (*StructCodec[T], error) {
+	t := reflect.TypeFor[T]()
+	if t.Kind() != reflect.Struct {
+		return nil, errors.New("Type is not a struct")
+	}
+
+	c := &StructCodec[T]{}
+	variable := false
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("gatt")
+		if !field.IsExported() || tag == "-" {
+			continue
+		}
+
+		format, ok := defaultFormat(field.Type)
+		if tag != "" {
+			format, ok = formatByName(tag)
+		}
+		if !ok || !formatFits(format, field.Type) {
+			return nil, fmt.Errorf("Field %s can not be packed", field.Name)
+		}
+
+		if variable {
+			return nil, fmt.Errorf("Field %s follows a field of variable length", field.Name)
+		}
+		variable = formats[format].size == 0
+
+		c.fields = append(c.fields, structField{index: i, name: field.Name, format: format})
+	}
+
+	return c, nil
+}
+
+func (c *StructCodec[T]) Encode(value T) ([]byte, error) {
+	rv := reflect.ValueOf(value)
+	var result []byte
+
+	for _, m := range c.fields {
+		fv := rv.Field(m.index)
+		info := formats[m.format]
+
+		var b []byte
+		var err error
+
+		switch {
+		case m.format == FormatBoolean:
+			b, err = CodecBoolean.Encode(fv.Bool())
+		case m.format.isInteger():
+			if fv.CanInt() {
+				if info.signed {
+					b, err = encodeSint(fv.Int(), info.size)
+				} else if fv.Int() < 0 {
+					err = errorCodecRange
+				} else {
+					b, err = encodeUint(uint64(fv.Int()), info.size)
+				}
+			} else {
+				if !info.signed {
+					b, err = encodeUint(fv.Uint(), info.size)
+				} else if int64(fv.Uint()) < 0 {
+					err = errorCodecRange
+				} else {
+					b, err = encodeSint(int64(fv.Uint()), info.size)
+				}
+			}
+		case m.format == FormatUTF8:
+			b = []byte(fv.String())
+		case m.format == FormatStruct:
+			b = fv.Bytes()
+		default:
+			b, err = NumberCodec{Format: m.format}.Encode(fv.Float())
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("Field %s: %w", m.name, err)
+		}
+		result = append(result, b...)
+	}
+
+	return result, nil
+}
+
+func (c *StructCodec[T]) Decode(data []byte) (T, error) {
+	var value T
+	rv := reflect.ValueOf(&value).Elem()
+
+	for _, m := range c.fields {
+		fv := rv.Field(m.index)
+		info := formats[m.format]
+
+		size := info.size
+		if size == 0 {
+			size = len(data)
+		}
+		if len(data) < size {
+			return value, errorCodecLength
+		}
+		b := data[:size]
+		data = data[size:]
+
+		var err error
+		switch {
+		case m.format == FormatBoolean:
+			fv.SetBool(b[0] != 0)
+		case m.format.isInteger():
+			err = setInteger(fv, b, info.signed)
+		case m.format == FormatUTF8:
+			if !utf8.Valid(b) {
+				err = errors.New("Value is not valid UTF-8")
+			}
+			fv.SetString(string(b))
+		case m.format == FormatStruct:
+			fv.SetBytes(append([]byte{}, b...))
+		default:
+			var f float64
+			f, err = NumberCodec{Format: m.format}.Decode(b)
+			fv.SetFloat(f)
+		}
+
+		if err != nil {
+			return value, fmt.Errorf("Field %s: %w", m.name, err)
+		}
+	}
+
+	if len(data) > 0 {
+		return value, errorCodecLength
+	}
+	return value, nil
+}
+
+func setInteger(fv reflect.Value, b []byte, signed bool) error {
+	if signed {
+		v := decodeSint(b)
+		if fv.CanInt() && !fv.OverflowInt(v) {
+			fv.SetInt(v)
+			return nil
+		}
+		if fv.CanUint() && v >= 0 && !fv.OverflowUint(uint64(v)) {
+			fv.SetUint(uint64(v))
+			return nil
+		}
+		return errorCodecRange
+	}
+
+	v := getUint(b)
+	if fv.CanUint() && !fv.OverflowUint(v) {
+		fv.SetUint(v)
+		return nil
+	}
+	if fv.CanInt() && int64(v) >= 0 && !fv.OverflowInt(int64(v)) {
+		fv.SetInt(int64(v))
+		return nil
+	}
+	return errorCodecRange
+}
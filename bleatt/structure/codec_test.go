@@ -0,0 +1,199 @@
+package attstructure
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"testing"
+
+	bleutil "github.com/BertoldVdb/go-ble/util"
+)
+
+func TestIntegerCodecs(t *testing.T) {
+	b, err := CodecUint24.Encode(0x123456)
+	if err != nil || !bytes.Equal(b, []byte{0x56, 0x34, 0x12}) {
+		t.Errorf("uint24: %x (%v)", b, err)
+	}
+	if _, err := CodecUint24.Encode(0x1000000); err == nil {
+		t.Error("uint24 overflow accepted")
+	}
+
+	b, _ = CodecSint24.Encode(-2)
+	if !bytes.Equal(b, []byte{0xFE, 0xFF, 0xFF}) {
+		t.Errorf("sint24: %x", b)
+	}
+	if v, err := CodecSint24.Decode(b); v != -2 || err != nil {
+		t.Errorf("sint24 decoded to %d (%v)", v, err)
+	}
+	if _, err := CodecSint16.Decode([]byte{1}); err == nil {
+		t.Error("short value accepted")
+	}
+}
+
+func TestMedFloatCodecs(t *testing.T) {
+	for _, m := range []struct {
+		codec MedFloatCodec
+		value float64
+		raw   []byte
+	}{
+		{CodecSFloat, 36.6, []byte{0x6E, 0xF1}},
+		{CodecSFloat, -1, []byte{0x18, 0xDC}},
+		{CodecSFloat, math.Inf(1), []byte{0xFE, 0x07}},
+		{CodecSFloat, math.Inf(-1), []byte{0x02, 0x08}},
+		{CodecFloat, 36.6, []byte{0xE0, 0xD8, 0x37, 0xFB}},
+	} {
+		b, err := m.codec.Encode(m.value)
+		if err != nil || !bytes.Equal(b, m.raw) {
+			t.Errorf("%v encoded to %x (%v), want %x", m.value, b, err, m.raw)
+		}
+		if v, err := m.codec.Decode(m.raw); v != m.value || err != nil {
+			t.Errorf("%x decoded to %v (%v)", m.raw, v, err)
+		}
+	}
+
+	/* NaN and NRes */
+	for _, m := range [][]byte{{0xFF, 0x07}, {0x00, 0x08}} {
+		if v, _ := CodecSFloat.Decode(m); !math.IsNaN(v) {
+			t.Errorf("%x decoded to %v", m, v)
+		}
+	}
+	if _, err := CodecSFloat.Encode(1e12); err == nil {
+		t.Error("out of range value accepted")
+	}
+}
+
+func TestNumberCodec(t *testing.T) {
+	format := PresentationFormat{Format: FormatSint16, Exponent: -2, Unit: 0x272F}
+	codec, err := format.NumberCodec()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := codec.Encode(-23.45)
+	if err != nil || !bytes.Equal(b, []byte{0xD7, 0xF6}) {
+		t.Errorf("encoded %x (%v)", b, err)
+	}
+	if v, _ := codec.Decode(b); v != -23.45 {
+		t.Errorf("decoded %v", v)
+	}
+
+	if _, err := (PresentationFormat{Format: FormatUTF8}).NumberCodec(); err == nil {
+		t.Error("string format has a number codec")
+	}
+
+	parsed, err := ParsePresentationFormat(format.Bytes())
+	if err != nil || parsed != format {
+		t.Errorf("parsed %+v (%v)", parsed, err)
+	}
+}
+
+type testMeasurement struct {
+	Flags       uint8
+	Temperature float64 `gatt:"sfloat"`
+	Counter     uint32  `gatt:"uint24"`
+	Offset      int     `gatt:"sint8"`
+	Internal    int     `gatt:"-"`
+	Name        string
+}
+
+func TestStructCodec(t *testing.T) {
+	codec, err := NewStructCodec[testMeasurement]()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value := testMeasurement{Flags: 1, Temperature: 36.6, Counter: 0x010203, Offset: -1, Internal: 5, Name: "arm"}
+	b, err := codec.Encode(value)
+	want := []byte{0x01, 0x6E, 0xF1, 0x03, 0x02, 0x01, 0xFF, 'a', 'r', 'm'}
+	if err != nil || !bytes.Equal(b, want) {
+		t.Fatalf("encoded %x (%v), want %x", b, err, want)
+	}
+
+	value.Internal = 0
+	if decoded, err := codec.Decode(b); err != nil || decoded != value {
+		t.Errorf("decoded %+v (%v)", decoded, err)
+	}
+	if _, err := codec.Decode(b[:5]); err == nil {
+		t.Error("short value accepted")
+	}
+
+	type misplaced struct {
+		Name  string
+		Value uint8
+	}
+	if _, err := NewStructCodec[misplaced](); err == nil {
+		t.Error("string before other fields accepted")
+	}
+
+	type mismatch struct {
+		Value string `gatt:"uint8"`
+	}
+	if _, err := NewStructCodec[mismatch](); err == nil {
+		t.Error("format that does not fit the field accepted")
+	}
+}
+
+// The same typed wrapper works on a local structure and on the structure
+// a client imported from it.
+func TestTypedCharacteristic(t *testing.T) {
+	s := NewStructure()
+	svc := s.AddPrimaryService(bleutil.UUIDFromStringPanic("1809"))
+	c := svc.AddCharacteristic(bleutil.UUIDFromStringPanic("2a1c"), CharacteristicRead|CharacteristicNotify, ValueConfig{})
+	c.AddPresentationFormat(PresentationFormat{Format: FormatSFloat, Unit: 0x272F})
+
+	exp := &ExportedStructure{}
+	exp.Append(s)
+
+	local := NewTypedCharacteristic[float64](c, CodecSFloat)
+	if _, err := local.Set(context.Background(), 37.2); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := local.Get(context.Background()); v != 37.2 || err != nil {
+		t.Errorf("local value %v (%v)", v, err)
+	}
+
+	var discovered []*GATTHandle
+	values := map[uint16][]byte{}
+	for _, m := range exp.Handles {
+		discovered = append(discovered, &GATTHandle{Info: m.Info, Value: m.Value})
+		values[m.Info.Handle] = m.Value
+	}
+	read := func(ctx context.Context, handle uint16, buf []byte) ([]byte, error) {
+		return append(buf[:0], values[handle]...), nil
+	}
+	write := func(ctx context.Context, handle uint16, buf []byte, withRsp bool) (int, error) {
+		return len(buf), nil
+	}
+
+	imported, err := ImportStructure(discovered, read, write)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ic := imported.GetService(svc.GetUUID()).GetCharacteristic(c.uuid)
+
+	format, err := ic.GetPresentationFormat(context.Background())
+	if err != nil || format.Format != FormatSFloat || format.Unit != 0x272F {
+		t.Fatalf("presentation format %+v (%v)", format, err)
+	}
+	codec, _ := format.NumberCodec()
+
+	remote := NewTypedCharacteristic[float64](ic, codec)
+	if v, err := remote.Get(context.Background()); v != 37.2 || err != nil {
+		t.Errorf("remote value %v (%v)", v, err)
+	}
+
+	var notified []float64
+	err = remote.SubscribeValue(context.Background(), func(value float64, err error) {
+		if err == nil {
+			notified = append(notified, value)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported.InjectNotify(ic.ValueHandle.Info.Handle, []byte{0x6E, 0xF1})
+	imported.InjectNotify(ic.ValueHandle.Info.Handle, []byte{0x6E})
+	if len(notified) != 1 || notified[0] != 36.6 {
+		t.Errorf("notified values %v", notified)
+	}
+}
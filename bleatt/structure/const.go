@@ -17,9 +17,36 @@ var (
 	UUIDCharacteristicFormat              = bleutil.UUIDFromStringPanic("2904")
 	UUIDCharacteristicAggregateFormat     = bleutil.UUIDFromStringPanic("2905")
 
-	UUIDDatabaseHash = bleutil.UUIDFromStringPanic("2b2a")
+	UUIDGenericAttribute        = bleutil.UUIDFromStringPanic("1801")
+	UUIDServiceChanged          = bleutil.UUIDFromStringPanic("2a05")
+	UUIDDatabaseHash            = bleutil.UUIDFromStringPanic("2b2a")
+	UUIDServerSupportedFeatures = bleutil.UUIDFromStringPanic("2b3a")
 )
 
+// fixedValueLengths lists the attributes whose value length is fixed by their definition
+var fixedValueLengths = map[bleutil.UUID]int{
+	UUIDCharacteristicExtendedProperties:  2,
+	UUIDCharacteristicClientConfiguration: 2,
+	UUIDCharacteristicServerConfiguration: 2,
+	UUIDCharacteristicFormat:              7,
+
+	UUIDDatabaseHash:                    16,
+	bleutil.UUIDFromStringPanic("2a01"): 2, // Appearance
+	bleutil.UUIDFromStringPanic("2a04"): 8, // Peripheral Preferred Connection Parameters
+	bleutil.UUIDFromStringPanic("2a19"): 1, // Battery Level
+	bleutil.UUIDFromStringPanic("2a6d"): 4, // Pressure
+	bleutil.UUIDFromStringPanic("2a6e"): 2, // Temperature
+	bleutil.UUIDFromStringPanic("2a6f"): 2, // Humidity
+	bleutil.UUIDFromStringPanic("2aa6"): 1, // Central Address Resolution
+}
+
+// FixedValueLength returns the length of the value of an attribute of this type, if it is fixed
+// by the specification
+func FixedValueLength(uuid bleutil.UUID) (int, bool) {
+	length, ok := fixedValueLengths[uuid]
+	return length, ok
+}
+
 type CharacteristicFlag uint16
 
 const (
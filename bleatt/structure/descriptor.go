@@ -0,0 +1,120 @@
+package attstructure
+
+import (
+	"context"
+	"errors"
+
+	bleutil "github.com/BertoldVdb/go-ble/util"
+)
+
+type Descriptor struct {
+	parent       *Characteristic
+	uuid         bleutil.UUID
+	flags        CharacteristicFlag
+	initialValue []byte
+
+	valueConfig ValueConfig
+
+	Handle *GATTHandle
+}
+
+// AddDescriptor adds a descriptor after the characteristic value. The flags set the permissions,
+// only the read, write and security flags are used. The client characteristic configuration
+// descriptor is generated automatically and can not be added.
+func (c *Characteristic) AddDescriptor(uuid bleutil.UUID, flags CharacteristicFlag, value []byte, valueConfig ValueConfig) (*Descriptor, error) {
+	if uuid == UUIDCharacteristicClientConfiguration {
+		return nil, errors.New("The client characteristic configuration descriptor is generated automatically")
+	}
+
+	return c.addDescriptor(uuid, flags, value, valueConfig), nil
+}
+
+func (c *Characteristic) addDescriptor(uuid bleutil.UUID, flags CharacteristicFlag, value []byte, valueConfig ValueConfig) *Descriptor {
+	d := &Descriptor{
+		parent:       c,
+		uuid:         uuid,
+		flags:        flags,
+		initialValue: value,
+		valueConfig:  valueConfig,
+	}
+
+	c.descriptors = append(c.descriptors, d)
+	c.parent.modified = true
+
+	return d
+}
+
+// AddUserDescription adds a read only Characteristic User Description
+func (c *Characteristic) AddUserDescription(description string) *Descriptor {
+	return c.addDescriptor(UUIDCharacteristicUserDescription, CharacteristicRead, []byte(description), ValueConfig{})
+}
+
+func (c *Characteristic) GetDescriptors() []*Descriptor {
+	return c.descriptors
+}
+
+func (c *Characteristic) GetDescriptor(uuid bleutil.UUID) *Descriptor {
+	for _, m := range c.descriptors {
+		if m.uuid == uuid {
+			return m
+		}
+	}
+	return nil
+}
+
+func (d *Descriptor) GetUUID() bleutil.UUID {
+	return d.uuid
+}
+
+func (d *Descriptor) GetFlags() CharacteristicFlag {
+	return d.flags
+}
+
+func (d *Descriptor) structure() *Structure {
+	return d.parent.parent.parent
+}
+
+// GetValue reads the descriptor. For a client structure the value is read from the peer
+func (d *Descriptor) GetValue(ctx context.Context, buf []byte) ([]byte, error) {
+	s := d.structure()
+	if s.isClient {
+		return s.clientRead(ctx, d.Handle.Info.Handle, buf)
+	}
+
+	if d.Handle == nil {
+		return nil, errors.New("Descriptor is not exported")
+	}
+
+	e := s.exported
+	e.Lock()
+	defer e.Unlock()
+
+	return append(buf[:0], d.Handle.Value...), nil
+}
+
+// SetValue changes the descriptor. For a client structure the value is written to the peer
+func (d *Descriptor) SetValue(ctx context.Context, new []byte) (int, error) {
+	s := d.structure()
+	if s.isClient {
+		return s.clientWrite(ctx, d.Handle.Info.Handle, new, true)
+	}
+
+	if d.Handle == nil {
+		return 0, errors.New("Descriptor is not exported")
+	}
+
+	if d.valueConfig.LengthMax > 0 && len(new) > int(d.valueConfig.LengthMax) {
+		return 0, errors.New("Value is longer than the maximum length")
+	}
+
+	e := s.exported
+	e.Lock()
+	defer e.Unlock()
+
+	if d.valueConfig.LengthFixed {
+		return copy(d.Handle.Value, new), nil
+	}
+
+	d.Handle.Value = append(d.Handle.Value[:0], new...)
+	return len(new), nil
+}
@@ -0,0 +1,88 @@
+package attstructure
+
+import (
+	"context"
+	"testing"
+
+	bleutil "github.com/BertoldVdb/go-ble/util"
+)
+
+// Descriptors follow the value and the generated CCCD, and survive a
+// round trip through export and import.
+func TestDescriptorExportImport(t *testing.T) {
+	vendorUUID := bleutil.UUIDFromStringPanic("6e400010-b5a3-f393-e0a9-e50e24dcca9e")
+
+	s := NewStructure()
+	svc := s.AddPrimaryService(bleutil.UUIDFromStringPanic("180a"))
+	c := svc.AddCharacteristic(bleutil.UUIDFromStringPanic("2a29"), CharacteristicRead|CharacteristicNotify, ValueConfig{})
+	desc := c.AddUserDescription("Manufacturer")
+	vendor, err := c.AddDescriptor(vendorUUID, CharacteristicRead|CharacteristicWriteAck|CharacteristicWriteNeedsEncryption, []byte{1}, ValueConfig{LengthMax: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.AddDescriptor(UUIDCharacteristicClientConfiguration, CharacteristicRead, nil, ValueConfig{}); err == nil {
+		t.Error("CCCD was added")
+	}
+
+	exp := &ExportedStructure{}
+	exp.Append(s)
+
+	cccd := c.ValueHandle.CCCHandle.Info.Handle
+	if desc.Handle.Info.Handle != cccd+1 || vendor.Handle.Info.Handle != cccd+2 {
+		t.Fatalf("descriptors at %d and %d, CCCD at %d", desc.Handle.Info.Handle, vendor.Handle.Info.Handle, cccd)
+	}
+	if vendor.Handle.Info.Flags != vendor.GetFlags() || vendor.Handle.ValueConfig.LengthMax != 4 {
+		t.Error("permissions not exported")
+	}
+	if exp.Handles[len(exp.Handles)-1] != vendor.Handle {
+		t.Error("descriptor not part of the service")
+	}
+
+	if n, err := vendor.SetValue(context.Background(), []byte{2, 3}); n != 2 || err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vendor.SetValue(context.Background(), []byte{4, 5, 6, 7, 8}); err == nil {
+		t.Error("value longer than LengthMax was accepted")
+	}
+	if value, _ := vendor.GetValue(context.Background(), nil); string(value) != "\x02\x03" {
+		t.Errorf("local value %x", value)
+	}
+
+	/* Import what a client would discover */
+	var discovered []*GATTHandle
+	for _, m := range exp.Handles {
+		discovered = append(discovered, &GATTHandle{Info: m.Info, Value: m.Value})
+	}
+
+	written := map[uint16][]byte{}
+	read := func(ctx context.Context, handle uint16, buf []byte) ([]byte, error) {
+		return append(buf[:0], written[handle]...), nil
+	}
+	write := func(ctx context.Context, handle uint16, buf []byte, withRsp bool) (int, error) {
+		written[handle] = append([]byte{}, buf...)
+		return len(buf), nil
+	}
+
+	imported, err := ImportStructure(discovered, read, write)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ic := imported.GetService(svc.GetUUID()).GetCharacteristic(c.uuid)
+	if len(ic.GetDescriptors()) != 2 || ic.ValueHandle.CCCHandle == nil {
+		t.Fatalf("imported descriptors: %v", ic.GetDescriptors())
+	}
+	remote := ic.GetDescriptor(vendorUUID)
+	if remote == nil || remote.Handle.Info.Handle != vendor.Handle.Info.Handle {
+		t.Fatal("vendor descriptor not imported")
+	}
+	if _, err := remote.SetValue(context.Background(), []byte{9}); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := remote.GetValue(context.Background(), nil); err != nil || string(value) != "\x09" {
+		t.Errorf("remote value %x (%v)", value, err)
+	}
+	if d := ic.GetDescriptor(UUIDCharacteristicUserDescription); d == nil || string(d.Handle.Value) != "Manufacturer" {
+		t.Error("user description not imported")
+	}
+}
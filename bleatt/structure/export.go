@@ -1,16 +1,20 @@
 package attstructure
 
 import (
+	"context"
 	"encoding/binary"
+	"sort"
 	"sync"
 )
 
 type ExportedStructure struct {
 	sync.Mutex
-	idx     uint16
 	Handles []*GATTHandle
 
-	HandleSet func(*Characteristic, []byte) (int, error)
+	HandleSet func(context.Context, *Characteristic, []byte) ([]NotifyResult, error)
+
+	// HandlesChanged is called when Update modified the attributes between start and end
+	HandlesChanged func(ctx context.Context, start uint16, end uint16) error
 }
 
 func (result *ExportedStructure) Append(s *Structure) {
@@ -19,88 +23,281 @@ func (result *ExportedStructure) Append(s *Structure) {
 
 	s.exported = result
 
+	used := result.usedRanges(nil)
 	for _, p := range s.services {
-		result.idx++
+		var start uint16
+		used, start = allocateRange(used, p.handleCount(), p.handleHint)
+		if start == 0 {
+			/* Left unexported, Update reports that there is no room */
+			continue
+		}
+		result.appendService(p, start)
+	}
+	s.resolveIncludes()
+}
+
+// handleRange is a span of handles that is in use
+type handleRange struct {
+	start int
+	end   int
+}
+
+// usedRanges returns the sorted ranges of handles in use, except the handles for which skip
+// returns true. The structure must be locked
+func (result *ExportedStructure) usedRanges(skip func(handle uint16) bool) []handleRange {
+	var used []handleRange
+	for _, m := range result.Handles {
+		h := int(m.Info.Handle)
+		if skip != nil && skip(m.Info.Handle) {
+			continue
+		}
+		if n := len(used); n > 0 && used[n-1].end+1 == h {
+			used[n-1].end = h
+			continue
+		}
+		used = append(used, handleRange{start: h, end: h})
+	}
+	return used
+}
+
+// allocateRange finds the first gap of count handles that starts at or after hint and marks it
+// as used. It returns zero as start handle if there is no such gap
+func allocateRange(used []handleRange, count int, hint uint16) ([]handleRange, uint16) {
+	next := 1
+	if int(hint) > next {
+		next = int(hint)
+	}
+
+	i := 0
+	for ; i < len(used); i++ {
+		if used[i].start >= next+count {
+			break
+		}
+		if used[i].end >= next {
+			next = used[i].end + 1
+		}
+	}
+	if next+count-1 > 0xFFFF {
+		return used, 0
+	}
+
+	r := handleRange{start: next, end: next + count - 1}
+	used = append(used[:i:i], append([]handleRange{r}, used[i:]...)...)
+	return used, uint16(next)
+}
+
+func (p *Service) handleCount() int {
+	count := 1 + len(p.includes)
+	for _, c := range p.characteristics {
+		count += 2 + len(c.descriptors)
+		if c.flags&(CharacteristicIndicate|CharacteristicNotify) > 0 {
+			count++
+		}
+	}
+	return count
+}
 
-		serviceDescr := &GATTHandle{
-			Info: HandleInfo{Handle: result.idx,
-				UUIDWidth: UUIDPrimaryService.GetLength(),
-				UUID:      UUIDPrimaryService,
+// exportValue copies the initial value, or the current one when a service is exported again
+func exportValue(initial []byte, current *GATTHandle, config ValueConfig) []byte {
+	value := initial
+	if current != nil {
+		value = current.Value
+	}
+
+	var valueCopy []byte
+	if config.LengthFixed {
+		valueCopy = make([]byte, config.LengthMax)
+	} else {
+		valueCopy = make([]byte, len(value))
+	}
+	copy(valueCopy, value)
+
+	return valueCopy
+}
+
+// appendService exports the service with its declaration at start, the range must be free.
+// The structure must be locked
+func (result *ExportedStructure) appendService(p *Service, start uint16) {
+	var handles []*GATTHandle
+	idx := start
+
+	serviceType := UUIDPrimaryService
+	if !p.isPrimary {
+		serviceType = UUIDSecondaryService
+	}
+
+	serviceDescr := &GATTHandle{
+		Info: HandleInfo{Handle: idx,
+			UUIDWidth: serviceType.GetLength(),
+			UUID:      serviceType,
+			Flags:     CharacteristicRead,
+		},
+		Value: p.uuid.UUIDToBytes(),
+	}
+
+	handles = append(handles, serviceDescr)
+
+	/* The value is filled in by resolveIncludes, the included service may come later */
+	p.includeHandles = p.includeHandles[:0]
+	for range p.includes {
+		idx++
+		includeDescr := &GATTHandle{
+			Info: HandleInfo{Handle: idx,
+				UUIDWidth: UUIDIncludedService.GetLength(),
+				UUID:      UUIDIncludedService,
 				Flags:     CharacteristicRead,
 			},
-			Value: p.uuid.UUIDToBytes(),
 		}
 
-		result.Handles = append(result.Handles, serviceDescr)
+		p.includeHandles = append(p.includeHandles, includeDescr)
+		handles = append(handles, includeDescr)
+	}
 
-		for _, c := range p.characteristics {
-			result.idx++
-			charDescrValue := []byte{byte(c.flags), 0, 0}
-			charDescrValue = append(charDescrValue, c.uuid.UUIDToBytes()...)
-			binary.LittleEndian.PutUint16(charDescrValue[1:], result.idx+1)
+	for _, c := range p.characteristics {
+		idx++
+		charDescrValue := []byte{byte(c.flags), 0, 0}
+		charDescrValue = append(charDescrValue, c.uuid.UUIDToBytes()...)
+		binary.LittleEndian.PutUint16(charDescrValue[1:], idx+1)
 
-			charDescr := &GATTHandle{
-				Info: HandleInfo{Handle: result.idx,
-					UUIDWidth: UUIDCharacteristic.GetLength(),
-					UUID:      UUIDCharacteristic,
-					Flags:     CharacteristicRead,
-				},
-				Value: charDescrValue,
-			}
+		charDescr := &GATTHandle{
+			Info: HandleInfo{Handle: idx,
+				UUIDWidth: UUIDCharacteristic.GetLength(),
+				UUID:      UUIDCharacteristic,
+				Flags:     CharacteristicRead,
+			},
+			Value: charDescrValue,
+		}
 
-			result.Handles = append(result.Handles, charDescr)
+		handles = append(handles, charDescr)
 
-			result.idx++
-			var valueCopy []byte
-			if c.valueConfig.LengthFixed {
-				valueCopy = make([]byte, c.valueConfig.LengthMax)
-			} else {
-				valueCopy = make([]byte, len(c.initialValue))
-			}
-			copy(valueCopy, c.initialValue)
+		idx++
+		charValue := &GATTHandle{
+			Info: HandleInfo{Handle: idx,
+				UUIDWidth: c.uuid.GetLength(),
+				UUID:      c.uuid,
+				Flags:     c.flags,
+			},
+			Value:       exportValue(c.initialValue, c.ValueHandle, c.valueConfig),
+			ValueConfig: c.valueConfig,
+		}
+		c.ValueHandle = charValue
+		handles = append(handles, charValue)
+
+		/* Derive CCC permissions from the characteristic's overall
+		   confidentiality model, not just its read encryption. A
+		   notify-only / write-encrypted characteristic is sensitive
+		   too — leaving the CCCD writable by anyone would let an
+		   unencrypted peer subscribe to its notification stream and
+		   read its current subscription state. */
+		var cccFlag CharacteristicFlag
+		if c.flags&(CharacteristicReadNeedsEncryption|CharacteristicWriteNeedsEncryption) > 0 {
+			cccFlag |= CharacteristicReadNeedsEncryption | CharacteristicWriteNeedsEncryption
+		}
+		if c.flags&(CharacteristicReadNeedsAuthentication|CharacteristicWriteNeedsAuthentication) > 0 {
+			cccFlag |= CharacteristicReadNeedsAuthentication | CharacteristicWriteNeedsAuthentication
+		}
 
-			charValue := &GATTHandle{
-				Info: HandleInfo{Handle: result.idx,
-					UUIDWidth: c.uuid.GetLength(),
-					UUID:      c.uuid,
-					Flags:     c.flags,
+		/* Does it need a CCC? */
+		if c.flags&(CharacteristicIndicate|CharacteristicNotify) > 0 {
+			idx++
+			charValue.CCCHandle = &GATTHandle{
+				Info: HandleInfo{Handle: idx,
+					UUIDWidth: UUIDCharacteristicClientConfiguration.GetLength(),
+					UUID:      UUIDCharacteristicClientConfiguration,
+					Flags:     CharacteristicRead | CharacteristicWriteAck | cccFlag,
 				},
-				Value:       valueCopy,
-				ValueConfig: c.valueConfig,
+				Value: []byte{0, 0},
 			}
-			c.ValueHandle = charValue
-			result.Handles = append(result.Handles, charValue)
-
-			/* Derive CCC permissions from the characteristic's overall
-			   confidentiality model, not just its read encryption. A
-			   notify-only / write-encrypted characteristic is sensitive
-			   too — leaving the CCCD writable by anyone would let an
-			   unencrypted peer subscribe to its notification stream and
-			   read its current subscription state. */
-			var cccFlag CharacteristicFlag
-			if c.flags&(CharacteristicReadNeedsEncryption|CharacteristicWriteNeedsEncryption) > 0 {
-				cccFlag |= CharacteristicReadNeedsEncryption | CharacteristicWriteNeedsEncryption
+
+			/* Subscribing hands the value to the client, so the CCC is
+			   guarded by the characteristic's read authorization */
+			if authorize := c.valueConfig.AuthorizeCb; authorize != nil {
+				charValue.CCCHandle.ValueConfig.AuthorizeCb = func(req AccessRequest) bool {
+					req.Handle = charValue
+					req.Write = false
+					return authorize(req)
+				}
 			}
-			if c.flags&(CharacteristicReadNeedsAuthentication|CharacteristicWriteNeedsAuthentication) > 0 {
-				cccFlag |= CharacteristicReadNeedsAuthentication | CharacteristicWriteNeedsAuthentication
+
+			handles = append(handles, charValue.CCCHandle)
+		}
+
+		for _, d := range c.descriptors {
+			idx++
+			d.Handle = &GATTHandle{
+				Info: HandleInfo{Handle: idx,
+					UUIDWidth: d.uuid.GetLength(),
+					UUID:      d.uuid,
+					Flags:     d.flags,
+				},
+				Value:       exportValue(d.initialValue, d.Handle, d.valueConfig),
+				ValueConfig: d.valueConfig,
 			}
 
-			/* Does it need a CCC? */
-			if c.flags&(CharacteristicIndicate|CharacteristicNotify) > 0 {
-				result.idx++
-				charValue.CCCHandle = &GATTHandle{
-					Info: HandleInfo{Handle: result.idx,
-						UUIDWidth: UUIDCharacteristicClientConfiguration.GetLength(),
-						UUID:      UUIDCharacteristicClientConfiguration,
-						Flags:     CharacteristicRead | CharacteristicWriteAck | cccFlag,
-					},
-					Value: []byte{0, 0},
-				}
+			handles = append(handles, d.Handle)
+		}
+	}
 
-				result.Handles = append(result.Handles, charValue.CCCHandle)
+	serviceDescr.Info.GroupEndHandle = idx
+
+	p.handleStart = serviceDescr.Info.Handle
+	p.handleEnd = idx
+
+	result.insertHandles(handles)
+	p.exported = true
+	p.modified = false
+}
+
+// resolveIncludes sets the value of the include declarations: the handle range of the included
+// service, followed by its UUID if it is 16 bits. The structure must be locked
+func (s *Structure) resolveIncludes() {
+	for _, p := range s.services {
+		for i, m := range p.includes {
+			if i >= len(p.includeHandles) {
+				break
 			}
+
+			value := make([]byte, 4, 6)
+			binary.LittleEndian.PutUint16(value[0:], m.handleStart)
+			binary.LittleEndian.PutUint16(value[2:], m.handleEnd)
+			if m.uuid.GetLength() == 2 {
+				value = append(value, m.uuid.UUIDToBytes()...)
+			}
+			p.includeHandles[i].Value = value
 		}
+	}
+}
 
-		serviceDescr.Info.GroupEndHandle = result.idx
+// The structure must be locked. A new slice is created, so a copy of the old one can still be
+// used without holding the lock
+func (result *ExportedStructure) removeHandles(start uint16, end uint16) {
+	handles := make([]*GATTHandle, 0, len(result.Handles))
+	for _, m := range result.Handles {
+		if m.Info.Handle < start || m.Info.Handle > end {
+			handles = append(handles, m)
+		}
 	}
+	result.Handles = handles
+}
+
+// insertHandles adds the handles of a service, keeping the attributes sorted. A new slice is
+// created, like in removeHandles. The structure must be locked
+func (result *ExportedStructure) insertHandles(added []*GATTHandle) {
+	i := sort.Search(len(result.Handles), func(i int) bool {
+		return result.Handles[i].Info.Handle > added[0].Info.Handle
+	})
+
+	handles := make([]*GATTHandle, 0, len(result.Handles)+len(added))
+	handles = append(handles, result.Handles[:i]...)
+	handles = append(handles, added...)
+	handles = append(handles, result.Handles[i:]...)
+	result.Handles = handles
+}
+
+// GetHandles returns the current attributes, sorted by handle
+func (result *ExportedStructure) GetHandles() []*GATTHandle {
+	result.Lock()
+	defer result.Unlock()
+
+	return result.Handles
 }
@@ -1,6 +1,9 @@
 package attstructure
 
 import (
+	"context"
+	"encoding/binary"
+	"fmt"
 	"testing"
 
 	bleutil "github.com/BertoldVdb/go-ble/util"
@@ -69,3 +72,203 @@ func TestExportCCCDPlainCharacteristic(t *testing.T) {
 		t.Errorf("CCCD on plain characteristic must not require encryption; got flags=%#x", ccc.Info.Flags)
 	}
 }
+
+func testHandleRange(e *ExportedStructure, p *Service) (uint16, uint16) {
+	for _, h := range e.Handles {
+		if h.Info.UUID == UUIDPrimaryService && string(h.Value) == string(p.uuid.UUIDToBytes()) {
+			return h.Info.Handle, h.Info.GroupEndHandle
+		}
+	}
+	return 0, 0
+}
+
+// Services can be added, modified and removed after export. Untouched
+// services keep their handles, and the modified range is reported.
+func TestExportUpdate(t *testing.T) {
+	s := NewStructure()
+	a := s.AddPrimaryService(bleutil.UUIDFromStringPanic("180a"))
+	a.AddCharacteristicReadOnly(bleutil.UUIDFromStringPanic("2a29"), []byte("a"))
+	b := s.AddPrimaryService(bleutil.UUIDFromStringPanic("180b"))
+	bc := b.AddCharacteristic(bleutil.UUIDFromStringPanic("2a2a"), CharacteristicRead|CharacteristicNotify, ValueConfig{})
+	c := s.AddPrimaryService(bleutil.UUIDFromStringPanic("180c"))
+	c.AddCharacteristicReadOnly(bleutil.UUIDFromStringPanic("2a2b"), []byte("c"))
+
+	exp := &ExportedStructure{}
+	exp.Append(s)
+
+	var changedStart, changedEnd uint16
+	exp.HandlesChanged = func(ctx context.Context, start uint16, end uint16) error {
+		changedStart, changedEnd = start, end
+		return nil
+	}
+
+	if _, err := bc.SetValueResults(context.Background(), []byte("kept")); err != nil {
+		t.Fatal(err)
+	}
+
+	aStart, aEnd := testHandleRange(exp, a)
+	bStart, bEnd := testHandleRange(exp, b)
+	cStart, _ := testHandleRange(exp, c)
+
+	/* Nothing is visible before Update */
+	b.AddCharacteristicReadOnly(bleutil.UUIDFromStringPanic("2a2c"), nil)
+	s.RemoveService(c)
+	d := s.AddPrimaryService(bleutil.UUIDFromStringPanic("180d"))
+	if start, _ := testHandleRange(exp, c); start != cStart {
+		t.Fatal("change visible before Update")
+	}
+
+	if err := s.Update(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if start, end := testHandleRange(exp, a); start != aStart || end != aEnd {
+		t.Errorf("untouched service moved to %d-%d", start, end)
+	}
+	if start, _ := testHandleRange(exp, c); start != 0 {
+		t.Error("removed service still exported")
+	}
+	/* The grown service and the new one fill the range freed by the removed one */
+	newStart, newEnd := testHandleRange(exp, b)
+	if newStart != bStart || newEnd-newStart != bEnd-bStart+2 {
+		t.Errorf("modified service at %d-%d, was %d-%d", newStart, newEnd, bStart, bEnd)
+	}
+	if start, end := testHandleRange(exp, d); start != newEnd+1 || end != newEnd+1 {
+		t.Errorf("new service at %d-%d", start, end)
+	}
+	if changedStart != bStart || changedEnd != newEnd+1 {
+		t.Errorf("changed range %d-%d, want %d-%d", changedStart, changedEnd, bStart, newEnd+1)
+	}
+
+	for i := 1; i < len(exp.Handles); i++ {
+		if exp.Handles[i].Info.Handle <= exp.Handles[i-1].Info.Handle {
+			t.Fatal("handles not sorted")
+		}
+	}
+	if value, _ := bc.GetValue(context.Background(), nil); string(value) != "kept" {
+		t.Errorf("value lost: %q", value)
+	}
+
+	for _, m := range c.GetCharacteristics() {
+		if _, err := m.SetValueResults(context.Background(), nil); err == nil {
+			t.Error("removed characteristic can still be set")
+		}
+	}
+
+	/* Without changes nothing is reported */
+	changedEnd = 0
+	if err := s.Update(context.Background()); err != nil || changedEnd != 0 {
+		t.Errorf("empty update reported %d (%v)", changedEnd, err)
+	}
+}
+
+// Handles freed by removed services are used again, so adding and removing
+// services many times does not run out of handles.
+func TestExportUpdateReusesHandles(t *testing.T) {
+	s := NewStructure()
+	a := s.AddPrimaryService(bleutil.UUIDFromStringPanic("180a"))
+	a.AddCharacteristicReadOnly(bleutil.UUIDFromStringPanic("2a29"), []byte("a"))
+
+	exp := &ExportedStructure{}
+	exp.Append(s)
+	aStart, aEnd := testHandleRange(exp, a)
+
+	var pool []*Service
+	for i := 0; i < 20000; i++ {
+		p := s.AddPrimaryService(bleutil.UUIDFromStringPanic(fmt.Sprintf("%04x", 0x1800+i%16)))
+		for j := 0; j <= i%3; j++ {
+			p.AddCharacteristic(bleutil.UUIDFromStringPanic("2a2a"), CharacteristicRead|CharacteristicNotify, ValueConfig{})
+		}
+		pool = append(pool, p)
+
+		/* Keep a few services around and remove one from varying positions */
+		if len(pool) > 4 {
+			k := (i * 7) % len(pool)
+			if err := s.RemoveService(pool[k]); err != nil {
+				t.Fatal(err)
+			}
+			pool = append(pool[:k:k], pool[k+1:]...)
+		}
+
+		if err := s.Update(context.Background()); err != nil {
+			t.Fatalf("cycle %d: %v", i, err)
+		}
+	}
+
+	if start, end := testHandleRange(exp, a); start != aStart || end != aEnd {
+		t.Errorf("untouched service moved to %d-%d", start, end)
+	}
+	for i := 1; i < len(exp.Handles); i++ {
+		if exp.Handles[i].Info.Handle <= exp.Handles[i-1].Info.Handle {
+			t.Fatal("handles not sorted")
+		}
+	}
+	for _, p := range pool {
+		if p.GetHandle() == 0 {
+			t.Error("service not exported")
+		}
+	}
+	if last := exp.Handles[len(exp.Handles)-1].Info.Handle; last > 200 {
+		t.Errorf("handles not reused, last handle is %d", last)
+	}
+}
+
+// Secondary services use their own declaration type, and include
+// declarations carry the range of the included service. Moving an included
+// service also moves the services that include it.
+func TestExportIncludedService(t *testing.T) {
+	s := NewStructure()
+	other := s.AddPrimaryService(bleutil.UUIDFromStringPanic("180a"))
+	primary := s.AddPrimaryService(bleutil.UUIDFromStringPanic("1812"))
+	secondary := s.AddSecondaryService(bleutil.UUIDFromStringPanic("180f"))
+	secondary.AddCharacteristicReadOnly(bleutil.UUIDFromStringPanic("2a19"), []byte{100})
+	if err := primary.Include(secondary); err != nil {
+		t.Fatal(err)
+	}
+	if err := primary.Include(primary); err == nil {
+		t.Error("service included itself")
+	}
+
+	exp := &ExportedStructure{}
+	exp.Append(s)
+
+	include := func() *GATTHandle {
+		for _, h := range exp.Handles {
+			if h.Info.UUID == UUIDIncludedService {
+				return h
+			}
+		}
+		return nil
+	}
+
+	h := include()
+	if h == nil || h.Info.Handle != primary.handleStart+1 {
+		t.Fatal("include declaration missing")
+	}
+	want := []byte{byte(secondary.handleStart), 0, byte(secondary.handleEnd), 0, 0x0f, 0x18}
+	if string(h.Value) != string(want) {
+		t.Errorf("include value %x, want %x", h.Value, want)
+	}
+	if exp.Handles[len(exp.Handles)-3].Info.UUID != UUIDSecondaryService {
+		t.Error("secondary service declared as primary")
+	}
+
+	otherStart := other.handleStart
+	secondary.AddCharacteristicReadOnly(bleutil.UUIDFromStringPanic("2a1a"), nil)
+	if err := s.Update(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if other.handleStart != otherStart {
+		t.Error("unrelated service moved")
+	}
+	h = include()
+	if h.Info.Handle != primary.handleStart+1 || binary.LittleEndian.Uint16(h.Value) != secondary.handleStart {
+		t.Errorf("include not updated: %x", h.Value)
+	}
+
+	s.RemoveService(secondary)
+	s.Update(context.Background())
+	if include() != nil || len(primary.GetIncludedServices()) != 0 {
+		t.Error("include of removed service kept")
+	}
+}
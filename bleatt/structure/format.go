@@ -0,0 +1,198 @@
+package attstructure
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// Format is the format field of the Characteristic Presentation Format descriptor
+type Format uint8
+
+const (
+	FormatBoolean Format = 0x01
+	FormatUint8   Format = 0x04
+	FormatUint16  Format = 0x06
+	FormatUint24  Format = 0x07
+	FormatUint32  Format = 0x08
+	FormatUint48  Format = 0x09
+	FormatUint64  Format = 0x0A
+	FormatSint8   Format = 0x0C
+	FormatSint16  Format = 0x0E
+	FormatSint24  Format = 0x0F
+	FormatSint32  Format = 0x10
+	FormatSint48  Format = 0x11
+	FormatSint64  Format = 0x12
+	FormatFloat32 Format = 0x14
+	FormatFloat64 Format = 0x15
+	FormatSFloat  Format = 0x16
+	FormatFloat   Format = 0x17
+	FormatUTF8    Format = 0x19
+	FormatStruct  Format = 0x1B
+)
+
+type formatInfo struct {
+	name   string
+	size   int
+	signed bool
+}
+
+var formats = map[Format]formatInfo{
+	FormatBoolean: {"boolean", 1, false},
+	FormatUint8:   {"uint8", 1, false},
+	FormatUint16:  {"uint16", 2, false},
+	FormatUint24:  {"uint24", 3, false},
+	FormatUint32:  {"uint32", 4, false},
+	FormatUint48:  {"uint48", 6, false},
+	FormatUint64:  {"uint64", 8, false},
+	FormatSint8:   {"sint8", 1, true},
+	FormatSint16:  {"sint16", 2, true},
+	FormatSint24:  {"sint24", 3, true},
+	FormatSint32:  {"sint32", 4, true},
+	FormatSint48:  {"sint48", 6, true},
+	FormatSint64:  {"sint64", 8, true},
+	FormatFloat32: {"float32", 4, true},
+	FormatFloat64: {"float64", 8, true},
+	FormatSFloat:  {"SFLOAT", 2, true},
+	FormatFloat:   {"FLOAT", 4, true},
+	FormatUTF8:    {"utf8s", 0, false},
+	FormatStruct:  {"struct", 0, false},
+}
+
+func (f Format) isInteger() bool {
+	_, ok := formats[f]
+	return ok && f >= FormatUint8 && f <= FormatSint64
+}
+
+// PresentationFormat is the value of the Characteristic Presentation Format descriptor
+type PresentationFormat struct {
+	Format      Format
+	Exponent    int8
+	Unit        uint16
+	Namespace   uint8
+	Description uint16
+}
+
+func (p PresentationFormat) Bytes() []byte {
+	b := []byte{byte(p.Format), byte(p.Exponent), 0, 0, p.Namespace, 0, 0}
+	binary.LittleEndian.PutUint16(b[2:], p.Unit)
+	binary.LittleEndian.PutUint16(b[5:], p.Description)
+	return b
+}
+
+func ParsePresentationFormat(value []byte) (PresentationFormat, error) {
+	if len(value) != 7 {
+		return PresentationFormat{}, errors.New("Presentation format has the wrong length")
+	}
+
+	return PresentationFormat{
+		Format:      Format(value[0]),
+		Exponent:    int8(value[1]),
+		Unit:        binary.LittleEndian.Uint16(value[2:]),
+		Namespace:   value[4],
+		Description: binary.LittleEndian.Uint16(value[5:]),
+	}, nil
+}
+
+// AddPresentationFormat adds a read only Characteristic Presentation Format descriptor
+func (c *Characteristic) AddPresentationFormat(format PresentationFormat) *Descriptor {
+	return c.addDescriptor(UUIDCharacteristicFormat, CharacteristicRead, format.Bytes(), ValueConfig{LengthFixed: true, LengthMax: 7})
+}
+
+// GetPresentationFormat reads the Characteristic Presentation Format descriptor
+func (c *Characteristic) GetPresentationFormat(ctx context.Context) (PresentationFormat, error) {
+	d := c.GetDescriptor(UUIDCharacteristicFormat)
+	if d == nil {
+		return PresentationFormat{}, errors.New("Characteristic has no presentation format")
+	}
+
+	value, err := d.GetValue(ctx, nil)
+	if err != nil {
+		return PresentationFormat{}, err
+	}
+	return ParsePresentationFormat(value)
+}
+
+// NumberCodec converts the numeric formats of a presentation format to float64. The exponent is
+// applied to integer formats: a sint16 of 2345 with exponent -2 is 23.45.
+type NumberCodec struct {
+	Format   Format
+	Exponent int8
+}
+
+func (p PresentationFormat) NumberCodec() (NumberCodec, error) {
+	info, ok := formats[p.Format]
+	if !ok || info.size == 0 {
+		return NumberCodec{}, errors.New("Presentation format is not numeric")
+	}
+	return NumberCodec{Format: p.Format, Exponent: p.Exponent}, nil
+}
+
+func (c NumberCodec) Encode(value float64) ([]byte, error) {
+	info := formats[c.Format]
+
+	switch c.Format {
+	case FormatBoolean:
+		return CodecBoolean.Encode(value != 0)
+	case FormatFloat32:
+		return CodecFloat32.Encode(float32(value))
+	case FormatFloat64:
+		return CodecFloat64.Encode(value)
+	case FormatSFloat:
+		return CodecSFloat.Encode(value)
+	case FormatFloat:
+		return CodecFloat.Encode(value)
+	}
+
+	if !c.Format.isInteger() {
+		return nil, errors.New("Format is not numeric")
+	}
+
+	raw := math.Round(scaleDecimal(value, -int(c.Exponent)))
+	if info.signed {
+		if raw < math.MinInt64 || raw >= math.MaxInt64 {
+			return nil, errorCodecRange
+		}
+		return encodeSint(int64(raw), info.size)
+	}
+
+	if raw < 0 || raw >= math.MaxUint64 {
+		return nil, errorCodecRange
+	}
+	return encodeUint(uint64(raw), info.size)
+}
+
+func (c NumberCodec) Decode(data []byte) (float64, error) {
+	info := formats[c.Format]
+
+	switch c.Format {
+	case FormatBoolean:
+		v, err := CodecBoolean.Decode(data)
+		if v {
+			return 1, err
+		}
+		return 0, err
+	case FormatFloat32:
+		v, err := CodecFloat32.Decode(data)
+		return float64(v), err
+	case FormatFloat64:
+		return CodecFloat64.Decode(data)
+	case FormatSFloat:
+		return CodecSFloat.Decode(data)
+	case FormatFloat:
+		return CodecFloat.Decode(data)
+	}
+
+	if !c.Format.isInteger() {
+		return 0, errors.New("Format is not numeric")
+	}
+	if len(data) != info.size {
+		return 0, errorCodecLength
+	}
+
+	if info.signed {
+		return scaleDecimal(float64(decodeSint(data)), int(c.Exponent)), nil
+	}
+	return scaleDecimal(float64(getUint(data)), int(c.Exponent)), nil
+}
@@ -19,6 +19,14 @@ func ImportStructure(gattHandles []*GATTHandle, rCb ClientReadHandler, wCb Clien
 	var currentService *Service
 	var currentCharacteristic *Characteristic
 
+	/* Includes refer to the handle of a service declaration, they are resolved at the end */
+	type include struct {
+		service *Service
+		handle  uint16
+	}
+	var includes []include
+	serviceByHandle := make(map[uint16]*Service)
+
 	finishCharacteristic := func() {
 		if currentCharacteristic != nil && currentService != nil {
 			if currentCharacteristic.ValueHandle != nil {
@@ -37,10 +45,6 @@ func ImportStructure(gattHandles []*GATTHandle, rCb ClientReadHandler, wCb Clien
 	}
 
 	for _, m := range gattHandles {
-		if m.Info.UUID == UUIDIncludedService {
-			return nil, errors.New("including services is not supported (TODO)")
-		}
-
 		if m.Info.UUID == UUIDPrimaryService || m.Info.UUID == UUIDSecondaryService {
 			finishService()
 
@@ -60,16 +64,30 @@ func ImportStructure(gattHandles []*GATTHandle, rCb ClientReadHandler, wCb Clien
 			}
 			if currentService == nil {
 				currentService = &Service{
-					isPrimary: m.Info.UUID == UUIDPrimaryService,
-					parent:    s,
-					uuid:      uuid,
+					isPrimary:   m.Info.UUID == UUIDPrimaryService,
+					parent:      s,
+					uuid:        uuid,
+					handleStart: m.Info.Handle,
 				}
 			}
+			serviceByHandle[m.Info.Handle] = currentService
 		} else {
 			if currentService == nil {
 				return nil, errors.New("this item must be in a service definition")
 			}
 
+			if m.Info.UUID == UUIDIncludedService {
+				if len(m.Value) < 4 {
+					return nil, errors.New("Include definition has an invalid length")
+				}
+
+				includes = append(includes, include{
+					service: currentService,
+					handle:  binary.LittleEndian.Uint16(m.Value),
+				})
+				continue
+			}
+
 			/* The standard says you can have multiple characteristic definitions with
 			   the same UUID. I don't know what that means in practice (different permissions?).
 			   We just add them all, the code that uses this can decide which one to access */
@@ -124,6 +142,12 @@ func ImportStructure(gattHandles []*GATTHandle, rCb ClientReadHandler, wCb Clien
 
 				if m.Info.UUID == UUIDCharacteristicClientConfiguration {
 					currentCharacteristic.ValueHandle.CCCHandle = m
+				} else if m.Info.Handle != currentCharacteristic.ValueHandle.Info.Handle {
+					currentCharacteristic.descriptors = append(currentCharacteristic.descriptors, &Descriptor{
+						parent: currentCharacteristic,
+						uuid:   m.Info.UUID,
+						Handle: m,
+					})
 				}
 			}
 		}
@@ -131,5 +155,12 @@ func ImportStructure(gattHandles []*GATTHandle, rCb ClientReadHandler, wCb Clien
 
 	finishService()
 
+	/* Includes of services that were not discovered are dropped */
+	for _, m := range includes {
+		if included, ok := serviceByHandle[m.handle]; ok && included != m.service {
+			m.service.includes = append(m.service.includes, included)
+		}
+	}
+
 	return s, nil
 }
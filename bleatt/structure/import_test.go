@@ -41,12 +41,53 @@ func TestImportStructureRoundTrip(t *testing.T) {
 	}
 }
 
-func TestImportStructureRejectsIncludedService(t *testing.T) {
+// Includes are resolved to the imported services, also when the included
+// service is declared after the service that includes it.
+func TestImportStructureIncludedService(t *testing.T) {
+	primaryUUID := bleutil.UUIDFromStringPanic("1812")
+	secondaryUUID := bleutil.UUIDFromStringPanic("180f")
+	longUUID := bleutil.UUIDFromStringPanic("6e400001-b5a3-f393-e0a9-e50e24dcca9e")
+	charUUID := bleutil.UUIDFromStringPanic("2a19")
+
 	handles := []*GATTHandle{
-		{Info: HandleInfo{Handle: 1, UUID: UUIDIncludedService}, Value: nil},
+		{Info: HandleInfo{Handle: 1, UUID: UUIDPrimaryService}, Value: primaryUUID.UUIDToBytes()},
+		{Info: HandleInfo{Handle: 2, UUID: UUIDIncludedService}, Value: []byte{5, 0, 7, 0, 0x0f, 0x18}},
+		{Info: HandleInfo{Handle: 3, UUID: UUIDIncludedService}, Value: []byte{8, 0, 8, 0}},
+		{Info: HandleInfo{Handle: 4, UUID: UUIDIncludedService}, Value: []byte{0x10, 0, 0x10, 0}},
+		{Info: HandleInfo{Handle: 5, UUID: UUIDSecondaryService}, Value: secondaryUUID.UUIDToBytes()},
+		{Info: HandleInfo{Handle: 6, UUID: UUIDCharacteristic}, Value: makeCharValue(0x02, 7, charUUID)},
+		{Info: HandleInfo{Handle: 7, UUID: charUUID}},
+		{Info: HandleInfo{Handle: 8, UUID: UUIDSecondaryService}, Value: longUUID.UUIDToBytes()},
+	}
+
+	s, err := ImportStructure(handles, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	primary := s.GetService(primaryUUID)
+	secondary := s.GetService(secondaryUUID)
+	if primary == nil || secondary == nil || !primary.IsPrimary() || secondary.IsPrimary() {
+		t.Fatal("services not imported")
+	}
+	if secondary.GetCharacteristic(charUUID) == nil {
+		t.Error("characteristic of secondary service not imported")
+	}
+
+	includes := primary.GetIncludedServices()
+	if len(includes) != 2 || includes[0] != secondary || includes[1] != s.GetService(longUUID) {
+		t.Errorf("includes not resolved: %v", includes)
+	}
+}
+
+func TestImportStructureRejectsShortInclude(t *testing.T) {
+	svcUUID := bleutil.UUIDFromStringPanic("180a")
+	handles := []*GATTHandle{
+		{Info: HandleInfo{Handle: 1, UUID: UUIDPrimaryService}, Value: svcUUID.UUIDToBytes()},
+		{Info: HandleInfo{Handle: 2, UUID: UUIDIncludedService}, Value: []byte{1, 0}},
 	}
 	if _, err := ImportStructure(handles, nil, nil); err == nil {
-		t.Error("expected error on included-service handle")
+		t.Error("expected error on short include value")
 	}
 }
 
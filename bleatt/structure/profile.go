@@ -0,0 +1,471 @@
+package attstructure
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	bleutil "github.com/BertoldVdb/go-ble/util"
+	"gopkg.in/yaml.v3"
+)
+
+// Profile describes a structure in a form that is stored as YAML or JSON. Values are given as
+// text with Value, or as hex encoded bytes with Hex. The handles of characteristics and
+// descriptors are only written for review, the handle of a service is used as a hint when the
+// structure is exported. Services are included by their ID, as several services can have the
+// same UUID.
+type Profile struct {
+	Services []ProfileService `json:"services" yaml:"services"`
+}
+
+type ProfileService struct {
+	ID        string   `json:"id,omitempty" yaml:"id,omitempty"`
+	UUID      string   `json:"uuid" yaml:"uuid"`
+	Secondary bool     `json:"secondary,omitempty" yaml:"secondary,omitempty"`
+	Handle    uint16   `json:"handle,omitempty" yaml:"handle,omitempty"`
+	Includes  []string `json:"includes,omitempty" yaml:"includes,omitempty"`
+
+	Characteristics []ProfileCharacteristic `json:"characteristics,omitempty" yaml:"characteristics,omitempty"`
+}
+
+type ProfileCharacteristic struct {
+	UUID        string   `json:"uuid" yaml:"uuid"`
+	Handle      uint16   `json:"handle,omitempty" yaml:"handle,omitempty"`
+	Properties  []string `json:"properties,omitempty" yaml:"properties,omitempty"`
+	Security    []string `json:"security,omitempty" yaml:"security,omitempty"`
+	Value       string   `json:"value,omitempty" yaml:"value,omitempty"`
+	Hex         string   `json:"hex,omitempty" yaml:"hex,omitempty"`
+	MaxLength   uint16   `json:"maxLength,omitempty" yaml:"maxLength,omitempty"`
+	FixedLength bool     `json:"fixedLength,omitempty" yaml:"fixedLength,omitempty"`
+
+	Descriptors []ProfileDescriptor `json:"descriptors,omitempty" yaml:"descriptors,omitempty"`
+}
+
+type ProfileDescriptor struct {
+	UUID        string   `json:"uuid" yaml:"uuid"`
+	Handle      uint16   `json:"handle,omitempty" yaml:"handle,omitempty"`
+	Properties  []string `json:"properties,omitempty" yaml:"properties,omitempty"`
+	Security    []string `json:"security,omitempty" yaml:"security,omitempty"`
+	Value       string   `json:"value,omitempty" yaml:"value,omitempty"`
+	Hex         string   `json:"hex,omitempty" yaml:"hex,omitempty"`
+	MaxLength   uint16   `json:"maxLength,omitempty" yaml:"maxLength,omitempty"`
+	FixedLength bool     `json:"fixedLength,omitempty" yaml:"fixedLength,omitempty"`
+}
+
+var profileProperties = []struct {
+	name string
+	flag CharacteristicFlag
+}{
+	{"broadcast", CharacteristicBroadcast},
+	{"read", CharacteristicRead},
+	{"write-without-response", CharacteristicWriteNoAck},
+	{"write", CharacteristicWriteAck},
+	{"notify", CharacteristicNotify},
+	{"indicate", CharacteristicIndicate},
+	{"signed-write", CharacteristicSignedWrite},
+	{"extended", CharacteristicExtended},
+}
+
+/* The combined names come first, the exporter uses the first name that matches */
+var profileSecurity = []struct {
+	name string
+	flag CharacteristicFlag
+}{
+	{"encryption", CharacteristicNeedsEncryption},
+	{"authentication", CharacteristicNeedsAuthentication},
+	{"read-encryption", CharacteristicReadNeedsEncryption},
+	{"write-encryption", CharacteristicWriteNeedsEncryption},
+	{"read-authentication", CharacteristicReadNeedsAuthentication},
+	{"write-authentication", CharacteristicWriteNeedsAuthentication},
+}
+
+func parseProfileFlags(properties []string, security []string) (CharacteristicFlag, error) {
+	var flags CharacteristicFlag
+
+	lookup := func(names []string, table []struct {
+		name string
+		flag CharacteristicFlag
+	}) error {
+	outer:
+		for _, name := range names {
+			for _, m := range table {
+				if strings.EqualFold(m.name, name) {
+					flags |= m.flag
+					continue outer
+				}
+			}
+			return fmt.Errorf("Unknown flag %q", name)
+		}
+		return nil
+	}
+
+	if err := lookup(properties, profileProperties); err != nil {
+		return 0, err
+	}
+	return flags, lookup(security, profileSecurity)
+}
+
+func profileFlags(flags CharacteristicFlag) ([]string, []string) {
+	var properties, security []string
+
+	for _, m := range profileProperties {
+		if flags&m.flag != 0 {
+			properties = append(properties, m.name)
+		}
+	}
+	for _, m := range profileSecurity {
+		if flags&m.flag == m.flag {
+			security = append(security, m.name)
+			flags &^= m.flag
+		}
+	}
+
+	return properties, security
+}
+
+func parseProfileValue(text string, hexValue string) ([]byte, error) {
+	if text != "" && hexValue != "" {
+		return nil, errors.New("Only one of value and hex can be set")
+	}
+	if text != "" {
+		return []byte(text), nil
+	}
+
+	hexValue = strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) || r == ':' {
+			return -1
+		}
+		return r
+	}, hexValue)
+	return hex.DecodeString(hexValue)
+}
+
+/* Values that are readable text are written as text, all others as hex */
+func profileValue(value []byte) (string, string) {
+	if len(value) == 0 {
+		return "", ""
+	}
+
+	if utf8.Valid(value) {
+		printable := true
+		for _, r := range string(value) {
+			if !unicode.IsPrint(r) {
+				printable = false
+				break
+			}
+		}
+		if printable {
+			return string(value), ""
+		}
+	}
+
+	return "", hex.EncodeToString(value)
+}
+
+// ParseProfile reads a profile. JSON is accepted as well, as it is a subset of YAML. Unknown
+// fields are an error.
+func ParseProfile(data []byte) (*Profile, error) {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+
+	p := &Profile{}
+	if err := decoder.Decode(p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// LoadProfile reads a profile file and builds the structure it describes
+func LoadProfile(filename string) (*Structure, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := ParseProfile(data)
+	if err != nil {
+		return nil, err
+	}
+	return p.Build(nil)
+}
+
+// Build creates a structure from the profile. The optional configure function is called for
+// every characteristic and can add callbacks to the value configuration that came from the
+// profile.
+func (p *Profile) Build(configure func(c *Characteristic, config *ValueConfig)) (*Structure, error) {
+	s := NewStructure()
+	var lastHandle uint16
+	ids := make(map[string]*Service)
+
+	for _, m := range p.Services {
+		uuid, err := bleutil.UUIDFromString(m.UUID)
+		if err != nil {
+			return nil, fmt.Errorf("Service %q: %w", m.UUID, err)
+		}
+		if _, ok := ids[m.ID]; ok && m.ID != "" {
+			return nil, fmt.Errorf("Service %q: ID %q is used twice", m.UUID, m.ID)
+		}
+
+		if m.Handle != 0 && m.Handle <= lastHandle {
+			return nil, fmt.Errorf("Service %q: Handle hints must increase", m.UUID)
+		}
+		if m.Handle != 0 {
+			lastHandle = m.Handle
+		}
+
+		var service *Service
+		if m.Secondary {
+			service = s.AddSecondaryService(uuid)
+		} else {
+			service = s.AddPrimaryService(uuid)
+		}
+		service.SetHandleHint(m.Handle)
+		if m.ID != "" {
+			ids[m.ID] = service
+		}
+
+		for _, k := range m.Characteristics {
+			if err := buildProfileCharacteristic(service, k, configure); err != nil {
+				return nil, fmt.Errorf("Service %q: %w", m.UUID, err)
+			}
+		}
+	}
+
+	/* Includes can refer to services that are defined later */
+	for i, m := range p.Services {
+		for _, k := range m.Includes {
+			included, ok := ids[k]
+			if !ok {
+				return nil, fmt.Errorf("Service %q: Included service %q not found", m.UUID, k)
+			}
+			if err := s.services[i].Include(included); err != nil {
+				return nil, fmt.Errorf("Service %q: %w", m.UUID, err)
+			}
+		}
+	}
+
+	return s, nil
+}
+
+func profileValueConfig(maxLength uint16, fixedLength bool, value []byte) (ValueConfig, error) {
+	config := ValueConfig{
+		LengthMax:   maxLength,
+		LengthFixed: fixedLength,
+	}
+	if config.LengthFixed && config.LengthMax == 0 {
+		config.LengthMax = uint16(len(value))
+	}
+	if config.LengthMax > 0 && len(value) > int(config.LengthMax) {
+		return config, errors.New("Value is longer than maxLength")
+	}
+	return config, nil
+}
+
+func buildProfileCharacteristic(p *Service, m ProfileCharacteristic, configure func(c *Characteristic, config *ValueConfig)) error {
+	uuid, err := bleutil.UUIDFromString(m.UUID)
+	if err != nil {
+		return fmt.Errorf("Characteristic %q: %w", m.UUID, err)
+	}
+
+	flags, err := parseProfileFlags(m.Properties, m.Security)
+	if err != nil {
+		return fmt.Errorf("Characteristic %q: %w", m.UUID, err)
+	}
+
+	value, err := parseProfileValue(m.Value, m.Hex)
+	if err != nil {
+		return fmt.Errorf("Characteristic %q: %w", m.UUID, err)
+	}
+
+	config, err := profileValueConfig(m.MaxLength, m.FixedLength, value)
+	if err != nil {
+		return fmt.Errorf("Characteristic %q: %w", m.UUID, err)
+	}
+
+	c := p.AddCharacteristic(uuid, flags, config)
+	c.initialValue = value
+	if configure != nil {
+		configure(c, &c.valueConfig)
+	}
+
+	for _, k := range m.Descriptors {
+		uuid, err := bleutil.UUIDFromString(k.UUID)
+		if err != nil {
+			return fmt.Errorf("Descriptor %q: %w", k.UUID, err)
+		}
+		flags, err := parseProfileFlags(k.Properties, k.Security)
+		if err != nil {
+			return fmt.Errorf("Descriptor %q: %w", k.UUID, err)
+		}
+
+		value, err := parseProfileValue(k.Value, k.Hex)
+		if err != nil {
+			return fmt.Errorf("Descriptor %q: %w", k.UUID, err)
+		}
+
+		config, err := profileValueConfig(k.MaxLength, k.FixedLength, value)
+		if err != nil {
+			return fmt.Errorf("Descriptor %q: %w", k.UUID, err)
+		}
+
+		_, err = c.AddDescriptor(uuid, flags, value, config)
+		if err != nil {
+			return fmt.Errorf("Descriptor %q: %w", k.UUID, err)
+		}
+	}
+
+	return nil
+}
+
+// NewProfile describes a structure, local or imported from a peer. Values are the current ones
+// if the structure was exported. For imported structures only values that were read during
+// discovery are known.
+func NewProfile(s *Structure) *Profile {
+	if e := s.exported; e != nil {
+		e.Lock()
+		defer e.Unlock()
+	}
+
+	p := &Profile{}
+	services := append([]*Service{}, s.services...)
+	for _, m := range services {
+		service := ProfileService{
+			UUID:      m.uuid.String(),
+			Secondary: !m.isPrimary,
+			Handle:    m.GetHandle(),
+		}
+		if service.Handle == 0 {
+			service.Handle = m.handleHint
+		}
+
+		for _, k := range m.characteristics {
+			service.Characteristics = append(service.Characteristics, newProfileCharacteristic(k))
+		}
+
+		p.Services = append(p.Services, service)
+	}
+
+	/* Update can move modified services, Build needs them in order. Services that are not
+	   exported yet are appended. */
+	if s.exported != nil {
+		order := make([]int, len(services))
+		for i := range order {
+			order[i] = i
+		}
+		sort.SliceStable(order, func(i, j int) bool {
+			a, b := p.Services[order[i]].Handle, p.Services[order[j]].Handle
+			return a != 0 && (b == 0 || a < b)
+		})
+
+		sorted := make([]ProfileService, len(order))
+		sortedServices := make([]*Service, len(order))
+		for i, m := range order {
+			sorted[i] = p.Services[m]
+			sortedServices[i] = services[m]
+		}
+		p.Services, services = sorted, sortedServices
+	}
+
+	/* Included services get an ID, the UUID unless it is used more than once */
+	count := make(map[bleutil.UUID]int)
+	for _, m := range services {
+		count[m.uuid]++
+	}
+	ids := make(map[*Service]string)
+	seen := make(map[bleutil.UUID]int)
+	for i, m := range services {
+		seen[m.uuid]++
+		included := false
+		for _, k := range services {
+			for _, l := range k.includes {
+				included = included || l == m
+			}
+		}
+		if !included {
+			continue
+		}
+
+		id := m.uuid.String()
+		if count[m.uuid] > 1 {
+			id = fmt.Sprintf("%s-%d", id, seen[m.uuid])
+		}
+		ids[m] = id
+		p.Services[i].ID = id
+	}
+	for i, m := range services {
+		for _, k := range m.includes {
+			p.Services[i].Includes = append(p.Services[i].Includes, ids[k])
+		}
+	}
+
+	return p
+}
+
+func newProfileCharacteristic(c *Characteristic) ProfileCharacteristic {
+	value := c.initialValue
+	result := ProfileCharacteristic{
+		UUID:        c.uuid.String(),
+		MaxLength:   c.valueConfig.LengthMax,
+		FixedLength: c.valueConfig.LengthFixed,
+	}
+	if c.ValueHandle != nil {
+		result.Handle = c.ValueHandle.Info.Handle
+		value = c.ValueHandle.Value
+	}
+	result.Properties, result.Security = profileFlags(c.flags)
+	result.Value, result.Hex = profileValue(value)
+
+	for _, d := range c.descriptors {
+		value := d.initialValue
+		descriptor := ProfileDescriptor{
+			UUID:        d.uuid.String(),
+			MaxLength:   d.valueConfig.LengthMax,
+			FixedLength: d.valueConfig.LengthFixed,
+		}
+		if d.Handle != nil {
+			descriptor.Handle = d.Handle.Info.Handle
+			value = d.Handle.Value
+		}
+		descriptor.Properties, descriptor.Security = profileFlags(d.flags)
+		descriptor.Value, descriptor.Hex = profileValue(value)
+
+		result.Descriptors = append(result.Descriptors, descriptor)
+	}
+
+	return result
+}
+
+func (p *Profile) YAML() ([]byte, error) {
+	return yaml.Marshal(p)
+}
+
+func (p *Profile) JSON() ([]byte, error) {
+	return json.MarshalIndent(p, "", "  ")
+}
+
+// SaveProfile writes the profile of a structure to a file. Files ending in .json are written as
+// JSON, all others as YAML.
+func SaveProfile(filename string, s *Structure) error {
+	p := NewProfile(s)
+
+	var data []byte
+	var err error
+	if strings.EqualFold(filepath.Ext(filename), ".json") {
+		data, err = p.JSON()
+	} else {
+		data, err = p.YAML()
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filename, data, 0644)
+}
@@ -0,0 +1,262 @@
+package attstructure
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	bleutil "github.com/BertoldVdb/go-ble/util"
+)
+
+const testProfile = `
+services:
+  - uuid: "180a"
+    includes: ["1801"]
+    characteristics:
+      - uuid: "2a29"
+        properties: [read]
+        value: ACME
+      - uuid: "2a50"
+        properties: [read]
+        security: [encryption]
+        hex: "01 0d 00 00 00 10 01"
+        fixedLength: true
+  - id: "1801"
+    uuid: "1801"
+    secondary: true
+    handle: 0x20
+    characteristics:
+      - uuid: "12345678-1234-5678-1234-56789abcdef0"
+        properties: [read, write, notify]
+        security: [write-authentication]
+        maxLength: 8
+        descriptors:
+          - uuid: "2901"
+            properties: [read]
+            value: Counter
+            maxLength: 16
+          - uuid: "2904"
+            properties: [read]
+            hex: "06000027010000"
+`
+
+func TestProfileBuild(t *testing.T) {
+	p, err := ParseProfile([]byte(testProfile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var configured []bleutil.UUID
+	s, err := p.Build(func(c *Characteristic, config *ValueConfig) {
+		configured = append(configured, c.uuid)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(configured) != 3 {
+		t.Errorf("configure called for %v", configured)
+	}
+
+	exp := &ExportedStructure{}
+	exp.Append(s)
+
+	info := s.GetService(bleutil.UUIDFromStringPanic("180a"))
+	manufacturer := info.GetCharacteristic(bleutil.UUIDFromStringPanic("2a29"))
+	if value, _ := manufacturer.GetValue(context.Background(), nil); string(value) != "ACME" {
+		t.Errorf("manufacturer is %q", value)
+	}
+	pnp := info.GetCharacteristic(bleutil.UUIDFromStringPanic("2a50"))
+	if pnp.GetFlags() != CharacteristicRead|CharacteristicNeedsEncryption || pnp.ValueHandle.ValueConfig.LengthMax != 7 {
+		t.Errorf("pnp flags %x, config %+v", pnp.GetFlags(), pnp.ValueHandle.ValueConfig)
+	}
+
+	/* The secondary service is placed at the hinted handle */
+	gatt := s.GetService(bleutil.UUIDFromStringPanic("1801"))
+	if gatt.IsPrimary() || gatt.GetHandle() != 0x20 {
+		t.Errorf("secondary service at %04x", gatt.GetHandle())
+	}
+	if includes := info.GetIncludedServices(); len(includes) != 1 || includes[0] != gatt {
+		t.Errorf("includes %v", includes)
+	}
+
+	c := gatt.GetCharacteristics()[0]
+	if c.GetFlags() != CharacteristicRead|CharacteristicWriteAck|CharacteristicNotify|CharacteristicWriteNeedsAuthentication {
+		t.Errorf("flags %x", c.GetFlags())
+	}
+	if format, err := c.GetPresentationFormat(context.Background()); err != nil || format.Format != FormatUint16 || format.Unit != 0x2700 {
+		t.Errorf("presentation format %+v (%v)", format, err)
+	}
+	if d := c.GetDescriptor(UUIDCharacteristicUserDescription); d.Handle.ValueConfig.LengthMax != 16 {
+		t.Errorf("description config %+v", d.Handle.ValueConfig)
+	}
+}
+
+// Services with the same UUID are told apart by their ID.
+func TestProfileIncludeByID(t *testing.T) {
+	const profile = `
+services:
+  - uuid: "1812"
+    includes: [second]
+  - id: first
+    uuid: "180f"
+    secondary: true
+  - id: second
+    uuid: "180f"
+    secondary: true
+`
+	p, err := ParseProfile([]byte(profile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := p.Build(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if includes := s.GetServices()[0].GetIncludedServices(); len(includes) != 1 || includes[0] != s.GetServices()[2] {
+		t.Errorf("includes %v", includes)
+	}
+
+	s.GetServices()[1].Include(s.GetServices()[2])
+	exp := &ExportedStructure{}
+	exp.Append(s)
+
+	result := NewProfile(s)
+	if result.Services[1].ID != "" || result.Services[2].ID != "180f-2" {
+		t.Errorf("ids %q %q", result.Services[1].ID, result.Services[2].ID)
+	}
+
+	loaded, err := result.Build(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp = &ExportedStructure{}
+	exp.Append(loaded)
+	if a, b := result, NewProfile(loaded); !reflect.DeepEqual(a, b) {
+		t.Errorf("profile changed:\n%+v\n%+v", a, b)
+	}
+}
+
+func TestProfileRoundTrip(t *testing.T) {
+	p, err := ParseProfile([]byte(testProfile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := p.Build(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := &ExportedStructure{}
+	exp.Append(s)
+
+	dir := t.TempDir()
+	for _, name := range []string{"profile.yaml", "profile.json"} {
+		filename := filepath.Join(dir, name)
+		if err := SaveProfile(filename, s); err != nil {
+			t.Fatal(err)
+		}
+
+		loaded, err := LoadProfile(filename)
+		if err != nil {
+			data, _ := os.ReadFile(filename)
+			t.Fatalf("%s: %v\n%s", name, err, data)
+		}
+
+		/* Handles are only known after exporting */
+		exp := &ExportedStructure{}
+		exp.Append(loaded)
+		if a, b := NewProfile(s), NewProfile(loaded); !reflect.DeepEqual(a, b) {
+			t.Errorf("%s: profile changed:\n%+v\n%+v", name, a, b)
+		}
+	}
+}
+
+// Update moves a modified service behind the others, the profile must follow the handles.
+func TestProfileAfterUpdate(t *testing.T) {
+	p, _ := ParseProfile([]byte(testProfile))
+	s, err := p.Build(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := &ExportedStructure{}
+	exp.Append(s)
+
+	s.GetServices()[0].AddCharacteristic(bleutil.UUIDFromStringPanic("2a24"), CharacteristicRead, ValueConfig{})
+	if err := s.Update(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := NewProfile(s).YAML()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err = ParseProfile(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := p.Build(nil)
+	if err != nil {
+		t.Fatalf("%v\n%s", err, data)
+	}
+
+	exp = &ExportedStructure{}
+	exp.Append(loaded)
+	if a, b := NewProfile(s), NewProfile(loaded); !reflect.DeepEqual(a, b) {
+		t.Errorf("profile changed:\n%+v\n%+v", a, b)
+	}
+}
+
+func TestProfileImported(t *testing.T) {
+	p, _ := ParseProfile([]byte(testProfile))
+	s, _ := p.Build(nil)
+	exp := &ExportedStructure{}
+	exp.Append(s)
+
+	var discovered []*GATTHandle
+	for _, m := range exp.Handles {
+		discovered = append(discovered, &GATTHandle{Info: m.Info, Value: m.Value})
+	}
+	imported, err := ImportStructure(discovered, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := NewProfile(imported)
+	if len(result.Services) != 2 || result.Services[1].Handle != 0x20 || !result.Services[1].Secondary {
+		t.Fatalf("services %+v", result.Services)
+	}
+	if includes := result.Services[0].Includes; len(includes) != 1 || includes[0] != "1801" {
+		t.Errorf("includes %v", includes)
+	}
+
+	c := result.Services[1].Characteristics[0]
+	if c.UUID != "12345678-1234-5678-1234-56789abcdef0" || c.Handle != 0x22 || !reflect.DeepEqual(c.Properties, []string{"read", "write", "notify"}) {
+		t.Errorf("characteristic %+v", c)
+	}
+	if len(c.Descriptors) != 2 || c.Descriptors[0].Value != "Counter" || c.Descriptors[1].Hex != "06000027010000" {
+		t.Errorf("descriptors %+v", c.Descriptors)
+	}
+}
+
+func TestProfileErrors(t *testing.T) {
+	for _, m := range []string{
+		"services: [{uuid: 180a, unknown: 1}]",
+		"services: [{uuid: xyz}]",
+		"services: [{uuid: 180a, characteristics: [{uuid: 2a29, properties: [fly]}]}]",
+		"services: [{uuid: 180a, characteristics: [{uuid: 2a29, value: a, hex: '61'}]}]",
+		"services: [{uuid: 180a, characteristics: [{uuid: 2a29, value: abc, maxLength: 2}]}]",
+		"services: [{uuid: 180a, characteristics: [{uuid: 2a29, descriptors: [{uuid: 2902}]}]}]",
+		"services: [{uuid: 180a, includes: [180f]}, {uuid: 180f}]",
+		"services: [{id: a, uuid: 180a}, {id: a, uuid: 180f}]",
+		"services: [{uuid: 180a, handle: 5}, {uuid: 180f, handle: 4}]",
+	} {
+		p, err := ParseProfile([]byte(m))
+		if err == nil {
+			_, err = p.Build(nil)
+		}
+		if err == nil {
+			t.Errorf("%s: accepted", m)
+		}
+	}
+}
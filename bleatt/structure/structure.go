@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"sync"
 
+	hciconnmgr "github.com/BertoldVdb/go-ble/hci/connmgr"
 	bleutil "github.com/BertoldVdb/go-ble/util"
 )
 
@@ -22,6 +23,7 @@ type Structure struct {
 	clientNotifyMap   map[uint16](ClientNotifyHandler)
 
 	services []*Service
+	removed  []*Service
 	exported *ExportedStructure
 }
 
@@ -30,6 +32,18 @@ type Service struct {
 	parent          *Structure
 	uuid            bleutil.UUID
 	characteristics []*Characteristic
+
+	includes       []*Service
+	includeHandles []*GATTHandle
+
+	/* Requested first handle, see SetHandleHint */
+	handleHint uint16
+
+	/* Position in the exported structure */
+	exported    bool
+	modified    bool
+	handleStart uint16
+	handleEnd   uint16
 }
 
 type Characteristic struct {
@@ -39,8 +53,10 @@ type Characteristic struct {
 	initialValue []byte
 
 	valueConfig ValueConfig
+	descriptors []*Descriptor
 
 	valueIsNext bool
+	removed     bool
 	ValueHandle *GATTHandle
 }
 
@@ -50,6 +66,22 @@ type ValueConfig struct {
 	ValueWriteCb      func(h *GATTHandle) error
 	LengthFixed       bool
 	LengthMax         uint16
+
+	/* AuthorizeCb is asked before a client reads or writes the value, the
+	   client gets an insufficient authorization error if it returns false */
+	AuthorizeCb func(req AccessRequest) bool
+}
+
+// AccessRequest describes a read or write of a client, it is given to authorization callbacks
+type AccessRequest struct {
+	Handle *GATTHandle
+	Write  bool
+
+	/* The identity address of the peer and the security of the link */
+	Peer          bleutil.BLEAddr
+	Encrypted     bool
+	Authenticated bool
+	Bonded        bool
 }
 
 func NewStructure() *Structure {
@@ -66,6 +98,136 @@ func (s *Structure) AddPrimaryService(uuid bleutil.UUID) *Service {
 	return p
 }
 
+// AddSecondaryService adds a service that is only meant to be included by other services
+func (s *Structure) AddSecondaryService(uuid bleutil.UUID) *Service {
+	p := &Service{
+		parent: s,
+		uuid:   uuid,
+	}
+	s.services = append(s.services, p)
+	return p
+}
+
+// RemoveService removes a service and all its characteristics. If the structure was exported
+// the change becomes visible when Update is called
+func (s *Structure) RemoveService(p *Service) error {
+	for i, m := range s.services {
+		if m != p {
+			continue
+		}
+
+		s.services = append(s.services[:i:i], s.services[i+1:]...)
+		for _, c := range p.characteristics {
+			c.removed = true
+		}
+		for _, m := range s.services {
+			m.removeInclude(p)
+		}
+		if p.exported {
+			s.removed = append(s.removed, p)
+		}
+		return nil
+	}
+
+	return errors.New("Service not found")
+}
+
+// Update applies all changes made after the structure was exported. Services that were not
+// modified keep their handles, new and modified services are given the first free range that
+// fits them, reusing the handles of removed services. Clients are informed about the modified range
+func (s *Structure) Update(ctx context.Context) error {
+	e := s.exported
+	if e == nil {
+		return nil
+	}
+
+	e.Lock()
+
+	/* Services that include a moved service need new include declarations */
+	for again := true; again; {
+		again = false
+		for _, p := range s.services {
+			if !p.exported || p.modified {
+				continue
+			}
+			for _, m := range p.includes {
+				if !m.exported || m.modified {
+					p.modified = true
+					again = true
+					break
+				}
+			}
+		}
+	}
+
+	/* The ranges of removed and modified services are free again */
+	moving := append([]*Service{}, s.removed...)
+	for _, p := range s.services {
+		if p.exported && p.modified {
+			moving = append(moving, p)
+		}
+	}
+	used := e.usedRanges(func(handle uint16) bool {
+		for _, p := range moving {
+			if handle >= p.handleStart && handle <= p.handleEnd {
+				return true
+			}
+		}
+		return false
+	})
+
+	starts := make(map[*Service]uint16)
+	for _, p := range s.services {
+		if p.exported && !p.modified {
+			continue
+		}
+		var start uint16
+		used, start = allocateRange(used, p.handleCount(), p.handleHint)
+		if start == 0 {
+			e.Unlock()
+			return errors.New("No free handles left")
+		}
+		starts[p] = start
+	}
+
+	start, end := uint16(0xFFFF), uint16(0)
+	changed := func(p *Service) {
+		if p.handleStart < start {
+			start = p.handleStart
+		}
+		if p.handleEnd > end {
+			end = p.handleEnd
+		}
+	}
+
+	for _, p := range s.removed {
+		e.removeHandles(p.handleStart, p.handleEnd)
+		changed(p)
+		p.exported = false
+	}
+	s.removed = nil
+
+	for _, p := range s.services {
+		if p.exported && !p.modified {
+			continue
+		}
+		if p.exported {
+			e.removeHandles(p.handleStart, p.handleEnd)
+			changed(p)
+		}
+		e.appendService(p, starts[p])
+		changed(p)
+	}
+	s.resolveIncludes()
+
+	e.Unlock()
+
+	if end == 0 || e.HandlesChanged == nil {
+		return nil
+	}
+	return e.HandlesChanged(ctx, start, end)
+}
+
 func (s *Structure) GetServices() []*Service {
 	return s.services
 }
@@ -79,6 +241,58 @@ func (s *Structure) GetService(uuid bleutil.UUID) *Service {
 	return nil
 }
 
+// Include references other from this service. Both services must be part of the same structure
+func (p *Service) Include(other *Service) error {
+	if other == p || other.parent != p.parent {
+		return errors.New("Service cannot be included")
+	}
+	for _, m := range p.includes {
+		if m == other {
+			return nil
+		}
+	}
+
+	p.includes = append(p.includes, other)
+	p.modified = true
+	return nil
+}
+
+func (p *Service) removeInclude(other *Service) {
+	for i, m := range p.includes {
+		if m == other {
+			p.includes = append(p.includes[:i:i], p.includes[i+1:]...)
+			p.modified = true
+			return
+		}
+	}
+}
+
+func (p *Service) GetIncludedServices() []*Service {
+	return p.includes
+}
+
+func (p *Service) IsPrimary() bool {
+	return p.isPrimary
+}
+
+func (p *Service) GetUUID() bleutil.UUID {
+	return p.uuid
+}
+
+// SetHandleHint asks for the service declaration to be placed at handle when the service is
+// exported. The hint is ignored if lower handles are already in use.
+func (p *Service) SetHandleHint(handle uint16) {
+	p.handleHint = handle
+}
+
+// GetHandle returns the handle of the service declaration, or zero if it is not known
+func (p *Service) GetHandle() uint16 {
+	if p.exported || p.parent.isClient {
+		return p.handleStart
+	}
+	return 0
+}
+
 func (p *Service) AddCharacteristic(uuid bleutil.UUID, flags CharacteristicFlag, valueConfig ValueConfig) *Characteristic {
 	c := &Characteristic{
 		parent: p,
@@ -89,6 +303,7 @@ func (p *Service) AddCharacteristic(uuid bleutil.UUID, flags CharacteristicFlag,
 	}
 
 	p.characteristics = append(p.characteristics, c)
+	p.modified = true
 
 	return c
 }
@@ -99,6 +314,21 @@ func (p *Service) AddCharacteristicReadOnly(uuid bleutil.UUID, value []byte) *Ch
 	return c
 }
 
+// RemoveCharacteristic removes a characteristic from the service. If the structure was exported
+// the change becomes visible when Update is called
+func (p *Service) RemoveCharacteristic(c *Characteristic) error {
+	for i, m := range p.characteristics {
+		if m == c {
+			p.characteristics = append(p.characteristics[:i:i], p.characteristics[i+1:]...)
+			p.modified = true
+			c.removed = true
+			return nil
+		}
+	}
+
+	return errors.New("Characteristic not found")
+}
+
 func (p *Service) GetCharacteristics() []*Characteristic {
 	return p.characteristics
 }
@@ -130,6 +360,16 @@ type GATTHandle struct {
 	CCCHandle *GATTHandle
 }
 
+/* NotifyResult describes the delivery of a value update to one subscribed client */
+type NotifyResult struct {
+	Conn       hciconnmgr.BufferConn
+	Indication bool
+	Bytes      int
+	Err        error
+}
+
+// SetValue updates the value and notifies all subscribed clients. The returned length is the
+// smallest number of bytes that reached every peer, or -1 if nobody is connected
 func (c *Characteristic) SetValue(ctx context.Context, new []byte) (int, error) {
 	if c.parent.parent.isClient {
 		useAck := c.flags&CharacteristicWriteAck > 0
@@ -137,6 +377,50 @@ func (c *Characteristic) SetValue(ctx context.Context, new []byte) (int, error)
 		return c.parent.parent.clientWrite(ctx, c.ValueHandle.Info.Handle, new, useAck)
 	}
 
+	results, err := c.SetValueResults(ctx, new)
+	if err != nil || results == nil {
+		return -1, err
+	}
+
+	bytes := -1
+	var firstErr error
+	for _, m := range results {
+		if m.Err != nil {
+			if firstErr == nil {
+				firstErr = m.Err
+			}
+			continue
+		}
+		if bytes < 0 || m.Bytes < bytes {
+			bytes = m.Bytes
+		}
+	}
+
+	/* Only fail if not a single peer was reached */
+	if bytes < 0 {
+		if firstErr != nil {
+			return -1, firstErr
+		}
+		bytes = 0
+	}
+
+	return bytes, nil
+}
+
+// SetValueResults updates the value of a local characteristic and returns the delivery
+// result for every connection. A nil slice means there is no connection at all, an empty
+// slice means nobody is subscribed
+func (c *Characteristic) SetValueResults(ctx context.Context, new []byte) ([]NotifyResult, error) {
+	if c.parent.parent.isClient {
+		return nil, errors.New("Invalid mode")
+	}
+	if c.removed {
+		return nil, errors.New("Characteristic was removed")
+	}
+	if c.ValueHandle == nil {
+		return nil, errors.New("Characteristic is not exported")
+	}
+
 	e := c.parent.parent.exported
 	e.Lock()
 
@@ -148,7 +432,11 @@ func (c *Characteristic) SetValue(ctx context.Context, new []byte) (int, error)
 
 	e.Unlock()
 
-	return e.HandleSet(c, new)
+	if e.HandleSet == nil {
+		return nil, nil
+	}
+
+	return e.HandleSet(ctx, c, new)
 }
 
 func (c *Characteristic) GetValue(ctx context.Context, buf []byte) ([]byte, error) {
@@ -209,7 +497,7 @@ func (c *Characteristic) Subscribe(ctx context.Context, handler ClientNotifyHand
 	return nil
 }
 
-func (s Structure) String() string {
+func (s *Structure) String() string {
 	result := ""
 	ln := func(format string, a ...interface{}) {
 		newLine := fmt.Sprintln()
@@ -217,7 +505,14 @@ func (s Structure) String() string {
 	}
 
 	for _, m := range s.services {
-		ln("%v:", m.uuid)
+		if m.isPrimary {
+			ln("%v:", m.uuid)
+		} else {
+			ln("%v (secondary):", m.uuid)
+		}
+		for _, k := range m.includes {
+			ln(" Includes %v", k.uuid)
+		}
 		for _, k := range m.characteristics {
 			ln(" %v (%02x):", k.uuid, k.flags)
 			if k.ValueHandle != nil {
@@ -226,6 +521,11 @@ func (s Structure) String() string {
 					ln("   CCCHandle: %04x", k.ValueHandle.CCCHandle.Info.Handle)
 				}
 			}
+			for _, d := range k.descriptors {
+				if d.Handle != nil {
+					ln("   %v: %04x", d.uuid, d.Handle.Info.Handle)
+				}
+			}
 		}
 	}
 
@@ -0,0 +1,49 @@
+package attstructure
+
+import "context"
+
+// TypedCharacteristic reads and writes a characteristic through a codec. It works on local
+// structures and on structures imported from a peer.
+type TypedCharacteristic[T any] struct {
+	*Characteristic
+	Codec Codec[T]
+}
+
+func NewTypedCharacteristic[T any](c *Characteristic, codec Codec[T]) *TypedCharacteristic[T] {
+	return &TypedCharacteristic[T]{
+		Characteristic: c,
+		Codec:          codec,
+	}
+}
+
+func (t *TypedCharacteristic[T]) Get(ctx context.Context) (T, error) {
+	value, err := t.GetValue(ctx, nil)
+	if err != nil {
+		var empty T
+		return empty, err
+	}
+
+	return t.Codec.Decode(value)
+}
+
+// Set encodes the value and calls SetValue
+func (t *TypedCharacteristic[T]) Set(ctx context.Context, value T) (int, error) {
+	b, err := t.Codec.Encode(value)
+	if err != nil {
+		return 0, err
+	}
+
+	return t.SetValue(ctx, b)
+}
+
+// SubscribeValue is Subscribe with decoded values. Values that can not be decoded are passed
+// with their error.
+func (t *TypedCharacteristic[T]) SubscribeValue(ctx context.Context, handler func(value T, err error)) error {
+	if handler == nil {
+		return t.Subscribe(ctx, nil)
+	}
+
+	return t.Subscribe(ctx, func(value []byte) {
+		handler(t.Codec.Decode(value))
+	})
+}
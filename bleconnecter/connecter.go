@@ -43,6 +43,9 @@ type BLEConnecter struct {
 
 	roles [2]BLEConnectionRole
 
+	/* Set by Run before the connect calls are activated */
+	extendedConnect bool
+
 	/* Bounded queue of pending HCI replies to peer-issued events
 	   (param-update requests, etc). Replacing per-event `go func()`
 	   spawn so a peer flooding requests cannot exhaust goroutines. */
@@ -203,6 +206,8 @@ func (c *BLEConnecter) Run() error {
 		c.logger.WithError(err).Warn("Failed to register LEConnectionUpdateComplete callback")
 	}
 
+	c.extendedConnect = c.ctrl.UseExtendedAdvertising()
+
 	/* Activate the connect calls */
 	for i := range c.roles {
 		c.roles[i].singleChan <- struct{}{}
@@ -311,21 +316,23 @@ func (c *BLEConnecter) Connect(ctx context.Context, isCentral bool, peerAddrs []
 			}
 		}
 
-		param := hcicommands.LECreateConnectionInput{
-			LEScanInterval:        0x10, /* Scan all the time */
-			LEScanWindow:          0x10,
-			InitiatorFilterPolicy: 1, /* Use allowlist */
-			OwnAddressType:        conn.ownAddrType,
-
-			ConnectionIntervalMin: request.ConnectionIntervalMin,
-			ConnectionIntervalMax: request.ConnectionIntervalMax,
-			ConnectionLatency:     request.ConnectionLatency,
-			SupervisionTimeout:    request.SupervisionTimeout,
-			MinCELength:           request.MinCELength,
-			MaxCELength:           request.MaxCELength,
+		if c.extendedConnect {
+			err = c.ctrl.Cmds.LEExtendedCreateConnectionSync(extendedCreateConnectionInput(conn.ownAddrType, request))
+		} else {
+			err = c.ctrl.Cmds.LECreateConnectionSync(hcicommands.LECreateConnectionInput{
+				LEScanInterval:        0x10, /* Scan all the time */
+				LEScanWindow:          0x10,
+				InitiatorFilterPolicy: 1, /* Use allowlist */
+				OwnAddressType:        conn.ownAddrType,
+
+				ConnectionIntervalMin: request.ConnectionIntervalMin,
+				ConnectionIntervalMax: request.ConnectionIntervalMax,
+				ConnectionLatency:     request.ConnectionLatency,
+				SupervisionTimeout:    request.SupervisionTimeout,
+				MinCELength:           request.MinCELength,
+				MaxCELength:           request.MaxCELength,
+			})
 		}
-
-		err = c.ctrl.Cmds.LECreateConnectionSync(param)
 		if err != nil {
 			stopPeer()
 			return nil, peerAddrs, err
@@ -367,7 +374,7 @@ func (c *BLEConnecter) Connect(ctx context.Context, isCentral bool, peerAddrs []
 	if conn.event == nil {
 		c.logger.WithError(err).WithField("0addr", conn.peerAddr).Debug("No event received, cancelling")
 
-		/* This can fail, log error but don't act on it */
+		/* This can fail, log error but don't act on it. The cancel command is used for both create commands. */
 		if peerAddrs != nil && conn.isCentral {
 			c.ctrl.Cmds.LECreateConnectionCancelSync()
 		}
@@ -417,6 +424,24 @@ func (c *BLEConnecter) Connect(ctx context.Context, isCentral bool, peerAddrs []
 	return conn, peerAddrs, nil
 }
 
+// extendedCreateConnectionInput initiates on the 1M PHY with the same parameters as the legacy command
+func extendedCreateConnectionInput(ownAddrType bleutil.MacAddrType, request BLEConnectionParametersRequested) hcicommands.LEExtendedCreateConnectionInput {
+	return hcicommands.LEExtendedCreateConnectionInput{
+		InitiatingFilterPolicy: 1, /* Use allowlist */
+		OwnAddressType:         ownAddrType,
+		InitiatingPHYs:         1,
+
+		ScanInterval:          []uint16{0x10}, /* Scan all the time */
+		ScanWindow:            []uint16{0x10},
+		ConnectionIntervalMin: []uint16{request.ConnectionIntervalMin},
+		ConnectionIntervalMax: []uint16{request.ConnectionIntervalMax},
+		ConnectionLatency:     []uint16{request.ConnectionLatency},
+		SupervisionTimeout:    []uint16{request.SupervisionTimeout},
+		MinCELength:           []uint16{request.MinCELength},
+		MaxCELength:           []uint16{request.MaxCELength},
+	}
+}
+
 func (c *BLEConnection) IsCentral() bool {
 	return c.isCentral
 }
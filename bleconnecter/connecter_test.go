@@ -125,3 +125,27 @@ func TestBLEConnectionRemoteAddr(t *testing.T) {
 		t.Errorf("Network: got %q want BLE", got.Network())
 	}
 }
+
+// The extended command carries one parameter set per initiating PHY
+func TestExtendedCreateConnectionInput(t *testing.T) {
+	r := BLEConnectionParametersRequested{
+		ConnectionIntervalMin: 0x18,
+		ConnectionIntervalMax: 0x28,
+		ConnectionLatency:     2,
+		SupervisionTimeout:    0x100,
+	}
+	in := extendedCreateConnectionInput(bleutil.MacAddrRandom, r)
+
+	if in.InitiatingPHYs != 1 || in.InitiatingFilterPolicy != 1 || in.OwnAddressType != bleutil.MacAddrRandom {
+		t.Errorf("input %+v", in)
+	}
+	for _, m := range [][]uint16{in.ScanInterval, in.ScanWindow, in.ConnectionIntervalMin, in.ConnectionIntervalMax,
+		in.ConnectionLatency, in.SupervisionTimeout, in.MinCELength, in.MaxCELength} {
+		if len(m) != 1 {
+			t.Fatalf("input %+v", in)
+		}
+	}
+	if in.ConnectionIntervalMin[0] != 0x18 || in.ConnectionIntervalMax[0] != 0x28 || in.ConnectionLatency[0] != 2 || in.SupervisionTimeout[0] != 0x100 {
+		t.Errorf("parameters %+v", in)
+	}
+}
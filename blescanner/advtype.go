@@ -8,6 +8,10 @@ const (
 	EventTypeScanInd    EventType = 2
 	EventTypeNonConnInd EventType = 3
 	EventTypeScanRsp    EventType = 4
+
+	/* Extended advertising PDUs that have no legacy equivalent */
+	EventTypeExtended        EventType = 5
+	EventTypeExtendedScanRsp EventType = 6
 )
 
 func (a EventType) String() string {
@@ -22,6 +26,10 @@ func (a EventType) String() string {
 		return "ADV_NONCONN_IND"
 	case EventTypeScanRsp:
 		return "SCAN_RSP"
+	case EventTypeExtended:
+		return "ADV_EXT_IND"
+	case EventTypeExtendedScanRsp:
+		return "AUX_SCAN_RSP"
 	}
 
 	return "Invalid"
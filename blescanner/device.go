@@ -27,6 +27,11 @@ type BLEDevice struct {
 	lastConnectable time.Time
 	lastSeenDev     time.Time
 
+	primaryPHY       uint8
+	secondaryPHY     uint8
+	sid              uint8
+	periodicInterval uint16
+
 	gapFields map[uint8]*GAPRecord
 	gapSingle *GAPRecord
 
@@ -68,6 +73,8 @@ func (s *BLEScanner) getDevice(addr bleutil.BLEAddr, create bool) (*BLEDevice, b
 		txPower:     -128,
 		lastSeen:    now,
 		lastSeenDev: now,
+		primaryPHY:  1,
+		sid:         0xFF,
 	}
 
 	if device.scanner.config.StoreGAPMap {
@@ -162,3 +169,26 @@ func (dev *BLEDevice) SetUpdateCallback(cb DeviceUpdatedCallback) {
 	dev.cb = cb
 	dev.cbMutex.Unlock()
 }
+
+// GetPHY returns the primary and secondary PHY the device was last heard on.
+// The secondary PHY is zero for legacy advertisements.
+func (dev *BLEDevice) GetPHY() (uint8, uint8) {
+	dev.RLock()
+	defer dev.RUnlock()
+	return dev.primaryPHY, dev.secondaryPHY
+}
+
+// GetSID returns the advertising set identifier, if the device uses extended advertising.
+func (dev *BLEDevice) GetSID() (uint8, bool) {
+	dev.RLock()
+	defer dev.RUnlock()
+	return dev.sid, dev.sid <= 0xF
+}
+
+// GetPeriodicAdvertisingInterval returns the interval of the periodic advertising train
+// announced by the device, or zero if there is none.
+func (dev *BLEDevice) GetPeriodicAdvertisingInterval() time.Duration {
+	dev.RLock()
+	defer dev.RUnlock()
+	return time.Duration(dev.periodicInterval) * 1250 * time.Microsecond
+}
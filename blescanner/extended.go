@@ -0,0 +1,186 @@
+package blescanner
+
+import (
+	"time"
+
+	"github.com/BertoldVdb/go-ble/hci"
+	hcicommands "github.com/BertoldVdb/go-ble/hci/commands"
+	hcievents "github.com/BertoldVdb/go-ble/hci/events"
+	deviceinfo "github.com/BertoldVdb/go-ble/hci/information"
+	bleutil "github.com/BertoldVdb/go-ble/util"
+)
+
+const (
+	extendedEventConnectable  = 0x01
+	extendedEventScannable    = 0x02
+	extendedEventDirected     = 0x04
+	extendedEventScanResponse = 0x08
+	extendedEventLegacy       = 0x10
+
+	extendedDataComplete   = 0
+	extendedDataIncomplete = 1
+
+	/* Limits for the reassembly of fragmented advertising data */
+	extendedReassemblyMaxData   = 1650
+	extendedReassemblyMaxChains = 16
+	extendedReassemblyTimeout   = 2 * time.Second
+)
+
+type extendedChainKey struct {
+	addr    uint64
+	sid     uint8
+	scanRsp bool
+}
+
+type extendedChain struct {
+	data       []byte
+	lastUpdate time.Time
+}
+
+func eventTypeFromExtended(props uint16) EventType {
+	if props&extendedEventLegacy > 0 {
+		switch props & 0x1F {
+		case 0x13:
+			return EventTypeInd
+		case 0x15:
+			return EventTypeDirectInd
+		case 0x12:
+			return EventTypeScanInd
+		case 0x10:
+			return EventTypeNonConnInd
+		case 0x1A, 0x1B:
+			return EventTypeScanRsp
+		}
+	}
+
+	if props&extendedEventScanResponse > 0 {
+		return EventTypeExtendedScanRsp
+	}
+
+	return EventTypeExtended
+}
+
+func (s *BLEScanner) configureExtendedScan(scanType int) error {
+	s.ctrl.Cmds.LESetExtendedScanEnableSync(hcicommands.LESetExtendedScanEnableInput{
+		Enable: 0,
+	})
+
+	if scanType < 0 {
+		return nil
+	}
+
+	params := hcicommands.LESetExtendedScanParametersInput{
+		OwnAddressType:       s.ctrl.GetLERecommenedOwnAddrType(hci.LEAddrUsageScan),
+		ScanningFilterPolicy: 0,
+		ScanningPHYs:         1, /* LE 1M */
+	}
+	if s.config.ScanCodedPHY && s.ctrl.Info.LEFeatureSupported(deviceinfo.LEFeatureCodedPHY) {
+		params.ScanningPHYs |= 4
+	}
+
+	leScanType := uint8(0)
+	if scanType >= 1 {
+		leScanType = 1
+	}
+	for i := 0; i < bleutil.CountSetBits(uint64(params.ScanningPHYs)); i++ {
+		params.ScanType = append(params.ScanType, leScanType)
+		params.ScanInterval = append(params.ScanInterval, s.config.LEScanInterval)
+		params.ScanWindow = append(params.ScanWindow, s.config.LEScanWindow)
+	}
+
+	err := s.ctrl.Cmds.LESetExtendedScanParametersSync(params)
+	if err != nil {
+		return err
+	}
+
+	return s.ctrl.Cmds.LESetExtendedScanEnableSync(hcicommands.LESetExtendedScanEnableInput{
+		Enable: 1,
+	})
+}
+
+// Collects the fragments of an advertising data chain. Returns the merged data once the
+// chain is complete or truncated by the controller
+func (s *BLEScanner) extendedReassemble(key extendedChainKey, status uint16, fragment []byte, now time.Time) ([]byte, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	chain := s.extendedChains[key]
+	if chain == nil {
+		if status != extendedDataIncomplete {
+			return fragment, true
+		}
+
+		if s.extendedChains == nil {
+			s.extendedChains = make(map[extendedChainKey]*extendedChain)
+		}
+
+		if len(s.extendedChains) >= extendedReassemblyMaxChains {
+			for i, m := range s.extendedChains {
+				if now.Sub(m.lastUpdate) > extendedReassemblyTimeout {
+					delete(s.extendedChains, i)
+				}
+			}
+
+			/* Avoid DoS by someone spamming unfinished chains */
+			if len(s.extendedChains) >= extendedReassemblyMaxChains {
+				return nil, false
+			}
+		}
+
+		chain = &extendedChain{}
+		s.extendedChains[key] = chain
+	}
+
+	room := extendedReassemblyMaxData - len(chain.data)
+	if len(fragment) > room {
+		fragment = fragment[:room]
+	}
+	chain.data = append(chain.data, fragment...)
+	chain.lastUpdate = now
+
+	if status == extendedDataIncomplete {
+		return nil, false
+	}
+
+	delete(s.extendedChains, key)
+	return chain.data, true
+}
+
+func (s *BLEScanner) handleExtendedScanResult(ad *hcievents.LEExtendedAdvertisingReportEvent) *hcievents.LEExtendedAdvertisingReportEvent {
+	now := time.Now()
+
+	for i := 0; i < int(ad.NumReports); i++ {
+		bleaddr := bleutil.BLEAddr{
+			MacAddr:     ad.Address[i],
+			MacAddrType: ad.AddressType[i],
+		}
+
+		props := ad.EventType[i]
+		status := (props >> 5) & 3
+
+		data, complete := s.extendedReassemble(extendedChainKey{
+			addr:    bleaddr.GetUint64(),
+			sid:     ad.AdvertisingSID[i],
+			scanRsp: props&extendedEventScanResponse > 0,
+		}, status, ad.Data[i], now)
+		if !complete {
+			continue
+		}
+
+		s.handleReport(now, &BLEAdvertisingReport{
+			Addr:             bleaddr,
+			RSSI:             int8(ad.RSSI[i]),
+			PktType:          eventTypeFromExtended(props),
+			Data:             data,
+			Extended:         true,
+			Connectable:      props&extendedEventConnectable > 0,
+			PrimaryPHY:       ad.PrimaryPHY[i],
+			SecondaryPHY:     ad.SecondaryPHY[i],
+			SID:              ad.AdvertisingSID[i],
+			TXPower:          int8(ad.TXPower[i]),
+			PeriodicInterval: ad.PeriodicAdvertisingInterval[i],
+		})
+	}
+
+	return ad
+}
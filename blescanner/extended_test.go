@@ -0,0 +1,119 @@
+package blescanner
+
+import (
+	"bytes"
+	"testing"
+
+	hcievents "github.com/BertoldVdb/go-ble/hci/events"
+	bleutil "github.com/BertoldVdb/go-ble/util"
+)
+
+func extendedReport(addr bleutil.MacAddr, eventType uint16, sid uint8, data []byte) *hcievents.LEExtendedAdvertisingReportEvent {
+	return &hcievents.LEExtendedAdvertisingReportEvent{
+		NumReports:                  1,
+		EventType:                   []uint16{eventType},
+		AddressType:                 []bleutil.MacAddrType{0},
+		Address:                     []bleutil.MacAddr{addr},
+		PrimaryPHY:                  []uint8{3},
+		SecondaryPHY:                []uint8{2},
+		AdvertisingSID:              []uint8{sid},
+		TXPower:                     []uint8{0xF6},
+		RSSI:                        []uint8{0xCE},
+		PeriodicAdvertisingInterval: []uint16{80},
+		DirectAddressType:           []bleutil.MacAddrType{0},
+		DirectAddress:               []bleutil.MacAddr{0},
+		DataLength:                  []uint8{uint8(len(data))},
+		Data:                        [][]byte{data},
+	}
+}
+
+// TestExtendedReportReassembly checks that a fragmented data chain is
+// delivered once, with all fragments merged.
+func TestExtendedReportReassembly(t *testing.T) {
+	s := New(nil, nil, &BLEScannerConfig{StoreGAPMap: true})
+
+	var reports []*BLEAdvertisingReport
+	s.RegisterAdvertisingReportCallback(func(pkt *BLEAdvertisingReport) bool {
+		r := *pkt
+		r.Data = append([]byte{}, pkt.Data...)
+		reports = append(reports, &r)
+		return false
+	})
+
+	first := []byte{0x02, 0x01, 0x06, 0x05, 0x09, 'a'}
+	second := []byte{'b', 'c', 'd'}
+
+	s.handleExtendedScanResult(extendedReport(0x010203040506, 0x21, 4, first))
+	if len(reports) != 0 {
+		t.Fatal("Incomplete chain was delivered")
+	}
+	s.handleExtendedScanResult(extendedReport(0x010203040506, 0x01, 4, second))
+	if len(reports) != 1 {
+		t.Fatalf("Got %d reports, want 1", len(reports))
+	}
+
+	r := reports[0]
+	if !bytes.Equal(r.Data, append(first, second...)) {
+		t.Errorf("Merged data is %x", r.Data)
+	}
+	if !r.Extended || !r.Connectable || r.PktType != EventTypeExtended || r.SID != 4 || r.TXPower != -10 {
+		t.Errorf("Unexpected report fields: %+v", r)
+	}
+
+	dev := s.GetDevice(r.Addr)
+	if dev == nil {
+		t.Fatal("Device was not created")
+	}
+	if primary, secondary := dev.GetPHY(); primary != 3 || secondary != 2 {
+		t.Errorf("Got PHY %d/%d", primary, secondary)
+	}
+	if sid, ok := dev.GetSID(); !ok || sid != 4 {
+		t.Errorf("Got SID %d (%v)", sid, ok)
+	}
+	if name := dev.GetName(); name != "abcd" {
+		t.Errorf("Got name %q", name)
+	}
+}
+
+// TestExtendedReassemblyLimit verifies that chains are capped at the
+// maximum extended advertising data length.
+func TestExtendedReassemblyLimit(t *testing.T) {
+	s := New(nil, nil, &BLEScannerConfig{})
+
+	var got []byte
+	s.RegisterAdvertisingReportCallback(func(pkt *BLEAdvertisingReport) bool {
+		got = append([]byte{}, pkt.Data...)
+		return false
+	})
+
+	fragment := make([]byte, 229)
+	for i := 0; i < 10; i++ {
+		s.handleExtendedScanResult(extendedReport(0x010203040506, 0x20, 1, fragment))
+	}
+	s.handleExtendedScanResult(extendedReport(0x010203040506, 0x40, 1, fragment))
+
+	if len(got) != extendedReassemblyMaxData {
+		t.Fatalf("Got %d bytes, want %d", len(got), extendedReassemblyMaxData)
+	}
+}
+
+// TestEventTypeFromExtended checks the mapping of legacy PDUs received
+// through the extended report event.
+func TestEventTypeFromExtended(t *testing.T) {
+	cases := map[uint16]EventType{
+		0x13: EventTypeInd,
+		0x15: EventTypeDirectInd,
+		0x12: EventTypeScanInd,
+		0x10: EventTypeNonConnInd,
+		0x1B: EventTypeScanRsp,
+		0x1A: EventTypeScanRsp,
+		0x01: EventTypeExtended,
+		0x0A: EventTypeExtendedScanRsp,
+	}
+
+	for in, want := range cases {
+		if got := eventTypeFromExtended(in); got != want {
+			t.Errorf("eventTypeFromExtended(%x) = %v, want %v", in, got, want)
+		}
+	}
+}
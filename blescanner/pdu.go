@@ -13,6 +13,15 @@ type BLEAdvertisingReport struct {
 	RSSI    int8
 	PktType EventType
 	Data    []byte
+
+	/* Only filled in for extended advertising reports */
+	Extended         bool
+	Connectable      bool
+	PrimaryPHY       uint8
+	SecondaryPHY     uint8
+	SID              uint8
+	TXPower          int8
+	PeriodicInterval uint16
 }
 
 func (dev *BLEDevice) handlePDU(event EventType, data []byte) {
@@ -61,73 +70,84 @@ func (s *BLEScanner) handleScanResult(ad *hcievents.LEAdvertisingReportEvent) *h
 	now := time.Now()
 
 	for i := 0; i < int(ad.NumReports); i++ {
-		bleaddr := bleutil.BLEAddr{
-			MacAddr:     ad.Address[i],
-			MacAddrType: ad.AddressType[i],
-		}
-
 		event := EventType(ad.EventType[i])
 
-		pkt := BLEAdvertisingReport{
-			Addr:    bleaddr,
-			RSSI:    int8(ad.RSSI[i]),
-			PktType: event,
-			Data:    ad.Data[i],
-		}
+		s.handleReport(now, &BLEAdvertisingReport{
+			Addr: bleutil.BLEAddr{
+				MacAddr:     ad.Address[i],
+				MacAddrType: ad.AddressType[i],
+			},
+			RSSI:        int8(ad.RSSI[i]),
+			PktType:     event,
+			Data:        ad.Data[i],
+			Connectable: event == EventTypeInd || event == EventTypeDirectInd,
+			TXPower:     127,
+		})
+	}
+	return ad
+}
 
-		skip := false
+func (s *BLEScanner) handleReport(now time.Time, pkt *BLEAdvertisingReport) {
+	skip := false
 
-		/* Snapshot the callback list so callbacks can safely re-enter
-		   scanner methods (the previous design held s.Lock() across the
-		   callback call, which would deadlock if the user touched the
-		   scanner from inside the callback). */
-		s.Lock()
-		cbs := append([]registeredAdvReportCB(nil), s.advertisingReportCallbacks...)
-		s.Unlock()
+	/* Snapshot the callback list so callbacks can safely re-enter
+	   scanner methods (the previous design held s.Lock() across the
+	   callback call, which would deadlock if the user touched the
+	   scanner from inside the callback). */
+	s.Lock()
+	cbs := append([]registeredAdvReportCB(nil), s.advertisingReportCallbacks...)
+	s.Unlock()
 
-		for _, m := range cbs {
-			if skip = m.cb(&pkt); skip {
-				break
-			}
-		}
-		if skip {
-			continue
+	for _, m := range cbs {
+		if skip = m.cb(pkt); skip {
+			break
 		}
+	}
+	if skip {
+		return
+	}
 
-		dev, isNew := s.getDevice(bleaddr, true)
-		if dev == nil {
-			continue
-		}
+	dev, isNew := s.getDevice(pkt.Addr, true)
+	if dev == nil {
+		return
+	}
 
-		dev.Lock()
-		dev.lastSeenDev = now
-		if event == EventTypeInd || event == EventTypeDirectInd {
-			dev.lastConnectable = now
+	dev.Lock()
+	dev.lastSeenDev = now
+	if pkt.Connectable {
+		dev.lastConnectable = now
+	}
+	dev.rssi = pkt.RSSI
+	if pkt.Extended {
+		dev.primaryPHY = pkt.PrimaryPHY
+		dev.secondaryPHY = pkt.SecondaryPHY
+		dev.sid = pkt.SID
+		dev.periodicInterval = pkt.PeriodicInterval
+		if pkt.TXPower != 127 {
+			dev.txPower = pkt.TXPower
 		}
-		dev.rssi = int8(ad.RSSI[i])
-		dev.handlePDU(event, ad.Data[i])
-
-		if s.logger != nil {
-			if isNew {
-				s.logger.WithFields(logrus.Fields{
-					"0addr": dev.addr,
-					"1rssi": dev.rssi,
-				}).Info("Found new device")
-
-			} else if s.logger.Logger.IsLevelEnabled(logrus.TraceLevel) {
-				s.logger.WithFields(logrus.Fields{
-					"0addr": dev.addr,
-					"1rssi": dev.rssi,
-				}).Trace("Device updated")
-			}
+	}
+	dev.handlePDU(pkt.PktType, pkt.Data)
+
+	if s.logger != nil {
+		if isNew {
+			s.logger.WithFields(logrus.Fields{
+				"0addr": dev.addr,
+				"1rssi": dev.rssi,
+			}).Info("Found new device")
+
+		} else if s.logger.Logger.IsLevelEnabled(logrus.TraceLevel) {
+			s.logger.WithFields(logrus.Fields{
+				"0addr": dev.addr,
+				"1rssi": dev.rssi,
+			}).Trace("Device updated")
 		}
+	}
 
-		dev.Unlock()
+	dev.Unlock()
 
-		/* Invoke user-update callbacks after the device write lock has
-		   been released; otherwise, callbacks that call self-locking
-		   getters on the same goroutine would deadlock. */
-		dev.signalUpdatedCallbacks()
-	}
-	return ad
+	/* Invoke user-update callbacks after the device write lock has
+	   been released; otherwise, callbacks that call self-locking
+	   getters on the same goroutine would deadlock. */
+	dev.signalUpdatedCallbacks()
 }
@@ -0,0 +1,399 @@
+package blescanner
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	hcicommands "github.com/BertoldVdb/go-ble/hci/commands"
+	hcievents "github.com/BertoldVdb/go-ble/hci/events"
+	deviceinfo "github.com/BertoldVdb/go-ble/hci/information"
+	bleutil "github.com/BertoldVdb/go-ble/util"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	ErrorPeriodicUnsupported = errors.New("Controller does not support periodic advertising")
+	ErrorPeriodicNoSID       = errors.New("Device is not advertising with an advertising SID")
+	ErrorPeriodicSyncLost    = errors.New("Periodic advertising sync lost")
+	ErrorPeriodicSyncClosed  = errors.New("Periodic advertising sync closed")
+)
+
+const (
+	periodicDataIncomplete = 1
+
+	/* How long to wait for the controller to confirm a cancelled sync */
+	periodicCancelTimeout = time.Second
+)
+
+// PeriodicAdvertisingReport contains the (reassembled) data of one periodic advertising event
+type PeriodicAdvertisingReport struct {
+	Sync    *PeriodicSync
+	TXPower int8
+	RSSI    int8
+	CTEType uint8
+	Data    []byte
+}
+
+type PeriodicAdvertisingReportCallback func(*PeriodicAdvertisingReport)
+
+type PeriodicSyncConfig struct {
+	/* Number of periodic advertising events that may be skipped */
+	Skip uint16
+
+	/* Supervision timeout of the sync, defaults to 2 seconds */
+	Timeout time.Duration
+
+	/* If Callback is set it is called from the event goroutine for every report,
+	   otherwise reports are delivered through the Reports() channel */
+	Callback    PeriodicAdvertisingReportCallback
+	ChannelSize int
+}
+
+// PeriodicSync represents a synchronization with the periodic advertising train of a remote device
+type PeriodicSync struct {
+	scanner *BLEScanner
+
+	addr     bleutil.BLEAddr
+	sid      uint8
+	handle   uint16
+	phy      uint8
+	interval uint16
+
+	callback PeriodicAdvertisingReportCallback
+	reports  chan *PeriodicAdvertisingReport
+	data     []byte
+
+	closeOnce sync.Once
+	done      chan struct{}
+	err       error
+}
+
+func (s *BLEScanner) periodicInit() error {
+	s.periodicSupported = s.ctrl.Info.LEFeatureSupported(deviceinfo.LEFeaturePeriodicAdvertising)
+	if !s.periodicSupported {
+		return nil
+	}
+
+	err := s.ctrl.Events.SetLEPeriodicAdvertisingSyncEstablishedEventCallback(s.handlePeriodicSyncEstablished)
+	if err != nil {
+		return err
+	}
+	err = s.ctrl.Events.SetLEPeriodicAdvertisingReportEventCallback(s.handlePeriodicReport)
+	if err != nil {
+		return err
+	}
+	return s.ctrl.Events.SetLEPeriodicAdvertisingSyncLostEventCallback(s.handlePeriodicSyncLost)
+}
+
+// PeriodicSyncCreate synchronizes to the periodic advertising train announced by dev. The scanner
+// must be running, as the controller finds the train through the extended advertisements.
+func (s *BLEScanner) PeriodicSyncCreate(ctx context.Context, dev *BLEDevice, config *PeriodicSyncConfig) (*PeriodicSync, error) {
+	if !s.periodicSupported {
+		return nil, ErrorPeriodicUnsupported
+	}
+
+	sid, ok := dev.GetSID()
+	if !ok {
+		return nil, ErrorPeriodicNoSID
+	}
+
+	if config == nil {
+		config = &PeriodicSyncConfig{}
+	}
+
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = 2 * time.Second
+	}
+	timeout10ms := timeout / (10 * time.Millisecond)
+	if timeout10ms < 0xA {
+		timeout10ms = 0xA
+	} else if timeout10ms > 0x4000 {
+		timeout10ms = 0x4000
+	}
+
+	/* The controller only allows one pending sync at a time */
+	s.periodicCreateMutex.Lock()
+	defer s.periodicCreateMutex.Unlock()
+
+	addr := dev.GetAddr()
+	p := &PeriodicSync{
+		scanner:  s,
+		addr:     addr,
+		callback: config.Callback,
+		done:     make(chan struct{}),
+	}
+
+	if p.callback == nil {
+		size := config.ChannelSize
+		if size <= 0 {
+			size = 16
+		}
+		p.reports = make(chan *PeriodicAdvertisingReport, size)
+	}
+
+	/* The event handler registers p as soon as the sync is established, so the reports and the
+	   sync lost event that follow it are not missed */
+	result := make(chan *hcievents.LEPeriodicAdvertisingSyncEstablishedEvent, 1)
+	s.Lock()
+	s.periodicPending = p
+	s.periodicResult = result
+	s.periodicAbandoned = false
+	s.Unlock()
+
+	defer func() {
+		s.Lock()
+		s.periodicPending = nil
+		s.periodicResult = nil
+		s.Unlock()
+	}()
+
+	err := s.ctrl.Cmds.LEPeriodicAdvertisingCreateSyncSync(hcicommands.LEPeriodicAdvertisingCreateSyncInput{
+		Options:               0,
+		AdvertisingSID:        sid,
+		AdvertiserAddressType: addr.MacAddrType,
+		AdvertiserAddress:     addr.MacAddr,
+		Skip:                  config.Skip,
+		SyncTimeout:           uint16(timeout10ms),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var event *hcievents.LEPeriodicAdvertisingSyncEstablishedEvent
+	select {
+	case event = <-result:
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-s.close.Chan():
+		err = ErrorPeriodicSyncClosed
+	}
+
+	if event == nil {
+		/* This can fail if the event is already underway, in that case we will still get it */
+		s.ctrl.Cmds.LEPeriodicAdvertisingCreateSyncCancelSync()
+
+		select {
+		case event = <-result:
+		case <-time.After(periodicCancelTimeout):
+		}
+
+		/* The handler sends the result with the lock held, after this it can no longer arrive */
+		s.Lock()
+		s.periodicPending = nil
+		if len(result) == 0 && event == nil {
+			/* A sync the controller still establishes is terminated by the handler */
+			s.periodicAbandoned = true
+		}
+		s.Unlock()
+
+		if event == nil {
+			select {
+			case event = <-result:
+			default:
+			}
+		}
+
+		if event != nil && event.Status == 0 {
+			p.Close()
+		}
+
+		return nil, err
+	}
+
+	if event.Status != 0 {
+		return nil, hcicommands.HciErrorToGo([]byte{event.Status}, nil)
+	}
+
+	if s.logger != nil {
+		s.logger.WithFields(logrus.Fields{
+			"0addr":     addr,
+			"1sid":      p.sid,
+			"2handle":   p.handle,
+			"3interval": p.GetInterval(),
+		}).Info("Periodic advertising sync established")
+	}
+
+	return p, nil
+}
+
+func (s *BLEScanner) handlePeriodicSyncEstablished(event *hcievents.LEPeriodicAdvertisingSyncEstablishedEvent) *hcievents.LEPeriodicAdvertisingSyncEstablishedEvent {
+	s.Lock()
+	defer s.Unlock()
+
+	p := s.periodicPending
+	if p == nil {
+		if s.periodicAbandoned {
+			s.periodicAbandoned = false
+			if event.Status == 0 {
+				/* Commands can not complete while the event goroutine waits for them */
+				go s.periodicTerminateAbandoned(event.SyncHandle)
+			}
+		}
+		return event
+	}
+	s.periodicPending = nil
+
+	if event.Status == 0 {
+		p.sid = event.AdvertisingSID
+		p.handle = event.SyncHandle
+		p.phy = event.AdvertiserPHY
+		p.interval = event.PeriodicAdvertisingInterval
+
+		if s.periodicSyncs == nil {
+			s.periodicSyncs = make(map[uint16]*PeriodicSync)
+		}
+		s.periodicSyncs[p.handle] = p
+	}
+
+	e := *event
+	select {
+	case s.periodicResult <- &e:
+	default:
+	}
+
+	return event
+}
+
+/* Terminates a sync that was established after PeriodicSyncCreate gave up on it */
+func (s *BLEScanner) periodicTerminateAbandoned(handle uint16) {
+	err := s.ctrl.Cmds.LEPeriodicAdvertisingTerminateSyncSync(hcicommands.LEPeriodicAdvertisingTerminateSyncInput{
+		SyncHandle: handle,
+	})
+	if s.logger != nil {
+		s.logger.WithError(err).WithField("0handle", handle).Info("Terminated late periodic advertising sync")
+	}
+}
+
+func (s *BLEScanner) handlePeriodicReport(event *hcievents.LEPeriodicAdvertisingReportEvent) *hcievents.LEPeriodicAdvertisingReportEvent {
+	s.RLock()
+	p := s.periodicSyncs[event.SyncHandle]
+	s.RUnlock()
+
+	if p != nil {
+		p.handleReport(event)
+	}
+
+	return event
+}
+
+func (s *BLEScanner) handlePeriodicSyncLost(event *hcievents.LEPeriodicAdvertisingSyncLostEvent) *hcievents.LEPeriodicAdvertisingSyncLostEvent {
+	s.Lock()
+	p := s.periodicSyncs[event.SyncHandle]
+	delete(s.periodicSyncs, event.SyncHandle)
+	s.Unlock()
+
+	if p != nil {
+		if s.logger != nil {
+			s.logger.WithFields(logrus.Fields{
+				"0addr":   p.addr,
+				"1handle": p.handle,
+			}).Info("Periodic advertising sync lost")
+		}
+		p.finish(ErrorPeriodicSyncLost)
+	}
+
+	return event
+}
+
+func (p *PeriodicSync) handleReport(event *hcievents.LEPeriodicAdvertisingReportEvent) {
+	/* Data status 0xFF means the controller did not receive the data */
+	if event.DataStatus > 2 {
+		p.data = p.data[:0]
+		return
+	}
+
+	if len(p.data)+len(event.Data) <= extendedReassemblyMaxData {
+		p.data = append(p.data, event.Data...)
+	}
+	if event.DataStatus == periodicDataIncomplete {
+		return
+	}
+
+	report := &PeriodicAdvertisingReport{
+		Sync:    p,
+		TXPower: int8(event.TXPower),
+		RSSI:    int8(event.RSSI),
+		CTEType: event.CTEType,
+		Data:    append([]byte{}, p.data...),
+	}
+	p.data = p.data[:0]
+
+	if p.callback != nil {
+		p.callback(report)
+		return
+	}
+
+	/* Never block the event goroutine, drop the report if the reader is too slow */
+	select {
+	case p.reports <- report:
+	default:
+	}
+}
+
+func (p *PeriodicSync) finish(err error) {
+	p.closeOnce.Do(func() {
+		p.err = err
+		close(p.done)
+	})
+}
+
+// Reports returns the channel on which the reports are delivered. It is nil if a callback was configured.
+func (p *PeriodicSync) Reports() <-chan *PeriodicAdvertisingReport {
+	return p.reports
+}
+
+// Done is closed when the sync is lost or closed
+func (p *PeriodicSync) Done() <-chan struct{} {
+	return p.done
+}
+
+// Err returns why the sync ended, or nil while it is active
+func (p *PeriodicSync) Err() error {
+	select {
+	case <-p.done:
+		return p.err
+	default:
+		return nil
+	}
+}
+
+func (p *PeriodicSync) GetAddr() bleutil.BLEAddr {
+	return p.addr
+}
+
+func (p *PeriodicSync) GetSID() uint8 {
+	return p.sid
+}
+
+func (p *PeriodicSync) GetPHY() uint8 {
+	return p.phy
+}
+
+func (p *PeriodicSync) GetInterval() time.Duration {
+	return time.Duration(p.interval) * 1250 * time.Microsecond
+}
+
+// Close terminates the sync
+func (p *PeriodicSync) Close() error {
+	s := p.scanner
+
+	s.Lock()
+	_, active := s.periodicSyncs[p.handle]
+	if active {
+		delete(s.periodicSyncs, p.handle)
+	}
+	s.Unlock()
+
+	p.finish(ErrorPeriodicSyncClosed)
+
+	if !active {
+		return nil
+	}
+
+	return s.ctrl.Cmds.LEPeriodicAdvertisingTerminateSyncSync(hcicommands.LEPeriodicAdvertisingTerminateSyncInput{
+		SyncHandle: p.handle,
+	})
+}
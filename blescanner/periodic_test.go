@@ -0,0 +1,127 @@
+package blescanner
+
+import (
+	"bytes"
+	"testing"
+
+	hcievents "github.com/BertoldVdb/go-ble/hci/events"
+)
+
+func newTestPeriodicSync(s *BLEScanner, handle uint16) *PeriodicSync {
+	p := &PeriodicSync{
+		scanner: s,
+		handle:  handle,
+		reports: make(chan *PeriodicAdvertisingReport, 4),
+		done:    make(chan struct{}),
+	}
+	s.periodicSyncs = map[uint16]*PeriodicSync{handle: p}
+	return p
+}
+
+// TestPeriodicReportReassembly checks that fragmented periodic data is
+// delivered as one report on the channel.
+func TestPeriodicReportReassembly(t *testing.T) {
+	s := New(nil, nil, &BLEScannerConfig{})
+	p := newTestPeriodicSync(s, 3)
+
+	s.handlePeriodicReport(&hcievents.LEPeriodicAdvertisingReportEvent{SyncHandle: 3, DataStatus: 1, Data: []byte{1, 2}})
+	s.handlePeriodicReport(&hcievents.LEPeriodicAdvertisingReportEvent{SyncHandle: 3, DataStatus: 0, RSSI: 0xCE, Data: []byte{3}})
+
+	/* Unknown sync handles are ignored */
+	s.handlePeriodicReport(&hcievents.LEPeriodicAdvertisingReportEvent{SyncHandle: 4, Data: []byte{9}})
+
+	select {
+	case r := <-p.Reports():
+		if !bytes.Equal(r.Data, []byte{1, 2, 3}) || r.RSSI != -50 || r.Sync != p {
+			t.Fatalf("Unexpected report %+v", r)
+		}
+	default:
+		t.Fatal("No report delivered")
+	}
+
+	if len(p.Reports()) != 0 {
+		t.Fatal("Extra report delivered")
+	}
+}
+
+// TestPeriodicSyncLost verifies that a lost sync is removed and signalled.
+func TestPeriodicSyncLost(t *testing.T) {
+	s := New(nil, nil, &BLEScannerConfig{})
+	p := newTestPeriodicSync(s, 7)
+
+	if p.Err() != nil {
+		t.Fatal("Active sync reports an error")
+	}
+
+	s.handlePeriodicSyncLost(&hcievents.LEPeriodicAdvertisingSyncLostEvent{SyncHandle: 7})
+
+	select {
+	case <-p.Done():
+	default:
+		t.Fatal("Done was not closed")
+	}
+	if p.Err() != ErrorPeriodicSyncLost {
+		t.Fatalf("Got %v, want %v", p.Err(), ErrorPeriodicSyncLost)
+	}
+	if len(s.periodicSyncs) != 0 {
+		t.Fatal("Lost sync was not removed")
+	}
+
+	/* Closing a lost sync does not talk to the controller */
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestPeriodicSyncRegisteredOnEstablish checks that reports following the established event are
+// delivered before PeriodicSyncCreate has picked up the result.
+func TestPeriodicSyncRegisteredOnEstablish(t *testing.T) {
+	s := New(nil, nil, &BLEScannerConfig{})
+	p := &PeriodicSync{
+		scanner: s,
+		reports: make(chan *PeriodicAdvertisingReport, 4),
+		done:    make(chan struct{}),
+	}
+	result := make(chan *hcievents.LEPeriodicAdvertisingSyncEstablishedEvent, 1)
+	s.periodicPending = p
+	s.periodicResult = result
+
+	s.handlePeriodicSyncEstablished(&hcievents.LEPeriodicAdvertisingSyncEstablishedEvent{SyncHandle: 5, AdvertisingSID: 2})
+	s.handlePeriodicReport(&hcievents.LEPeriodicAdvertisingReportEvent{SyncHandle: 5, Data: []byte{1}})
+	s.handlePeriodicSyncLost(&hcievents.LEPeriodicAdvertisingSyncLostEvent{SyncHandle: 5})
+
+	if event := <-result; event.SyncHandle != 5 || p.handle != 5 || p.GetSID() != 2 {
+		t.Fatalf("Unexpected event %+v", event)
+	}
+	if len(p.Reports()) != 1 {
+		t.Fatal("Report was dropped")
+	}
+	if p.Err() != ErrorPeriodicSyncLost {
+		t.Fatalf("Got %v, want %v", p.Err(), ErrorPeriodicSyncLost)
+	}
+
+	/* Only the first event belongs to the pending sync */
+	s.handlePeriodicSyncEstablished(&hcievents.LEPeriodicAdvertisingSyncEstablishedEvent{SyncHandle: 6})
+	if len(result) != 0 || len(s.periodicSyncs) != 0 {
+		t.Fatal("Unexpected event was registered")
+	}
+}
+
+// TestPeriodicSyncAbandoned checks that only the first event after an abandoned create is
+// treated as its late result.
+func TestPeriodicSyncAbandoned(t *testing.T) {
+	s := New(nil, nil, &BLEScannerConfig{})
+	s.periodicAbandoned = true
+
+	/* The controller confirms the cancel, there is nothing to terminate */
+	s.handlePeriodicSyncEstablished(&hcievents.LEPeriodicAdvertisingSyncEstablishedEvent{Status: 0x44})
+	if s.periodicAbandoned || len(s.periodicSyncs) != 0 {
+		t.Fatal("Cancelled sync was not consumed")
+	}
+
+	/* Without an abandoned create the controller is not touched */
+	s.handlePeriodicSyncEstablished(&hcievents.LEPeriodicAdvertisingSyncEstablishedEvent{SyncHandle: 6})
+	if len(s.periodicSyncs) != 0 {
+		t.Fatal("Unexpected event was registered")
+	}
+}
@@ -6,6 +6,7 @@ import (
 
 	"github.com/BertoldVdb/go-ble/hci"
 	hcicommands "github.com/BertoldVdb/go-ble/hci/commands"
+	hcievents "github.com/BertoldVdb/go-ble/hci/events"
 	bleutil "github.com/BertoldVdb/go-ble/util"
 	"github.com/BertoldVdb/go-misc/closeflag"
 	"github.com/sirupsen/logrus"
@@ -27,6 +28,8 @@ type BLEScannerConfig struct {
 
 	LEScanInterval uint16
 	LEScanWindow   uint16
+
+	ScanCodedPHY bool
 }
 
 type registeredDeviceUpdateCB struct {
@@ -52,6 +55,16 @@ type BLEScanner struct {
 	advertisingReportCallbacks   []registeredAdvReportCB
 	nextCallbackHandle           CallbackHandle
 	scanType                     int
+	extendedScan                 bool
+	addressBlockedChan           chan (struct{})
+	extendedChains               map[extendedChainKey]*extendedChain
+
+	periodicSupported   bool
+	periodicCreateMutex sync.Mutex
+	periodicPending     *PeriodicSync
+	periodicResult      chan *hcievents.LEPeriodicAdvertisingSyncEstablishedEvent
+	periodicAbandoned   bool
+	periodicSyncs       map[uint16]*PeriodicSync
 
 	nextCleanup time.Time
 }
@@ -66,14 +79,42 @@ func New(logger *logrus.Entry, ctrl *hci.Controller, config *BLEScannerConfig) *
 		ctrl:                         ctrl,
 		devices:                      make(map[uint64]*BLEDevice),
 		manufacturerSpecificCallback: make(map[uint16]GAPCallback),
+		addressBlockedChan:           make(chan (struct{}), 1),
 	}
 
 	return e
 }
 
+/* The controller refuses a new random address while scanning */
+func (s *BLEScanner) randomAddressChanged(addr bleutil.MacAddr, err error) {
+	if err == nil {
+		return
+	}
+
+	select {
+	case s.addressBlockedChan <- struct{}{}:
+	default:
+	}
+}
+
+func (s *BLEScanner) rotateAddress() error {
+	s.RLock()
+	scanType := s.scanType
+	s.RUnlock()
+
+	s.configureScan(-1, -1)
+	err := s.ctrl.RotateResolvablePrivateAddress()
+	if err != nil && s.logger != nil {
+		s.logger.WithError(err).Warn("Failed to rotate random address while scanning")
+	}
+
+	return s.configureScan(scanType, -1)
+}
+
 func (s *BLEScanner) configureScan(scanType int, durationMs int) error {
 	s.Lock()
 	s.scanType = scanType
+	extendedScan := s.extendedScan
 	s.Unlock()
 
 	if s.logger != nil {
@@ -92,6 +133,10 @@ func (s *BLEScanner) configureScan(scanType int, durationMs int) error {
 		}).Info(str)
 	}
 
+	if extendedScan {
+		return s.configureExtendedScan(scanType)
+	}
+
 	s.ctrl.Cmds.LESetScanEnableSync(hcicommands.LESetScanEnableInput{
 		LEScanEnable:     0,
 		FilterDuplicates: 0,
@@ -128,7 +173,26 @@ func (s *BLEScanner) Run() error {
 		s.configureScan(-1, -1)
 	}()
 
-	err := s.ctrl.Events.SetLEAdvertisingReportEventCallback(s.handleScanResult)
+	handle := s.ctrl.AddRandomAddressHandler(s.randomAddressChanged)
+	defer s.ctrl.RemoveRandomAddressHandler(handle)
+
+	/* Controllers refuse legacy scan commands once extended advertising commands are used */
+	var err error
+	extendedScan := s.ctrl.UseExtendedAdvertising()
+	s.Lock()
+	s.extendedScan = extendedScan
+	s.Unlock()
+
+	if extendedScan {
+		err = s.ctrl.Events.SetLEExtendedAdvertisingReportEventCallback(s.handleExtendedScanResult)
+	} else {
+		err = s.ctrl.Events.SetLEAdvertisingReportEventCallback(s.handleScanResult)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = s.periodicInit()
 	if err != nil {
 		return err
 	}
@@ -157,6 +221,12 @@ func (s *BLEScanner) Run() error {
 			case <-timer.C:
 			case <-s.close.Chan():
 				return nil
+			case <-s.addressBlockedChan:
+				err := s.rotateAddress()
+				if err != nil {
+					return err
+				}
+				continue
 			}
 
 			dutycycle := s.config.ScanCycleActiveDuty
@@ -176,8 +246,13 @@ func (s *BLEScanner) Run() error {
 		}
 	}
 
-	if err == nil {
-		<-s.close.Chan()
+	for err == nil {
+		select {
+		case <-s.close.Chan():
+			return nil
+		case <-s.addressBlockedChan:
+			err = s.rotateAddress()
+		}
 	}
 
 	return err
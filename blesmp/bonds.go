@@ -0,0 +1,50 @@
+package blesmp
+
+import (
+	"time"
+
+	bleutil "github.com/BertoldVdb/go-ble/util"
+)
+
+// Bonds returns all bonded peers, sorted by address.
+func (s *SMP) Bonds() ([]Bond, error) {
+	return s.keys.List()
+}
+
+// Bond returns the bond with the peer that has identity address addr. A
+// resolvable private address of a bonded peer is resolved first.
+func (s *SMP) Bond(addr bleutil.BLEAddr) (Bond, error) {
+	addr, _ = s.ResolveAddress(addr)
+	return s.keys.Get(addr)
+}
+
+// DeleteBond removes the bond with a peer, and the peer from the resolving
+// list of the controller. A connection that is already encrypted stays
+// encrypted, but the peer has to pair again next time.
+func (s *SMP) DeleteBond(addr bleutil.BLEAddr) error {
+	addr, _ = s.ResolveAddress(addr)
+
+	bond, err := s.keys.Get(addr)
+	if err != nil {
+		return err
+	}
+
+	err = s.keys.Delete(addr)
+	if err != nil {
+		return err
+	}
+
+	if bond.PeerIRKValid && s.controller != nil {
+		return s.controller.UpdateResolvingList()
+	}
+	return nil
+}
+
+// touchBond records that the bond was used to encrypt a link. Bonds that
+// were deleted in the meantime are not written back.
+func (s *SMP) touchBond(addr bleutil.BLEAddr) {
+	s.keys.Update(addr, func(bond *Bond) error {
+		bond.LastUsed = time.Now()
+		return nil
+	})
+}
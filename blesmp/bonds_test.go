@@ -0,0 +1,53 @@
+package blesmp
+
+import (
+	"testing"
+
+	bleutil "github.com/BertoldVdb/go-ble/util"
+)
+
+func TestBondManagement(t *testing.T) {
+	s := newTestSMP(0x44)
+
+	peer := [16]byte{1, 2, 3, 4}
+	identity := bleutil.BLEAddr{MacAddr: 0xc01234567890, MacAddrType: bleutil.MacAddrRandom}
+	other := bleutil.BLEAddr{MacAddr: 0x001122334455}
+	s.keys.Put(Bond{Address: identity, Bonded: true, PeerIRK: peer, PeerIRKValid: true})
+	s.keys.Put(Bond{Address: other, Bonded: true})
+
+	bonds, err := s.Bonds()
+	if err != nil || len(bonds) != 2 || bonds[0].Address != other || bonds[1].Address != identity {
+		t.Fatalf("bonds: %+v (%v)", bonds, err)
+	}
+
+	// A private address of the peer refers to the same bond.
+	rpa, err := CryptoGenerateRPA(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	private := bleutil.BLEAddr{MacAddr: rpa, MacAddrType: bleutil.MacAddrRandom}
+	if bond, err := s.Bond(private); err != nil || bond.Address != identity {
+		t.Errorf("bond by private address: %+v (%v)", bond, err)
+	}
+
+	s.touchBond(other)
+	if bond, _ := s.Bond(other); bond.LastUsed.IsZero() {
+		t.Error("last used time not updated")
+	}
+
+	if err := s.DeleteBond(private); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteBond(identity); err != ErrorBondNotFound {
+		t.Errorf("second delete: %v", err)
+	}
+	if _, ok := s.ResolveAddress(private); ok {
+		t.Error("deleted peer still resolves")
+	}
+
+	// A deleted bond must not come back when it is touched.
+	s.touchBond(identity)
+	if bonds, _ := s.Bonds(); len(bonds) != 1 || bonds[0].Address != other {
+		t.Errorf("bonds after delete: %+v", bonds)
+	}
+}
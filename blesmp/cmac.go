@@ -20,6 +20,12 @@ func aesCMAC(key, msg []byte) [16]byte {
 	return aesCMACBlock(block, msg)
 }
 
+// CryptoAESCMAC computes AES-CMAC over msg. Key and result are in the
+// byte order of the standard, callers reverse them when needed.
+func CryptoAESCMAC(key [16]byte, msg []byte) [16]byte {
+	return aesCMAC(key[:], msg)
+}
+
 func aesCMACBlock(block cipher.Block, msg []byte) [16]byte {
 	const bs = 16
 	const rb = 0x87
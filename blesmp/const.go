@@ -22,6 +22,14 @@ const (
 	opcodeKeypressNotification smpOpcode = 0xE
 )
 
+/* Key distribution bits in the Pairing Request/Response */
+const (
+	keyDistEncKey  byte = 0x1
+	keyDistIdKey   byte = 0x2
+	keyDistSignKey byte = 0x4
+	keyDistLinkKey byte = 0x8
+)
+
 type smpFailedReason byte
 
 const (
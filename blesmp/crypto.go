@@ -2,6 +2,7 @@ package blesmp
 
 import (
 	crand "crypto/rand"
+	"crypto/subtle"
 	"encoding/binary"
 
 	bleutil "github.com/BertoldVdb/go-ble/util"
@@ -66,6 +67,56 @@ func CryptoFuncS1(isCentral bool, tk [16]byte, rand1 [16]byte, rand2 [16]byte) [
 	return r
 }
 
+// CryptoFuncAh is the random address hash function ah, used to generate
+// and resolve resolvable private addresses.
+func CryptoFuncAh(irk [16]byte, r [3]byte) [3]byte {
+	block := NewReversedAESCipher(irk[:])
+
+	/* r' is r padded with zeros */
+	var p [16]byte
+	copy(p[:], r[:])
+	block.Encrypt(p[:], p[:])
+
+	var result [3]byte
+	copy(result[:], p[:3])
+	return result
+}
+
+// CryptoGenerateRPA creates a new resolvable private address for irk.
+func CryptoGenerateRPA(irk [16]byte) (bleutil.MacAddr, error) {
+	var addr [6]byte
+
+	for {
+		_, err := crand.Read(addr[3:])
+		if err != nil {
+			return 0, err
+		}
+
+		/* Two MSB are 01, the random part may not be all zero or all one */
+		addr[5] = addr[5]&0x3F | 0x40
+		prand := uint32(addr[3]) | uint32(addr[4])<<8 | uint32(addr[5]&0x3F)<<16
+		if prand != 0 && prand != 0x3FFFFF {
+			break
+		}
+	}
+
+	hash := CryptoFuncAh(irk, [3]byte{addr[3], addr[4], addr[5]})
+	copy(addr[:], hash[:])
+
+	var result bleutil.MacAddr
+	result.Decode(addr[:])
+	return result, nil
+}
+
+// CryptoResolveRPA checks whether addr was generated from irk.
+func CryptoResolveRPA(irk [16]byte, addr bleutil.MacAddr) bool {
+	var raw [6]byte
+	addr.Encode(raw[:])
+
+	hash := CryptoFuncAh(irk, [3]byte{raw[3], raw[4], raw[5]})
+	return subtle.ConstantTimeCompare(hash[:], raw[:3]) == 1
+}
+
 func CryptoShortenKey(in [16]byte, l int) [16]byte {
 	for i := l; i < len(in); i++ {
 		in[i] = 0
@@ -162,3 +162,49 @@ func TestCryptoFuncS1Symmetric(t *testing.T) {
 		t.Fatalf("S1 disagreement central/peripheral: %x vs %x", a, b)
 	}
 }
+
+// Sample data for ah from the Core specification (Vol 3, Part H,
+// Appendix D.7), given MSB first.
+func TestCryptoFuncAh(t *testing.T) {
+	irkMSB := []byte{0xec, 0x02, 0x34, 0xa3, 0x57, 0xc8, 0xad, 0x05, 0x34, 0x10, 0x10, 0xa6, 0x0a, 0x39, 0x7d, 0x9b}
+	var irk [16]byte
+	for i := range irk {
+		irk[i] = irkMSB[15-i]
+	}
+
+	hash := CryptoFuncAh(irk, [3]byte{0x94, 0x81, 0x70})
+	if hash != [3]byte{0xaa, 0xfb, 0x0d} {
+		t.Fatalf("ah: got %x", hash)
+	}
+
+	if !CryptoResolveRPA(irk, 0x708194_0dfbaa) {
+		t.Error("sample address not resolved")
+	}
+	if CryptoResolveRPA(irk, 0x708194_0dfbab) {
+		t.Error("wrong hash resolved")
+	}
+}
+
+// Generated addresses have the RPA marker bits and resolve with the IRK
+// they were created from, and only with that one.
+func TestCryptoGenerateRPA(t *testing.T) {
+	irk := [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	other := irk
+	other[0] ^= 1
+
+	for i := 0; i < 16; i++ {
+		addr, err := CryptoGenerateRPA(irk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !(bleutil.BLEAddr{MacAddr: addr, MacAddrType: bleutil.MacAddrRandom}).IsResolvablePrivate() {
+			t.Fatalf("%s is not a resolvable private address", addr)
+		}
+		if !CryptoResolveRPA(irk, addr) {
+			t.Fatalf("%s does not resolve", addr)
+		}
+		if CryptoResolveRPA(other, addr) {
+			t.Fatalf("%s resolves with another IRK", addr)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package blesmp
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+
+	bleutil "github.com/BertoldVdb/go-ble/util"
+	"github.com/sirupsen/logrus"
+)
+
+// keyDistributionSetup works out which keys each side will distribute
+// once the Pairing Request and Response are both known.
+func (c *SMPConn) keyDistributionSetup() {
+	initiatorKeys := c.protocol.pairingRequest[5] & c.protocol.pairingResponse[5]
+	responderKeys := c.protocol.pairingRequest[6] & c.protocol.pairingResponse[6]
+
+	/* We never distribute or accept an LTK as initiator, and with LE
+	   Secure Connections the LTK is not distributed at all */
+	initiatorKeys &= keyDistIdKey | keyDistSignKey
+	responderKeys &= keyDistEncKey | keyDistIdKey | keyDistSignKey
+	if c.scNegotiated() {
+		responderKeys &^= keyDistEncKey
+	}
+
+	if c.isCentral {
+		c.protocol.pairingKeysLocal = initiatorKeys
+		c.protocol.pairingKeysRemote = responderKeys
+	} else {
+		c.protocol.pairingKeysLocal = responderKeys
+		c.protocol.pairingKeysRemote = initiatorKeys
+	}
+	c.protocol.pairingKeysDone = false
+	c.protocol.pairingIRKValid = false
+}
+
+func (c *SMPConn) localIRK() [16]byte {
+	if c.parent == nil {
+		return [16]byte{}
+	}
+	return c.parent.localIRK
+}
+
+func (c *SMPConn) localIdentityAddr() bleutil.BLEAddr {
+	/* A resolvable private address is not an identity, use the public one */
+	if c.addrLELocal.IsResolvablePrivate() && c.parent != nil && c.parent.controller != nil {
+		return c.parent.controller.GetOwnAddress(bleutil.MacAddrPublic)
+	}
+	return c.addrLELocal
+}
+
+// sendKeyDistribution sends all keys we still owe the peer, in the
+// order mandated by the specification.
+func (c *SMPConn) sendKeyDistribution() error {
+	keys := c.protocol.pairingKeysLocal
+	c.protocol.pairingKeysLocal = 0
+
+	send := func(opcode smpOpcode, data []byte) error {
+		buf := bleutil.GetBuffer(1)
+		buf.Buf()[0] = byte(opcode)
+		buf.Append(data...)
+		return c.sendBuf(buf)
+	}
+
+	if keys&keyDistEncKey > 0 {
+		/* Send LTK, then EDIV/RAND */
+		if err := send(opcodeKDEncryptionInformation, c.protocol.pairingLTK.LTK[:]); err != nil {
+			return err
+		}
+
+		var ident [10]byte
+		binary.LittleEndian.PutUint16(ident[:], c.protocol.pairingLTK.EDIV)
+		binary.LittleEndian.PutUint64(ident[2:], c.protocol.pairingLTK.Rand)
+		if err := send(opcodeKDIdentification, ident[:]); err != nil {
+			return err
+		}
+	}
+
+	if keys&keyDistIdKey > 0 {
+		c.protocol.pairingLTK.LocalIRK = c.localIRK()
+		c.protocol.pairingLTK.LocalIRKValid = true
+		if err := send(opcodeKDIdentityInformation, c.protocol.pairingLTK.LocalIRK[:]); err != nil {
+			return err
+		}
+
+		var addr [7]byte
+		identity := c.localIdentityAddr()
+		addr[0] = byte(identity.MacAddrType & 1)
+		identity.MacAddr.Encode(addr[1:])
+		if err := send(opcodeKDIdentityAddressInformation, addr[:]); err != nil {
+			return err
+		}
+	}
+
+	if keys&keyDistSignKey > 0 {
+		if _, err := crand.Read(c.protocol.pairingLTK.LocalCSRK[:]); err != nil {
+			return err
+		}
+		c.protocol.pairingLTK.LocalCSRKValid = true
+		if err := send(opcodeKDSigningInformation, c.protocol.pairingLTK.LocalCSRK[:]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// keyDistributionEncrypted is called when the link becomes encrypted. A
+// Secure Connections responder only learns about this from the
+// controller, so this is where it starts distributing its keys.
+func (c *SMPConn) keyDistributionEncrypted() {
+	if c.isCentral || c.protocol.state != smpKeyDistribution || c.protocol.pairingKeysLocal == 0 {
+		return
+	}
+
+	if err := c.sendKeyDistribution(); err != nil {
+		c.sendPairingFailed(failedUnspecifiedReason)
+		return
+	}
+
+	c.keyDistributionCheck()
+}
+
+// keyDistributionCheck advances the key distribution phase. The
+// responder sends its keys first, the initiator answers with its own
+// once everything it expects has arrived. When both directions are done
+// the collected keys are stored together with the LTK.
+func (c *SMPConn) keyDistributionCheck() {
+	if c.protocol.state != smpKeyDistribution || c.protocol.pairingKeysDone || c.protocol.pairingKeysRemote != 0 {
+		return
+	}
+
+	if c.isCentral {
+		if err := c.sendKeyDistribution(); err != nil {
+			c.sendPairingFailed(failedUnspecifiedReason)
+			return
+		}
+	} else if c.protocol.pairingKeysLocal != 0 {
+		return
+	}
+
+	c.protocol.pairingKeysDone = true
+
+	c.logger.WithFields(logrus.Fields{
+		"0irk":      c.protocol.pairingLTK.PeerIRKValid,
+		"1identity": c.protocol.pairingLTK.Address,
+		"2csrk":     c.protocol.pairingLTK.PeerCSRKValid,
+	}).Debug("Key distribution complete")
+
+	/* Without an LTK there is nothing to attach the keys to */
+	if !c.protocol.pairingLTKComplete {
+		return
+	}
+	c.updateLTK()
+	c.saveBond()
+
+	if c.protocol.pairingLTK.PeerIRKValid && c.protocol.pairingLTK.Bonded && c.parent != nil && c.parent.controller != nil {
+		err := c.parent.controller.UpdateResolvingList()
+		if err != nil {
+			c.logger.WithError(err).Warn("Failed to update resolving list")
+		}
+	}
+}
+
+func (c *SMPConn) handleKeyDistribution(opcode smpOpcode, data []byte) bool {
+	handleLTK := func() {
+		if !c.protocol.pairingEDIVValid || !c.protocol.pairingLTKValid {
+			return
+		}
+
+		if c.protocol.pairingLTKComplete {
+			return
+		}
+
+		c.protocol.pairingLTKComplete = true
+		c.protocol.pairingLTK.Bonded = true
+		c.protocol.pairingKeysRemote &^= keyDistEncKey
+
+		c.updateLTK()
+	}
+
+	/* Keys the peer sends without having negotiated them are still
+	   accepted: failing the connection would prevent pairing with stacks
+	   that always send them */
+	switch opcode {
+	case opcodeKDIdentification:
+		if len(data) != 10 {
+			return false
+		}
+		c.protocol.pairingEDIVValid = true
+		c.protocol.pairingLTK.EDIV = binary.LittleEndian.Uint16(data)
+		c.protocol.pairingLTK.Rand = binary.LittleEndian.Uint64(data[2:])
+
+		handleLTK()
+
+	case opcodeKDEncryptionInformation:
+		if len(data) != 16 {
+			return false
+		}
+		c.protocol.pairingLTKValid = true
+		copy(c.protocol.pairingLTK.LTK[:], data)
+
+		handleLTK()
+
+	case opcodeKDIdentityInformation:
+		if len(data) != 16 {
+			return false
+		}
+		copy(c.protocol.pairingLTK.PeerIRK[:], data)
+		c.protocol.pairingIRKValid = true
+
+	case opcodeKDIdentityAddressInformation:
+		if len(data) != 7 {
+			return false
+		}
+
+		/* The address is only useful together with the IRK that precedes it */
+		if c.protocol.pairingIRKValid {
+			c.protocol.pairingLTK.Address.MacAddrType = bleutil.MacAddrType(data[0] & 1)
+			c.protocol.pairingLTK.Address.MacAddr.Decode(data[1:])
+			c.protocol.pairingLTK.PeerIRKValid = true
+		}
+		c.protocol.pairingKeysRemote &^= keyDistIdKey
+
+	case opcodeKDSigningInformation:
+		if len(data) != 16 {
+			return false
+		}
+		copy(c.protocol.pairingLTK.PeerCSRK[:], data)
+		c.protocol.pairingLTK.PeerCSRKValid = true
+		c.protocol.pairingKeysRemote &^= keyDistSignKey
+
+	default:
+		return false
+	}
+
+	c.keyDistributionCheck()
+	return true
+}
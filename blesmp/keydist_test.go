@@ -0,0 +1,175 @@
+package blesmp
+
+import (
+	"testing"
+	"time"
+
+	bleutil "github.com/BertoldVdb/go-ble/util"
+)
+
+func newTestSMP(irk byte) *SMP {
+	s := &SMP{
+		config: &SMPConfig{},
+		keys:   NewMemoryKeyStore(),
+	}
+	for i := range s.localIRK {
+		s.localIRK[i] = irk
+	}
+	return s
+}
+
+// The pairing request asks for all identity and signing keys when
+// bonding, and the responder only grants what was asked for.
+func TestKeyDistributionNegotiation(t *testing.T) {
+	cInit, fInit := newTestSMPConn(t, true)
+	cResp, fResp := newTestSMPConn(t, false)
+
+	cInit.sendPairingRequest()
+	prq := scExtractPDU(t, fInit.nextTx(), opcodePairingRequest)
+	if prq[4] != keyDistIdKey|keyDistSignKey || prq[5] != keyDistEncKey|keyDistIdKey|keyDistSignKey {
+		t.Fatalf("unexpected key distribution in request: %x", prq)
+	}
+
+	prq[4] = keyDistIdKey
+	prq[5] = keyDistIdKey | keyDistSignKey
+	cResp.handlePairingRequest(append([]byte{byte(opcodePairingRequest)}, prq...))
+	prs := scExtractPDU(t, fResp.nextTx(), opcodePairingResponse)
+	if prs[4] != keyDistIdKey || prs[5] != keyDistIdKey|keyDistSignKey {
+		t.Fatalf("responder granted keys that were not requested: %x", prs)
+	}
+
+	if cResp.protocol.pairingKeysLocal != keyDistIdKey|keyDistSignKey || cResp.protocol.pairingKeysRemote != keyDistIdKey {
+		t.Errorf("responder key plan: local %x remote %x", cResp.protocol.pairingKeysLocal, cResp.protocol.pairingKeysRemote)
+	}
+}
+
+// Drive a bonded Secure Connections pairing and the key distribution that
+// follows it. Each side must end up with the other side's IRK, identity
+// address and CSRK stored next to the LTK.
+func TestKeyDistributionSecureConnections(t *testing.T) {
+	cInit, fInit := newTestSMPConn(t, true)
+	cResp, fResp := newTestSMPConn(t, false)
+	cInit.parent = newTestSMP(0x11)
+	cResp.parent = newTestSMP(0x22)
+
+	cResp.addrLELocal = cInit.addrLERemote
+	cResp.addrLERemote = cInit.addrLELocal
+
+	noIO := byte(cIONoInputNoOutput)
+	allKeys := keyDistEncKey | keyDistIdKey | keyDistSignKey
+	prq := [7]byte{byte(opcodePairingRequest), noIO, 0, 0x09, 16, keyDistIdKey | keyDistSignKey, allKeys}
+	prs := [7]byte{byte(opcodePairingResponse), noIO, 0, 0x09, 16, keyDistIdKey | keyDistSignKey, allKeys}
+	for _, c := range []*SMPConn{cInit, cResp} {
+		c.protocol.pairingRequest = prq
+		c.protocol.pairingResponse = prs
+		c.protocol.scActive = true
+		c.protocol.pairingKeySize = 16
+		c.keyDistributionSetup()
+	}
+
+	ltkInit, ltkResp := driveJustWorksOrNumComp(t, cInit, cResp, fInit, fResp)
+	if ltkInit != ltkResp {
+		t.Fatal("LTK disagreement")
+	}
+
+	// The initiator must wait for the responder.
+	if p := fInit.nextTx(); p != nil {
+		t.Fatalf("initiator sent %x before receiving keys", p.Buf())
+	}
+
+	// The responder distributes once the link is encrypted.
+	cResp.keyDistributionEncrypted()
+	for _, op := range []smpOpcode{opcodeKDIdentityInformation, opcodeKDIdentityAddressInformation, opcodeKDSigningInformation} {
+		p := fResp.nextTx()
+		scExtractPDU(t, p, op)
+		cInit.handleMessage(p)
+	}
+	for _, op := range []smpOpcode{opcodeKDIdentityInformation, opcodeKDIdentityAddressInformation, opcodeKDSigningInformation} {
+		p := fInit.nextTx()
+		scExtractPDU(t, p, op)
+		cResp.handleMessage(p)
+	}
+	if p := fInit.nextTx(); p != nil {
+		t.Fatalf("unexpected PDU from initiator: %x", p.Buf())
+	}
+	if p := fResp.nextTx(); p != nil {
+		t.Fatalf("unexpected PDU from responder: %x", p.Buf())
+	}
+
+	check := func(c *SMPConn, peer *SMPConn) {
+		t.Helper()
+		stored, err := c.parent.keys.Get(c.addrLERemote)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.LTK != ltkInit || !stored.Bonded || stored.Central != c.isCentral {
+			t.Error("LTK not stored")
+		}
+		if !stored.PeerIRKValid || stored.PeerIRK != peer.parent.localIRK || stored.Address != peer.addrLELocal {
+			t.Errorf("peer identity not stored: %+v", stored)
+		}
+		if !stored.PeerCSRKValid || stored.PeerCSRK != peer.protocol.pairingLTK.LocalCSRK {
+			t.Error("peer CSRK not stored")
+		}
+		if !stored.LocalIRKValid || stored.LocalIRK != c.parent.localIRK || !stored.LocalCSRKValid {
+			t.Error("local keys not stored")
+		}
+		if !stored.SecureConnections || stored.KeySize != 16 || stored.Created.IsZero() || stored.LastUsed != stored.Created {
+			t.Errorf("bond metadata not stored: %+v", stored)
+		}
+	}
+
+	check(cInit, cResp)
+	check(cResp, cInit)
+}
+
+// A peer connecting from a private address is stored under its identity
+// address, so it can be found again after the address changed.
+func TestKeyDistributionIdentityAddress(t *testing.T) {
+	c, _ := newTestSMPConn(t, true)
+	c.parent = newTestSMP(0x33)
+	c.addrLERemote = bleutil.BLEAddr{MacAddr: 0x4a1122334455, MacAddrType: bleutil.MacAddrRandom}
+	c.addrLEIdentity = c.addrLERemote
+	c.protocol.pairingLTK = Bond{Address: c.addrLEIdentity}
+
+	/* The peer paired before, the creation time of that bond is kept */
+	identity := bleutil.BLEAddr{MacAddr: 0x112233445566, MacAddrType: bleutil.MacAddrPublic}
+	created := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	c.parent.keys.Put(Bond{Address: identity, Bonded: true, Created: created})
+
+	c.protocol.state = smpKeyDistribution
+	c.protocol.pairingKeysRemote = keyDistEncKey | keyDistIdKey
+
+	var ltk [16]byte
+	ltk[0] = 0x55
+	if !c.handleKeyDistribution(opcodeKDEncryptionInformation, ltk[:]) ||
+		!c.handleKeyDistribution(opcodeKDIdentification, make([]byte, 10)) {
+		t.Fatal("LTK rejected")
+	}
+
+	irk := make([]byte, 16)
+	irk[15] = 0xAA
+	if !c.handleKeyDistribution(opcodeKDIdentityInformation, irk) {
+		t.Fatal("IRK rejected")
+	}
+	if !c.handleKeyDistribution(opcodeKDIdentityAddressInformation, []byte{0, 0x66, 0x55, 0x44, 0x33, 0x22, 0x11}) {
+		t.Fatal("identity address rejected")
+	}
+	if !c.protocol.pairingKeysDone {
+		t.Fatal("key distribution not complete")
+	}
+
+	stored, err := c.parent.keys.Get(identity)
+	if err != nil {
+		t.Fatal("keys not stored under identity address")
+	}
+	if stored.LTK != ltk || stored.PeerIRK[15] != 0xAA || !stored.PeerIRKValid || stored.Address != identity {
+		t.Errorf("wrong keys stored: %+v", stored)
+	}
+	if !stored.Created.Equal(created) || stored.LastUsed.IsZero() {
+		t.Errorf("creation time not kept: %+v", stored)
+	}
+	if bonds, _ := c.parent.Bonds(); len(bonds) != 1 {
+		t.Errorf("keys stored under private address: %+v", bonds)
+	}
+}
@@ -0,0 +1,191 @@
+package blesmp
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	bleutil "github.com/BertoldVdb/go-ble/util"
+)
+
+var (
+	ErrorBondNotFound = errors.New("Bond not found")
+)
+
+// Bond holds the keys shared with a bonded peer.
+type Bond struct {
+	// Address is the identity address of the peer, or the address it
+	// paired from when it did not distribute an identity.
+	Address bleutil.BLEAddr
+	// Central is set when we were the central while pairing.
+	Central bool
+
+	EDIV          uint16
+	Rand          uint64
+	LTK           [16]byte
+	Authenticated bool
+	Bonded        bool
+
+	/* SecureConnections is set when the LTK was generated with LE Secure
+	   Connections. KeySize is the negotiated key length in bytes, zero if
+	   unknown. */
+	SecureConnections bool
+	KeySize           int
+
+	/* Created is the time of pairing, LastUsed the last time the LTK
+	   encrypted a link */
+	Created  time.Time
+	LastUsed time.Time
+
+	/* Keys received from the peer during key distribution. The IRK is
+	   needed to recognize a peer that uses resolvable private
+	   addresses, the CSRK to verify its signed writes. */
+	PeerIRK       [16]byte
+	PeerIRKValid  bool
+	PeerCSRK      [16]byte
+	PeerCSRKValid bool
+
+	/* Keys we distributed to the peer */
+	LocalIRK       [16]byte
+	LocalIRKValid  bool
+	LocalCSRK      [16]byte
+	LocalCSRKValid bool
+
+	/* LocalSignCounter is the counter for the next write we sign,
+	   PeerSignCounter the lowest counter accepted from the peer */
+	LocalSignCounter uint32
+	PeerSignCounter  uint32
+}
+
+// KeyStore persists bonds, keyed by the identity address of the peer, and
+// the local IRK. Implementations must be safe for concurrent use.
+//
+// There is one bond per peer, whatever the role: pairing again, also in the
+// other role, replaces the bond. Central records the role of the last
+// pairing.
+type KeyStore interface {
+	// Get returns ErrorBondNotFound if there is no bond with addr.
+	Get(addr bleutil.BLEAddr) (Bond, error)
+	Put(bond Bond) error
+	// Update changes the bond with addr in place, so it cannot race a
+	// Delete. Nothing is stored if fn returns an error, which is passed
+	// on. It returns ErrorBondNotFound if there is no bond with addr.
+	Update(addr bleutil.BLEAddr, fn func(bond *Bond) error) error
+	Delete(addr bleutil.BLEAddr) error
+	List() ([]Bond, error)
+
+	GetLocalIRK() ([16]byte, bool, error)
+	PutLocalIRK(irk [16]byte) error
+}
+
+// bondAddr normalizes addr for use as a key: resolved identity addresses
+// are stored as their public or random counterpart.
+func bondAddr(addr bleutil.BLEAddr) bleutil.BLEAddr {
+	return bleutil.BLEAddr{
+		MacAddr:     addr.MacAddr,
+		MacAddrType: addr.MacAddrType & 1,
+	}
+}
+
+func sortBonds(bonds []Bond) []Bond {
+	sort.Slice(bonds, func(i, j int) bool {
+		return bonds[i].Address.IsLess(bonds[j].Address)
+	})
+	return bonds
+}
+
+// MemoryKeyStore keeps bonds in memory only. It is mostly useful for tests
+// and devices that should forget all peers when restarted.
+type MemoryKeyStore struct {
+	sync.Mutex
+
+	bonds         map[bleutil.BLEAddr]Bond
+	localIRK      [16]byte
+	localIRKValid bool
+}
+
+func NewMemoryKeyStore() *MemoryKeyStore {
+	return &MemoryKeyStore{
+		bonds: make(map[bleutil.BLEAddr]Bond),
+	}
+}
+
+func (m *MemoryKeyStore) Get(addr bleutil.BLEAddr) (Bond, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	bond, ok := m.bonds[bondAddr(addr)]
+	if !ok {
+		return Bond{}, ErrorBondNotFound
+	}
+	return bond, nil
+}
+
+func (m *MemoryKeyStore) Put(bond Bond) error {
+	m.Lock()
+	defer m.Unlock()
+
+	bond.Address = bondAddr(bond.Address)
+	m.bonds[bond.Address] = bond
+	return nil
+}
+
+func (m *MemoryKeyStore) Update(addr bleutil.BLEAddr, fn func(bond *Bond) error) error {
+	m.Lock()
+	defer m.Unlock()
+
+	addr = bondAddr(addr)
+	bond, ok := m.bonds[addr]
+	if !ok {
+		return ErrorBondNotFound
+	}
+
+	err := fn(&bond)
+	if err != nil {
+		return err
+	}
+
+	bond.Address = addr
+	m.bonds[addr] = bond
+	return nil
+}
+
+func (m *MemoryKeyStore) Delete(addr bleutil.BLEAddr) error {
+	m.Lock()
+	defer m.Unlock()
+
+	addr = bondAddr(addr)
+	if _, ok := m.bonds[addr]; !ok {
+		return ErrorBondNotFound
+	}
+	delete(m.bonds, addr)
+	return nil
+}
+
+func (m *MemoryKeyStore) List() ([]Bond, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	result := make([]Bond, 0, len(m.bonds))
+	for _, bond := range m.bonds {
+		result = append(result, bond)
+	}
+	return sortBonds(result), nil
+}
+
+func (m *MemoryKeyStore) GetLocalIRK() ([16]byte, bool, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.localIRK, m.localIRKValid, nil
+}
+
+func (m *MemoryKeyStore) PutLocalIRK(irk [16]byte) error {
+	m.Lock()
+	defer m.Unlock()
+
+	m.localIRK = irk
+	m.localIRKValid = true
+	return nil
+}
@@ -0,0 +1,254 @@
+package blesmp
+
+import (
+	"os"
+
+	bleutil "github.com/BertoldVdb/go-ble/util"
+	"github.com/BertoldVdb/go-misc/gobpersist"
+)
+
+type gobKeyStoreData struct {
+	Bonds         map[bleutil.BLEAddr]Bond
+	LocalIRK      [16]byte
+	LocalIRKValid bool
+}
+
+// GobKeyStore keeps all bonds in a single gob encoded file, which is
+// rewritten on every change. Without a filename nothing is written to disk.
+type GobKeyStore struct {
+	data    gobKeyStoreData
+	persist *gobpersist.GobPersist
+}
+
+func NewGobKeyStore(filename string) *GobKeyStore {
+	g := &GobKeyStore{
+		data: gobKeyStoreData{
+			Bonds: make(map[bleutil.BLEAddr]Bond),
+		},
+	}
+
+	g.persist = &gobpersist.GobPersist{
+		Target:   &g.data,
+		Filename: filename,
+	}
+
+	return g
+}
+
+// Load reads the file. Files written by versions that stored raw LTK
+// entries are converted.
+func (g *GobKeyStore) Load() error {
+	err := g.persist.Load()
+	if err == nil || os.IsNotExist(err) || g.persist.Filename == "" {
+		g.persist.Lock()
+		if g.data.Bonds == nil {
+			g.data.Bonds = make(map[bleutil.BLEAddr]Bond)
+		}
+		g.persist.Unlock()
+		return err
+	}
+
+	/* A failed decode may have left partial data behind, so the
+	   store is replaced either way */
+	data, ok := g.loadLegacy()
+	g.persist.Lock()
+	g.data = data
+	g.persist.Unlock()
+	if !ok {
+		return err
+	}
+
+	return g.persist.Save()
+}
+
+func (g *GobKeyStore) loadLegacy() (gobKeyStoreData, bool) {
+	data := gobKeyStoreData{
+		Bonds: make(map[bleutil.BLEAddr]Bond),
+	}
+
+	legacy := make(map[gobLegacyKey]gobLegacyLTK)
+	old := &gobpersist.GobPersist{Target: &legacy, Filename: g.persist.Filename}
+	if old.Load() != nil {
+		return data, false
+	}
+
+	for key, ltk := range legacy {
+		if irk, ok := key.localIRK(ltk); ok {
+			data.LocalIRK = irk
+			data.LocalIRKValid = true
+		} else if bond, ok := key.bond(ltk); ok {
+			if prev, ok := data.Bonds[bond.Address]; ok && !gobLegacyPrefer(bond, prev) {
+				continue
+			}
+			data.Bonds[bond.Address] = bond
+		}
+	}
+
+	return data, true
+}
+
+func (g *GobKeyStore) Get(addr bleutil.BLEAddr) (Bond, error) {
+	g.persist.Lock()
+	defer g.persist.Unlock()
+
+	bond, ok := g.data.Bonds[bondAddr(addr)]
+	if !ok {
+		return Bond{}, ErrorBondNotFound
+	}
+	return bond, nil
+}
+
+func (g *GobKeyStore) Put(bond Bond) error {
+	g.persist.Lock()
+	bond.Address = bondAddr(bond.Address)
+	g.data.Bonds[bond.Address] = bond
+	g.persist.Unlock()
+
+	return g.persist.Save()
+}
+
+func (g *GobKeyStore) Update(addr bleutil.BLEAddr, fn func(bond *Bond) error) error {
+	g.persist.Lock()
+	addr = bondAddr(addr)
+	bond, ok := g.data.Bonds[addr]
+	if !ok {
+		g.persist.Unlock()
+		return ErrorBondNotFound
+	}
+
+	err := fn(&bond)
+	if err != nil {
+		g.persist.Unlock()
+		return err
+	}
+
+	bond.Address = addr
+	g.data.Bonds[addr] = bond
+	g.persist.Unlock()
+
+	return g.persist.Save()
+}
+
+func (g *GobKeyStore) Delete(addr bleutil.BLEAddr) error {
+	g.persist.Lock()
+	addr = bondAddr(addr)
+	_, ok := g.data.Bonds[addr]
+	delete(g.data.Bonds, addr)
+	g.persist.Unlock()
+
+	if !ok {
+		return ErrorBondNotFound
+	}
+	return g.persist.Save()
+}
+
+func (g *GobKeyStore) List() ([]Bond, error) {
+	g.persist.Lock()
+	defer g.persist.Unlock()
+
+	result := make([]Bond, 0, len(g.data.Bonds))
+	for _, bond := range g.data.Bonds {
+		result = append(result, bond)
+	}
+	return sortBonds(result), nil
+}
+
+func (g *GobKeyStore) GetLocalIRK() ([16]byte, bool, error) {
+	g.persist.Lock()
+	defer g.persist.Unlock()
+
+	return g.data.LocalIRK, g.data.LocalIRKValid, nil
+}
+
+func (g *GobKeyStore) PutLocalIRK(irk [16]byte) error {
+	g.persist.Lock()
+	g.data.LocalIRK = irk
+	g.data.LocalIRKValid = true
+	g.persist.Unlock()
+
+	return g.persist.Save()
+}
+
+// gobLegacyPrefer decides which bond is kept when a peer paired in both
+// roles, as the store has one bond per peer. Legacy entries carry no time, so
+// the newest one is unknown: the authenticated key wins, then the one that
+// knows the identity of the peer, then the one where we were central. This
+// keeps the result independent of the map order.
+func gobLegacyPrefer(a Bond, b Bond) bool {
+	if a.Authenticated != b.Authenticated {
+		return a.Authenticated
+	}
+	if a.PeerIRKValid != b.PeerIRKValid {
+		return a.PeerIRKValid
+	}
+	return a.Central && !b.Central
+}
+
+// Earlier versions stored a map of LTKs, indexed by role, local address and
+// either the remote address or EDIV/Rand.
+type gobLegacyKey [19]byte
+
+type gobLegacyLTK struct {
+	EDIV          uint16
+	Rand          uint64
+	LTK           [16]byte
+	Authenticated bool
+	Bonded        bool
+
+	PeerIRK           [16]byte
+	PeerIdentity      bleutil.BLEAddr
+	PeerIdentityValid bool
+	PeerCSRK          [16]byte
+	PeerCSRKValid     bool
+	LocalIRK          [16]byte
+	LocalIRKValid     bool
+	LocalCSRK         [16]byte
+	LocalCSRKValid    bool
+}
+
+func (k gobLegacyKey) localIRK(ltk gobLegacyLTK) ([16]byte, bool) {
+	return ltk.LocalIRK, k[0] == 0xFF && ltk.LocalIRKValid
+}
+
+func (k gobLegacyKey) bond(ltk gobLegacyLTK) (Bond, bool) {
+	var remote bleutil.BLEAddr
+
+	switch {
+	case k[0] == 1:
+		remote.MacAddr.Decode(k[8:])
+		remote.MacAddrType = bleutil.MacAddrType(k[14] & 1)
+	case k[0] == 0 && k[8] == 1:
+		remote.MacAddr.Decode(k[9:])
+		remote.MacAddrType = bleutil.MacAddrType(k[15] & 1)
+	default:
+		/* Entries indexed by EDIV/Rand do not say who the peer is */
+		return Bond{}, false
+	}
+
+	if !ltk.Bonded {
+		return Bond{}, false
+	}
+
+	bond := Bond{
+		Address:        remote,
+		Central:        k[0] == 1,
+		EDIV:           ltk.EDIV,
+		Rand:           ltk.Rand,
+		LTK:            ltk.LTK,
+		Authenticated:  ltk.Authenticated,
+		Bonded:         true,
+		PeerIRK:        ltk.PeerIRK,
+		PeerIRKValid:   ltk.PeerIdentityValid,
+		PeerCSRK:       ltk.PeerCSRK,
+		PeerCSRKValid:  ltk.PeerCSRKValid,
+		LocalIRK:       ltk.LocalIRK,
+		LocalIRKValid:  ltk.LocalIRKValid,
+		LocalCSRK:      ltk.LocalCSRK,
+		LocalCSRKValid: ltk.LocalCSRKValid,
+	}
+	if ltk.PeerIdentityValid {
+		bond.Address = bondAddr(ltk.PeerIdentity)
+	}
+
+	return bond, true
+}
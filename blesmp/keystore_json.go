@@ -0,0 +1,301 @@
+package blesmp
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	bleutil "github.com/BertoldVdb/go-ble/util"
+)
+
+var (
+	ErrorInvalidKey = errors.New("Invalid key in bond file")
+)
+
+// JSONDirKeyStore keeps every bond in its own JSON file inside a
+// directory, so bonds can be inspected, removed or copied to another
+// machine with ordinary tools.
+type JSONDirKeyStore struct {
+	sync.Mutex
+	dir string
+}
+
+func NewJSONDirKeyStore(dir string) *JSONDirKeyStore {
+	return &JSONDirKeyStore{dir: dir}
+}
+
+type jsonBond struct {
+	Address       string `json:"address"`
+	AddressType   string `json:"addressType"`
+	Central       bool   `json:"central"`
+	EDIV          uint16 `json:"ediv"`
+	Rand          uint64 `json:"rand"`
+	LTK           string `json:"ltk"`
+	Authenticated bool   `json:"authenticated"`
+	SecureConn    bool   `json:"secureConnections"`
+	KeySize       int    `json:"keySize,omitempty"`
+	PeerIRK       string `json:"peerIRK,omitempty"`
+	PeerCSRK      string `json:"peerCSRK,omitempty"`
+	LocalIRK      string `json:"localIRK,omitempty"`
+	LocalCSRK     string `json:"localCSRK,omitempty"`
+
+	LocalSignCounter uint32 `json:"localSignCounter,omitempty"`
+	PeerSignCounter  uint32 `json:"peerSignCounter,omitempty"`
+
+	Created  time.Time `json:"created"`
+	LastUsed time.Time `json:"lastUsed"`
+}
+
+type jsonLocal struct {
+	IRK string `json:"irk"`
+}
+
+const jsonLocalFile = "local.json"
+
+func jsonKeyEncode(key [16]byte, valid bool) string {
+	if !valid {
+		return ""
+	}
+	return hex.EncodeToString(key[:])
+}
+
+func jsonKeyDecode(value string) ([16]byte, bool, error) {
+	var key [16]byte
+	if value == "" {
+		return key, false, nil
+	}
+
+	data, err := hex.DecodeString(value)
+	if err != nil || len(data) != len(key) {
+		return key, false, ErrorInvalidKey
+	}
+	copy(key[:], data)
+	return key, true, nil
+}
+
+func jsonAddrType(t bleutil.MacAddrType) string {
+	if t&1 == 1 {
+		return "random"
+	}
+	return "public"
+}
+
+func (j *JSONDirKeyStore) bondFile(addr bleutil.BLEAddr) string {
+	addr = bondAddr(addr)
+	return filepath.Join(j.dir, fmt.Sprintf("bond-%012x-%s.json", uint64(addr.MacAddr), jsonAddrType(addr.MacAddrType)))
+}
+
+func (j *JSONDirKeyStore) readFile(name string, value interface{}) error {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, value)
+}
+
+func (j *JSONDirKeyStore) writeFile(name string, value interface{}) error {
+	data, err := json.MarshalIndent(value, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(j.dir, 0o700)
+	if err != nil {
+		return err
+	}
+
+	/* Write and rename so a crash never leaves a truncated bond behind */
+	tmpName := name + ".tmp"
+	err = os.WriteFile(tmpName, append(data, '\n'), 0o600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpName, name)
+}
+
+func (j *JSONDirKeyStore) decodeBond(name string) (Bond, error) {
+	var jb jsonBond
+	err := j.readFile(name, &jb)
+	if err != nil {
+		return Bond{}, err
+	}
+
+	bond := Bond{
+		Central:       jb.Central,
+		EDIV:          jb.EDIV,
+		Rand:          jb.Rand,
+		Authenticated: jb.Authenticated,
+		Bonded:        true,
+
+		SecureConnections: jb.SecureConn,
+		KeySize:           jb.KeySize,
+		Created:           jb.Created,
+		LastUsed:          jb.LastUsed,
+
+		LocalSignCounter: jb.LocalSignCounter,
+		PeerSignCounter:  jb.PeerSignCounter,
+	}
+
+	bond.Address.MacAddr, err = bleutil.MacAddrFromString(jb.Address)
+	if err != nil {
+		return Bond{}, err
+	}
+	if jb.AddressType == "random" {
+		bond.Address.MacAddrType = bleutil.MacAddrRandom
+	}
+
+	var ltkValid bool
+	for _, m := range []struct {
+		value string
+		key   *[16]byte
+		valid *bool
+	}{
+		{jb.LTK, &bond.LTK, &ltkValid},
+		{jb.PeerIRK, &bond.PeerIRK, &bond.PeerIRKValid},
+		{jb.PeerCSRK, &bond.PeerCSRK, &bond.PeerCSRKValid},
+		{jb.LocalIRK, &bond.LocalIRK, &bond.LocalIRKValid},
+		{jb.LocalCSRK, &bond.LocalCSRK, &bond.LocalCSRKValid},
+	} {
+		*m.key, *m.valid, err = jsonKeyDecode(m.value)
+		if err != nil {
+			return Bond{}, err
+		}
+	}
+	if !ltkValid {
+		return Bond{}, ErrorInvalidKey
+	}
+
+	return bond, nil
+}
+
+func (j *JSONDirKeyStore) Get(addr bleutil.BLEAddr) (Bond, error) {
+	j.Lock()
+	defer j.Unlock()
+
+	bond, err := j.decodeBond(j.bondFile(addr))
+	if os.IsNotExist(err) {
+		return Bond{}, ErrorBondNotFound
+	}
+	return bond, err
+}
+
+func (j *JSONDirKeyStore) Put(bond Bond) error {
+	j.Lock()
+	defer j.Unlock()
+
+	return j.writeBond(bond)
+}
+
+func (j *JSONDirKeyStore) Update(addr bleutil.BLEAddr, fn func(bond *Bond) error) error {
+	j.Lock()
+	defer j.Unlock()
+
+	bond, err := j.decodeBond(j.bondFile(addr))
+	if os.IsNotExist(err) {
+		return ErrorBondNotFound
+	} else if err != nil {
+		return err
+	}
+
+	err = fn(&bond)
+	if err != nil {
+		return err
+	}
+
+	bond.Address = bondAddr(addr)
+	return j.writeBond(bond)
+}
+
+func (j *JSONDirKeyStore) writeBond(bond Bond) error {
+	bond.Address = bondAddr(bond.Address)
+	return j.writeFile(j.bondFile(bond.Address), jsonBond{
+		Address:       bond.Address.MacAddr.String(),
+		AddressType:   jsonAddrType(bond.Address.MacAddrType),
+		Central:       bond.Central,
+		EDIV:          bond.EDIV,
+		Rand:          bond.Rand,
+		LTK:           jsonKeyEncode(bond.LTK, true),
+		Authenticated: bond.Authenticated,
+		PeerIRK:       jsonKeyEncode(bond.PeerIRK, bond.PeerIRKValid),
+		PeerCSRK:      jsonKeyEncode(bond.PeerCSRK, bond.PeerCSRKValid),
+		LocalIRK:      jsonKeyEncode(bond.LocalIRK, bond.LocalIRKValid),
+		LocalCSRK:     jsonKeyEncode(bond.LocalCSRK, bond.LocalCSRKValid),
+		SecureConn:    bond.SecureConnections,
+		KeySize:       bond.KeySize,
+		Created:       bond.Created,
+		LastUsed:      bond.LastUsed,
+
+		LocalSignCounter: bond.LocalSignCounter,
+		PeerSignCounter:  bond.PeerSignCounter,
+	})
+}
+
+func (j *JSONDirKeyStore) Delete(addr bleutil.BLEAddr) error {
+	j.Lock()
+	defer j.Unlock()
+
+	err := os.Remove(j.bondFile(addr))
+	if os.IsNotExist(err) {
+		return ErrorBondNotFound
+	}
+	return err
+}
+
+// List returns all bonds in the directory. Files that cannot be parsed
+// are skipped, so one damaged file does not hide all other bonds.
+func (j *JSONDirKeyStore) List() ([]Bond, error) {
+	j.Lock()
+	defer j.Unlock()
+
+	entries, err := os.ReadDir(j.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var result []Bond
+	for _, m := range entries {
+		name := m.Name()
+		if m.IsDir() || !strings.HasPrefix(name, "bond-") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+
+		bond, err := j.decodeBond(filepath.Join(j.dir, name))
+		if err == nil {
+			result = append(result, bond)
+		}
+	}
+
+	return sortBonds(result), nil
+}
+
+func (j *JSONDirKeyStore) GetLocalIRK() ([16]byte, bool, error) {
+	j.Lock()
+	defer j.Unlock()
+
+	var local jsonLocal
+	err := j.readFile(filepath.Join(j.dir, jsonLocalFile), &local)
+	if os.IsNotExist(err) {
+		return [16]byte{}, false, nil
+	} else if err != nil {
+		return [16]byte{}, false, err
+	}
+
+	return jsonKeyDecode(local.IRK)
+}
+
+func (j *JSONDirKeyStore) PutLocalIRK(irk [16]byte) error {
+	j.Lock()
+	defer j.Unlock()
+
+	return j.writeFile(filepath.Join(j.dir, jsonLocalFile), jsonLocal{
+		IRK: jsonKeyEncode(irk, true),
+	})
+}
@@ -0,0 +1,207 @@
+package blesmp
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bleutil "github.com/BertoldVdb/go-ble/util"
+	"github.com/BertoldVdb/go-misc/gobpersist"
+)
+
+func testKeyStoreBond(addr uint64, central bool) Bond {
+	bond := Bond{
+		Address:        bleutil.BLEAddr{MacAddr: bleutil.MacAddr(addr), MacAddrType: bleutil.MacAddrRandom},
+		Central:        central,
+		EDIV:           0x1234,
+		Rand:           0x1122334455667788,
+		Authenticated:  true,
+		Bonded:         true,
+		PeerIRKValid:   true,
+		LocalCSRKValid: true,
+
+		LocalSignCounter: 7,
+		PeerSignCounter:  3,
+
+		SecureConnections: true,
+		KeySize:           16,
+		Created:           time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC),
+		LastUsed:          time.Date(2025, 3, 2, 12, 0, 0, 0, time.UTC),
+	}
+	for i := range bond.LTK {
+		bond.LTK[i] = byte(addr) + byte(i)
+		bond.PeerIRK[i] = byte(i)
+		bond.LocalCSRK[i] = 0xFF - byte(i)
+	}
+	return bond
+}
+
+// testKeyStore checks the behaviour every KeyStore implementation must
+// share. reopen returns a store backed by the same storage, or the same
+// store for volatile implementations.
+func testKeyStore(t *testing.T, store KeyStore, reopen func() KeyStore) {
+	t.Helper()
+
+	if _, ok, err := store.GetLocalIRK(); ok || err != nil {
+		t.Fatalf("fresh store has a local IRK (%v)", err)
+	}
+	if bonds, err := store.List(); len(bonds) != 0 || err != nil {
+		t.Fatalf("fresh store has bonds: %v (%v)", bonds, err)
+	}
+
+	a := testKeyStoreBond(0x4a1122334455, true)
+	b := testKeyStoreBond(0xc01122334455, false)
+	b.PeerIRK, b.PeerIRKValid = [16]byte{}, false
+	for _, bond := range []Bond{b, a} {
+		if err := store.Put(bond); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.PutLocalIRK([16]byte{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	store = reopen()
+
+	/* Resolved identity addresses find the same bond */
+	lookup := a.Address
+	lookup.MacAddrType = bleutil.MacAddrStaticIdentity
+	if got, err := store.Get(lookup); err != nil || got != a {
+		t.Errorf("get: %+v (%v)", got, err)
+	}
+	if bonds, err := store.List(); err != nil || len(bonds) != 2 || bonds[0] != a || bonds[1] != b {
+		t.Errorf("list: %+v (%v)", bonds, err)
+	}
+	if irk, ok, err := store.GetLocalIRK(); !ok || err != nil || irk != [16]byte{1, 2, 3} {
+		t.Errorf("local IRK: %x %v (%v)", irk, ok, err)
+	}
+
+	/* Update only stores the change if fn succeeds */
+	if err := store.Update(lookup, func(bond *Bond) error {
+		bond.PeerSignCounter = 10
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Update(a.Address, func(bond *Bond) error {
+		bond.PeerSignCounter = 20
+		return ErrorSignatureReplay
+	}); err != ErrorSignatureReplay {
+		t.Errorf("failed update: %v", err)
+	}
+	a.PeerSignCounter = 10
+	if got, err := reopen().Get(a.Address); err != nil || got != a {
+		t.Errorf("get after update: %+v (%v)", got, err)
+	}
+
+	if err := store.Delete(a.Address); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete(a.Address); err != ErrorBondNotFound {
+		t.Errorf("second delete: %v", err)
+	}
+	if err := store.Update(a.Address, func(bond *Bond) error { return nil }); err != ErrorBondNotFound {
+		t.Errorf("update of deleted bond: %v", err)
+	}
+
+	store = reopen()
+	if _, err := store.Get(a.Address); err != ErrorBondNotFound {
+		t.Errorf("deleted bond found: %v", err)
+	}
+	if bonds, _ := store.List(); len(bonds) != 1 || bonds[0] != b {
+		t.Errorf("list after delete: %+v", bonds)
+	}
+}
+
+func TestMemoryKeyStore(t *testing.T) {
+	store := NewMemoryKeyStore()
+	testKeyStore(t, store, func() KeyStore { return store })
+}
+
+func TestGobKeyStore(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "smp.gob")
+
+	open := func() KeyStore {
+		store := NewGobKeyStore(name)
+		if err := store.Load(); err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		return store
+	}
+	testKeyStore(t, open(), open)
+}
+
+func TestJSONDirKeyStore(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "bonds")
+
+	open := func() KeyStore { return NewJSONDirKeyStore(dir) }
+	testKeyStore(t, open(), open)
+
+	/* Damaged files are skipped by List */
+	if err := os.WriteFile(filepath.Join(dir, "bond-000000000001-public.json"), []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if bonds, err := open().List(); err != nil || len(bonds) != 1 {
+		t.Errorf("list with damaged file: %+v (%v)", bonds, err)
+	}
+}
+
+// Files written before the key store existed hold a map of raw LTK
+// entries. They are converted when loaded.
+func TestGobKeyStoreLegacy(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "smp.gob")
+
+	var central, peripheral gobLegacyKey
+	central[0] = 1
+	bleutil.MacAddr(0x112233445566).Encode(central[8:])
+	peripheral[8] = 1
+	bleutil.MacAddr(0x4a1122334455).Encode(peripheral[9:])
+	peripheral[15] = 1
+	ediv := gobLegacyKey{0, 0, 0, 0, 0, 0, 0, 0, 0, 0x34, 0x12}
+
+	/* The same peer also paired with us as central, the authenticated entry is kept */
+	var centralSame gobLegacyKey
+	centralSame[0] = 1
+	bleutil.MacAddr(0x4a1122334455).Encode(centralSame[8:])
+	centralSame[14] = 1
+
+	legacy := map[gobLegacyKey]gobLegacyLTK{
+		central:     {LTK: [16]byte{1}, Bonded: true, Authenticated: true},
+		peripheral:  {LTK: [16]byte{2}, Bonded: true, EDIV: 0x1234, Authenticated: true},
+		centralSame: {LTK: [16]byte{4}, Bonded: true},
+		ediv:        {LTK: [16]byte{2}, Bonded: true, EDIV: 0x1234},
+		{0xFF}:      {LocalIRK: [16]byte{3}, LocalIRKValid: true},
+	}
+	if err := (&gobpersist.GobPersist{Target: &legacy, Filename: name}).Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	store := NewGobKeyStore(name)
+	if err := store.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	bonds, _ := store.List()
+	if len(bonds) != 2 {
+		t.Fatalf("expected two bonds, got %+v", bonds)
+	}
+	if bonds[0].Address != (bleutil.BLEAddr{MacAddr: 0x112233445566}) || !bonds[0].Central || bonds[0].LTK[0] != 1 || !bonds[0].Authenticated {
+		t.Errorf("central bond: %+v", bonds[0])
+	}
+	if bonds[1].Address != (bleutil.BLEAddr{MacAddr: 0x4a1122334455, MacAddrType: bleutil.MacAddrRandom}) || bonds[1].Central || bonds[1].EDIV != 0x1234 || bonds[1].LTK[0] != 2 {
+		t.Errorf("peripheral bond: %+v", bonds[1])
+	}
+	if irk, ok, _ := store.GetLocalIRK(); !ok || irk[0] != 3 {
+		t.Error("local IRK not converted")
+	}
+
+	/* The converted data was written back in the new format */
+	store = NewGobKeyStore(name)
+	if err := store.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if bonds, _ := store.List(); len(bonds) != 2 {
+		t.Errorf("converted file not saved: %+v", bonds)
+	}
+}
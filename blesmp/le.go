@@ -38,14 +38,15 @@ drain:
 	}
 }
 
-func (s *SMPConn) leSetKeyFlagsFromLTK(ltk smpStoredLTK) {
+func (s *SMPConn) leSetKeyFlagsFromLTK(ltk Bond) {
 	s.keyMutex.Lock()
 	s.keyIsBonded = ltk.Bonded
 	s.keyIsAuthenticated = ltk.Authenticated
+	s.keySize = ltk.KeySize
 	s.keyMutex.Unlock()
 }
 
-func (c *SMPConn) leEncrypt(ltk smpStoredLTK) error {
+func (c *SMPConn) leEncrypt(ltk Bond) error {
 	raw := c.rawConnLE()
 
 	return c.leEncryptWait(func() error {
@@ -66,27 +67,58 @@ func (s *SMP) connmgrLEGetKey(conn *hciconnmgr.Connection, event *hcievents.LELo
 		return nil, event
 	}
 
-	s.storedKeysPersist.Lock()
-	ltk, ok := s.storedKeys[makeSMPStoredLTKMapKey(false, smpConn.addrLELocal, smpConn.addrLERemote, event.EncryptedDiversifier, event.RandomNumber)]
-	s.storedKeysPersist.Unlock()
+	ltk, ok := s.findPeripheralKey(smpConn, event.EncryptedDiversifier, event.RandomNumber)
 	if !ok {
 		return nil, event
 	}
 
 	smpConn.leSetKeyFlagsFromLTK(ltk)
+	if ltk.Bonded {
+		s.touchBond(ltk.Address)
+	}
 
 	return ltk.LTK[:], event
 }
 
+func (s *SMP) findPeripheralKey(smpConn *SMPConn, ediv uint16, rand uint64) (Bond, bool) {
+	smpConn.keyMutex.Lock()
+	session, sessionValid := smpConn.keySession, smpConn.keySessionValid
+	smpConn.keyMutex.Unlock()
+
+	match := func(bond Bond) bool {
+		return !bond.Central && bond.EDIV == ediv && bond.Rand == rand
+	}
+
+	if sessionValid && match(session) {
+		return session, true
+	}
+
+	bond, err := s.keys.Get(smpConn.addrLEIdentity)
+	if err == nil && match(bond) {
+		return bond, true
+	}
+
+	/* A legacy LTK is identified by EDIV/Rand, so it can be found even
+	   when the address of the peer could not be resolved */
+	if ediv != 0 || rand != 0 {
+		bonds, _ := s.keys.List()
+		for _, bond := range bonds {
+			if match(bond) {
+				return bond, true
+			}
+		}
+	}
+
+	return Bond{}, false
+}
+
 func (c *SMPConn) leTryEncryptLTK() error {
-	c.parent.storedKeysPersist.Lock()
-	ltk, ok := c.parent.storedKeys[makeSMPStoredLTKMapKey(true, c.addrLELocal, c.addrLERemote, 0, 0)]
-	c.parent.storedKeysPersist.Unlock()
-	if !ok {
+	ltk, err := c.parent.keys.Get(c.addrLEIdentity)
+	if err != nil || !ltk.Central {
 		return nil
 	}
 
-	err := c.leEncrypt(ltk)
+	err = c.leEncrypt(ltk)
 	if err != nil {
 		return err
 	}
@@ -97,6 +129,7 @@ func (c *SMPConn) leTryEncryptLTK() error {
 	   StateInsecure even though the link is fully encrypted, which makes
 	   GetSecurity() report unencrypted and breaks GoSecure(ctx, false). */
 	c.setState(StateSecure)
+	c.parent.touchBond(ltk.Address)
 
 	return nil
 }
@@ -0,0 +1,54 @@
+package blesmp
+
+import (
+	"github.com/BertoldVdb/go-ble/hci"
+	bleutil "github.com/BertoldVdb/go-ble/util"
+)
+
+// GenerateRPA returns a new resolvable private address for the local IRK.
+func (s *SMP) GenerateRPA() (bleutil.MacAddr, error) {
+	return CryptoGenerateRPA(s.localIRK)
+}
+
+// ResolvingList returns one entry for every bonded peer that distributed
+// its identity.
+func (s *SMP) ResolvingList() []hci.ResolvingListEntry {
+	bonds, _ := s.keys.List()
+
+	var result []hci.ResolvingListEntry
+	for _, m := range bonds {
+		if m.PeerIRKValid {
+			result = append(result, hci.ResolvingListEntry{
+				PeerIdentity: m.Address,
+				PeerIRK:      m.PeerIRK,
+				LocalIRK:     s.localIRK,
+			})
+		}
+	}
+
+	return result
+}
+
+// ResolveAddress tries to resolve a resolvable private address against the
+// IRKs of all bonded peers. On success the identity address of the peer
+// is returned.
+func (s *SMP) ResolveAddress(addr bleutil.BLEAddr) (bleutil.BLEAddr, bool) {
+	if !addr.IsResolvablePrivate() {
+		return addr, false
+	}
+
+	bonds, _ := s.keys.List()
+	for _, m := range bonds {
+		if m.PeerIRKValid && CryptoResolveRPA(m.PeerIRK, addr.MacAddr) {
+			return m.Address, true
+		}
+	}
+
+	return addr, false
+}
+
+// RemoteIdentity returns the identity address of the peer if its address
+// could be resolved, otherwise the address it is connected with.
+func (c *SMPConn) RemoteIdentity() bleutil.BLEAddr {
+	return c.addrLEIdentity
+}
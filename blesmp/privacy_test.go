@@ -0,0 +1,72 @@
+package blesmp
+
+import (
+	"testing"
+
+	bleutil "github.com/BertoldVdb/go-ble/util"
+)
+
+// A bonded peer that distributed its IRK is found again from any address
+// it generates, and it shows up in the resolving list.
+func TestResolveAddress(t *testing.T) {
+	s := newTestSMP(0x44)
+
+	identity := bleutil.BLEAddr{MacAddr: 0x112233445566, MacAddrType: bleutil.MacAddrPublic}
+	peerIRK := [16]byte{0xA0, 0xA1, 0xA2}
+	s.keys.Put(Bond{Address: identity, Bonded: true, PeerIRK: peerIRK, PeerIRKValid: true})
+	s.keys.Put(Bond{Address: bleutil.BLEAddr{MacAddr: 0x665544332211}, Bonded: true})
+
+	rpa, err := CryptoGenerateRPA(peerIRK)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, ok := s.ResolveAddress(bleutil.BLEAddr{MacAddr: rpa, MacAddrType: bleutil.MacAddrRandom})
+	if !ok || got != identity {
+		t.Errorf("resolved to %s (%v)", got, ok)
+	}
+
+	other, err := CryptoGenerateRPA([16]byte{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.ResolveAddress(bleutil.BLEAddr{MacAddr: other, MacAddrType: bleutil.MacAddrRandom}); ok {
+		t.Error("unknown address resolved")
+	}
+	if _, ok := s.ResolveAddress(bleutil.BLEAddr{MacAddr: rpa, MacAddrType: bleutil.MacAddrPublic}); ok {
+		t.Error("public address resolved")
+	}
+
+	list := s.ResolvingList()
+	if len(list) != 1 || list[0].PeerIdentity != identity || list[0].PeerIRK != peerIRK || list[0].LocalIRK != s.localIRK {
+		t.Errorf("unexpected resolving list: %+v", list)
+	}
+}
+
+// The local IRK is generated once and then kept in the key store, unless
+// one is configured.
+func TestLoadLocalIRK(t *testing.T) {
+	s := newTestSMP(0)
+	if err := s.loadLocalIRK(); err != nil {
+		t.Fatal(err)
+	}
+	first := s.LocalIRK()
+	if first == ([16]byte{}) {
+		t.Fatal("no IRK generated")
+	}
+
+	if err := s.loadLocalIRK(); err != nil {
+		t.Fatal(err)
+	}
+	if s.LocalIRK() != first {
+		t.Error("IRK changed on reload")
+	}
+
+	s.config.IdentityResolvingKey = [16]byte{9}
+	if err := s.loadLocalIRK(); err != nil {
+		t.Fatal(err)
+	}
+	if s.LocalIRK() != s.config.IdentityResolvingKey {
+		t.Error("configured IRK not used")
+	}
+}
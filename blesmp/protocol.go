@@ -9,6 +9,7 @@ import (
 
 	crand "crypto/rand"
 	"crypto/subtle"
+	"time"
 )
 
 type smpFsmState int
@@ -46,7 +47,14 @@ type smpProtocol struct {
 	pairingLTKComplete bool
 	pairingLTKValid    bool
 	pairingEDIVValid   bool
-	pairingLTK         smpStoredLTK
+	pairingLTK         Bond
+
+	/* Key distribution bits still to be received from and sent to the
+	   peer, negotiated in the Pairing Request/Response */
+	pairingKeysRemote byte
+	pairingKeysLocal  byte
+	pairingKeysDone   bool
+	pairingIRKValid   bool
 
 	/* LE Secure Connections — populated only when both sides agree on
 	   the SC bit during the Pairing Request/Response exchange. All
@@ -143,7 +151,11 @@ func (c *SMPConn) sendPairingRequestResponse(initiator bool) {
 	c.protocol.pairingEDIVValid = false
 	c.protocol.pairingLTKComplete = false
 	c.protocol.pairingKeySize = 16
-	c.protocol.pairingLTK.Authenticated = false
+	c.protocol.pairingLTK = Bond{Address: c.addrLEIdentity}
+	c.protocol.pairingKeysRemote = 0
+	c.protocol.pairingKeysLocal = 0
+	c.protocol.pairingKeysDone = false
+	c.protocol.pairingIRKValid = false
 
 	authReq := c.secureAuthReq
 	// Always advertise SC capability when the implementation can do it
@@ -158,13 +170,16 @@ func (c *SMPConn) sendPairingRequestResponse(initiator bool) {
 		byte(c.protocol.pairingKeySize),
 	}
 
-	/* Ask for EncKey if we will bond */
+	/* Ask for the keys if we will bond. As initiator we do not hand out
+	   an LTK of our own: it would only be used if the roles were swapped. */
 	if c.secureAuthReq&0x1 > 0 {
 		if initiator {
-			req[6] = 1
+			req[5] = keyDistIdKey | keyDistSignKey
+			req[6] = keyDistEncKey | keyDistIdKey | keyDistSignKey
 		} else {
 			/* Only if other side asked for it */
-			req[6] = c.protocol.pairingRequest[6] & 1
+			req[5] = c.protocol.pairingRequest[5] & (keyDistIdKey | keyDistSignKey)
+			req[6] = c.protocol.pairingRequest[6] & (keyDistEncKey | keyDistIdKey | keyDistSignKey)
 		}
 	}
 
@@ -192,10 +207,14 @@ func (c *SMPConn) signalPairingFailed(reason smpFailedReason) {
 	/* Wipe in-progress LTK material so a stale partial LTK from this
 	   pairing attempt cannot leak into a subsequent attempt or be
 	   mistakenly accepted as bonded. */
-	c.protocol.pairingLTK = smpStoredLTK{}
+	c.protocol.pairingLTK = Bond{}
 	c.protocol.pairingLTKValid = false
 	c.protocol.pairingEDIVValid = false
 	c.protocol.pairingLTKComplete = false
+	c.protocol.pairingKeysRemote = 0
+	c.protocol.pairingKeysLocal = 0
+	c.protocol.pairingKeysDone = false
+	c.protocol.pairingIRKValid = false
 	c.protocol.pairingTK = [16]byte{}
 	c.protocol.pairingSTK = [16]byte{}
 
@@ -319,6 +338,7 @@ func (c *SMPConn) handleStageConfirm(initiator bool) bool {
 func (c *SMPConn) handlePairingRequest(req []byte) {
 	copy(c.protocol.pairingRequest[:], req)
 	c.sendPairingRequestResponse(false)
+	c.keyDistributionSetup()
 
 	if c.scNegotiated() {
 		c.protocol.scActive = true
@@ -333,6 +353,7 @@ func (c *SMPConn) handlePairingRequest(req []byte) {
 
 func (c *SMPConn) handlePairingResponse(resp []byte) {
 	copy(c.protocol.pairingResponse[:], resp)
+	c.keyDistributionSetup()
 
 	if c.scNegotiated() {
 		c.protocol.scActive = true
@@ -394,7 +415,7 @@ func (c *SMPConn) handlePairingRandom(rand []byte) {
 	c.updateTimeout(false)
 
 	if c.isCentral {
-		err := c.leEncrypt(smpStoredLTK{
+		err := c.leEncrypt(Bond{
 			LTK:           c.protocol.pairingSTK,
 			Authenticated: c.protocol.pairingLTK.Authenticated,
 		})
@@ -414,7 +435,8 @@ func (c *SMPConn) handlePairingRandom(rand []byte) {
 		c.protocol.pairingLTK.EDIV = binary.LittleEndian.Uint16(bytes[:])
 		c.protocol.pairingLTK.Rand = binary.LittleEndian.Uint64(bytes[2:])
 		c.protocol.pairingLTK.LTK = c.protocol.pairingSTK
-		c.protocol.pairingLTK.Bonded = c.protocol.pairingResponse[6]&1 > 0
+		c.protocol.pairingLTK.Bonded = c.protocol.pairingResponse[6]&keyDistEncKey > 0
+		c.protocol.pairingLTKComplete = true
 		c.updateLTK()
 
 		err = c.leEncryptWait(func() error {
@@ -429,113 +451,71 @@ func (c *SMPConn) handlePairingRandom(rand []byte) {
 			return
 		}
 
-		if c.protocol.pairingLTK.Bonded {
-			/* Send LTK, then EDIV/RAND */
-			buf := bleutil.GetBuffer(1)
-			buf.Buf()[0] = byte(opcodeKDEncryptionInformation)
-			buf.Append(c.protocol.pairingLTK.LTK[:]...)
-			c.sendBuf(buf)
-
-			buf = bleutil.GetBuffer(1)
-			buf.Buf()[0] = byte(opcodeKDIdentification)
-			binary.LittleEndian.PutUint16(buf.ExtendRight(2), c.protocol.pairingLTK.EDIV)
-			binary.LittleEndian.PutUint64(buf.ExtendRight(8), c.protocol.pairingLTK.Rand)
-			c.sendBuf(buf)
+		/* The responder distributes its keys first */
+		if err := c.sendKeyDistribution(); err != nil {
+			c.sendPairingFailed(failedUnspecifiedReason)
+			return
 		}
 	}
 
 	c.setState(StateSecure)
 
 	c.protocol.state = smpKeyDistribution
+	c.keyDistributionCheck()
 }
 
+// updateLTK makes the pairing key the session key of the connection. The bond is only stored
+// by saveBond, once key distribution told us who the peer is.
 func (c *SMPConn) updateLTK() {
+	bond := c.protocol.pairingLTK
+	bond.Address = bondAddr(bond.Address)
+	bond.Central = c.isCentral
+	bond.SecureConnections = c.scNegotiated()
+	bond.KeySize = c.protocol.pairingKeySize
+	bond.Created = time.Now()
+	bond.LastUsed = bond.Created
+
+	/* The session key answers LELongTermKeyRequest events for this
+	   connection, also when the peers did not bond */
+	c.keyMutex.Lock()
+	c.keySession = bond
+	c.keySessionValid = true
+	c.keyMutex.Unlock()
+
+	c.leSetKeyFlagsFromLTK(bond)
+}
+
+// saveBond stores the session key under the identity address of the peer. A peer that paired
+// before keeps its creation time.
+func (c *SMPConn) saveBond() {
+	c.keyMutex.Lock()
+	bond := c.keySession
+	c.keyMutex.Unlock()
+
 	/* In production c.parent is always set. Tests construct an SMPConn
-	   in isolation; for those we just update the in-memory key flags
-	   and skip the shared key store. */
-	if c.parent == nil {
-		c.leSetKeyFlagsFromLTK(c.protocol.pairingLTK)
+	   in isolation; for those we only keep the session key. Non-bonded
+	   keys should not survive the connection. */
+	if c.parent == nil || !bond.Bonded {
 		return
 	}
 
-	c.parent.storedKeysPersist.Lock()
-	if !c.isCentral {
-		c.parent.storedKeys[makeSMPStoredLTKMapKey(c.isCentral, c.addrLELocal, c.addrLERemote, 0, 0)] = c.protocol.pairingLTK
-	}
-	c.parent.storedKeys[makeSMPStoredLTKMapKey(c.isCentral, c.addrLELocal, c.addrLERemote, c.protocol.pairingLTK.EDIV, c.protocol.pairingLTK.Rand)] = c.protocol.pairingLTK
-	c.parent.storedKeysPersist.Unlock()
-
-	/* Persist to disk only for bonded keys. Non-bonded LTKs are kept
-	   in-memory so the LELongTermKeyRequest handler can find them for
-	   the duration of the session, but should not survive a restart. */
-	var err error
-	if c.protocol.pairingLTK.Bonded {
-		err = c.parent.storedKeysPersist.Save()
+	if old, err := c.parent.keys.Get(bond.Address); err == nil && !old.Created.IsZero() {
+		bond.Created = old.Created
 	}
+	err := c.parent.keys.Put(bond)
 
-	c.leSetKeyFlagsFromLTK(c.protocol.pairingLTK)
+	/* The counters of the old keys must not be written over the new bond */
+	c.signingReload()
 
 	c.logger.WithError(err).WithFields(logrus.Fields{
-		"0ediv":   c.protocol.pairingLTK.EDIV,
-		"1rand":   c.protocol.pairingLTK.Rand,
-		"2bonded": c.protocol.pairingLTK.Bonded,
-		"3auth":   c.protocol.pairingLTK.Authenticated,
+		"0ediv":   bond.EDIV,
+		"1rand":   bond.Rand,
+		"2bonded": bond.Bonded,
+		"3auth":   bond.Authenticated,
+		"4addr":   bond.Address,
 	}).Info("LTK saved")
 }
 
-func (c *SMPConn) handleKeyDistribution(opcode smpOpcode, data []byte) bool {
-	handleLTK := func() {
-		if !c.protocol.pairingEDIVValid || !c.protocol.pairingLTKValid {
-			return
-		}
-
-		if c.protocol.pairingLTKComplete {
-			return
-		}
-
-		c.protocol.pairingLTKComplete = true
-		c.protocol.pairingLTK.Bonded = true
-
-		c.updateLTK()
-	}
-
-	if opcode == opcodeKDIdentification && len(data) == 10 {
-		c.protocol.pairingEDIVValid = true
-		c.protocol.pairingLTK.EDIV = binary.LittleEndian.Uint16(data)
-		c.protocol.pairingLTK.Rand = binary.LittleEndian.Uint64(data[2:])
-
-		handleLTK()
-		return true
-	}
-	if opcode == opcodeKDEncryptionInformation && len(data) == 16 {
-		c.protocol.pairingLTKValid = true
-		copy(c.protocol.pairingLTK.LTK[:], data)
-
-		handleLTK()
-		return true
-	}
-	/* Other valid key-distribution PDUs (IRK, IdentityAddress, CSRK) are not
-	   yet processed by this implementation. Silently accept them — the spec
-	   permits the peer to send any keys it advertised in the pairing
-	   request/response, and failing the connection here would prevent
-	   pairing with stacks that always send IRK/CSRK. */
-	switch opcode {
-	case opcodeKDIdentityInformation:
-		if len(data) == 16 {
-			return true
-		}
-	case opcodeKDIdentityAddressInformation:
-		if len(data) == 7 {
-			return true
-		}
-	case opcodeKDSigningInformation:
-		if len(data) == 16 {
-			return true
-		}
-	}
-	return false
-}
-
 func (c *SMPConn) handleMessage(pdu *pdu.PDU) bool {
 	if pdu.Len() < 1 {
 		return false
@@ -612,6 +592,10 @@ func (c *SMPConn) handleMessage(pdu *pdu.PDU) bool {
 			c.handlePairingRandom(pdu.Buf()[1:])
 			return false
 		}
+	case smpKeyDistribution:
+		if c.handleKeyDistribution(opcode, pdu.Buf()[1:]) {
+			return false
+		}
 	}
 
 	c.sendPairingFailed(failedCommandNotSupported)
@@ -80,7 +80,7 @@ func newTestSMPConn(t *testing.T, isCentral bool) (*SMPConn, *fakeBufferConn) {
 			MacAddrType: bleutil.MacAddrPublic,
 		},
 		secureAuthReq:   4 | 1 | 0x08, // include SC bit
-		testEncryptHook: func(ltk smpStoredLTK) error { return nil },
+		testEncryptHook: func(ltk Bond) error { return nil },
 	}
 	return c, conn
 }
@@ -602,7 +602,7 @@ func TestSignalPairingFailedStateTransition(t *testing.T) {
 // assertion conn.SMPConn.(*SMPConn) and crashed.
 func TestSMPCallbacksSafeWithoutSMPConn(t *testing.T) {
 	s := &SMP{
-		storedKeys: make(map[smpStoredLTKMapKey]smpStoredLTK),
+		keys: NewMemoryKeyStore(),
 	}
 
 	defer func() {
@@ -631,7 +631,7 @@ type fakeConnNoSMP struct{}
 func TestSCEncryptHookFires(t *testing.T) {
 	called := false
 	c, _ := newTestSMPConn(t, true)
-	c.testEncryptHook = func(ltk smpStoredLTK) error {
+	c.testEncryptHook = func(ltk Bond) error {
 		called = true
 		return errors.New("hook invoked")
 	}
@@ -512,7 +512,7 @@ func (c *SMPConn) scHandleDHKeyCheck(data []byte) {
 		// Encrypt with the new LTK.
 		c.protocol.pairingLTK.LTK = c.protocol.scLTK
 		c.protocol.pairingLTK.Authenticated = c.protocol.scAlgorithm != scAlgorithmJustWorks
-		ltk := smpStoredLTK{
+		ltk := Bond{
 			LTK:           c.protocol.scLTK,
 			Authenticated: c.protocol.pairingLTK.Authenticated,
 		}
@@ -555,12 +555,11 @@ func (c *SMPConn) scComplete() {
 	c.protocol.pairingEDIVValid = true
 	c.protocol.pairingLTKComplete = true
 
-	/* Stash the LTK in the in-memory store regardless of bonding. The
-	   peripheral's LELongTermKeyRequest handler only consults
-	   storedKeys, so without this entry a non-bonded SC session cannot
-	   complete encryption — the peripheral would NegativeReply and the
-	   central would see encryption fail. The on-disk persistence is
-	   gated on bonding so non-bonded keys don't leak across restarts. */
+	/* Keep the LTK as session key regardless of bonding. Without it the
+	   peripheral's LELongTermKeyRequest handler cannot find the key of a
+	   non-bonded SC session — the peripheral would NegativeReply and the
+	   central would see encryption fail. The key store only receives
+	   bonded keys so non-bonded keys don't leak across restarts. */
 	c.updateLTK()
 
 	c.leSetKeyFlagsFromLTK(c.protocol.pairingLTK)
@@ -596,6 +595,8 @@ func (c *SMPConn) scComplete() {
 	if c.isCentral {
 		c.setState(StateSecure)
 	}
+
+	c.keyDistributionCheck()
 }
 
 // scHandleMessage routes incoming SMP PDUs to the SC handlers when SC
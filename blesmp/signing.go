@@ -0,0 +1,191 @@
+package blesmp
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+var (
+	ErrorNoSigningKey     = errors.New("No signing key for peer")
+	ErrorSignatureInvalid = errors.New("Signature is invalid")
+	ErrorSignatureReplay  = errors.New("Sign counter was used before")
+	ErrorSignCounterLimit = errors.New("Sign counter reached its maximum")
+)
+
+// CryptoSign calculates the authentication signature of msg (Vol 3, Part H, 2.4.5). The CSRK
+// and the signature use the byte order of the PDU: the signature is the 32 bit counter followed
+// by the 64 bit MAC.
+func CryptoSign(csrk [16]byte, counter uint32, msg []byte) [12]byte {
+	m := make([]byte, len(msg)+4)
+	copy(m, msg)
+	binary.LittleEndian.PutUint32(m[len(msg):], counter)
+
+	var key [16]byte
+	copy(key[:], reversed(csrk[:]))
+	mac := CryptoAESCMAC(key, reversed(m))
+
+	/* The MAC is the most significant half of the CMAC */
+	var signature [12]byte
+	binary.LittleEndian.PutUint32(signature[:], counter)
+	copy(signature[4:], reversed(mac[:8]))
+	return signature
+}
+
+/* Sign counters of a bond are written back after this many uses and when the connection closes */
+const signSaveInterval = 32
+
+// signingUpdate runs fn on the keys of the peer. The counters of a bond are kept with the
+// connection and saved in batches, the local counter skips the values that may have been used
+// after the last save. If the peers did not bond the keys of the session are used, their counters
+// are lost with the connection.
+func (c *SMPConn) signingUpdate(fn func(bond *Bond) error) error {
+	s := c.parent
+	s.signMutex.Lock()
+	defer s.signMutex.Unlock()
+
+	if !c.signBondValid {
+		bond, err := s.keys.Get(c.addrLEIdentity)
+		if err == nil {
+			bond.LocalSignCounter += signSaveInterval
+			c.signBond = bond
+			c.signBondValid = true
+
+			/* Save the skipped counter before it is used */
+			c.signUnsaved = signSaveInterval
+		}
+	}
+
+	if c.signBondValid {
+		err := fn(&c.signBond)
+		if err != nil {
+			return err
+		}
+
+		c.signUnsaved++
+		if c.signUnsaved >= signSaveInterval {
+			return c.signingSave()
+		}
+		return nil
+	}
+
+	c.keyMutex.Lock()
+	defer c.keyMutex.Unlock()
+
+	if !c.keySessionValid {
+		return ErrorNoSigningKey
+	}
+	return fn(&c.keySession)
+}
+
+// signingSave writes the cached counters back to the bond, signMutex must be held. A bond that
+// was deleted or paired again in the meantime is left alone and loaded again on the next use.
+func (c *SMPConn) signingSave() error {
+	cached := c.signBond
+	c.signUnsaved = 0
+
+	stale := false
+	err := c.parent.keys.Update(c.addrLEIdentity, func(bond *Bond) error {
+		/* Paired again, the counters belong to other keys */
+		if bond.LocalCSRK != cached.LocalCSRK || bond.PeerCSRK != cached.PeerCSRK {
+			stale = true
+			return ErrorBondNotFound
+		}
+
+		bond.LocalSignCounter = cached.LocalSignCounter
+		bond.PeerSignCounter = cached.PeerSignCounter
+		return nil
+	})
+
+	if stale || err == ErrorBondNotFound {
+		c.signBondValid = false
+		return nil
+	}
+	return err
+}
+
+// signingFlush saves the counters that were not written yet, it is called when the connection
+// closes
+func (c *SMPConn) signingFlush() error {
+	if c.parent == nil {
+		return nil
+	}
+
+	s := c.parent
+	s.signMutex.Lock()
+	defer s.signMutex.Unlock()
+
+	if !c.signBondValid || c.signUnsaved == 0 {
+		return nil
+	}
+	return c.signingSave()
+}
+
+// signingReload drops the cached bond after pairing replaced it
+func (c *SMPConn) signingReload() {
+	if c.parent == nil {
+		return
+	}
+
+	s := c.parent
+	s.signMutex.Lock()
+	c.signBondValid = false
+	s.signMutex.Unlock()
+}
+
+// SignData returns the signature the peer needs to verify msg, which is the complete PDU
+// without the signature. Each call uses the next value of the sign counter.
+func (c *SMPConn) SignData(msg []byte) ([12]byte, error) {
+	var signature [12]byte
+
+	err := c.signingUpdate(func(bond *Bond) error {
+		if !bond.LocalCSRKValid {
+			return ErrorNoSigningKey
+		}
+
+		/* The counter can not advance past its maximum without repeating */
+		if bond.LocalSignCounter == math.MaxUint32 {
+			return ErrorSignCounterLimit
+		}
+
+		signature = CryptoSign(bond.LocalCSRK, bond.LocalSignCounter, msg)
+		bond.LocalSignCounter++
+		return nil
+	})
+
+	return signature, err
+}
+
+// VerifySignedData checks the signature of msg received from the peer. A counter that is not
+// larger than the last accepted one is rejected, so a captured PDU can not be replayed. The
+// maximum counter is rejected too, as accepting it would wrap the expected one. The result tells
+// if the signing key came from an authenticated pairing.
+func (c *SMPConn) VerifySignedData(msg []byte, signature [12]byte) (bool, error) {
+	authenticated := false
+
+	err := c.signingUpdate(func(bond *Bond) error {
+		if !bond.PeerCSRKValid {
+			return ErrorNoSigningKey
+		}
+
+		counter := binary.LittleEndian.Uint32(signature[:])
+		if counter < bond.PeerSignCounter {
+			return ErrorSignatureReplay
+		}
+		if counter == math.MaxUint32 {
+			return ErrorSignCounterLimit
+		}
+
+		expected := CryptoSign(bond.PeerCSRK, counter, msg)
+		if subtle.ConstantTimeCompare(expected[:], signature[:]) != 1 {
+			return ErrorSignatureInvalid
+		}
+
+		bond.PeerSignCounter = counter + 1
+		authenticated = bond.Authenticated
+		return nil
+	})
+
+	return authenticated, err
+}
@@ -0,0 +1,146 @@
+package blesmp
+
+import (
+	"bytes"
+	"math"
+	"testing"
+
+	bleutil "github.com/BertoldVdb/go-ble/util"
+)
+
+// Derived from RFC 4493 example 2. The message and key are reversed into
+// PDU byte order, the last four message bytes become the counter.
+func TestCryptoSign(t *testing.T) {
+	csrk := [16]byte{0x3c, 0x4f, 0xcf, 0x09, 0x88, 0x15, 0xf7, 0xab, 0xa6, 0xd2, 0xae, 0x28, 0x16, 0x15, 0x7e, 0x2b}
+	msg := []byte{0x2a, 0x17, 0x93, 0x73, 0x11, 0x7e, 0x3d, 0xe9, 0x96, 0x9f, 0x40, 0x2e}
+
+	got := CryptoSign(csrk, 0x6bc1bee2, msg)
+	want := []byte{0xe2, 0xbe, 0xc1, 0x6b, 0x44, 0x41, 0x4d, 0x6b, 0xb4, 0x16, 0x0a, 0x07}
+	if !bytes.Equal(got[:], want) {
+		t.Errorf("signature %x, want %x", got, want)
+	}
+}
+
+func TestSignedDataExchange(t *testing.T) {
+	csrk := [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	addrA := bleutil.BLEAddr{MacAddr: 0x010203040506}
+	addrB := bleutil.BLEAddr{MacAddr: 0x070809ab0c0d}
+
+	signer := &SMPConn{parent: newTestSMP(1), addrLEIdentity: addrB}
+	signer.parent.keys.Put(Bond{Address: addrB, Bonded: true, LocalCSRK: csrk, LocalCSRKValid: true})
+
+	verifier := &SMPConn{parent: newTestSMP(2), addrLEIdentity: addrA}
+	verifier.parent.keys.Put(Bond{Address: addrA, Bonded: true, Authenticated: true, PeerCSRK: csrk, PeerCSRKValid: true})
+
+	msg := []byte{0xd2, 0x10, 0x00, 'h', 'i'}
+	first, err := signer.SignData(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _ := signer.SignData(msg)
+	if first == second {
+		t.Fatal("counter did not advance")
+	}
+
+	if auth, err := verifier.VerifySignedData(msg, second); err != nil || !auth {
+		t.Fatalf("verify: %v (authenticated %v)", err, auth)
+	}
+	if _, err := verifier.VerifySignedData(msg, second); err != ErrorSignatureReplay {
+		t.Errorf("replay: %v", err)
+	}
+	if _, err := verifier.VerifySignedData(msg, first); err != ErrorSignatureReplay {
+		t.Errorf("older counter: %v", err)
+	}
+
+	third, _ := signer.SignData(msg)
+	if _, err := verifier.VerifySignedData([]byte{0xd2, 0x10, 0x00, 'h', 'o'}, third); err != ErrorSignatureInvalid {
+		t.Errorf("modified message: %v", err)
+	}
+
+	/* The counters are part of the bond once the connection closes. The local one skipped the
+	   values that could have been used before a crash */
+	signer.signingFlush()
+	verifier.signingFlush()
+	if bond, _ := signer.parent.keys.Get(addrB); bond.LocalSignCounter != signSaveInterval+3 {
+		t.Errorf("local counter %d", bond.LocalSignCounter)
+	}
+	if bond, _ := verifier.parent.keys.Get(addrA); bond.PeerSignCounter != signSaveInterval+2 {
+		t.Errorf("peer counter %d", bond.PeerSignCounter)
+	}
+}
+
+// Counters are saved in batches, and never bring back a bond that was deleted.
+func TestSignCounterBatches(t *testing.T) {
+	addr := bleutil.BLEAddr{MacAddr: 0x010203040506}
+	c := &SMPConn{parent: newTestSMP(1), addrLEIdentity: addr}
+	c.parent.keys.Put(Bond{Address: addr, Bonded: true, LocalCSRK: [16]byte{1}, LocalCSRKValid: true})
+
+	stored := func() uint32 {
+		bond, _ := c.parent.keys.Get(addr)
+		return bond.LocalSignCounter
+	}
+
+	/* The skipped counter is saved before it is used */
+	c.SignData(nil)
+	if got := stored(); got != signSaveInterval+1 {
+		t.Fatalf("counter after first use %d", got)
+	}
+
+	for i := 1; i < signSaveInterval; i++ {
+		c.SignData(nil)
+	}
+	if got := stored(); got != signSaveInterval+1 {
+		t.Errorf("counter saved before the batch was full: %d", got)
+	}
+	c.SignData(nil)
+	if got := stored(); got != 2*signSaveInterval+1 {
+		t.Errorf("counter after a batch %d", got)
+	}
+
+	c.SignData(nil)
+	if err := c.parent.DeleteBond(addr); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.signingFlush(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.parent.keys.Get(addr); err != ErrorBondNotFound {
+		t.Errorf("deleted bond written back: %v", err)
+	}
+	if _, err := c.SignData(nil); err != ErrorNoSigningKey {
+		t.Errorf("sign after delete: %v", err)
+	}
+}
+
+// Peers that paired without bonding sign with the keys of the session.
+func TestSignedDataSession(t *testing.T) {
+	c := &SMPConn{parent: newTestSMP(1)}
+	if _, err := c.SignData(nil); err != ErrorNoSigningKey {
+		t.Fatalf("sign without key: %v", err)
+	}
+
+	c.keySession = Bond{LocalCSRK: [16]byte{1}, LocalCSRKValid: true, PeerCSRK: [16]byte{1}, PeerCSRKValid: true}
+	c.keySessionValid = true
+
+	signature, err := c.SignData([]byte{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth, err := c.VerifySignedData([]byte{1}, signature); err != nil || auth {
+		t.Errorf("verify: %v (authenticated %v)", err, auth)
+	}
+
+	/* The last counter would wrap the peer counter and allow replays */
+	last := CryptoSign(c.keySession.PeerCSRK, math.MaxUint32, []byte{1})
+	if _, err := c.VerifySignedData([]byte{1}, last); err != ErrorSignCounterLimit {
+		t.Errorf("verify last counter: %v", err)
+	}
+	if c.keySession.PeerSignCounter != 1 {
+		t.Errorf("peer counter %d", c.keySession.PeerSignCounter)
+	}
+
+	c.keySession.LocalSignCounter = math.MaxUint32
+	if _, err := c.SignData([]byte{1}); err != ErrorSignCounterLimit {
+		t.Errorf("sign last counter: %v", err)
+	}
+}
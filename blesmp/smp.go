@@ -2,7 +2,7 @@ package blesmp
 
 import (
 	"context"
-	"encoding/binary"
+	crand "crypto/rand"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -15,56 +15,11 @@ import (
 	hcievents "github.com/BertoldVdb/go-ble/hci/events"
 	blel2cap "github.com/BertoldVdb/go-ble/l2cap"
 	bleutil "github.com/BertoldVdb/go-ble/util"
-	"github.com/BertoldVdb/go-misc/gobpersist"
 	pdu "github.com/BertoldVdb/go-misc/pdubuf"
 	"github.com/BertoldVdb/go-misc/waitstate"
 	"github.com/sirupsen/logrus"
 )
 
-type smpStoredLTKMapKey [19]byte
-
-type smpStoredLTK struct {
-	EDIV          uint16
-	Rand          uint64
-	LTK           [16]byte
-	Authenticated bool
-	Bonded        bool
-}
-
-func makeSMPStoredLTKMapKey(isCentral bool, ia bleutil.BLEAddr, ra bleutil.BLEAddr, EDIV uint16, Rand uint64) smpStoredLTKMapKey {
-	var result smpStoredLTKMapKey
-
-	if isCentral {
-		result[0] = 1
-	}
-
-	ia.MacAddr.Encode(result[1:])
-	result[7] = byte(ia.MacAddrType & 1)
-
-	if !isCentral {
-		if EDIV == 0 && Rand == 0 {
-			/* LE Secure Connections: there is no EDIV/Rand to identify
-			   the LTK, so the key has to identify the remote (central)
-			   side. Earlier versions stored ia (= local peripheral
-			   address) twice, which made every bonded peripheral LTK
-			   keyed only on the peripheral's own address — different
-			   centrals paired with the same peripheral would collide
-			   and overwrite each other's LTKs. */
-			result[8] = 1
-			ra.MacAddr.Encode(result[9:])
-			result[15] = byte(ra.MacAddrType & 1)
-		} else {
-			binary.LittleEndian.PutUint16(result[9:], EDIV)
-			binary.LittleEndian.PutUint64(result[11:], Rand)
-		}
-	} else {
-		ra.MacAddr.Encode(result[8:])
-		result[14] = byte(ra.MacAddrType & 1)
-	}
-
-	return result
-}
-
 type SMPConnConfig struct {
 	DisplayNumeric func(conn *SMPConn, number uint32) error
 	InputYesNo     func(conn *SMPConn) (bool, error)
@@ -84,8 +39,16 @@ type SMPConnConfig struct {
 }
 
 type SMPConfig struct {
+	// KeyStore keeps the bonds. When nil a GobKeyStore writing to
+	// StoredKeysPath is used.
+	KeyStore          KeyStore
 	StoredKeysPath    string
 	DefaultConnConfig *SMPConnConfig
+
+	// IdentityResolvingKey is the local IRK that is distributed to peers
+	// during bonding. When it is all zeroes a random key is generated once
+	// and kept in the key database.
+	IdentityResolvingKey [16]byte
 }
 
 func DefaultConfig() *SMPConfig {
@@ -112,8 +75,11 @@ type SMP struct {
 
 	controller *hci.Controller
 
-	storedKeys        map[smpStoredLTKMapKey]smpStoredLTK
-	storedKeysPersist *gobpersist.GobPersist
+	keys     KeyStore
+	localIRK [16]byte
+
+	/* Sign counters are read, checked and written back as one step */
+	signMutex sync.Mutex
 }
 
 // smpConnFromConn returns the SMPConn attached to a connmgr.Connection,
@@ -167,7 +133,7 @@ func New(logger *logrus.Entry, controller *hci.Controller, config *SMPConfig) *S
 	s := &SMP{
 		controller: controller,
 		config:     config,
-		storedKeys: make(map[smpStoredLTKMapKey]smpStoredLTK),
+		keys:       config.KeyStore,
 	}
 
 	controller.ConnMgr.SetEventsSMP(hciconnmgr.ConnectionMangerEventsSMP{
@@ -176,20 +142,52 @@ func New(logger *logrus.Entry, controller *hci.Controller, config *SMPConfig) *S
 		EncryptionRefresh:  s.connmgrEncryptionRefresh,
 	})
 
-	s.storedKeysPersist = &gobpersist.GobPersist{
-		Target:   &s.storedKeys,
-		Filename: config.StoredKeysPath,
-	}
+	if s.keys == nil {
+		if config.StoredKeysPath != "" {
+			logger.WithError(os.MkdirAll(filepath.Dir(config.StoredKeysPath), 0o700)).Debug("Creating LTK database directory")
+		}
 
-	if config.StoredKeysPath != "" {
-		logger.WithError(os.MkdirAll(filepath.Dir(config.StoredKeysPath), 0o700)).Debug("Creating LTK database directory")
+		store := NewGobKeyStore(config.StoredKeysPath)
+		logger.WithError(store.Load()).Info("Loading LTK database")
+		s.keys = store
 	}
-	logger.WithError(s.storedKeysPersist.Load()).Info("Loading LTK database")
-	logger.WithError(s.storedKeysPersist.Save()).Debug("Saving LTK database")
+	logger.WithError(s.loadLocalIRK()).Debug("Loading local IRK")
+
+	controller.SetPrivacyProvider(s)
 
 	return s
 }
 
+func (s *SMP) loadLocalIRK() error {
+	if s.config.IdentityResolvingKey != [16]byte{} {
+		s.localIRK = s.config.IdentityResolvingKey
+		return nil
+	}
+
+	irk, ok, err := s.keys.GetLocalIRK()
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		if _, err := crand.Read(irk[:]); err != nil {
+			return err
+		}
+
+		/* Keep using the key even if it could not be stored */
+		err = s.keys.PutLocalIRK(irk)
+	}
+
+	s.localIRK = irk
+	return err
+}
+
+// LocalIRK returns the identity resolving key that is distributed to
+// bonded peers.
+func (s *SMP) LocalIRK() [16]byte {
+	return s.localIRK
+}
+
 type SMPConn struct {
 	parent *SMP
 
@@ -203,8 +201,9 @@ type SMPConn struct {
 
 	timeout <-chan (time.Time)
 
-	addrLERemote bleutil.BLEAddr
-	addrLELocal  bleutil.BLEAddr
+	addrLERemote   bleutil.BLEAddr
+	addrLELocal    bleutil.BLEAddr
+	addrLEIdentity bleutil.BLEAddr
 
 	isCentral bool
 
@@ -218,11 +217,19 @@ type SMPConn struct {
 	keyMutex           sync.Mutex
 	keyIsAuthenticated bool
 	keyIsBonded        bool
+	keySize            int
+	keySession         Bond
+	keySessionValid    bool
+
+	/* Copy of the bond used for signing, protected by the signMutex of the parent */
+	signBond      Bond
+	signBondValid bool
+	signUnsaved   int
 
 	// testEncryptHook, if set, replaces leEncrypt for unit tests so
 	// the SC state machine can be exercised without a live HCI link.
 	// It is package-private and only used by *_test.go files.
-	testEncryptHook func(ltk smpStoredLTK) error
+	testEncryptHook func(ltk Bond) error
 }
 
 func (c *SMPConn) updateTimeout(run bool) {
@@ -241,6 +248,7 @@ func (c *SMPConn) setState(state SMPState) {
 func (c *SMPConn) smpHandler() {
 	defer func() {
 		c.setState(StatePermanentlyFailed)
+		c.signingFlush()
 
 		c.conn.Close()
 		/* Drain channel */
@@ -262,6 +270,7 @@ func (c *SMPConn) smpHandler() {
 		case value := <-c.encUpdateChan:
 			if value {
 				c.setState(StateSecure)
+				c.keyDistributionEncrypted()
 			}
 
 		case <-c.secureChan:
@@ -330,6 +339,9 @@ func (p *SMP) AddConn(conn hciconnmgr.BufferConn, config *SMPConnConfig) *SMPCon
 	c.isCentral = raw.IsCentral()
 	raw.Connection.SMPConn = c
 
+	/* Bonded peers using a private address are found through their identity */
+	c.addrLEIdentity, _ = p.ResolveAddress(c.addrLERemote)
+
 	c.setState(StateInsecure)
 
 	/* Try to use the key we already have */
@@ -367,6 +379,19 @@ func (c *SMPConn) GetSecurity() (bool, bool, bool) {
 	return true, c.keyIsAuthenticated, c.keyIsBonded
 }
 
+// GetKeySize returns the size of the encryption key in bytes, zero if the link is not encrypted
+// or the size is unknown
+func (c *SMPConn) GetKeySize() int {
+	if encrypted, _, _ := c.GetSecurity(); !encrypted {
+		return 0
+	}
+
+	c.keyMutex.Lock()
+	defer c.keyMutex.Unlock()
+
+	return c.keySize
+}
+
 func (c *SMPConn) GoSecure(ctx context.Context, allowStart bool) (SMPState, error) {
 	first := true
 
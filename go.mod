@@ -6,6 +6,7 @@ require (
 	github.com/BertoldVdb/go-misc v0.1.10
 	github.com/sirupsen/logrus v1.9.4
 	golang.org/x/sys v0.44.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
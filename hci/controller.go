@@ -2,12 +2,14 @@ package hci
 
 import (
 	"encoding/hex"
+	"errors"
 	"sync"
 	"time"
 
 	hcicmdmgr "github.com/BertoldVdb/go-ble/hci/cmdmgr"
 	hcicommands "github.com/BertoldVdb/go-ble/hci/commands"
 	hciconnmgr "github.com/BertoldVdb/go-ble/hci/connmgr"
+	hciconst "github.com/BertoldVdb/go-ble/hci/const"
 	hciinterface "github.com/BertoldVdb/go-ble/hci/drivers/interface"
 	hcievents "github.com/BertoldVdb/go-ble/hci/events"
 	deviceinfo "github.com/BertoldVdb/go-ble/hci/information"
@@ -17,6 +19,13 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+var (
+	// ErrorVendorInitLoop is returned when VendorInit keeps asking to configure the device again
+	ErrorVendorInitLoop = errors.New("Vendor initialization did not complete")
+)
+
+const maxVendorInitPasses = 3
+
 type ReadyCallback func() error
 type CloseCallback func()
 
@@ -33,9 +42,21 @@ type Controller struct {
 
 	Info deviceinfo.ControllerInfo
 
+	addrMutex                sync.Mutex
+	privacy                  PrivacyProvider
+	randomAddressHandlers    []registeredRandomAddressHandler
+	nextRandomAddressHandler RandomAddressHandle
+	resolvingListMutex       sync.Mutex
+
+	vendorEventMutex   sync.Mutex
+	vendorEventHandler VendorEventHandler
+
 	multirun multirun.MultiRun
 }
 
+// VendorEventHandler receives the parameters of vendor specific events
+type VendorEventHandler func(params []byte)
+
 type ControllerConfig struct {
 	AwaitStartup     bool
 	LERandomAddrBits int
@@ -44,8 +65,29 @@ type ControllerConfig struct {
 	PrivacyScan      bool
 	PrivacyAdvertise bool
 
+	// ResolvablePrivateAddress makes the random address a resolvable
+	// private address, generated from the local IRK of the PrivacyProvider
+	// and rotated every RPATimeout. The advertiser and scanner pause to let
+	// the controller accept a new address, a pending connection attempt
+	// delays the rotation.
+	ResolvablePrivateAddress bool
+	RPATimeout               time.Duration
+
+	// ResolvingListOffload loads the IRKs of bonded peers into the
+	// controller resolving list when LL privacy is supported, so the
+	// controller resolves peer addresses itself.
+	ResolvingListOffload bool
+
+	// ExtendedAdvertisingDisable uses the legacy advertising, scanning and connection commands
+	// even if the controller supports extended advertising.
+	ExtendedAdvertisingDisable bool
+
 	HookInitDevice func(ctrl *Controller) error
 
+	// VendorInit is called after the reset with the local version information read. It can
+	// load patches or change the baud rate. Returning true configures the device again.
+	VendorInit func(ctrl *Controller) (bool, error)
+
 	ConnectionManagerUsed   bool
 	ConnectionManagerConfig *hciconnmgr.ConnectionManagerConfig
 
@@ -61,6 +103,8 @@ func DefaultConfig() *ControllerConfig {
 		PrivacyScan:      true,
 		PrivacyAdvertise: true,
 
+		RPATimeout: 15 * time.Minute,
+
 		ConnectionManagerUsed:   true,
 		ConnectionManagerConfig: hciconnmgr.DefaultConfig(),
 
@@ -109,6 +153,10 @@ func New(logger *logrus.Entry, dev hciinterface.HCIInterface, config *Controller
 			}).Trace("Received HCI RX packet from hardware")
 		}
 
+		if c.handleVendorEvent(rxPkt.Data) {
+			return nil
+		}
+
 		if c.Events.HandleEvent(rxPkt) {
 			return nil
 		}
@@ -138,6 +186,10 @@ func New(logger *logrus.Entry, dev hciinterface.HCIInterface, config *Controller
 		c.multirun.RegisterRunnableReady(&hciKeepAlive{ctrl: c})
 	}
 
+	if config.ResolvablePrivateAddress && config.RPATimeout > 0 {
+		c.multirun.RegisterRunnableReady(&hciPrivacy{ctrl: c})
+	}
+
 	if c.ConnMgr != nil {
 		c.multirun.RegisterRunnableReady(c.ConnMgr)
 	}
@@ -145,17 +197,79 @@ func New(logger *logrus.Entry, dev hciinterface.HCIInterface, config *Controller
 	return c
 }
 
-func (c *Controller) configureDevice() error {
-	err := c.Cmds.BasebandResetSync()
-	if err != nil {
-		return err
+// UseExtendedAdvertising tells if the extended advertising, scanning and connection commands are
+// used. Controllers refuse legacy commands once extended ones were used, so the advertiser,
+// scanner and connecter all follow this decision.
+func (c *Controller) UseExtendedAdvertising() bool {
+	return !c.config.ExtendedAdvertisingDisable && c.Info.LEFeatureSupported(deviceinfo.LEFeatureExtendedAdvertising)
+}
+
+// SetVendorEventHandler sets the function that receives vendor specific events, nil removes it
+func (c *Controller) SetVendorEventHandler(handler VendorEventHandler) {
+	c.vendorEventMutex.Lock()
+	defer c.vendorEventMutex.Unlock()
+
+	c.vendorEventHandler = handler
+}
+
+func (c *Controller) handleVendorEvent(data []byte) bool {
+	if len(data) < 3 || data[0] != hciconst.MsgTypeEvent || data[1] != 0xFF || int(data[2]) != len(data)-3 {
+		return false
+	}
+
+	c.vendorEventMutex.Lock()
+	handler := c.vendorEventHandler
+	c.vendorEventMutex.Unlock()
+
+	if handler == nil {
+		return false
 	}
 
-	if c.config.HookInitDevice != nil {
-		err = c.config.HookInitDevice(c)
+	handler(data[3:])
+	return true
+}
+
+// resetDevice resets the controller and runs the vendor initialization, which can ask for
+// another reset after changing the firmware
+func (c *Controller) resetDevice() error {
+	for pass := 0; ; pass++ {
+		err := c.Cmds.BasebandResetSync()
 		if err != nil {
 			return err
 		}
+
+		if c.config.HookInitDevice != nil {
+			err = c.config.HookInitDevice(c)
+			if err != nil {
+				return err
+			}
+		}
+
+		if c.config.VendorInit == nil {
+			return nil
+		}
+
+		/* A controller that is waiting for its firmware may not support the other informational
+		   commands yet, so only the version is read before the vendor code runs */
+		c.Info.LocalVersionInformation, err = c.Cmds.InformationalReadLocalVersionInformationSync(nil)
+		if err != nil {
+			return err
+		}
+
+		reconfigure, err := c.config.VendorInit(c)
+		if err != nil || !reconfigure {
+			return err
+		}
+		if pass >= maxVendorInitPasses {
+			return ErrorVendorInitLoop
+		}
+	}
+}
+
+func (c *Controller) configureDevice() error {
+	err := c.resetDevice()
+	if err != nil {
+		return err
 	}
 
 	err = c.Info.Read(c.Cmds)
@@ -173,7 +287,16 @@ func (c *Controller) configureDevice() error {
 	c.Cmds.BasebandWriteFlowControlModeSync(hcicommands.BasebandWriteFlowControlModeInput{})
 
 	/* Setup the privacy address */
-	return c.setLERandomAddress()
+	err = c.setLERandomAddress()
+	if err != nil {
+		return err
+	}
+
+	/* Failure to use the resolving list is not fatal, resolution falls back to the host */
+	if err := c.UpdateResolvingList(); err != nil {
+		c.logger.WithError(err).Warn("Failed to load resolving list")
+	}
+	return nil
 }
 
 func (c *Controller) Run(ready func()) error {
@@ -43,8 +43,8 @@ func Wrap(dev hciinterface.HCIInterface, out io.WriteCloser) (hciinterface.HCIIn
 	   header desynchronizes the entire log). */
 	header := make([]byte, 0, 16)
 	header = append(header, "btsnoop\x00"...)
-	header = binary.BigEndian.AppendUint32(header, 1)    // version
-	header = binary.BigEndian.AppendUint32(header, 1002) // datalink type: HCI UART (H4)
+	header = binary.BigEndian.AppendUint32(header, 1) // version
+	header = binary.BigEndian.AppendUint32(header, DatalinkUART)
 
 	if err := writeAll(out, header); err != nil {
 		return dev, err
@@ -94,7 +94,7 @@ func (l *logger) logPacket(isTransmit bool, ts time.Time, data []byte) {
 		flags |= 2
 	}
 
-	interval := ts.Sub(refTime).Microseconds() + 0x00E03AB44A676000
+	interval := ts.Sub(refTime).Microseconds() + timeOffset
 
 	binary.BigEndian.PutUint32(entry, uint32(len(data)))
 	binary.BigEndian.PutUint32(entry[4:], uint32(len(data)))
@@ -0,0 +1,309 @@
+package btsnoop
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	hciconst "github.com/BertoldVdb/go-ble/hci/const"
+)
+
+// Datalink types of the btsnoop file header
+const (
+	DatalinkHCI     = 1001 // HCI packets without the packet type
+	DatalinkUART    = 1002 // HCI UART (H4), written by Wrap and by Android
+	DatalinkMonitor = 2001 // BlueZ btmon
+)
+
+/* Microseconds from year 0 to 2000-01-01, btsnoop timestamps count from year 0 */
+const timeOffset = 0x00E03AB44A676000
+
+const maxRecordLength = 0x10000 + 16
+
+var (
+	ErrorNotBtsnoop         = errors.New("Not a btsnoop file")
+	ErrorUnsupportedVersion = errors.New("Unsupported btsnoop version")
+)
+
+// Record is a packet from a capture. Data starts with the HCI packet type, like on an UART.
+type Record struct {
+	// Received is true for packets sent by the controller
+	Received bool
+	Time     time.Time
+
+	// Index is the controller index in btmon captures, it is zero for other formats
+	Index uint16
+	Data  []byte
+}
+
+// Reader parses btsnoop files with the HCI, HCI UART or btmon datalink
+type Reader struct {
+	r        io.Reader
+	Datalink uint32
+}
+
+func NewReader(r io.Reader) (*Reader, error) {
+	var header [16]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrorNotBtsnoop
+		}
+		return nil, err
+	}
+
+	if string(header[:8]) != "btsnoop\x00" {
+		return nil, ErrorNotBtsnoop
+	}
+	if binary.BigEndian.Uint32(header[8:]) != 1 {
+		return nil, ErrorUnsupportedVersion
+	}
+
+	datalink := binary.BigEndian.Uint32(header[12:])
+	switch datalink {
+	case DatalinkHCI, DatalinkUART, DatalinkMonitor:
+	default:
+		return nil, fmt.Errorf("Unsupported datalink %d", datalink)
+	}
+
+	return &Reader{
+		r:        r,
+		Datalink: datalink,
+	}, nil
+}
+
+/* btmon opcodes of HCI packets, other opcodes are skipped */
+var monitorTypes = map[uint16]struct {
+	msgType  byte
+	received bool
+}{
+	2:  {hciconst.MsgTypeCommand, false},
+	3:  {hciconst.MsgTypeEvent, true},
+	4:  {hciconst.MsgTypeACL, false},
+	5:  {hciconst.MsgTypeACL, true},
+	6:  {hciconst.MsgTypeSCO, false},
+	7:  {hciconst.MsgTypeSCO, true},
+	18: {hciconst.MsgTypeISO, false},
+	19: {hciconst.MsgTypeISO, true},
+}
+
+// Next returns the next packet. It returns io.EOF at the end of the file.
+func (r *Reader) Next() (Record, error) {
+	for {
+		var header [24]byte
+		if _, err := io.ReadFull(r.r, header[:]); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				err = errors.New("Truncated record header")
+			}
+			return Record{}, err
+		}
+
+		length := binary.BigEndian.Uint32(header[4:])
+		flags := binary.BigEndian.Uint32(header[8:])
+		timestamp := int64(binary.BigEndian.Uint64(header[16:]))
+		if length > maxRecordLength {
+			return Record{}, errors.New("Record is too long")
+		}
+
+		data := make([]byte, 1+length)
+		if _, err := io.ReadFull(r.r, data[1:]); err != nil {
+			return Record{}, errors.New("Truncated record")
+		}
+
+		record := Record{
+			Time: refTime.Add(time.Duration(timestamp-timeOffset) * time.Microsecond),
+		}
+
+		switch r.Datalink {
+		case DatalinkUART:
+			if length == 0 {
+				continue
+			}
+			record.Received = flags&1 > 0
+			record.Data = data[1:]
+
+		case DatalinkHCI:
+			record.Received = flags&1 > 0
+			record.Data = data
+			if flags&2 == 0 {
+				data[0] = hciconst.MsgTypeACL
+			} else if record.Received {
+				data[0] = hciconst.MsgTypeEvent
+			} else {
+				data[0] = hciconst.MsgTypeCommand
+			}
+
+		case DatalinkMonitor:
+			info, ok := monitorTypes[uint16(flags)]
+			if !ok {
+				continue
+			}
+			record.Received = info.received
+			record.Index = uint16(flags >> 16)
+			record.Data = data
+			data[0] = info.msgType
+		}
+
+		return record, nil
+	}
+}
+
+// ReadAll returns all remaining packets
+func (r *Reader) ReadAll() ([]Record, error) {
+	var result []Record
+	for {
+		record, err := r.Next()
+		if err == io.EOF {
+			return result, nil
+		}
+		if err != nil {
+			return result, err
+		}
+		result = append(result, record)
+	}
+}
+
+/* Packet types used by the Android snoop summary */
+var snoozTypes = map[byte]struct {
+	msgType  byte
+	received bool
+}{
+	0x10: {hciconst.MsgTypeEvent, true},
+	0x11: {hciconst.MsgTypeACL, true},
+	0x12: {hciconst.MsgTypeSCO, true},
+	0x17: {hciconst.MsgTypeISO, true},
+	0x20: {hciconst.MsgTypeCommand, false},
+	0x21: {hciconst.MsgTypeACL, false},
+	0x22: {hciconst.MsgTypeSCO, false},
+	0x2D: {hciconst.MsgTypeISO, false},
+}
+
+// ReadBugreport extracts the snoop log summary from an Android bugreport. It only contains the
+// most recent packets, and long packets are truncated by Android.
+func ReadBugreport(r io.Reader) ([]Record, error) {
+	var encoded strings.Builder
+	found, inside := false, false
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.Contains(line, "BEGIN:BTSNOOP_LOG_SUMMARY") {
+			found, inside = true, true
+			continue
+		}
+		if strings.Contains(line, "END:BTSNOOP_LOG_SUMMARY") {
+			break
+		}
+		if inside {
+			encoded.WriteString(line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, errors.New("Bugreport has no snoop log")
+	}
+
+	snooz, err := base64.StdEncoding.DecodeString(encoded.String())
+	if err != nil {
+		return nil, err
+	}
+	return parseSnooz(snooz)
+}
+
+func parseSnooz(snooz []byte) ([]Record, error) {
+	if len(snooz) < 9 {
+		return nil, errors.New("Snoop log is too short")
+	}
+
+	version := snooz[0]
+	if version != 1 && version != 2 {
+		return nil, ErrorUnsupportedVersion
+	}
+	last := time.UnixMilli(int64(binary.LittleEndian.Uint64(snooz[1:])))
+
+	z, err := zlib.NewReader(bytes.NewReader(snooz[9:]))
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(z)
+	if err != nil {
+		return nil, err
+	}
+
+	/* Version 2 adds the original packet length */
+	headerLen := 7
+	if version == 2 {
+		headerLen = 9
+	}
+
+	var result []Record
+	var offsets []time.Duration
+	var total time.Duration
+	for len(data) > 0 {
+		if len(data) < headerLen {
+			return nil, errors.New("Truncated record header")
+		}
+
+		length := int(binary.LittleEndian.Uint16(data))
+		delta := binary.LittleEndian.Uint32(data[headerLen-5:])
+		snoozType := data[headerLen-1]
+		if length < 1 || len(data) < headerLen+length-1 {
+			return nil, errors.New("Truncated record")
+		}
+
+		packet := data[headerLen : headerLen+length-1]
+		data = data[headerLen+length-1:]
+
+		/* Timestamps are the time between packets, the header has the time of the last */
+		total += time.Duration(delta) * time.Millisecond
+		info, ok := snoozTypes[snoozType]
+		if !ok {
+			continue
+		}
+
+		result = append(result, Record{
+			Received: info.received,
+			Data:     append([]byte{info.msgType}, packet...),
+		})
+		offsets = append(offsets, total)
+	}
+
+	start := last.Add(-total)
+	for i := range result {
+		result[i].Time = start.Add(offsets[i])
+	}
+
+	return result, nil
+}
+
+// ReadFile reads a btsnoop file or the snoop log of an Android bugreport
+func ReadFile(path string) ([]Record, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	r, err := NewReader(file)
+	if err == ErrorNotBtsnoop {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		return ReadBugreport(file)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return r.ReadAll()
+}
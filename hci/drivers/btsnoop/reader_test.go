@@ -0,0 +1,174 @@
+package btsnoop
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	hciinterface "github.com/BertoldVdb/go-ble/hci/drivers/interface"
+)
+
+func btsnoopFile(datalink uint32, records ...[]byte) []byte {
+	out := append([]byte("btsnoop\x00"), 0, 0, 0, 1)
+	out = binary.BigEndian.AppendUint32(out, datalink)
+	for _, m := range records {
+		out = append(out, m...)
+	}
+	return out
+}
+
+func btsnoopRecord(flags uint32, ts time.Time, data []byte) []byte {
+	out := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	out = binary.BigEndian.AppendUint32(out, uint32(len(data)))
+	out = binary.BigEndian.AppendUint32(out, flags)
+	out = binary.BigEndian.AppendUint32(out, 0)
+	out = binary.BigEndian.AppendUint64(out, uint64(ts.Sub(refTime).Microseconds()+timeOffset))
+	return append(out, data...)
+}
+
+func TestReaderReadsWrap(t *testing.T) {
+	buf := &closableBuf{Buffer: &bytes.Buffer{}}
+	f := &fakeIface{}
+	w, err := Wrap(f, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.SetRecvHandler(nil)
+
+	ts := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	w.SendPacket(hciinterface.HCITxPacket{Data: []byte{0x01, 0x03, 0x0c, 0x00}})
+	f.cb(hciinterface.HCIRxPacket{Received: true, RxTime: ts, Data: []byte{0x04, 0x0e, 0x04, 0x01, 0x03, 0x0c, 0x00}})
+
+	r, err := NewReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := r.ReadAll()
+	if err != nil || len(records) != 2 {
+		t.Fatalf("records %v (%v)", records, err)
+	}
+
+	if records[0].Received || !bytes.Equal(records[0].Data, []byte{0x01, 0x03, 0x0c, 0x00}) {
+		t.Errorf("command record %+v", records[0])
+	}
+	if !records[1].Received || records[1].Data[0] != 0x04 || !records[1].Time.Equal(ts) {
+		t.Errorf("event record %+v", records[1])
+	}
+}
+
+func TestReaderDatalinks(t *testing.T) {
+	ts := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	/* Unencapsulated HCI: the flags give the packet type */
+	file := btsnoopFile(DatalinkHCI,
+		btsnoopRecord(2, ts, []byte{0x03, 0x0c, 0x00}),
+		btsnoopRecord(3, ts, []byte{0x0e, 0x01, 0x00}),
+		btsnoopRecord(1, ts, []byte{0x40, 0x00, 0x00, 0x00}))
+	r, err := NewReader(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := r.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var types []byte
+	for _, m := range records {
+		types = append(types, m.Data[0])
+	}
+	if !bytes.Equal(types, []byte{0x01, 0x04, 0x02}) || !records[2].Received {
+		t.Errorf("records %+v", records)
+	}
+
+	/* btmon: notes are skipped, the index is kept */
+	file = btsnoopFile(DatalinkMonitor,
+		btsnoopRecord(12, ts, []byte("note\x00")),
+		btsnoopRecord(1<<16|2, ts, []byte{0x03, 0x0c, 0x00}),
+		btsnoopRecord(1<<16|5, ts, []byte{0x40, 0x00, 0x00, 0x00}))
+	r, err = NewReader(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err = r.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Record{
+		{Received: false, Time: ts, Index: 1, Data: []byte{0x01, 0x03, 0x0c, 0x00}},
+		{Received: true, Time: ts, Index: 1, Data: []byte{0x02, 0x40, 0x00, 0x00, 0x00}},
+	}
+	if !reflect.DeepEqual(records, want) {
+		t.Errorf("records %+v", records)
+	}
+
+	if _, err := NewReader(bytes.NewReader([]byte("not a capture at all"))); err != ErrorNotBtsnoop {
+		t.Errorf("got %v", err)
+	}
+	r, _ = NewReader(bytes.NewReader(file[:len(file)-2]))
+	if _, err := r.ReadAll(); err == nil {
+		t.Error("truncated file accepted")
+	}
+}
+
+func snoozLog(version byte, last time.Time) []byte {
+	var packets bytes.Buffer
+	add := func(delta uint32, snoozType byte, data []byte) {
+		packets.Write(binary.LittleEndian.AppendUint16(nil, uint16(len(data)+1)))
+		if version == 2 {
+			packets.Write(binary.LittleEndian.AppendUint16(nil, uint16(len(data)+1)))
+		}
+		packets.Write(binary.LittleEndian.AppendUint32(nil, delta))
+		packets.WriteByte(snoozType)
+		packets.Write(data)
+	}
+	add(0, 0x20, []byte{0x03, 0x0c, 0x00})
+	add(5, 0x10, []byte{0x0e, 0x04, 0x01, 0x03, 0x0c, 0x00})
+	add(10, 0x11, []byte{0x40, 0x00, 0x00, 0x00})
+
+	out := []byte{version}
+	out = binary.LittleEndian.AppendUint64(out, uint64(last.UnixMilli()))
+	var z bytes.Buffer
+	w := zlib.NewWriter(&z)
+	w.Write(packets.Bytes())
+	w.Close()
+	return append(out, z.Bytes()...)
+}
+
+func TestReadBugreport(t *testing.T) {
+	last := time.UnixMilli(1714564800000)
+
+	for _, version := range []byte{1, 2} {
+		encoded := base64.StdEncoding.EncodeToString(snoozLog(version, last))
+		report := "== dumpsys bluetooth_manager\n" +
+			"--- BEGIN:BTSNOOP_LOG_SUMMARY (1234 bytes in) ---\n" +
+			encoded[:20] + "\n" + encoded[20:] + "\n" +
+			"--- END:BTSNOOP_LOG_SUMMARY ---\n"
+
+		path := filepath.Join(t.TempDir(), "bugreport.txt")
+		os.WriteFile(path, []byte(report), 0600)
+
+		records, err := ReadFile(path)
+		if err != nil || len(records) != 3 {
+			t.Fatalf("v%d: records %+v (%v)", version, records, err)
+		}
+		if records[0].Received || !bytes.Equal(records[0].Data, []byte{0x01, 0x03, 0x0c, 0x00}) {
+			t.Errorf("v%d: command %+v", version, records[0])
+		}
+		if !records[2].Received || records[2].Data[0] != 0x02 || !records[2].Time.Equal(last) {
+			t.Errorf("v%d: acl %+v", version, records[2])
+		}
+		if !records[0].Time.Equal(last.Add(-15 * time.Millisecond)) {
+			t.Errorf("v%d: first packet at %v", version, records[0].Time)
+		}
+	}
+
+	if _, err := ReadBugreport(bytes.NewReader([]byte("nothing here\n"))); err == nil {
+		t.Error("bugreport without log accepted")
+	}
+}
@@ -0,0 +1,221 @@
+package btsnoop
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	hciconst "github.com/BertoldVdb/go-ble/hci/const"
+	hciinterface "github.com/BertoldVdb/go-ble/hci/drivers/interface"
+)
+
+var (
+	ErrorReplayMismatch = errors.New("Packet does not match the capture")
+	ErrorReplayEnded    = errors.New("Packet sent after the end of the capture")
+	ErrorReplayIndex    = errors.New("Capture contains more than one controller")
+)
+
+// MatchFunc compares a packet sent by the host with the packet in the capture
+type MatchFunc func(expected []byte, actual []byte) bool
+
+// MatchIgnoreParameters compares packets byte by byte, except for the given commands where only
+// the opcode is compared. This is useful for commands with random parameters, like
+// LE Set Random Address (0x2005).
+func MatchIgnoreParameters(opcodes ...uint16) MatchFunc {
+	return func(expected []byte, actual []byte) bool {
+		if len(expected) >= 3 && len(actual) >= 3 && expected[0] == hciconst.MsgTypeCommand && actual[0] == hciconst.MsgTypeCommand {
+			opcode := binary.LittleEndian.Uint16(expected[1:])
+			for _, m := range opcodes {
+				if m == opcode {
+					return opcode == binary.LittleEndian.Uint16(actual[1:])
+				}
+			}
+		}
+		return bytes.Equal(expected, actual)
+	}
+}
+
+// FilterIndex returns the records of one controller of a btmon capture
+func FilterIndex(records []Record, index uint16) []Record {
+	var result []Record
+	for _, m := range records {
+		if m.Index == index {
+			result = append(result, m)
+		}
+	}
+	return result
+}
+
+// Replay is a HCIInterface that plays back a capture. Packets received in the capture are given
+// to the host, packets sent in the capture are expected from the host in the same order. Nothing
+// is delivered until the host has sent everything that came before it in the capture, so the
+// host sees the same sequence every time.
+type Replay struct {
+	records []Record
+	match   MatchFunc
+
+	mutex     sync.Mutex
+	rxHandler hciinterface.HCIRxHandler
+	sent      [][]byte
+	ended     bool
+	err       error
+
+	sentNotify chan struct{}
+	done       chan struct{}
+	closeOnce  sync.Once
+	closeChan  chan struct{}
+}
+
+// NewReplay creates a replay of records. Packets from the host are compared with match, or byte
+// by byte if it is nil. The records must belong to one controller, use FilterIndex to pick one
+// from a btmon capture.
+func NewReplay(records []Record, match MatchFunc) *Replay {
+	if match == nil {
+		match = bytes.Equal
+	}
+
+	return &Replay{
+		records:    records,
+		match:      match,
+		sentNotify: make(chan struct{}, 1),
+		done:       make(chan struct{}),
+		closeChan:  make(chan struct{}),
+	}
+}
+
+func (r *Replay) setErr(err error) {
+	r.mutex.Lock()
+	if r.err == nil {
+		r.err = err
+	}
+	r.mutex.Unlock()
+}
+
+// Err returns the first difference between the host and the capture
+func (r *Replay) Err() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.err
+}
+
+// Done is closed when the whole capture was played, when the host did not follow it or when the
+// replay was closed before the end
+func (r *Replay) Done() <-chan struct{} {
+	return r.done
+}
+
+/* nextSent waits for a packet from the host, it returns nil when closed */
+func (r *Replay) nextSent() []byte {
+	for {
+		r.mutex.Lock()
+		if len(r.sent) > 0 {
+			pkt := r.sent[0]
+			r.sent = r.sent[1:]
+			r.mutex.Unlock()
+			return pkt
+		}
+		r.mutex.Unlock()
+
+		select {
+		case <-r.sentNotify:
+		case <-r.closeChan:
+			return nil
+		}
+	}
+}
+
+func (r *Replay) Run() error {
+	ended, err := r.play()
+	close(r.done)
+	if !ended {
+		return err
+	}
+
+	<-r.closeChan
+	return nil
+}
+
+/* play returns true if all records were played */
+func (r *Replay) play() (bool, error) {
+	for _, m := range r.records {
+		if m.Index != r.records[0].Index {
+			r.setErr(ErrorReplayIndex)
+			return false, ErrorReplayIndex
+		}
+	}
+
+	for i, m := range r.records {
+		if m.Received {
+			r.mutex.Lock()
+			handler := r.rxHandler
+			r.mutex.Unlock()
+
+			if handler != nil {
+				handler(hciinterface.HCIRxPacket{
+					Received: true,
+					RxTime:   time.Now(),
+					Data:     append([]byte{}, m.Data...),
+				})
+			}
+			continue
+		}
+
+		pkt := r.nextSent()
+		if pkt == nil {
+			return false, nil
+		}
+
+		if !r.match(m.Data, pkt) {
+			err := fmt.Errorf("%w: record %d: expected %x, got %x", ErrorReplayMismatch, i, m.Data, pkt)
+			r.setErr(err)
+			return false, err
+		}
+	}
+
+	r.mutex.Lock()
+	r.ended = true
+	if len(r.sent) > 0 && r.err == nil {
+		r.err = fmt.Errorf("%w: %x", ErrorReplayEnded, r.sent[0])
+	}
+	r.mutex.Unlock()
+	return true, nil
+}
+
+func (r *Replay) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.closeChan)
+	})
+	return nil
+}
+
+func (r *Replay) SetRecvHandler(cb hciinterface.HCIRxHandler) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.rxHandler = cb
+	return nil
+}
+
+func (r *Replay) SendPacket(pkt hciinterface.HCITxPacket) error {
+	data := append([]byte{}, pkt.Data...)
+
+	r.mutex.Lock()
+	if r.ended {
+		if r.err == nil {
+			r.err = fmt.Errorf("%w: %x", ErrorReplayEnded, data)
+		}
+		r.mutex.Unlock()
+		return nil
+	}
+	r.sent = append(r.sent, data)
+	r.mutex.Unlock()
+
+	select {
+	case r.sentNotify <- struct{}{}:
+	default:
+	}
+	return nil
+}
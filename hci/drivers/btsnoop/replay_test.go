@@ -0,0 +1,193 @@
+package btsnoop
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/BertoldVdb/go-ble/hci"
+	hciinterface "github.com/BertoldVdb/go-ble/hci/drivers/interface"
+	"github.com/BertoldVdb/go-ble/hci/drivers/loopback"
+	"github.com/sirupsen/logrus"
+)
+
+func silentLogger() *logrus.Entry {
+	l := logrus.New()
+	l.Out = io.Discard
+	return logrus.NewEntry(l)
+}
+
+func testControllerConfig() *hci.ControllerConfig {
+	config := hci.DefaultConfig()
+	config.WatchdogTimeout = 0
+	config.PrivacyAdvertise = false
+	config.PrivacyConnect = false
+	config.PrivacyScan = false
+	return config
+}
+
+// runController starts a controller on dev and waits until it is configured
+func runController(t *testing.T, dev hciinterface.HCIInterface) (*hci.Controller, chan error) {
+	t.Helper()
+
+	ctrl := hci.New(silentLogger(), dev, testControllerConfig())
+	ready := make(chan struct{})
+	result := make(chan error, 1)
+	go func() {
+		result <- ctrl.Run(func() { close(ready) })
+	}()
+
+	select {
+	case <-ready:
+	case err := <-result:
+		t.Fatalf("controller stopped: %v", err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("controller did not become ready")
+	}
+	return ctrl, result
+}
+
+// recordBringup captures the startup of a controller on the loopback driver
+func recordBringup(t *testing.T) ([]Record, *hci.Controller) {
+	_, a, _ := loopback.NewWorld(silentLogger())
+
+	buf := &closableBuf{Buffer: &bytes.Buffer{}}
+	dev, err := Wrap(a, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctrl, _ := runController(t, dev)
+	ctrl.Close()
+
+	r, err := NewReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := r.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records, ctrl
+}
+
+func TestReplayBringup(t *testing.T) {
+	records, recorded := recordBringup(t)
+
+	/* The random address is different every time */
+	replay := NewReplay(records, MatchIgnoreParameters(0x2005))
+	ctrl, _ := runController(t, replay)
+
+	/* The capture ends with the reset done when closing */
+	ctrl.Close()
+	select {
+	case <-replay.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("capture was not played completely")
+	}
+	if err := replay.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if ctrl.Info.BdAddr == nil || *ctrl.Info.BdAddr != *recorded.Info.BdAddr {
+		t.Errorf("address %v, recorded %v", ctrl.Info.BdAddr, recorded.Info.BdAddr)
+	}
+}
+
+func TestReplayMismatch(t *testing.T) {
+	records, _ := recordBringup(t)
+
+	/* Without ignoring the random address the host diverges from the capture */
+	replay := NewReplay(records, nil)
+	ctrl := hci.New(silentLogger(), replay, testControllerConfig())
+	result := make(chan error, 1)
+	go func() {
+		result <- ctrl.Run(nil)
+	}()
+	defer ctrl.Close()
+
+	select {
+	case <-replay.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("mismatch was not detected")
+	}
+	if err := replay.Err(); !errors.Is(err, ErrorReplayMismatch) {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestReplayEnded(t *testing.T) {
+	replay := NewReplay([]Record{
+		{Data: []byte{0x01, 0x03, 0x0c, 0x00}},
+		{Received: true, Data: []byte{0x04, 0x0e, 0x04, 0x01, 0x03, 0x0c, 0x00}},
+	}, nil)
+
+	var received [][]byte
+	replay.SetRecvHandler(func(pkt hciinterface.HCIRxPacket) error {
+		received = append(received, pkt.Data)
+		replay.SendPacket(hciinterface.HCITxPacket{Data: []byte{0x01, 0x01, 0x10, 0x00}})
+		return nil
+	})
+
+	go replay.Run()
+	defer replay.Close()
+	replay.SendPacket(hciinterface.HCITxPacket{Data: []byte{0x01, 0x03, 0x0c, 0x00}})
+
+	<-replay.Done()
+	if len(received) != 1 || !errors.Is(replay.Err(), ErrorReplayEnded) {
+		t.Errorf("received %x, error %v", received, replay.Err())
+	}
+}
+
+func TestReplayClosedEarly(t *testing.T) {
+	replay := NewReplay([]Record{
+		{Data: []byte{0x01, 0x03, 0x0c, 0x00}},
+	}, nil)
+
+	result := make(chan error, 1)
+	go func() {
+		result <- replay.Run()
+	}()
+	replay.Close()
+
+	select {
+	case <-replay.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("done not closed")
+	}
+	if err := <-result; err != nil {
+		t.Errorf("run: %v", err)
+	}
+}
+
+func TestReplayIndex(t *testing.T) {
+	records := []Record{
+		{Index: 1, Data: []byte{0x01, 0x03, 0x0c, 0x00}},
+		{Index: 0, Data: []byte{0x01, 0x01, 0x10, 0x00}},
+		{Index: 1, Received: true, Data: []byte{0x04, 0x0e, 0x04, 0x01, 0x03, 0x0c, 0x00}},
+	}
+
+	/* Packets of another controller would be mixed into the replay */
+	replay := NewReplay(records, nil)
+	if err := replay.Run(); err != ErrorReplayIndex || replay.Err() != ErrorReplayIndex {
+		t.Errorf("run: %v", err)
+	}
+
+	replay = NewReplay(FilterIndex(records, 1), nil)
+	var received [][]byte
+	replay.SetRecvHandler(func(pkt hciinterface.HCIRxPacket) error {
+		received = append(received, pkt.Data)
+		return nil
+	})
+
+	go replay.Run()
+	defer replay.Close()
+	replay.SendPacket(hciinterface.HCITxPacket{Data: []byte{0x01, 0x03, 0x0c, 0x00}})
+
+	<-replay.Done()
+	if len(received) != 1 || replay.Err() != nil {
+		t.Errorf("received %x, error %v", received, replay.Err())
+	}
+}
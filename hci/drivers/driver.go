@@ -4,13 +4,14 @@ import (
 	hciinterface "github.com/BertoldVdb/go-ble/hci/drivers/interface"
 	hcidriveros "github.com/BertoldVdb/go-ble/hci/drivers/os"
 	hcidriverserial "github.com/BertoldVdb/go-ble/hci/drivers/serial"
+	hcidriverusb "github.com/BertoldVdb/go-ble/hci/drivers/usb"
 )
 
 var listFunctions = [](func() ([]string, error)){
-	hcidriveros.ListDevices, hcidriverserial.ListDevices,
+	hcidriveros.ListDevices, hcidriverserial.ListDevices, hcidriverusb.ListDevices,
 }
 var openFunctions = [](func(string) (hciinterface.HCIInterface, error)){
-	hcidriveros.Open, hcidriverserial.Open,
+	hcidriveros.Open, hcidriverserial.Open, hcidriverusb.Open,
 }
 
 // ListDevices returns all found HCI devices
@@ -0,0 +1,248 @@
+// Package pcapng records HCI traffic in the pcapng format, which Wireshark can read directly or
+// from a named pipe while the stack is running.
+package pcapng
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	hciinterface "github.com/BertoldVdb/go-ble/hci/drivers/interface"
+)
+
+const (
+	blockSectionHeader        = 0x0A0D0D0A
+	blockInterfaceDescription = 0x00000001
+	blockEnhancedPacket       = 0x00000006
+
+	optionEnd         = 0
+	optionComment     = 1
+	optionShbUserAppl = 4
+	optionIfName      = 2
+	optionIfDescr     = 3
+	optionIfTsResol   = 9
+	optionEpbFlags    = 2
+
+	// LinkTypeH4WithPhdr is DLT_BLUETOOTH_HCI_H4_WITH_PHDR: an H4 packet preceded by a 32-bit big
+	// endian direction, 0 for sent and 1 for received
+	LinkTypeH4WithPhdr = 201
+)
+
+type Config struct {
+	// InterfaceName and InterfaceDescription are shown by Wireshark
+	InterfaceName        string
+	InterfaceDescription string
+
+	// Comment is called for every packet, a non-empty result is stored as packet comment
+	Comment func(received bool, data []byte) string
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		InterfaceName:        "hci",
+		InterfaceDescription: "go-ble HCI",
+	}
+}
+
+type logger struct {
+	sync.Mutex
+	hciinterface.HCIInterface
+	config *Config
+
+	out    io.WriteCloser
+	failed bool
+
+	/* Only used by pipes: blocks waiting for the writer goroutine, dropped when it is full */
+	queue     chan []byte
+	closeOnce sync.Once
+	closeChan chan struct{}
+}
+
+func newLogger(dev hciinterface.HCIInterface, config *Config) *logger {
+	if config == nil {
+		config = DefaultConfig()
+	}
+
+	return &logger{
+		HCIInterface: dev,
+		config:       config,
+		closeChan:    make(chan struct{}),
+	}
+}
+
+// WrapFile creates path with mode 0600, as captures may contain keys, and wraps dev so all HCI
+// traffic is written to it
+func WrapFile(dev hciinterface.HCIInterface, path string, config *Config) (hciinterface.HCIInterface, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return dev, err
+	}
+
+	w, err := Wrap(dev, file, config)
+	if err != nil {
+		file.Close()
+		return dev, err
+	}
+
+	return w, nil
+}
+
+// Wrap writes all HCI traffic of dev to out. A nil config uses DefaultConfig.
+func Wrap(dev hciinterface.HCIInterface, out io.WriteCloser, config *Config) (hciinterface.HCIInterface, error) {
+	l := newLogger(dev, config)
+	if err := writeAll(out, l.header()); err != nil {
+		return dev, err
+	}
+
+	l.out = out
+	return l, nil
+}
+
+// writeAll keeps writing until the buffer is consumed, pcapng can not recover from a short write
+func writeAll(w io.Writer, buf []byte) error {
+	for len(buf) > 0 {
+		n, err := w.Write(buf)
+		buf = buf[n:]
+		if err != nil && n == 0 {
+			return err
+		}
+	}
+	return nil
+}
+
+func appendOption(b []byte, code uint16, value []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, code)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(value)))
+	b = append(b, value...)
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func appendBlock(b []byte, blockType uint32, body []byte) []byte {
+	length := uint32(12 + len(body))
+	b = binary.LittleEndian.AppendUint32(b, blockType)
+	b = binary.LittleEndian.AppendUint32(b, length)
+	b = append(b, body...)
+	return binary.LittleEndian.AppendUint32(b, length)
+}
+
+/* header returns the section header and interface description, a reader needs both first */
+func (l *logger) header() []byte {
+	shb := binary.LittleEndian.AppendUint32(nil, 0x1A2B3C4D)
+	shb = binary.LittleEndian.AppendUint16(shb, 1)
+	shb = binary.LittleEndian.AppendUint16(shb, 0)
+	shb = binary.LittleEndian.AppendUint64(shb, 0xFFFFFFFFFFFFFFFF) // section length unknown
+	shb = appendOption(shb, optionShbUserAppl, []byte("go-ble"))
+	shb = appendOption(shb, optionEnd, nil)
+
+	idb := binary.LittleEndian.AppendUint16(nil, LinkTypeH4WithPhdr)
+	idb = binary.LittleEndian.AppendUint16(idb, 0)
+	idb = binary.LittleEndian.AppendUint32(idb, 0) // no snap length
+	if l.config.InterfaceName != "" {
+		idb = appendOption(idb, optionIfName, []byte(l.config.InterfaceName))
+	}
+	if l.config.InterfaceDescription != "" {
+		idb = appendOption(idb, optionIfDescr, []byte(l.config.InterfaceDescription))
+	}
+	idb = appendOption(idb, optionIfTsResol, []byte{6}) // microseconds
+	idb = appendOption(idb, optionEnd, nil)
+
+	return appendBlock(appendBlock(nil, blockSectionHeader, shb), blockInterfaceDescription, idb)
+}
+
+func (l *logger) packet(received bool, ts time.Time, data []byte) []byte {
+	direction := uint32(0)
+	flags := uint32(2) // outbound
+	if received {
+		direction = 1
+		flags = 1 // inbound
+	}
+
+	us := uint64(ts.UnixMicro())
+	captured := 4 + len(data)
+
+	epb := binary.LittleEndian.AppendUint32(nil, 0) // interface
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(us>>32))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(us))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(captured))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(captured))
+	epb = binary.BigEndian.AppendUint32(epb, direction)
+	epb = append(epb, data...)
+	for len(epb)%4 != 0 {
+		epb = append(epb, 0)
+	}
+
+	epb = appendOption(epb, optionEpbFlags, binary.LittleEndian.AppendUint32(nil, flags))
+	if l.config.Comment != nil {
+		if comment := l.config.Comment(received, data); comment != "" {
+			epb = appendOption(epb, optionComment, []byte(comment))
+		}
+	}
+	epb = appendOption(epb, optionEnd, nil)
+
+	return appendBlock(nil, blockEnhancedPacket, epb)
+}
+
+func (l *logger) logPacket(received bool, ts time.Time, data []byte) {
+	if len(data) < 1 {
+		return
+	}
+
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	block := l.packet(received, ts, data)
+
+	l.Lock()
+	defer l.Unlock()
+
+	if l.out == nil || l.failed {
+		return
+	}
+	if l.queue != nil {
+		/* A reader that does not keep up must not stall the stack */
+		select {
+		case l.queue <- block:
+		default:
+		}
+		return
+	}
+	if err := writeAll(l.out, block); err != nil {
+		/* A partial block breaks the file */
+		l.failed = true
+	}
+}
+
+func (l *logger) SendPacket(pkt hciinterface.HCITxPacket) error {
+	l.logPacket(false, time.Now(), pkt.Data)
+	return l.HCIInterface.SendPacket(pkt)
+}
+
+func (l *logger) SetRecvHandler(cb hciinterface.HCIRxHandler) error {
+	return l.HCIInterface.SetRecvHandler(func(pkt hciinterface.HCIRxPacket) error {
+		l.logPacket(true, pkt.RxTime, pkt.Data)
+		if cb == nil {
+			return nil
+		}
+		return cb(pkt)
+	})
+}
+
+func (l *logger) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closeChan)
+	})
+
+	l.Lock()
+	if l.out != nil {
+		l.out.Close()
+		l.out = nil
+	}
+	l.Unlock()
+
+	return l.HCIInterface.Close()
+}
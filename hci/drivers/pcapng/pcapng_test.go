@@ -0,0 +1,131 @@
+package pcapng
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	hciinterface "github.com/BertoldVdb/go-ble/hci/drivers/interface"
+)
+
+type fakeIface struct {
+	cb hciinterface.HCIRxHandler
+}
+
+func (f *fakeIface) Run() error   { return nil }
+func (f *fakeIface) Close() error { return nil }
+func (f *fakeIface) SetRecvHandler(cb hciinterface.HCIRxHandler) error {
+	f.cb = cb
+	return nil
+}
+func (f *fakeIface) SendPacket(_ hciinterface.HCITxPacket) error { return nil }
+
+type closableBuf struct {
+	bytes.Buffer
+}
+
+func (c *closableBuf) Close() error { return nil }
+
+type block struct {
+	blockType uint32
+	body      []byte
+}
+
+// parseBlocks splits a little endian pcapng stream into blocks
+func parseBlocks(t *testing.T, data []byte) []block {
+	t.Helper()
+
+	var result []block
+	for len(data) > 0 {
+		if len(data) < 12 {
+			t.Fatalf("truncated block: %x", data)
+		}
+		length := binary.LittleEndian.Uint32(data[4:])
+		if length%4 != 0 || int(length) > len(data) || binary.LittleEndian.Uint32(data[length-4:]) != length {
+			t.Fatalf("invalid block length %d", length)
+		}
+		result = append(result, block{binary.LittleEndian.Uint32(data), data[8 : length-4]})
+		data = data[length:]
+	}
+	return result
+}
+
+// parseOptions returns the options following a fixed part of fixed bytes
+func parseOptions(t *testing.T, body []byte) map[uint16][]byte {
+	t.Helper()
+
+	result := make(map[uint16][]byte)
+	for len(body) >= 4 {
+		code := binary.LittleEndian.Uint16(body)
+		length := int(binary.LittleEndian.Uint16(body[2:]))
+		if code == optionEnd {
+			return result
+		}
+		result[code] = body[4 : 4+length]
+		body = body[4+(length+3)/4*4:]
+	}
+	t.Fatal("options are not terminated")
+	return nil
+}
+
+func TestWrapFormat(t *testing.T) {
+	out := &closableBuf{}
+	f := &fakeIface{}
+
+	config := DefaultConfig()
+	config.Comment = func(received bool, data []byte) string {
+		if data[0] == 0x01 {
+			return "command"
+		}
+		return ""
+	}
+	w, err := Wrap(f, out, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.SetRecvHandler(nil)
+
+	ts := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	w.SendPacket(hciinterface.HCITxPacket{Data: []byte{0x01, 0x03, 0x0c, 0x00}})
+	f.cb(hciinterface.HCIRxPacket{Received: true, RxTime: ts, Data: []byte{0x04, 0x0e, 0x04, 0x01, 0x03, 0x0c, 0x00}})
+
+	blocks := parseBlocks(t, out.Bytes())
+	if len(blocks) != 4 {
+		t.Fatalf("got %d blocks", len(blocks))
+	}
+
+	if blocks[0].blockType != blockSectionHeader || binary.LittleEndian.Uint32(blocks[0].body) != 0x1A2B3C4D {
+		t.Errorf("section header %x", blocks[0].body)
+	}
+
+	idb := blocks[1]
+	if idb.blockType != blockInterfaceDescription || binary.LittleEndian.Uint16(idb.body) != LinkTypeH4WithPhdr {
+		t.Errorf("interface description %x", idb.body)
+	}
+	if options := parseOptions(t, idb.body[8:]); string(options[optionIfName]) != "hci" || !bytes.Equal(options[optionIfTsResol], []byte{6}) {
+		t.Errorf("interface options %q", options)
+	}
+
+	check := func(b block, direction uint32, flags uint32, data []byte, comment string) {
+		t.Helper()
+		if b.blockType != blockEnhancedPacket {
+			t.Fatalf("block type %x", b.blockType)
+		}
+		captured := int(binary.LittleEndian.Uint32(b.body[12:]))
+		if captured != 4+len(data) || binary.BigEndian.Uint32(b.body[20:]) != direction || !bytes.Equal(b.body[24:20+captured], data) {
+			t.Errorf("packet %x", b.body)
+		}
+		options := parseOptions(t, b.body[20+(captured+3)/4*4:])
+		if binary.LittleEndian.Uint32(options[optionEpbFlags]) != flags || string(options[optionComment]) != comment {
+			t.Errorf("packet options %q", options)
+		}
+	}
+	check(blocks[2], 0, 2, []byte{0x01, 0x03, 0x0c, 0x00}, "command")
+	check(blocks[3], 1, 1, []byte{0x04, 0x0e, 0x04, 0x01, 0x03, 0x0c, 0x00}, "")
+
+	us := uint64(binary.LittleEndian.Uint32(blocks[3].body[4:]))<<32 | uint64(binary.LittleEndian.Uint32(blocks[3].body[8:]))
+	if int64(us) != ts.UnixMicro() {
+		t.Errorf("timestamp %d", us)
+	}
+}
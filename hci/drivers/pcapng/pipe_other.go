@@ -0,0 +1,14 @@
+//go:build !unix
+
+package pcapng
+
+import (
+	"errors"
+
+	hciinterface "github.com/BertoldVdb/go-ble/hci/drivers/interface"
+)
+
+// WrapPipe is only supported on unix systems
+func WrapPipe(dev hciinterface.HCIInterface, path string, config *Config) (hciinterface.HCIInterface, error) {
+	return dev, errors.New("Named pipes are not supported on this platform")
+}
@@ -0,0 +1,105 @@
+//go:build unix
+
+package pcapng
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	hciinterface "github.com/BertoldVdb/go-ble/hci/drivers/interface"
+	"golang.org/x/sys/unix"
+)
+
+var pipePollInterval = 250 * time.Millisecond
+
+/* Number of packets waiting for a slow reader before new ones are dropped */
+const pipeQueueLength = 256
+
+// WrapPipe creates a named pipe at path and streams all HCI traffic of dev to it, so Wireshark
+// can attach to a running stack with "wireshark -k -i path". Packets are dropped while nobody
+// is reading or the reader does not keep up, every new reader gets the headers first.
+func WrapPipe(dev hciinterface.HCIInterface, path string, config *Config) (hciinterface.HCIInterface, error) {
+	err := unix.Mkfifo(path, 0o600)
+	if errors.Is(err, os.ErrExist) {
+		info, statErr := os.Stat(path)
+		if statErr != nil {
+			return dev, statErr
+		}
+		if info.Mode()&os.ModeNamedPipe == 0 {
+			return dev, errors.New("Path exists and is not a named pipe")
+		}
+	} else if err != nil {
+		return dev, err
+	}
+
+	l := newLogger(dev, config)
+	l.queue = make(chan []byte, pipeQueueLength)
+	go l.servePipe(path)
+
+	return l, nil
+}
+
+func (l *logger) servePipe(path string) {
+	ticker := time.NewTicker(pipePollInterval)
+	defer ticker.Stop()
+
+	for {
+		/* Without a reader the open fails instead of blocking, so Close is never held up */
+		file, err := os.OpenFile(path, os.O_WRONLY|unix.O_NONBLOCK, 0)
+		if err == nil {
+			l.servePipeReader(file)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-l.closeChan:
+			return
+		}
+	}
+}
+
+// servePipeReader streams packets to one reader until it goes away. Only this goroutine writes,
+// so a full pipe never blocks logPacket.
+func (l *logger) servePipeReader(file *os.File) {
+	defer file.Close()
+
+	/* Packets of the previous reader that were never written */
+	for drained := false; !drained; {
+		select {
+		case <-l.queue:
+		default:
+			drained = true
+		}
+	}
+
+	l.Lock()
+	select {
+	case <-l.closeChan:
+		l.Unlock()
+		return
+	default:
+	}
+	l.out = file
+	l.failed = false
+	l.Unlock()
+
+	/* Packets logged from now on are queued behind the headers */
+	err := writeAll(file, l.header())
+	for err == nil {
+		select {
+		case block := <-l.queue:
+			err = writeAll(file, block)
+
+		case <-l.closeChan:
+			return
+		}
+	}
+
+	/* A partial block breaks the stream, the next reader starts with new headers */
+	l.Lock()
+	if l.out == file {
+		l.out = nil
+	}
+	l.Unlock()
+}
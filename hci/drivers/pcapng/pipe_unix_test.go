@@ -0,0 +1,119 @@
+//go:build unix
+
+package pcapng
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	hciinterface "github.com/BertoldVdb/go-ble/hci/drivers/interface"
+)
+
+// Every reader of the pipe gets the headers first, packets without a reader are dropped
+func TestWrapPipe(t *testing.T) {
+	pipePollInterval = 10 * time.Millisecond
+
+	path := filepath.Join(t.TempDir(), "hci.pcapng")
+	w, err := WrapPipe(&fakeIface{}, path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	l := w.(*logger)
+
+	cmd := []byte{0x01, 0x03, 0x0c, 0x00}
+	packetLen := len(l.packet(false, time.Now(), cmd))
+
+	for i := 0; i < 2; i++ {
+		reader, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		header := make([]byte, len(l.header()))
+		if _, err := io.ReadFull(reader, header); err != nil || !bytes.Equal(header, l.header()) {
+			t.Fatalf("reader %d: header %x (%v)", i, header, err)
+		}
+
+		w.SendPacket(hciinterface.HCITxPacket{Data: cmd})
+		packet := make([]byte, packetLen)
+		if _, err := io.ReadFull(reader, packet); err != nil || !bytes.Equal(packet[32:36], cmd) {
+			t.Fatalf("reader %d: packet %x (%v)", i, packet, err)
+		}
+		reader.Close()
+
+		/* The first write without a reader fails and makes the logger wait for the next. A
+		   reader that opens the pipe before that would attach to the old writer. */
+		w.SendPacket(hciinterface.HCITxPacket{Data: cmd})
+		waitPipeReleased(t, l)
+	}
+
+	if _, err := WrapPipe(&fakeIface{}, t.TempDir(), nil); err == nil {
+		t.Error("directory used as pipe")
+	}
+}
+
+func waitPipeReleased(t *testing.T, l *logger) {
+	t.Helper()
+
+	for start := time.Now(); time.Since(start) < 2*time.Second; time.Sleep(time.Millisecond) {
+		l.Lock()
+		released := l.out == nil
+		l.Unlock()
+		if released {
+			return
+		}
+	}
+	t.Fatal("writer did not notice the reader went away")
+}
+
+// A reader that does not keep up makes the logger drop packets instead of blocking the stack
+func TestWrapPipeSlowReader(t *testing.T) {
+	pipePollInterval = 10 * time.Millisecond
+
+	path := filepath.Join(t.TempDir(), "hci.pcapng")
+	w, err := WrapPipe(&fakeIface{}, path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	l := w.(*logger)
+
+	reader, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	header := make([]byte, len(l.header()))
+	if _, err := io.ReadFull(reader, header); err != nil {
+		t.Fatal(err)
+	}
+
+	/* Far more than the pipe and the queue hold together */
+	data := make([]byte, 1024)
+	data[0] = 0x02
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 4*pipeQueueLength+1024; i++ {
+			w.SendPacket(hciinterface.HCITxPacket{Data: data})
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sending blocked on the reader")
+	}
+
+	/* What was written is still a valid stream */
+	packet := make([]byte, len(l.packet(false, time.Now(), data)))
+	if _, err := io.ReadFull(reader, packet); err != nil || !bytes.Equal(packet[32:32+len(data)], data) {
+		t.Fatalf("packet %x (%v)", packet[:40], err)
+	}
+}
@@ -0,0 +1,523 @@
+package hcidriverserial
+
+import (
+	"errors"
+	"io"
+	"math/bits"
+	"sync"
+	"time"
+
+	hciconst "github.com/BertoldVdb/go-ble/hci/const"
+	hciinterface "github.com/BertoldVdb/go-ble/hci/drivers/interface"
+)
+
+// Three-wire UART (H5), Core specification Vol 4 Part D. Packets are SLIP framed and carry a
+// header with sequence numbers, so reliable packets are retransmitted until acknowledged.
+
+const (
+	slipDelimiter = 0xC0
+	slipEscape    = 0xDB
+	slipEscapedC0 = 0xDC
+	slipEscapedDB = 0xDD
+
+	h5TypeAck         = 0
+	h5TypeLinkControl = 15
+
+	h5MaxPayload = 4095
+)
+
+var (
+	h5Sync           = []byte{0x01, 0x7E}
+	h5SyncResponse   = []byte{0x02, 0x7D}
+	h5Config         = []byte{0x03, 0xFC}
+	h5ConfigResponse = []byte{0x04, 0x7B}
+	h5Wakeup         = []byte{0x05, 0xFA}
+	h5Woken          = []byte{0x06, 0xF9}
+)
+
+/* Timing of link establishment and retransmission, variables so tests can speed them up */
+var (
+	h5TickInterval      = 50 * time.Millisecond
+	h5SyncInterval      = 250 * time.Millisecond
+	h5RetransmitTimeout = 250 * time.Millisecond
+)
+
+// H5Config contains the options proposed to the peer during link establishment
+type H5Config struct {
+	// WindowSize is the number of unacknowledged reliable packets, between 1 and 7
+	WindowSize int
+
+	// CRC adds a data integrity check to every packet if the peer supports it
+	CRC bool
+}
+
+func DefaultH5Config() *H5Config {
+	return &H5Config{
+		WindowSize: 4,
+	}
+}
+
+type h5State int
+
+const (
+	h5Uninitialized h5State = iota
+	h5Initialized
+	h5Active
+)
+
+type h5Packet struct {
+	seq     uint8
+	pktType uint8
+	payload []byte
+}
+
+// HCIH5 is a HCIInterface using the Three-wire UART protocol
+type HCIH5 struct {
+	sync.Mutex
+
+	port      io.ReadWriteCloser
+	config    H5Config
+	rxHandler hciinterface.HCIRxHandler
+
+	state      h5State
+	window     int
+	crc        bool
+	txSeq      uint8
+	rxExpected uint8
+	ackPending bool
+
+	queue     [][]byte
+	unacked   []h5Packet
+	control   [][]byte
+	lastTx    time.Time
+	nextLink  time.Time
+	wakeChan  chan struct{}
+	closeChan chan struct{}
+
+	closeOnce sync.Once
+	closeErr  error
+	closed    bool
+}
+
+// OpenPortH5 returns a Three-wire UART HCIInterface using port. A nil config uses
+// DefaultH5Config.
+func OpenPortH5(port io.ReadWriteCloser, config *H5Config) (hciinterface.HCIInterface, error) {
+	if config == nil {
+		config = DefaultH5Config()
+	}
+	if config.WindowSize < 1 || config.WindowSize > 7 {
+		return nil, errors.New("Window size must be between 1 and 7")
+	}
+
+	return &HCIH5{
+		port:      port,
+		config:    *config,
+		window:    config.WindowSize,
+		wakeChan:  make(chan struct{}, 1),
+		closeChan: make(chan struct{}),
+	}, nil
+}
+
+func (d *HCIH5) wake() {
+	select {
+	case d.wakeChan <- struct{}{}:
+	default:
+	}
+}
+
+func slipEncode(data []byte) []byte {
+	result := make([]byte, 0, len(data)+8)
+	result = append(result, slipDelimiter)
+	for _, m := range data {
+		switch m {
+		case slipDelimiter:
+			result = append(result, slipEscape, slipEscapedC0)
+		case slipEscape:
+			result = append(result, slipEscape, slipEscapedDB)
+		default:
+			result = append(result, m)
+		}
+	}
+	return append(result, slipDelimiter)
+}
+
+// h5CRC is the CRC-CCITT used by H5: computed LSB first and sent bit reversed, MSB first
+func h5CRC(data []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, m := range data {
+		crc ^= uint16(m)
+		for i := 0; i < 8; i++ {
+			if crc&1 > 0 {
+				crc = crc>>1 ^ 0x8408
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return bits.Reverse16(crc)
+}
+
+// encode creates a frame, the acknowledgement is always the next expected sequence number.
+// The lock must be held
+func (d *HCIH5) encode(reliable bool, seq uint8, pktType uint8, payload []byte) []byte {
+	hdr := make([]byte, 4, 4+len(payload)+2)
+	hdr[0] = seq&7 | (d.rxExpected&7)<<3
+	if d.crc {
+		hdr[0] |= 0x40
+	}
+	if reliable {
+		hdr[0] |= 0x80
+	}
+	hdr[1] = pktType&0xF | byte(len(payload)&0xF)<<4
+	hdr[2] = byte(len(payload) >> 4)
+	hdr[3] = ^(hdr[0] + hdr[1] + hdr[2])
+
+	frame := append(hdr, payload...)
+	if d.crc {
+		crc := h5CRC(frame)
+		frame = append(frame, byte(crc>>8), byte(crc))
+	}
+
+	d.ackPending = false
+	return slipEncode(frame)
+}
+
+func h5Reliable(pktType uint8) bool {
+	return pktType != hciconst.MsgTypeSCO
+}
+
+func (d *HCIH5) configField() byte {
+	field := byte(d.config.WindowSize)
+	if d.config.CRC {
+		field |= 1 << 4
+	}
+	return field
+}
+
+/* collectFrames returns everything that has to be sent now */
+func (d *HCIH5) collectFrames(now time.Time) [][]byte {
+	d.Lock()
+	defer d.Unlock()
+
+	var frames [][]byte
+	for _, m := range d.control {
+		frames = append(frames, d.encode(false, 0, h5TypeLinkControl, m))
+	}
+	d.control = nil
+
+	switch d.state {
+	case h5Uninitialized:
+		if !now.Before(d.nextLink) {
+			frames = append(frames, d.encode(false, 0, h5TypeLinkControl, h5Sync))
+			d.nextLink = now.Add(h5SyncInterval)
+		}
+
+	case h5Initialized:
+		if !now.Before(d.nextLink) {
+			frames = append(frames, d.encode(false, 0, h5TypeLinkControl, append(h5Config, d.configField())))
+			d.nextLink = now.Add(h5SyncInterval)
+		}
+
+	case h5Active:
+		if len(d.unacked) > 0 && now.Sub(d.lastTx) >= h5RetransmitTimeout {
+			for _, m := range d.unacked {
+				frames = append(frames, d.encode(true, m.seq, m.pktType, m.payload))
+			}
+			d.lastTx = now
+		}
+
+		for len(d.queue) > 0 {
+			pkt := d.queue[0]
+			pktType := pkt[0]
+
+			if !h5Reliable(pktType) {
+				frames = append(frames, d.encode(false, 0, pktType, pkt[1:]))
+				d.queue = d.queue[1:]
+				continue
+			}
+
+			if len(d.unacked) >= d.window {
+				break
+			}
+			if len(d.unacked) == 0 {
+				d.lastTx = now
+			}
+
+			m := h5Packet{seq: d.txSeq, pktType: pktType, payload: pkt[1:]}
+			d.txSeq = (d.txSeq + 1) & 7
+			d.unacked = append(d.unacked, m)
+			d.queue = d.queue[1:]
+			frames = append(frames, d.encode(true, m.seq, m.pktType, m.payload))
+		}
+
+		if d.ackPending {
+			frames = append(frames, d.encode(false, 0, h5TypeAck, nil))
+		}
+	}
+
+	return frames
+}
+
+func (d *HCIH5) writer() {
+	ticker := time.NewTicker(h5TickInterval)
+	defer ticker.Stop()
+
+	for {
+		for _, m := range d.collectFrames(time.Now()) {
+			if _, err := d.port.Write(m); err != nil {
+				d.Close()
+				return
+			}
+		}
+
+		select {
+		case <-d.wakeChan:
+		case <-ticker.C:
+		case <-d.closeChan:
+			return
+		}
+	}
+}
+
+// reset returns to link establishment, packets that were not acknowledged are sent again.
+// The lock must be held
+func (d *HCIH5) reset() {
+	var requeue [][]byte
+	for _, m := range d.unacked {
+		requeue = append(requeue, append([]byte{m.pktType}, m.payload...))
+	}
+
+	d.queue = append(requeue, d.queue...)
+	d.unacked = nil
+	d.state = h5Uninitialized
+	d.window = d.config.WindowSize
+	d.crc = false
+	d.txSeq = 0
+	d.rxExpected = 0
+	d.ackPending = false
+	d.nextLink = time.Time{}
+}
+
+func (d *HCIH5) handleLinkControl(payload []byte) {
+	if len(payload) < 2 {
+		return
+	}
+
+	msg := payload[:2]
+	switch {
+	case string(msg) == string(h5Sync):
+		/* A sync in the active state means the peer restarted */
+		if d.state == h5Active {
+			d.reset()
+		}
+		d.control = append(d.control, h5SyncResponse)
+
+	case string(msg) == string(h5SyncResponse):
+		if d.state == h5Uninitialized {
+			d.state = h5Initialized
+			d.nextLink = time.Time{}
+		}
+
+	case string(msg) == string(h5Config):
+		if d.state != h5Uninitialized {
+			d.control = append(d.control, append(h5ConfigResponse, d.configField()))
+		}
+
+	case string(msg) == string(h5ConfigResponse):
+		if d.state != h5Initialized {
+			return
+		}
+
+		/* Without a configuration field the peer uses the defaults */
+		d.state = h5Active
+		if len(payload) > 2 {
+			if window := int(payload[2] & 7); window > 0 && window < d.window {
+				d.window = window
+			}
+			d.crc = d.config.CRC && payload[2]&(1<<4) > 0
+		}
+
+	case string(msg) == string(h5Wakeup):
+		d.control = append(d.control, h5Woken)
+	}
+}
+
+/* handleFrame processes a decoded frame and returns the packet to pass to the host, if any */
+func (d *HCIH5) handleFrame(frame []byte) []byte {
+	if len(frame) < 4 || frame[0]+frame[1]+frame[2]+frame[3] != 0xFF {
+		return nil
+	}
+
+	hasCRC := frame[0]&0x40 > 0
+	reliable := frame[0]&0x80 > 0
+	seq := frame[0] & 7
+	ack := (frame[0] >> 3) & 7
+	pktType := frame[1] & 0xF
+	length := int(frame[1]>>4) | int(frame[2])<<4
+
+	end := 4 + length
+	if hasCRC {
+		if len(frame) != end+2 || h5CRC(frame[:end]) != uint16(frame[end])<<8|uint16(frame[end+1]) {
+			return nil
+		}
+	} else if len(frame) != end {
+		return nil
+	}
+	payload := frame[4:end]
+
+	d.Lock()
+	defer d.Unlock()
+	defer d.wake()
+
+	if pktType == h5TypeLinkControl {
+		d.handleLinkControl(payload)
+		return nil
+	}
+
+	if d.state != h5Active {
+		return nil
+	}
+
+	/* The acknowledgement is the next sequence number the peer expects */
+	if len(d.unacked) > 0 {
+		count := int((ack - d.unacked[0].seq) & 7)
+		if count > 0 && count <= len(d.unacked) {
+			d.unacked = d.unacked[count:]
+			d.lastTx = time.Now()
+		}
+	}
+
+	if pktType == h5TypeAck {
+		return nil
+	}
+
+	if reliable {
+		/* Packets out of order are dropped, the acknowledgement asks for the right one */
+		d.ackPending = true
+		if seq != d.rxExpected {
+			return nil
+		}
+		d.rxExpected = (d.rxExpected + 1) & 7
+	}
+
+	return append([]byte{pktType}, payload...)
+}
+
+// Run is the worker function. It needs to be running before packets can be sent or received.
+func (d *HCIH5) Run() error {
+	defer d.Close()
+	go d.writer()
+
+	rxBuf := make([]byte, 8192)
+	frame := make([]byte, 0, 4+h5MaxPayload+2)
+	inFrame, escaped := false, false
+
+	for {
+		n, err := d.port.Read(rxBuf)
+		if n == 0 || err != nil {
+			return err
+		}
+
+		for _, m := range rxBuf[:n] {
+			if m == slipDelimiter {
+				if inFrame && len(frame) > 0 {
+					if pkt := d.handleFrame(frame); pkt != nil {
+						if err := d.deliver(pkt); err != nil {
+							return err
+						}
+					}
+				}
+				frame = frame[:0]
+				inFrame, escaped = true, false
+				continue
+			}
+			if !inFrame {
+				continue
+			}
+
+			if escaped {
+				escaped = false
+				switch m {
+				case slipEscapedC0:
+					m = slipDelimiter
+				case slipEscapedDB:
+					m = slipEscape
+				default:
+					/* Invalid escape, skip the rest of the frame */
+					inFrame = false
+					continue
+				}
+			} else if m == slipEscape {
+				escaped = true
+				continue
+			}
+
+			if len(frame) == cap(frame) {
+				inFrame = false
+				continue
+			}
+			frame = append(frame, m)
+		}
+	}
+}
+
+func (d *HCIH5) deliver(pkt []byte) error {
+	d.Lock()
+	rxHandler := d.rxHandler
+	d.Unlock()
+
+	if rxHandler == nil {
+		return nil
+	}
+
+	return rxHandler(hciinterface.HCIRxPacket{
+		Received: true,
+		Data:     pkt,
+		RxTime:   time.Now(),
+	})
+}
+
+// Close closes the the interface. It can be called at any time and multiple times as well.
+// It will terminate Run, if it was running.
+func (d *HCIH5) Close() error {
+	d.closeOnce.Do(func() {
+		d.Lock()
+		d.closed = true
+		d.Unlock()
+		close(d.closeChan)
+		d.closeErr = d.port.Close()
+	})
+	return d.closeErr
+}
+
+// SendPacket queues a HCI packet for the device. It is sent once the link is established and
+// the window has room.
+func (d *HCIH5) SendPacket(pkt hciinterface.HCITxPacket) error {
+	if len(pkt.Data) < 1 || len(pkt.Data)-1 > h5MaxPayload {
+		return errors.New("Invalid packet length")
+	}
+	if pkt.Data[0] < hciconst.MsgTypeCommand || pkt.Data[0] > hciconst.MsgTypeISO {
+		return errors.New("Invalid packet type")
+	}
+
+	d.Lock()
+	if d.closed {
+		d.Unlock()
+		return io.ErrClosedPipe
+	}
+	d.queue = append(d.queue, append([]byte{}, pkt.Data...))
+	d.Unlock()
+
+	d.wake()
+	return nil
+}
+
+// SetRecvHandler configures the receive handler callback function. It will be called
+// when a HCI packet is received.
+func (d *HCIH5) SetRecvHandler(handler hciinterface.HCIRxHandler) error {
+	d.Lock()
+	defer d.Unlock()
+
+	d.rxHandler = handler
+	return nil
+}
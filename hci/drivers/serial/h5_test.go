@@ -0,0 +1,224 @@
+package hcidriverserial
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	hciinterface "github.com/BertoldVdb/go-ble/hci/drivers/interface"
+)
+
+func init() {
+	h5TickInterval = 5 * time.Millisecond
+	h5SyncInterval = 10 * time.Millisecond
+	h5RetransmitTimeout = 20 * time.Millisecond
+}
+
+func TestH5Frame(t *testing.T) {
+	d := &HCIH5{}
+
+	/* SYNC as seen on the wire */
+	if f := d.encode(false, 0, h5TypeLinkControl, h5Sync); !bytes.Equal(f, []byte{0xC0, 0x00, 0x2F, 0x00, 0xD0, 0x01, 0x7E, 0xC0}) {
+		t.Errorf("sync frame %x", f)
+	}
+
+	/* Delimiters in the payload are escaped */
+	if f := slipEncode([]byte{0x01, 0xC0, 0xDB}); !bytes.Equal(f, []byte{0xC0, 0x01, 0xDB, 0xDC, 0xDB, 0xDD, 0xC0}) {
+		t.Errorf("slip %x", f)
+	}
+
+	/* The CRC-16/MCRF4XX check value 0x6F91, bit reversed */
+	if crc := h5CRC([]byte("123456789")); crc != 0x89F6 {
+		t.Errorf("crc %04x", crc)
+	}
+}
+
+// h5Pair runs two H5 endpoints against each other. The controller side records what it receives.
+type h5Pair struct {
+	host, controller *HCIH5
+
+	mutex    sync.Mutex
+	toHost   [][]byte
+	toDevice [][]byte
+}
+
+func newH5Pair(t *testing.T, hostPort io.ReadWriteCloser, controllerPort io.ReadWriteCloser, config *H5Config) *h5Pair {
+	t.Helper()
+
+	p := &h5Pair{}
+	host, err := OpenPortH5(hostPort, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	controller, _ := OpenPortH5(controllerPort, config)
+	p.host, p.controller = host.(*HCIH5), controller.(*HCIH5)
+
+	p.host.SetRecvHandler(func(pkt hciinterface.HCIRxPacket) error {
+		p.mutex.Lock()
+		p.toHost = append(p.toHost, pkt.Data)
+		p.mutex.Unlock()
+		return nil
+	})
+	p.controller.SetRecvHandler(func(pkt hciinterface.HCIRxPacket) error {
+		p.mutex.Lock()
+		p.toDevice = append(p.toDevice, pkt.Data)
+		p.mutex.Unlock()
+		return nil
+	})
+
+	go p.host.Run()
+	go p.controller.Run()
+	t.Cleanup(func() {
+		p.host.Close()
+		p.controller.Close()
+	})
+	return p
+}
+
+func (p *h5Pair) wait(t *testing.T, toHost int, toDevice int) ([][]byte, [][]byte) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		p.mutex.Lock()
+		a, b := p.toHost, p.toDevice
+		p.mutex.Unlock()
+		if len(a) >= toHost && len(b) >= toDevice {
+			return a, b
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	t.Fatalf("received %d and %d packets", len(p.toHost), len(p.toDevice))
+	return nil, nil
+}
+
+func testPacket(i int) []byte {
+	/* Every packet contains bytes that need escaping */
+	return []byte{0x02, byte(i), 0x00, 0x04, 0x00, 0xC0, 0xDB, byte(i), 0x11}
+}
+
+func TestH5Transfer(t *testing.T) {
+	a, b := net.Pipe()
+	p := newH5Pair(t, a, b, nil)
+
+	/* More packets than the window and the sequence numbers, in both directions */
+	for i := 0; i < 20; i++ {
+		p.host.SendPacket(hciinterface.HCITxPacket{Data: testPacket(i)})
+		p.controller.SendPacket(hciinterface.HCITxPacket{Data: []byte{0x04, 0x0e, 0x01, byte(i)}})
+	}
+	p.controller.SendPacket(hciinterface.HCITxPacket{Data: []byte{0x03, 0x40, 0x00, 0x01, 0x55}})
+
+	toHost, toDevice := p.wait(t, 21, 20)
+	for i := 0; i < 20; i++ {
+		if !bytes.Equal(toDevice[i], testPacket(i)) {
+			t.Errorf("packet %d to device: %x", i, toDevice[i])
+		}
+		if !bytes.Equal(toHost[i], []byte{0x04, 0x0e, 0x01, byte(i)}) {
+			t.Errorf("packet %d to host: %x", i, toHost[i])
+		}
+	}
+	if !bytes.Equal(toHost[20], []byte{0x03, 0x40, 0x00, 0x01, 0x55}) {
+		t.Errorf("sco packet %x", toHost[20])
+	}
+}
+
+// lossyPort damages frames written by the host: the first reliable frame is dropped and the
+// second one gets a corrupted payload.
+type lossyPort struct {
+	net.Conn
+	reliable int
+	lost     int
+}
+
+func (l *lossyPort) Write(p []byte) (int, error) {
+	if len(p) > 8 && p[1]&0x80 > 0 {
+		l.reliable++
+		switch l.reliable {
+		case 1:
+			l.lost++
+			return len(p), nil
+		case 2:
+			l.lost++
+			damaged := append([]byte{}, p...)
+			damaged[6] ^= 0x01
+			_, err := l.Conn.Write(damaged)
+			return len(p), err
+		}
+	}
+	return l.Conn.Write(p)
+}
+
+func TestH5Retransmit(t *testing.T) {
+	a, b := net.Pipe()
+	lossy := &lossyPort{Conn: a}
+
+	config := DefaultH5Config()
+	config.CRC = true
+	p := newH5Pair(t, lossy, b, config)
+
+	for i := 0; i < 5; i++ {
+		p.host.SendPacket(hciinterface.HCITxPacket{Data: testPacket(i)})
+	}
+
+	_, toDevice := p.wait(t, 0, 5)
+	for i, m := range toDevice {
+		if !bytes.Equal(m, testPacket(i)) {
+			t.Errorf("packet %d: %x", i, m)
+		}
+	}
+
+	p.host.Lock()
+	crc := p.host.crc
+	p.host.Unlock()
+	if !crc || lossy.lost != 2 {
+		t.Errorf("crc %v, lost %d", crc, lossy.lost)
+	}
+}
+
+// A peer that restarts sends SYNC again, the link is established again and data still flows
+func TestH5PeerReset(t *testing.T) {
+	a, b := net.Pipe()
+	p := newH5Pair(t, a, b, nil)
+
+	p.host.SendPacket(hciinterface.HCITxPacket{Data: testPacket(0)})
+	p.wait(t, 0, 1)
+
+	p.controller.Lock()
+	p.controller.reset()
+	p.controller.Unlock()
+	p.controller.wake()
+
+	p.host.SendPacket(hciinterface.HCITxPacket{Data: testPacket(1)})
+	_, toDevice := p.wait(t, 0, 2)
+	if !bytes.Equal(toDevice[1], testPacket(1)) {
+		t.Errorf("packet after reset %x", toDevice[1])
+	}
+}
+
+func TestOpenProtocol(t *testing.T) {
+	RegisterDevice("h5test", func(name string) (io.ReadWriteCloser, error) {
+		return newFakePort(nil), nil
+	})
+	RegisterDeviceProtocol("h5test2", ProtocolH5, func(name string) (io.ReadWriteCloser, error) {
+		return newFakePort(nil), nil
+	})
+
+	for name, h5 := range map[string]bool{"h5test": false, "h5:h5test": true, "h5test2": true, "h4:h5test2": false} {
+		dev, err := Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := dev.(*HCIH5); ok != h5 {
+			t.Errorf("%s: got %T", name, dev)
+		}
+		dev.Close()
+	}
+
+	if _, err := Open("h5:missing"); err != hciinterface.ErrorDeviceNotFound {
+		t.Errorf("got %v", err)
+	}
+}
@@ -3,6 +3,7 @@ package hcidriverserial
 import (
 	"errors"
 	"io"
+	"strings"
 	"sync"
 	"time"
 
@@ -10,7 +11,20 @@ import (
 	hciinterface "github.com/BertoldVdb/go-ble/hci/drivers/interface"
 )
 
-var portOpenFuncs = make(map[string]HCISerialOpenFunc)
+// Protocol selects the framing used on the serial port
+type Protocol int
+
+const (
+	ProtocolH4 Protocol = iota
+	ProtocolH5
+)
+
+type registeredDevice struct {
+	open     HCISerialOpenFunc
+	protocol Protocol
+}
+
+var portOpenFuncs = make(map[string]registeredDevice)
 
 var (
 	// ErrorSynchronisationLost is returned by the Run function when bad data is received,
@@ -53,19 +67,33 @@ func OpenPort(port io.ReadWriteCloser) (hciinterface.HCIInterface, error) {
 	}, nil
 }
 
-// Open returns the HCIInterface with a given device name.
+// Open returns the HCIInterface with a given device name. The protocol given when the device
+// was registered can be overridden by prefixing the name with "h4:" or "h5:".
 func Open(deviceName string) (hciinterface.HCIInterface, error) {
-	f, ok := portOpenFuncs[deviceName]
+	override := false
+	var protocol Protocol
+	if name, ok := strings.CutPrefix(deviceName, "h4:"); ok {
+		deviceName, protocol, override = name, ProtocolH4, true
+	} else if name, ok := strings.CutPrefix(deviceName, "h5:"); ok {
+		deviceName, protocol, override = name, ProtocolH5, true
+	}
 
+	dev, ok := portOpenFuncs[deviceName]
 	if !ok {
 		return nil, hciinterface.ErrorDeviceNotFound
 	}
+	if !override {
+		protocol = dev.protocol
+	}
 
-	port, err := f(deviceName)
+	port, err := dev.open(deviceName)
 	if err != nil {
 		return nil, err
 	}
 
+	if protocol == ProtocolH5 {
+		return OpenPortH5(port, nil)
+	}
 	return OpenPort(port)
 }
 
@@ -190,7 +218,15 @@ func (d *HCISerial) SetRecvHandler(handler hciinterface.HCIRxHandler) error {
 	return nil
 }
 
-// RegisterDevice registers an open function for a device name.
+// RegisterDevice registers an open function for a device name that uses H4.
 func RegisterDevice(deviceName string, f HCISerialOpenFunc) {
-	portOpenFuncs[deviceName] = f
+	RegisterDeviceProtocol(deviceName, ProtocolH4, f)
+}
+
+// RegisterDeviceProtocol registers an open function for a device name that uses protocol.
+func RegisterDeviceProtocol(deviceName string, protocol Protocol, f HCISerialOpenFunc) {
+	portOpenFuncs[deviceName] = registeredDevice{
+		open:     f,
+		protocol: protocol,
+	}
 }
@@ -0,0 +1,189 @@
+package hcidriverusb
+
+import (
+	"io"
+	"sync"
+)
+
+// TransferType is the kind of a transfer recorded by FakeDevice
+type TransferType int
+
+const (
+	TransferControl TransferType = iota
+	TransferInterrupt
+	TransferBulk
+	TransferIsochronous
+)
+
+// FakeTransfer is a transfer sent to a FakeDevice
+type FakeTransfer struct {
+	Type TransferType
+
+	// Endpoint is 0 for control transfers
+	Endpoint uint8
+
+	RequestType uint8
+	Request     uint8
+	Value       uint16
+	Index       uint16
+
+	Data []byte
+}
+
+// FakeDevice is a USBDevice without hardware. Transfers sent to it are recorded and passed to
+// OnTransfer, data for IN endpoints is queued with Inject.
+type FakeDevice struct {
+	sync.Mutex
+
+	// MaxPacketSize splits injected data into USB packets, like a real endpoint. A transfer ends
+	// with a packet that is shorter, or when the buffer is full.
+	MaxPacketSize int
+
+	// OnTransfer is called for every transfer sent to the device
+	OnTransfer func(t FakeTransfer)
+
+	transfers []FakeTransfer
+	in        map[uint8]chan fakeInPacket
+	closeChan chan struct{}
+	closeOnce sync.Once
+}
+
+// fakeInPacket is a USB packet queued for an IN endpoint, or an error for the transfer
+type fakeInPacket struct {
+	data []byte
+	err  error
+}
+
+func NewFakeDevice(maxPacketSize int) *FakeDevice {
+	return &FakeDevice{
+		MaxPacketSize: maxPacketSize,
+		in:            make(map[uint8]chan fakeInPacket),
+		closeChan:     make(chan struct{}),
+	}
+}
+
+func (f *FakeDevice) endpoint(endpoint uint8) chan fakeInPacket {
+	f.Lock()
+	defer f.Unlock()
+
+	c, ok := f.in[endpoint]
+	if !ok {
+		c = make(chan fakeInPacket, 1024)
+		f.in[endpoint] = c
+	}
+	return c
+}
+
+// Inject queues one transfer for an IN endpoint, split in packets of at most MaxPacketSize bytes
+func (f *FakeDevice) Inject(endpoint uint8, data []byte) {
+	c := f.endpoint(endpoint)
+	for {
+		n := len(data)
+		if f.MaxPacketSize > 0 && n > f.MaxPacketSize {
+			n = f.MaxPacketSize
+		}
+
+		c <- fakeInPacket{data: append([]byte{}, data[:n]...)}
+		data = data[n:]
+		if len(data) > 0 {
+			continue
+		}
+
+		/* A zero length packet ends a transfer that fills its last packet */
+		if f.MaxPacketSize > 0 && n == f.MaxPacketSize {
+			c <- fakeInPacket{data: []byte{}}
+		}
+		return
+	}
+}
+
+// InjectError makes the next transfer on an IN endpoint fail with err
+func (f *FakeDevice) InjectError(endpoint uint8, err error) {
+	f.endpoint(endpoint) <- fakeInPacket{err: err}
+}
+
+// Transfers returns the transfers sent to the device so far
+func (f *FakeDevice) Transfers() []FakeTransfer {
+	f.Lock()
+	defer f.Unlock()
+
+	return append([]FakeTransfer{}, f.transfers...)
+}
+
+func (f *FakeDevice) out(t FakeTransfer) (int, error) {
+	select {
+	case <-f.closeChan:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+
+	t.Data = append([]byte{}, t.Data...)
+
+	f.Lock()
+	f.transfers = append(f.transfers, t)
+	cb := f.OnTransfer
+	f.Unlock()
+
+	if cb != nil {
+		cb(t)
+	}
+	return len(t.Data), nil
+}
+
+func (f *FakeDevice) transfer(transferType TransferType, endpoint uint8, data []byte) (int, error) {
+	if endpoint&0x80 == 0 {
+		return f.out(FakeTransfer{Type: transferType, Endpoint: endpoint, Data: data})
+	}
+
+	c := f.endpoint(endpoint)
+	n := 0
+	for {
+		select {
+		case m := <-c:
+			if m.err != nil {
+				return 0, m.err
+			}
+			if n+len(m.data) > len(data) {
+				return 0, io.ErrShortBuffer
+			}
+			n += copy(data[n:], m.data)
+
+			if f.MaxPacketSize <= 0 || len(m.data) < f.MaxPacketSize || n == len(data) {
+				return n, nil
+			}
+
+		case <-f.closeChan:
+			return 0, io.EOF
+		}
+	}
+}
+
+func (f *FakeDevice) Control(requestType uint8, request uint8, value uint16, index uint16, data []byte) (int, error) {
+	return f.out(FakeTransfer{
+		Type:        TransferControl,
+		RequestType: requestType,
+		Request:     request,
+		Value:       value,
+		Index:       index,
+		Data:        data,
+	})
+}
+
+func (f *FakeDevice) Interrupt(endpoint uint8, data []byte) (int, error) {
+	return f.transfer(TransferInterrupt, endpoint, data)
+}
+
+func (f *FakeDevice) Bulk(endpoint uint8, data []byte) (int, error) {
+	return f.transfer(TransferBulk, endpoint, data)
+}
+
+func (f *FakeDevice) Isochronous(endpoint uint8, data []byte) (int, error) {
+	return f.transfer(TransferIsochronous, endpoint, data)
+}
+
+func (f *FakeDevice) Close() error {
+	f.closeOnce.Do(func() {
+		close(f.closeChan)
+	})
+	return nil
+}
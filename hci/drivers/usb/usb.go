@@ -0,0 +1,337 @@
+// Package hcidriverusb implements the USB HCI transport on top of a USBDevice, which can be
+// backed by libusb, usbfs or any other user space USB stack.
+package hcidriverusb
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	hciconst "github.com/BertoldVdb/go-ble/hci/const"
+	hciinterface "github.com/BertoldVdb/go-ble/hci/drivers/interface"
+)
+
+var (
+	// ErrorUnsupportedPacket is returned by SendPacket for packets that can not be carried
+	ErrorUnsupportedPacket = errors.New("Packet type is not supported by the transport")
+
+	// ErrorSynchronisationLost is returned by Run when a transfer on the event or ACL endpoint ends
+	// in the middle of a packet
+	ErrorSynchronisationLost = errors.New("Synchronization lost")
+
+	// ErrorTransferTransient is wrapped by a USBDevice for a transfer that failed without breaking
+	// the endpoint, like a missed isochronous packet. Other errors stop the transport.
+	ErrorTransferTransient = errors.New("Transient transfer error")
+)
+
+// Class specific request to an interface, used to send HCI commands on the control endpoint
+const requestTypeClassInterface = 0x20
+
+// USBDevice is the part of a USB Bluetooth controller used by the transport. Transfers to an IN
+// endpoint (bit 7 of the address set) block until data is received.
+type USBDevice interface {
+	// Control performs a transfer on the default control endpoint
+	Control(requestType uint8, request uint8, value uint16, index uint16, data []byte) (int, error)
+
+	Interrupt(endpoint uint8, data []byte) (int, error)
+	Bulk(endpoint uint8, data []byte) (int, error)
+	Isochronous(endpoint uint8, data []byte) (int, error)
+
+	// Close aborts pending transfers and releases the device
+	Close() error
+}
+
+type Config struct {
+	// Interface is the number of the interface with the HCI endpoints
+	Interface uint16
+
+	EventEndpoint          uint8
+	ACLInEndpoint          uint8
+	ACLOutEndpoint         uint8
+	IsochronousInEndpoint  uint8
+	IsochronousOutEndpoint uint8
+
+	// IsochronousType is the type of the packets carried by the isochronous endpoints, SCO
+	// unless the controller uses them for ISO data. Zero disables the isochronous endpoints.
+	IsochronousType uint8
+
+	// TransferSize is the buffer size of IN transfers, packets can span several transfers
+	TransferSize int
+}
+
+// DefaultConfig uses the endpoint addresses of the Bluetooth USB specification
+func DefaultConfig() *Config {
+	return &Config{
+		EventEndpoint:          0x81,
+		ACLInEndpoint:          0x82,
+		ACLOutEndpoint:         0x02,
+		IsochronousInEndpoint:  0x83,
+		IsochronousOutEndpoint: 0x03,
+		IsochronousType:        hciconst.MsgTypeSCO,
+		TransferSize:           1024,
+	}
+}
+
+// HCIUSB is a HCIInterface using a USB device
+type HCIUSB struct {
+	sync.Mutex
+
+	dev       USBDevice
+	config    Config
+	rxHandler hciinterface.HCIRxHandler
+
+	/* Packets are delivered one at a time, as the event decoders are not reentrant */
+	deliverMutex sync.Mutex
+
+	closeOnce sync.Once
+	closeErr  error
+	closed    bool
+}
+
+// OpenDevice returns the HCIInterface for dev. A nil config uses DefaultConfig.
+func OpenDevice(dev USBDevice, config *Config) (hciinterface.HCIInterface, error) {
+	if config == nil {
+		config = DefaultConfig()
+	}
+
+	return &HCIUSB{
+		dev:    dev,
+		config: *config,
+	}, nil
+}
+
+// packetLength returns the length of the packet at the start of buffer, which begins with the
+// packet type, 0 if more data is needed
+func packetLength(buffer []byte) int {
+	if len(buffer) < 1 {
+		return 0
+	}
+
+	switch buffer[0] {
+	case hciconst.MsgTypeEvent:
+		if len(buffer) >= 3 {
+			return 3 + int(buffer[2])
+		}
+	case hciconst.MsgTypeACL:
+		if len(buffer) >= 5 {
+			return 5 + int(binary.LittleEndian.Uint16(buffer[3:]))
+		}
+	case hciconst.MsgTypeSCO:
+		if len(buffer) >= 4 {
+			return 4 + int(buffer[3])
+		}
+	case hciconst.MsgTypeISO:
+		if len(buffer) >= 5 {
+			return 5 + int(binary.LittleEndian.Uint16(buffer[3:])&0x3FFF)
+		}
+	default:
+		return -1
+	}
+
+	return 0
+}
+
+// receive reads transfers from an IN endpoint. A transfer can hold several packets, and a packet
+// only continues in the next transfer when the buffer was filled. Packets are split using their
+// headers, a transfer that ends in the middle of a packet means data was lost. On a lossy
+// endpoint the partial packet is dropped and the next transfer starts a new one, otherwise the
+// transport is stopped.
+func (d *HCIUSB) receive(pktType uint8, transfer func(endpoint uint8, data []byte) (int, error), endpoint uint8, lossy bool) error {
+	buf := make([]byte, d.config.TransferSize)
+	pending := []byte{pktType}
+
+	for {
+		n, err := transfer(endpoint, buf)
+		if errors.Is(err, ErrorTransferTransient) {
+			pending = pending[:1]
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		pending = append(pending, buf[:n]...)
+		for {
+			pktLen := packetLength(pending)
+			if pktLen < 0 {
+				return ErrorSynchronisationLost
+			}
+			if pktLen == 0 || pktLen > len(pending) {
+				break
+			}
+
+			err = d.deliver(pending[:pktLen])
+			if err != nil {
+				return err
+			}
+			pending = append([]byte{pktType}, pending[pktLen:]...)
+		}
+
+		if n < len(buf) && len(pending) > 1 {
+			if !lossy {
+				return ErrorSynchronisationLost
+			}
+			pending = pending[:1]
+		}
+	}
+}
+
+func (d *HCIUSB) deliver(pkt []byte) error {
+	d.Lock()
+	rxHandler := d.rxHandler
+	d.Unlock()
+
+	if rxHandler == nil {
+		return nil
+	}
+
+	d.deliverMutex.Lock()
+	defer d.deliverMutex.Unlock()
+
+	return rxHandler(hciinterface.HCIRxPacket{
+		Received: true,
+		Data:     append([]byte{}, pkt...),
+		RxTime:   time.Now(),
+	})
+}
+
+// Run is the worker function. It needs to be running before packets can be sent or received.
+func (d *HCIUSB) Run() error {
+	readers := []func() error{
+		func() error {
+			return d.receive(hciconst.MsgTypeEvent, d.dev.Interrupt, d.config.EventEndpoint, false)
+		},
+		func() error {
+			return d.receive(hciconst.MsgTypeACL, d.dev.Bulk, d.config.ACLInEndpoint, false)
+		},
+	}
+	if d.config.IsochronousType != 0 && d.config.IsochronousInEndpoint != 0 {
+		readers = append(readers, func() error {
+			return d.receive(d.config.IsochronousType, d.dev.Isochronous, d.config.IsochronousInEndpoint, true)
+		})
+	}
+
+	errChan := make(chan error, len(readers))
+	for _, m := range readers {
+		go func(reader func() error) {
+			errChan <- reader()
+		}(m)
+	}
+
+	/* The first reader that stops closes the device, which stops the others */
+	err := <-errChan
+	d.Lock()
+	closed := d.closed
+	d.Unlock()
+	d.Close()
+
+	for i := 1; i < len(readers); i++ {
+		<-errChan
+	}
+
+	if closed {
+		return nil
+	}
+	return err
+}
+
+// Close closes the the interface. It can be called at any time and multiple times as well.
+// It will terminate Run, if it was running.
+func (d *HCIUSB) Close() error {
+	d.closeOnce.Do(func() {
+		d.Lock()
+		d.closed = true
+		d.Unlock()
+		d.closeErr = d.dev.Close()
+	})
+	return d.closeErr
+}
+
+// SendPacket sends a HCI packet to the device. Commands use the control endpoint, ACL data the
+// bulk endpoint and SCO or ISO data the isochronous endpoint.
+func (d *HCIUSB) SendPacket(pkt hciinterface.HCITxPacket) error {
+	d.Lock()
+	if d.closed {
+		d.Unlock()
+		return io.ErrClosedPipe
+	}
+	d.Unlock()
+
+	if len(pkt.Data) < 1 {
+		return ErrorUnsupportedPacket
+	}
+
+	var err error
+	data := pkt.Data[1:]
+	switch pkt.Data[0] {
+	case hciconst.MsgTypeCommand:
+		_, err = d.dev.Control(requestTypeClassInterface, 0, 0, d.config.Interface, data)
+	case hciconst.MsgTypeACL:
+		_, err = d.dev.Bulk(d.config.ACLOutEndpoint, data)
+	case hciconst.MsgTypeSCO, hciconst.MsgTypeISO:
+		if pkt.Data[0] != d.config.IsochronousType || d.config.IsochronousOutEndpoint == 0 {
+			return ErrorUnsupportedPacket
+		}
+		_, err = d.dev.Isochronous(d.config.IsochronousOutEndpoint, data)
+	default:
+		return ErrorUnsupportedPacket
+	}
+	return err
+}
+
+// SetRecvHandler configures the receive handler callback function. It will be called
+// when a HCI packet is received.
+func (d *HCIUSB) SetRecvHandler(handler hciinterface.HCIRxHandler) error {
+	d.Lock()
+	defer d.Unlock()
+
+	d.rxHandler = handler
+	return nil
+}
+
+// OpenFunc opens a registered device
+type OpenFunc func(deviceName string) (USBDevice, error)
+
+var (
+	devicesMutex sync.Mutex
+	devices      = make(map[string]OpenFunc)
+)
+
+// RegisterDevice makes a USB device available by name to Open
+func RegisterDevice(deviceName string, f OpenFunc) {
+	devicesMutex.Lock()
+	defer devicesMutex.Unlock()
+
+	devices[deviceName] = f
+}
+
+// ListDevices returns the names of the registered devices
+func ListDevices() ([]string, error) {
+	devicesMutex.Lock()
+	defer devicesMutex.Unlock()
+
+	var result []string
+	for k := range devices {
+		result = append(result, k)
+	}
+	return result, nil
+}
+
+// Open returns the HCIInterface of a registered device with the default configuration
+func Open(deviceName string) (hciinterface.HCIInterface, error) {
+	devicesMutex.Lock()
+	f, ok := devices[deviceName]
+	devicesMutex.Unlock()
+
+	if !ok {
+		return nil, hciinterface.ErrorDeviceNotFound
+	}
+
+	dev, err := f(deviceName)
+	if err != nil {
+		return nil, err
+	}
+	return OpenDevice(dev, nil)
+}
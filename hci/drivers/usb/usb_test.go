@@ -0,0 +1,278 @@
+package hcidriverusb
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/BertoldVdb/go-ble/hci"
+	hciconst "github.com/BertoldVdb/go-ble/hci/const"
+	hciinterface "github.com/BertoldVdb/go-ble/hci/drivers/interface"
+	"github.com/BertoldVdb/go-ble/hci/drivers/loopback"
+	"github.com/sirupsen/logrus"
+)
+
+func silentLogger() *logrus.Entry {
+	l := logrus.New()
+	l.Out = io.Discard
+	return logrus.NewEntry(l)
+}
+
+func TestSendRouting(t *testing.T) {
+	f := NewFakeDevice(64)
+	config := DefaultConfig()
+	config.Interface = 2
+	dev, _ := OpenDevice(f, config)
+
+	packets := [][]byte{
+		{hciconst.MsgTypeCommand, 0x03, 0x0c, 0x00},
+		{hciconst.MsgTypeACL, 0x40, 0x00, 0x01, 0x00, 0xAA},
+		{hciconst.MsgTypeSCO, 0x41, 0x00, 0x01, 0xBB},
+	}
+	for _, m := range packets {
+		if err := dev.SendPacket(hciinterface.HCITxPacket{Data: m}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []FakeTransfer{
+		{Type: TransferControl, RequestType: 0x20, Index: 2, Data: packets[0][1:]},
+		{Type: TransferBulk, Endpoint: 0x02, Data: packets[1][1:]},
+		{Type: TransferIsochronous, Endpoint: 0x03, Data: packets[2][1:]},
+	}
+	got := f.Transfers()
+	if len(got) != len(want) {
+		t.Fatalf("transfers %+v", got)
+	}
+	for i, m := range want {
+		g := got[i]
+		if g.Type != m.Type || g.Endpoint != m.Endpoint || g.RequestType != m.RequestType || g.Index != m.Index || !bytes.Equal(g.Data, m.Data) {
+			t.Errorf("transfer %d: %+v, want %+v", i, g, m)
+		}
+	}
+
+	/* ISO data only uses the isochronous endpoints if configured */
+	iso := []byte{hciconst.MsgTypeISO, 0x42, 0x00, 0x01, 0x00, 0xCC}
+	if err := dev.SendPacket(hciinterface.HCITxPacket{Data: iso}); err != ErrorUnsupportedPacket {
+		t.Errorf("iso: %v", err)
+	}
+	if err := dev.SendPacket(hciinterface.HCITxPacket{Data: []byte{hciconst.MsgTypeEvent, 0x0e, 0x00}}); err != ErrorUnsupportedPacket {
+		t.Errorf("event: %v", err)
+	}
+
+	config.IsochronousType = hciconst.MsgTypeISO
+	dev, _ = OpenDevice(f, config)
+	if err := dev.SendPacket(hciinterface.HCITxPacket{Data: iso}); err != nil {
+		t.Errorf("iso: %v", err)
+	}
+	if err := dev.SendPacket(hciinterface.HCITxPacket{Data: packets[2]}); err != ErrorUnsupportedPacket {
+		t.Errorf("sco: %v", err)
+	}
+}
+
+// receiver collects the packets received from a running transport
+type receiver struct {
+	mutex   sync.Mutex
+	packets map[byte][][]byte
+}
+
+func startTransport(t *testing.T, f *FakeDevice) (hciinterface.HCIInterface, *receiver, chan error) {
+	dev, _ := OpenDevice(f, nil)
+	r := &receiver{packets: make(map[byte][][]byte)}
+	dev.SetRecvHandler(func(pkt hciinterface.HCIRxPacket) error {
+		r.mutex.Lock()
+		r.packets[pkt.Data[0]] = append(r.packets[pkt.Data[0]], pkt.Data)
+		r.mutex.Unlock()
+		return nil
+	})
+
+	result := make(chan error, 1)
+	go func() {
+		result <- dev.Run()
+	}()
+	t.Cleanup(func() {
+		dev.Close()
+	})
+	return dev, r, result
+}
+
+func (r *receiver) wait(t *testing.T, pktType byte, count int) [][]byte {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		r.mutex.Lock()
+		packets := r.packets[pktType]
+		r.mutex.Unlock()
+		if len(packets) >= count {
+			return packets
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	t.Fatalf("received %d packets of type %d", len(r.packets[pktType]), pktType)
+	return nil
+}
+
+func TestReceiveFraming(t *testing.T) {
+	f := NewFakeDevice(16)
+	_, r, _ := startTransport(t, f)
+
+	/* An event longer than the endpoint packet size, then two events in one transfer */
+	long := append([]byte{0x3E, 38}, bytes.Repeat([]byte{0x11}, 38)...)
+	short := []byte{0x0E, 0x04, 0x01, 0x03, 0x0C, 0x00}
+	status := []byte{0x0F, 0x02, 0x00, 0x01}
+	f.Inject(0x81, long)
+	f.Inject(0x81, append(append([]byte{}, status...), short...))
+
+	acl := append([]byte{0x40, 0x00, 100, 0x00}, bytes.Repeat([]byte{0x22}, 100)...)
+	f.Inject(0x82, acl)
+	sco := []byte{0x41, 0x00, 0x03, 0x01, 0x02, 0x03}
+	f.Inject(0x83, sco)
+
+	events := r.wait(t, hciconst.MsgTypeEvent, 3)
+	want := [][]byte{long, status, short}
+	for i, m := range want {
+		if !bytes.Equal(events[i], append([]byte{hciconst.MsgTypeEvent}, m...)) {
+			t.Errorf("event %d: %x", i, events[i])
+		}
+	}
+
+	if got := r.wait(t, hciconst.MsgTypeACL, 1); !bytes.Equal(got[0], append([]byte{hciconst.MsgTypeACL}, acl...)) {
+		t.Errorf("acl %x", got[0])
+	}
+	if got := r.wait(t, hciconst.MsgTypeSCO, 1); !bytes.Equal(got[0], append([]byte{hciconst.MsgTypeSCO}, sco...)) {
+		t.Errorf("sco %x", got[0])
+	}
+}
+
+// A lost isochronous packet is dropped and the next transfer starts a new
+// one, transient errors do not stop the transport.
+func TestReceiveIsochronousResync(t *testing.T) {
+	f := NewFakeDevice(16)
+	_, r, result := startTransport(t, f)
+
+	sco := []byte{0x41, 0x00, 0x03, 0x01, 0x02, 0x03}
+	f.Inject(0x83, sco[:5])
+	f.InjectError(0x83, fmt.Errorf("missed packet: %w", ErrorTransferTransient))
+	f.Inject(0x83, sco)
+
+	if got := r.wait(t, hciconst.MsgTypeSCO, 1); !bytes.Equal(got[0], append([]byte{hciconst.MsgTypeSCO}, sco...)) {
+		t.Errorf("sco %x", got[0])
+	}
+
+	select {
+	case err := <-result:
+		t.Fatalf("run stopped: %v", err)
+	default:
+	}
+}
+
+// Event and ACL endpoints don't lose data, a transfer that ends in the
+// middle of a packet stops the transport.
+func TestReceiveSynchronisationLost(t *testing.T) {
+	f := NewFakeDevice(16)
+	_, _, result := startTransport(t, f)
+
+	f.Inject(0x81, []byte{0x0E, 0x04, 0x01, 0x03})
+	select {
+	case err := <-result:
+		if err != ErrorSynchronisationLost {
+			t.Errorf("run returned %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("run did not stop")
+	}
+}
+
+func TestClose(t *testing.T) {
+	f := NewFakeDevice(64)
+	dev, _, result := startTransport(t, f)
+
+	dev.Close()
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Errorf("run returned %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("run did not stop")
+	}
+
+	if err := dev.SendPacket(hciinterface.HCITxPacket{Data: []byte{hciconst.MsgTypeCommand, 0x03, 0x0c, 0x00}}); err != io.ErrClosedPipe {
+		t.Errorf("send after close: %v", err)
+	}
+}
+
+// A controller is brought up over USB, the fake device forwards everything to a loopback endpoint
+func TestControllerOverUSB(t *testing.T) {
+	_, a, _ := loopback.NewWorld(silentLogger())
+	f := NewFakeDevice(16)
+
+	a.SetRecvHandler(func(pkt hciinterface.HCIRxPacket) error {
+		switch pkt.Data[0] {
+		case hciconst.MsgTypeEvent:
+			f.Inject(0x81, pkt.Data[1:])
+		case hciconst.MsgTypeACL:
+			f.Inject(0x82, pkt.Data[1:])
+		}
+		return nil
+	})
+	f.OnTransfer = func(transfer FakeTransfer) {
+		pktType := byte(hciconst.MsgTypeACL)
+		if transfer.Type == TransferControl {
+			pktType = hciconst.MsgTypeCommand
+		}
+		a.SendPacket(hciinterface.HCITxPacket{Data: append([]byte{pktType}, transfer.Data...)})
+	}
+
+	dev, _ := OpenDevice(f, nil)
+	config := hci.DefaultConfig()
+	config.WatchdogTimeout = 0
+	ctrl := hci.New(silentLogger(), dev, config)
+
+	ready := make(chan struct{})
+	result := make(chan error, 1)
+	go func() {
+		result <- ctrl.Run(func() { close(ready) })
+	}()
+	defer ctrl.Close()
+
+	select {
+	case <-ready:
+	case err := <-result:
+		t.Fatalf("controller stopped: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("controller did not become ready")
+	}
+
+	if ctrl.Info.BdAddr == nil || ctrl.Info.LocalVersionInformation == nil {
+		t.Errorf("controller information was not read")
+	}
+}
+
+func TestOpen(t *testing.T) {
+	RegisterDevice("usbtest", func(name string) (USBDevice, error) {
+		return NewFakeDevice(64), nil
+	})
+
+	dev, err := Open("usbtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := dev.(*HCIUSB); !ok {
+		t.Errorf("got %T", dev)
+	}
+	dev.Close()
+
+	names, _ := ListDevices()
+	if len(names) != 1 || names[0] != "usbtest" {
+		t.Errorf("devices %v", names)
+	}
+	if _, err := Open("missing"); err != hciinterface.ErrorDeviceNotFound {
+		t.Errorf("got %v", err)
+	}
+}
@@ -40,3 +40,33 @@ func (c *ControllerInfo) Read(cmds *hcicommands.Commands) error {
 	c.LESupportedFeatures, err = cmds.LEReadLocalSupportedFeaturesSync(nil)
 	return err
 }
+
+type LEFeature int
+
+const (
+	LEFeatureEncryption                LEFeature = 0
+	LEFeatureConnectionParameterReq    LEFeature = 1
+	LEFeatureExtendedRejectIndication  LEFeature = 2
+	LEFeaturePeripheralFeatureExchange LEFeature = 3
+	LEFeaturePing                      LEFeature = 4
+	LEFeatureDataPacketLength          LEFeature = 5
+	LEFeatureLLPrivacy                 LEFeature = 6
+	LEFeatureExtendedScannerFilter     LEFeature = 7
+	LEFeature2MPHY                     LEFeature = 8
+	LEFeatureStableModulationIndexTX   LEFeature = 9
+	LEFeatureStableModulationIndexRX   LEFeature = 10
+	LEFeatureCodedPHY                  LEFeature = 11
+	LEFeatureExtendedAdvertising       LEFeature = 12
+	LEFeaturePeriodicAdvertising       LEFeature = 13
+	LEFeatureChannelSelectionAlgo2     LEFeature = 14
+	LEFeaturePowerClass1               LEFeature = 15
+	LEFeatureMinUsedChannels           LEFeature = 16
+)
+
+func (c *ControllerInfo) LEFeatureSupported(feature LEFeature) bool {
+	if c == nil || c.LESupportedFeatures == nil {
+		return false
+	}
+
+	return c.LESupportedFeatures.LEFeatures&(1<<uint(feature)) != 0
+}
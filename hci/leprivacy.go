@@ -2,11 +2,15 @@ package hci
 
 import (
 	"encoding/binary"
+	"time"
 
 	crypto_rand "crypto/rand"
 
 	hcicommands "github.com/BertoldVdb/go-ble/hci/commands"
+	deviceinfo "github.com/BertoldVdb/go-ble/hci/information"
 	bleutil "github.com/BertoldVdb/go-ble/util"
+	"github.com/BertoldVdb/go-misc/closeflag"
+	"github.com/sirupsen/logrus"
 )
 
 type LEAddrUsage int
@@ -17,7 +21,80 @@ const (
 	LEAddrUsageAdvertise LEAddrUsage = 2
 )
 
+// PrivacyProvider supplies the keys needed for LE privacy. It is
+// implemented by the security manager, which owns the key database.
+type PrivacyProvider interface {
+	GenerateRPA() (bleutil.MacAddr, error)
+	ResolvingList() []ResolvingListEntry
+}
+
+type ResolvingListEntry struct {
+	PeerIdentity bleutil.BLEAddr
+	PeerIRK      [16]byte
+	LocalIRK     [16]byte
+}
+
+// RandomAddressHandler is called after every attempt to replace the resolvable private address,
+// err tells why the controller kept the old one
+type RandomAddressHandler func(addr bleutil.MacAddr, err error)
+
+// RandomAddressHandle identifies a handler registered via AddRandomAddressHandler
+type RandomAddressHandle uint64
+
+type registeredRandomAddressHandler struct {
+	handle  RandomAddressHandle
+	handler RandomAddressHandler
+}
+
+/* How long to wait before trying again when the controller refused a new address */
+const rpaRetryInterval = 30 * time.Second
+
+// AddRandomAddressHandler registers a function that is told about resolvable private address
+// rotations. Users of the commands that make the controller refuse a new address (legacy
+// advertising, scanning and initiating) can stop and call RotateResolvablePrivateAddress. The
+// returned handle removes the handler again.
+func (c *Controller) AddRandomAddressHandler(handler RandomAddressHandler) RandomAddressHandle {
+	c.addrMutex.Lock()
+	defer c.addrMutex.Unlock()
+
+	c.nextRandomAddressHandler++
+	h := c.nextRandomAddressHandler
+	c.randomAddressHandlers = append(c.randomAddressHandlers, registeredRandomAddressHandler{handle: h, handler: handler})
+	return h
+}
+
+func (c *Controller) RemoveRandomAddressHandler(handle RandomAddressHandle) {
+	c.addrMutex.Lock()
+	defer c.addrMutex.Unlock()
+
+	/* Copy, a rotation may be walking the old slice */
+	var out []registeredRandomAddressHandler
+	for _, m := range c.randomAddressHandlers {
+		if m.handle != handle {
+			out = append(out, m)
+		}
+	}
+	c.randomAddressHandlers = out
+}
+
+func (c *Controller) SetPrivacyProvider(p PrivacyProvider) {
+	c.addrMutex.Lock()
+	defer c.addrMutex.Unlock()
+
+	c.privacy = p
+}
+
+func (c *Controller) getPrivacyProvider() PrivacyProvider {
+	c.addrMutex.Lock()
+	defer c.addrMutex.Unlock()
+
+	return c.privacy
+}
+
 func (c *Controller) GetLERecommenedOwnAddrType(usage LEAddrUsage) bleutil.MacAddrType {
+	c.addrMutex.Lock()
+	defer c.addrMutex.Unlock()
+
 	if c.Info.RandomAddr == 0 {
 		return 0
 	}
@@ -40,6 +117,9 @@ func (c *Controller) GetOwnAddress(t bleutil.MacAddrType) bleutil.BLEAddr {
 		MacAddrType: t,
 	}
 
+	c.addrMutex.Lock()
+	defer c.addrMutex.Unlock()
+
 	switch t {
 	case bleutil.MacAddrPublic:
 		result.MacAddr = c.Info.BdAddr.BDADDR
@@ -53,6 +133,18 @@ func (c *Controller) GetOwnAddress(t bleutil.MacAddrType) bleutil.BLEAddr {
 }
 
 func (c *Controller) setLERandomAddress() error {
+	if c.config.ResolvablePrivateAddress {
+		if privacy := c.getPrivacyProvider(); privacy != nil {
+			/* Not all devices support the random address so failure is not fatal */
+			err := c.setLEResolvablePrivateAddress(privacy, true)
+			if err != nil {
+				c.logger.WithError(err).Warn("Failed to set LE resolvable private address")
+			}
+			return nil
+		}
+		c.logger.Warn("No privacy provider, using a non-resolvable random address")
+	}
+
 	/* Validate the random-bit budget. Anything below 32 leaks too much
 	   of the public BD_ADDR into the "private" address — privacy is
 	   then a thin veneer. The static-random / RPA top bits cost 2 of
@@ -84,19 +176,176 @@ func (c *Controller) setLERandomAddress() error {
 	}
 
 	/* Randomize last x bits */
-	c.Info.RandomAddr = c.Info.BdAddr.BDADDR
-	c.Info.RandomAddr ^= bleutil.MacAddr(value >> (48 - bits))
+	addr := c.Info.BdAddr.BDADDR
+	addr ^= bleutil.MacAddr(value >> (48 - bits))
 
 	/* Two MSB must be one */
-	c.Info.RandomAddr |= 0x3 << (48 - 2)
+	addr |= 0x3 << (48 - 2)
 
 	/* Not all devices support the random address so failure is not fatal */
 	err := c.Cmds.LESetRandomAddressSync(hcicommands.LESetRandomAddressInput{
-		RandomAddess: c.Info.RandomAddr,
+		RandomAddess: addr,
 	})
-	c.logger.WithError(err).WithField("0addr", c.Info.RandomAddr).Info("Set LE random address")
+	c.logger.WithError(err).WithField("0addr", addr).Info("Set LE random address")
 	if err != nil {
-		c.Info.RandomAddr = 0
+		addr = 0
 	}
+
+	c.addrMutex.Lock()
+	c.Info.RandomAddr = addr
+	c.addrMutex.Unlock()
 	return nil
 }
+
+// RotateResolvablePrivateAddress replaces the resolvable private address now. The controller
+// refuses this while legacy advertising, scanning or initiating is enabled. A refusal is only
+// returned to the caller: the handlers are not told about it, so two users that each stop their
+// own activity do not keep triggering each other. The address therefore only rotates if a single
+// user blocks it; connection attempts are short and are not stopped, the rotation is retried later.
+func (c *Controller) RotateResolvablePrivateAddress() error {
+	privacy := c.getPrivacyProvider()
+	if !c.config.ResolvablePrivateAddress || privacy == nil {
+		return nil
+	}
+
+	return c.setLEResolvablePrivateAddress(privacy, false)
+}
+
+func (c *Controller) setLEResolvablePrivateAddress(privacy PrivacyProvider, notifyError bool) error {
+	addr, err := privacy.GenerateRPA()
+	if err == nil {
+		err = c.Cmds.LESetRandomAddressSync(hcicommands.LESetRandomAddressInput{
+			RandomAddess: addr,
+		})
+	}
+
+	c.addrMutex.Lock()
+	if err == nil {
+		c.Info.RandomAddr = addr
+	}
+	handlers := c.randomAddressHandlers
+	c.addrMutex.Unlock()
+
+	if err == nil {
+		c.logger.WithField("0addr", addr).Info("Set LE resolvable private address")
+	} else if !notifyError {
+		return err
+	}
+
+	for _, m := range handlers {
+		m.handler(addr, err)
+	}
+	return err
+}
+
+// UpdateResolvingList loads the bonded peers of the privacy provider into
+// the controller resolving list. It does nothing unless
+// ResolvingListOffload is configured and the controller supports LL
+// privacy.
+func (c *Controller) UpdateResolvingList() error {
+	privacy := c.getPrivacyProvider()
+	if !c.config.ResolvingListOffload || privacy == nil || !c.Info.LEFeatureSupported(deviceinfo.LEFeatureLLPrivacy) {
+		return nil
+	}
+
+	c.resolvingListMutex.Lock()
+	defer c.resolvingListMutex.Unlock()
+
+	var size hcicommands.LEReadResolvingListSizeOutput
+	_, err := c.Cmds.LEReadResolvingListSizeSync(&size)
+	if err != nil {
+		return err
+	}
+
+	/* The list can only be changed while resolution is disabled */
+	err = c.Cmds.LESetAddressResolutionEnableSync(hcicommands.LESetAddressResolutionEnableInput{})
+	if err != nil {
+		return err
+	}
+
+	err = c.Cmds.LEClearResolvingListSync()
+	if err != nil {
+		return err
+	}
+
+	entries := privacy.ResolvingList()
+	if len(entries) > int(size.ResolvingListSize) {
+		c.logger.WithFields(logrus.Fields{
+			"0bonds": len(entries),
+			"1size":  size.ResolvingListSize,
+		}).Warn("Resolving list too small, remaining peers are resolved by the host")
+		entries = entries[:size.ResolvingListSize]
+	}
+
+	for _, m := range entries {
+		err = c.Cmds.LEAddDeviceToResolvingListSync(hcicommands.LEAddDeviceToResolvingListInput{
+			PeerIdentityAddressType: m.PeerIdentity.MacAddrType & 1,
+			PeerIdentityAddress:     m.PeerIdentity.MacAddr,
+			PeerIRK:                 m.PeerIRK,
+			LocalIRK:                m.LocalIRK,
+		})
+		if err != nil {
+			return err
+		}
+
+		/* Device privacy mode also accepts peers that connect with their
+		   identity address. Older controllers lack the command. */
+		c.Cmds.LESetPrivacyModeSync(hcicommands.LESetPrivacyModeInput{
+			PeerIdentityAddressType: m.PeerIdentity.MacAddrType & 1,
+			PeerIdentityAddress:     m.PeerIdentity.MacAddr,
+			PrivacyMode:             1,
+		})
+	}
+
+	if c.config.RPATimeout > 0 {
+		err = c.Cmds.LESetResolvablePrivateAddressTimeoutSync(hcicommands.LESetResolvablePrivateAddressTimeoutInput{
+			RPATimeout: uint16(c.config.RPATimeout / time.Second),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	err = c.Cmds.LESetAddressResolutionEnableSync(hcicommands.LESetAddressResolutionEnableInput{
+		AddressResolutionEnable: 1,
+	})
+	c.logger.WithError(err).WithField("0entries", len(entries)).Info("Resolving list loaded")
+	return err
+}
+
+type hciPrivacy struct {
+	closeFlag closeflag.CloseFlag
+	ctrl      *Controller
+}
+
+func (p *hciPrivacy) Run(readyCb func()) error {
+	readyCb()
+
+	interval := p.ctrl.config.RPATimeout
+	for {
+		select {
+		case <-p.closeFlag.Chan():
+			return nil
+
+		case <-time.After(interval):
+		}
+
+		/* The old address stays in use until the controller accepts a new one */
+		interval = p.ctrl.config.RPATimeout
+		privacy := p.ctrl.getPrivacyProvider()
+		if !p.ctrl.config.ResolvablePrivateAddress || privacy == nil {
+			continue
+		}
+		err := p.ctrl.setLEResolvablePrivateAddress(privacy, true)
+		if err != nil {
+			p.ctrl.logger.WithError(err).Warn("Failed to rotate LE resolvable private address")
+			if rpaRetryInterval < interval {
+				interval = rpaRetryInterval
+			}
+		}
+	}
+}
+
+func (p *hciPrivacy) Close() error {
+	return p.closeFlag.Close()
+}
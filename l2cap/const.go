@@ -6,3 +6,6 @@ const (
 	PSMTypeATT             PSMType = 0x7
 	PSMTypeSecurityManager PSMType = 0x10000
 )
+
+/* LE PSM used for the enhanced ATT bearers */
+const LEPSMEATT = 0x27
@@ -0,0 +1,1086 @@
+package blel2cap
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	hciconnmgr "github.com/BertoldVdb/go-ble/hci/connmgr"
+	bleutil "github.com/BertoldVdb/go-ble/util"
+	"github.com/BertoldVdb/go-misc/closeflag"
+	pdu "github.com/BertoldVdb/go-misc/pdubuf"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	ErrorL2InvalidPSM                 = errors.New("Invalid LE PSM")
+	ErrorL2PSMInUse                   = errors.New("LE PSM is already being listened on")
+	ErrorL2ListenerClosed             = errors.New("L2CAP listener is closed")
+	ErrorL2SDUTooLong                 = errors.New("SDU exceeds the MTU of the peer")
+	ErrorL2NoResources                = errors.New("No resources available for L2CAP channel")
+	ErrorL2PSMNotSupported            = errors.New("LE PSM not supported by the peer")
+	ErrorL2InsufficientAuthentication = errors.New("Insufficient authentication for L2CAP channel")
+	ErrorL2InsufficientAuthorization  = errors.New("Insufficient authorization for L2CAP channel")
+	ErrorL2InsufficientKeySize        = errors.New("Insufficient encryption key size for L2CAP channel")
+	ErrorL2InsufficientEncryption     = errors.New("Insufficient encryption for L2CAP channel")
+	ErrorL2InvalidCID                 = errors.New("Invalid source CID for L2CAP channel")
+	ErrorL2CIDInUse                   = errors.New("Source CID for L2CAP channel already allocated")
+	ErrorL2UnacceptableParameters     = errors.New("Unacceptable L2CAP channel parameters")
+	ErrorL2ConnectionRefused          = errors.New("L2CAP channel refused by the peer")
+	ErrorL2InvalidChannelCount        = errors.New("Between 1 and 5 enhanced channels can be opened at once")
+	ErrorL2NotEnhanced                = errors.New("Only enhanced credit based channels can be reconfigured")
+	ErrorL2MTUReduction               = errors.New("The MTU of a channel cannot be reduced")
+	ErrorL2ReconfigureRefused         = errors.New("Channel reconfiguration refused by the peer")
+)
+
+const (
+	creditResultSuccess                    = 0x0000
+	creditResultPSMNotSupported            = 0x0002
+	creditResultNoResources                = 0x0004
+	creditResultInsufficientAuthentication = 0x0005
+	creditResultInsufficientAuthorization  = 0x0006
+	creditResultInsufficientKeySize        = 0x0007
+	creditResultInsufficientEncryption     = 0x0008
+	creditResultInvalidSourceCID           = 0x0009
+	creditResultSourceCIDInUse             = 0x000A
+	creditResultUnacceptableParameters     = 0x000B
+	creditResultInvalidParameters          = 0x000C
+
+	reconfigureResultSuccess                = 0x0000
+	reconfigureResultMTUReduction           = 0x0001
+	reconfigureResultMPSReduction           = 0x0002
+	reconfigureResultInvalidCID             = 0x0003
+	reconfigureResultUnacceptableParameters = 0x0004
+
+	creditCIDFirst = 0x0040
+	creditCIDLast  = 0x007F
+
+	creditMinMTU = 23
+	creditMinMPS = 23
+	creditMaxMPS = 65533
+
+	/* Enhanced credit based channels have larger minimums and are opened in groups */
+	enhancedMinMTU      = 64
+	enhancedMinMPS      = 64
+	enhancedMaxChannels = 5
+)
+
+var creditResultErrors = map[uint16]error{
+	creditResultPSMNotSupported:            ErrorL2PSMNotSupported,
+	creditResultNoResources:                ErrorL2NoResources,
+	creditResultInsufficientAuthentication: ErrorL2InsufficientAuthentication,
+	creditResultInsufficientAuthorization:  ErrorL2InsufficientAuthorization,
+	creditResultInsufficientKeySize:        ErrorL2InsufficientKeySize,
+	creditResultInsufficientEncryption:     ErrorL2InsufficientEncryption,
+	creditResultInvalidSourceCID:           ErrorL2InvalidCID,
+	creditResultSourceCIDInUse:             ErrorL2CIDInUse,
+	creditResultUnacceptableParameters:     ErrorL2UnacceptableParameters,
+	creditResultInvalidParameters:          ErrorL2UnacceptableParameters,
+}
+
+var reconfigureResultErrors = map[uint16]error{
+	reconfigureResultMTUReduction:           ErrorL2MTUReduction,
+	reconfigureResultMPSReduction:           ErrorL2UnacceptableParameters,
+	reconfigureResultInvalidCID:             ErrorL2InvalidCID,
+	reconfigureResultUnacceptableParameters: ErrorL2UnacceptableParameters,
+}
+
+type SecurityLevel int
+
+const (
+	SecurityNone SecurityLevel = iota
+	SecurityEncrypted
+	SecurityAuthenticated
+)
+
+// SecurityInfo reports the security state of the link. It is implemented by blesmp.SMPConn.
+type SecurityInfo interface {
+	GetSecurity() (bool, bool, bool)
+}
+
+// KeySizeInfo is implemented by a SecurityInfo that knows the size of the encryption key in
+// bytes. Zero means the size is unknown.
+type KeySizeInfo interface {
+	GetKeySize() int
+}
+
+type CreditChannelConfig struct {
+	MTU            uint16
+	MPS            uint16
+	InitialCredits uint16
+
+	/* Required security for incoming channels, indexed by PSM */
+	PSMSecurity map[uint16]SecurityLevel
+
+	/* Smallest encryption key in bytes accepted for PSMs that require security, 0 means 16 */
+	MinKeySize int
+}
+
+func (l *L2CAP) creditConfig() CreditChannelConfig {
+	var config CreditChannelConfig
+	if l.config != nil {
+		config = l.config.CreditChannel
+	}
+
+	if config.MTU < creditMinMTU {
+		config.MTU = 1024
+	}
+	if config.MPS < creditMinMPS || config.MPS > creditMaxMPS {
+		/* Fits in a single LL PDU when data length extension is used */
+		config.MPS = 247
+	}
+	if config.InitialCredits == 0 {
+		config.InitialCredits = 8
+	}
+	if config.MinKeySize <= 0 || config.MinKeySize > 16 {
+		config.MinKeySize = 16
+	}
+
+	return config
+}
+
+// SetSecurity sets the source of the link security state used to protect incoming channels
+func (l *L2CAP) SetSecurity(info SecurityInfo) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.security = info
+}
+
+func (l *L2CAP) creditCheckSecurity(psm uint16, minimum SecurityLevel) uint16 {
+	config := l.creditConfig()
+	level := config.PSMSecurity[psm]
+	if level < minimum {
+		level = minimum
+	}
+	if level == SecurityNone {
+		return creditResultSuccess
+	}
+
+	l.RLock()
+	info := l.security
+	l.RUnlock()
+
+	encrypted, authenticated := false, false
+	if info != nil {
+		encrypted, authenticated, _ = info.GetSecurity()
+	}
+
+	if level == SecurityAuthenticated && !authenticated {
+		return creditResultInsufficientAuthentication
+	}
+	if !encrypted {
+		return creditResultInsufficientEncryption
+	}
+	if ks, ok := info.(KeySizeInfo); ok {
+		if size := ks.GetKeySize(); size > 0 && size < config.MinKeySize {
+			return creditResultInsufficientKeySize
+		}
+	}
+	return creditResultSuccess
+}
+
+type L2Listener struct {
+	l          *L2CAP
+	psm        uint16
+	acceptChan chan *L2CreditConnection
+	closed     closeflag.CloseFlag
+
+	/* Required security, on top of the one configured for the PSM */
+	security SecurityLevel
+
+	/* Holds one token for every place in acceptChan that is taken or promised to a channel whose
+	   response is still being sent */
+	reserved chan struct{}
+}
+
+/* Number of channels waiting for Accept before new ones are refused */
+const listenBacklog = 4
+
+// Listen accepts LE credit based channels for the given PSM
+func (l *L2CAP) Listen(psm uint16) (*L2Listener, error) {
+	return l.ListenSecurity(psm, SecurityNone)
+}
+
+// ListenSecurity is Listen, but channels are refused unless the link has at least the given
+// security level
+func (l *L2CAP) ListenSecurity(psm uint16, security SecurityLevel) (*L2Listener, error) {
+	if psm == 0 || psm > 0xFF {
+		return nil, ErrorL2InvalidPSM
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	if _, ok := l.listeners[psm]; ok {
+		return nil, ErrorL2PSMInUse
+	}
+
+	ln := &L2Listener{
+		l:          l,
+		psm:        psm,
+		acceptChan: make(chan *L2CreditConnection, listenBacklog),
+		reserved:   make(chan struct{}, listenBacklog),
+		security:   security,
+	}
+	l.listeners[psm] = ln
+
+	return ln, nil
+}
+
+func (ln *L2Listener) Accept(ctx context.Context) (*L2CreditConnection, error) {
+	select {
+	case c := <-ln.acceptChan:
+		<-ln.reserved
+		return c, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-ln.closed.Chan():
+		return nil, ErrorL2ListenerClosed
+	}
+}
+
+func (ln *L2Listener) Close() error {
+	ln.l.Lock()
+	if ln.l.listeners[ln.psm] == ln {
+		delete(ln.l.listeners, ln.psm)
+	}
+	ln.l.Unlock()
+
+	err := ln.closed.Close()
+	if err == nil {
+		ln.drain()
+	}
+	return err
+}
+
+/* drain closes the channels that were never accepted */
+func (ln *L2Listener) drain() {
+	for {
+		select {
+		case c := <-ln.acceptChan:
+			<-ln.reserved
+			go c.Close()
+		default:
+			return
+		}
+	}
+}
+
+/* reserve takes a place in the backlog for a channel that is being opened */
+func (ln *L2Listener) reserve() bool {
+	select {
+	case ln.reserved <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+/* deliver hands a channel to Accept after the peer was told it is open, it never blocks */
+func (ln *L2Listener) deliver(c *L2CreditConnection) {
+	ln.acceptChan <- c
+
+	select {
+	case <-ln.closed.Chan():
+		ln.drain()
+	default:
+	}
+}
+
+/* release gives the place back if the response could not be sent */
+func (ln *L2Listener) release(c *L2CreditConnection) {
+	<-ln.reserved
+	c.closed.Close()
+	c.unregister()
+}
+
+type creditSDU struct {
+	buf    *pdu.PDU
+	frames int
+}
+
+// L2CreditConnection is an LE credit based flow control channel. Every buffer is one SDU.
+type L2CreditConnection struct {
+	l         *L2CAP
+	psm       uint16
+	localCID  uint16
+	remoteCID uint16
+	enhanced  bool
+	localMTU  uint16
+	localMPS  uint16
+	remoteMTU uint16
+	remoteMPS uint16
+
+	/* Receive side, only the reassembly state is private to the L2CAP goroutine */
+	rxMutex        sync.Mutex
+	rxQueue        []creditSDU
+	rxChan         chan (struct{})
+	rxCredits      int
+	rxFramesQueued int
+	rxInitial      int
+	rxSDU          *pdu.PDU
+	rxSDULen       int
+	rxSDUFrames    int
+
+	txWriteMutex sync.Mutex
+	txMutex      sync.Mutex
+	txCredits    int
+	txChan       chan (struct{})
+
+	closed closeflag.CloseFlag
+}
+
+func (l *L2CAP) creditAllocateCID() uint16 {
+	for cid := uint16(creditCIDFirst); cid <= creditCIDLast; cid++ {
+		if _, ok := l.cidMap[cid]; !ok {
+			return cid
+		}
+	}
+	return 0
+}
+
+func (l *L2CAP) creditRemoteCIDInUse(cid uint16) bool {
+	for _, m := range l.creditConns {
+		if m.remoteCID == cid {
+			return true
+		}
+	}
+	return false
+}
+
+/* Allocates a local CID and registers the channel, returns nil if no CID is free */
+func (l *L2CAP) creditCreate(psm uint16, config CreditChannelConfig, enhanced bool) *L2CreditConnection {
+	if enhanced && config.MTU < enhancedMinMTU {
+		config.MTU = enhancedMinMTU
+	}
+	if enhanced && config.MPS < enhancedMinMPS {
+		config.MPS = enhancedMinMPS
+	}
+
+	c := &L2CreditConnection{
+		l:         l,
+		psm:       psm,
+		enhanced:  enhanced,
+		localMTU:  config.MTU,
+		localMPS:  config.MPS,
+		rxChan:    make(chan (struct{}), 1),
+		rxCredits: int(config.InitialCredits),
+		rxInitial: int(config.InitialCredits),
+		txChan:    make(chan (struct{}), 1),
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	c.localCID = l.creditAllocateCID()
+	if c.localCID == 0 {
+		return nil
+	}
+
+	l.cidMap[c.localCID] = &l2cid{
+		rxHandler: c.rxHandler,
+	}
+	l.creditConns[c.localCID] = c
+
+	return c
+}
+
+func (c *L2CreditConnection) unregister() {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	delete(c.l.cidMap, c.localCID)
+	delete(c.l.creditConns, c.localCID)
+}
+
+// DialPSM opens an LE credit based channel to the given PSM of the peer
+func (l *L2CAP) DialPSM(ctx context.Context, psm uint16) (*L2CreditConnection, error) {
+	if psm == 0 || psm > 0xFF {
+		return nil, ErrorL2InvalidPSM
+	}
+
+	config := l.creditConfig()
+	c := l.creditCreate(psm, config, false)
+	if c == nil {
+		return nil, ErrorL2NoResources
+	}
+
+	var result [5]uint16
+	code, params, err := l.SendCommandUint16(ctx, SigLECreditBasedConnectionReq, result[:0], psm, c.localCID, config.MTU, config.MPS, config.InitialCredits)
+	if err == nil && (code != SigLECreditBasedConnectionRsp || len(params) != 5) {
+		err = ErrorL2ConnectionRefused
+	}
+	if err == nil && params[4] != creditResultSuccess {
+		err = creditResultErrors[params[4]]
+		if err == nil {
+			err = ErrorL2ConnectionRefused
+		}
+	}
+	if err == nil && (params[0] < creditCIDFirst || params[0] > creditCIDLast || params[1] < creditMinMTU || params[2] < creditMinMPS || params[2] > creditMaxMPS) {
+		err = ErrorL2UnacceptableParameters
+	}
+
+	if err != nil {
+		c.closed.Close()
+		c.unregister()
+		return nil, err
+	}
+
+	c.remoteCID = params[0]
+	c.remoteMTU = params[1]
+	c.remoteMPS = params[2]
+	c.txCredits = int(params[3])
+
+	c.logOpened()
+
+	return c, nil
+}
+
+func (s *signalling) creditHandleConnectionReq(payload *pdu.PDU, cid uint16, id uint8, params []uint16) (error, bool) {
+	l := s.l
+	psm, scid, mtu, mps, credits := params[0], params[1], params[2], params[3], params[4]
+	config := l.creditConfig()
+
+	respond := func(dcid uint16, result uint16) (error, bool) {
+		if dcid == 0 {
+			return s.signallingCommandUint16(payload, cid, id, SigLECreditBasedConnectionRsp, 0, 0, 0, 0, result)
+		}
+		return s.signallingCommandUint16(payload, cid, id, SigLECreditBasedConnectionRsp, dcid, config.MTU, config.MPS, config.InitialCredits, result)
+	}
+
+	l.RLock()
+	ln := l.listeners[psm]
+	cidInUse := l.creditRemoteCIDInUse(scid)
+	l.RUnlock()
+
+	if ln == nil {
+		return respond(0, creditResultPSMNotSupported)
+	}
+	if result := l.creditCheckSecurity(psm, ln.security); result != creditResultSuccess {
+		return respond(0, result)
+	}
+	if scid < creditCIDFirst || scid > creditCIDLast {
+		return respond(0, creditResultInvalidSourceCID)
+	}
+	if cidInUse {
+		return respond(0, creditResultSourceCIDInUse)
+	}
+	if mtu < creditMinMTU || mps < creditMinMPS || mps > creditMaxMPS {
+		return respond(0, creditResultUnacceptableParameters)
+	}
+
+	c := l.creditCreate(psm, config, false)
+	if c == nil {
+		return respond(0, creditResultNoResources)
+	}
+
+	c.remoteCID = scid
+	c.remoteMTU = mtu
+	c.remoteMPS = mps
+	c.txCredits = int(credits)
+
+	/* The peer only accepts data once it has the response, so the channel is handed out after it */
+	if !ln.reserve() {
+		c.closed.Close()
+		c.unregister()
+		return respond(0, creditResultNoResources)
+	}
+
+	err, ok := respond(c.localCID, creditResultSuccess)
+	if err != nil {
+		ln.release(c)
+		return err, ok
+	}
+
+	c.logOpened()
+	ln.deliver(c)
+
+	return nil, ok
+}
+
+// DialEnhanced opens count enhanced credit based channels to the given PSM of the peer in one
+// request. The channels the peer accepted are returned, an error is only returned if none were.
+func (l *L2CAP) DialEnhanced(ctx context.Context, psm uint16, count int) ([]*L2CreditConnection, error) {
+	if psm == 0 || psm > 0xFF {
+		return nil, ErrorL2InvalidPSM
+	}
+	if count < 1 || count > enhancedMaxChannels {
+		return nil, ErrorL2InvalidChannelCount
+	}
+
+	config := l.creditConfig()
+	var conns []*L2CreditConnection
+	for i := 0; i < count; i++ {
+		c := l.creditCreate(psm, config, true)
+		if c == nil {
+			break
+		}
+		conns = append(conns, c)
+	}
+
+	release := func(c *L2CreditConnection) {
+		c.closed.Close()
+		c.unregister()
+	}
+
+	if len(conns) != count {
+		for _, m := range conns {
+			release(m)
+		}
+		return nil, ErrorL2NoResources
+	}
+
+	params := []uint16{psm, conns[0].localMTU, conns[0].localMPS, config.InitialCredits}
+	for _, m := range conns {
+		params = append(params, m.localCID)
+	}
+
+	result := make([]uint16, 0, 4+count)
+	code, result, err := l.SendCommandUint16(ctx, SigCreditBasedConnectionReq, result, params...)
+	if err == nil && (code != SigCreditBasedConnectionRsp || len(result) != 4+count) {
+		err = ErrorL2ConnectionRefused
+	}
+	if err == nil && (result[0] < enhancedMinMTU || result[1] < enhancedMinMPS || result[1] > creditMaxMPS) {
+		err = ErrorL2UnacceptableParameters
+	}
+
+	if err != nil {
+		for _, m := range conns {
+			release(m)
+		}
+		return nil, err
+	}
+
+	var accepted []*L2CreditConnection
+	for i, m := range conns {
+		dcid := result[4+i]
+		if dcid < creditCIDFirst || dcid > creditCIDLast {
+			release(m)
+			continue
+		}
+
+		m.remoteCID = dcid
+		m.remoteMTU = result[0]
+		m.remoteMPS = result[1]
+		m.txCredits = int(result[2])
+		m.logOpened()
+
+		accepted = append(accepted, m)
+	}
+
+	if len(accepted) == 0 {
+		err = creditResultErrors[result[3]]
+		if err == nil {
+			err = ErrorL2ConnectionRefused
+		}
+		return nil, err
+	}
+
+	return accepted, nil
+}
+
+func (s *signalling) creditHandleEnhancedReq(payload *pdu.PDU, cid uint16, id uint8, params []uint16) (error, bool) {
+	l := s.l
+	psm, mtu, mps, credits := params[0], params[1], params[2], params[3]
+	scids := params[4:]
+	config := l.creditConfig()
+
+	dcids := make([]uint16, len(scids))
+	respond := func(result uint16, c *L2CreditConnection) (error, bool) {
+		rsp := []uint16{0, 0, 0, result}
+		if c != nil {
+			rsp = []uint16{c.localMTU, c.localMPS, config.InitialCredits, result}
+		}
+		return s.signallingCommandUint16(payload, cid, id, SigCreditBasedConnectionRsp, append(rsp, dcids...)...)
+	}
+
+	l.RLock()
+	ln := l.listeners[psm]
+	l.RUnlock()
+
+	if len(scids) == 0 || len(scids) > enhancedMaxChannels {
+		return respond(creditResultInvalidParameters, nil)
+	}
+	if ln == nil {
+		return respond(creditResultPSMNotSupported, nil)
+	}
+	if result := l.creditCheckSecurity(psm, ln.security); result != creditResultSuccess {
+		return respond(result, nil)
+	}
+	if mtu < enhancedMinMTU || mps < enhancedMinMPS || mps > creditMaxMPS {
+		return respond(creditResultUnacceptableParameters, nil)
+	}
+
+	/* Every channel is judged on its own, the result reports the last refusal */
+	result := uint16(creditResultSuccess)
+	var accepted []*L2CreditConnection
+	for i, scid := range scids {
+		l.RLock()
+		inUse := l.creditRemoteCIDInUse(scid)
+		l.RUnlock()
+		for _, m := range scids[:i] {
+			inUse = inUse || m == scid
+		}
+
+		if scid < creditCIDFirst || scid > creditCIDLast {
+			result = creditResultInvalidSourceCID
+			continue
+		}
+		if inUse {
+			result = creditResultSourceCIDInUse
+			continue
+		}
+
+		c := l.creditCreate(psm, config, true)
+		if c == nil {
+			result = creditResultNoResources
+			continue
+		}
+
+		c.remoteCID = scid
+		c.remoteMTU = mtu
+		c.remoteMPS = mps
+		c.txCredits = int(credits)
+
+		if !ln.reserve() {
+			c.closed.Close()
+			c.unregister()
+			result = creditResultNoResources
+			continue
+		}
+
+		dcids[i] = c.localCID
+		accepted = append(accepted, c)
+	}
+
+	var last *L2CreditConnection
+	if len(accepted) > 0 {
+		last = accepted[len(accepted)-1]
+	}
+	err, ok := respond(result, last)
+
+	/* The peer only accepts data once it has the response, so the channels are handed out after it */
+	for _, c := range accepted {
+		if err != nil {
+			ln.release(c)
+			continue
+		}
+
+		c.logOpened()
+		ln.deliver(c)
+	}
+
+	return err, ok
+}
+
+// Reconfigure changes the receive MTU and MPS of enhanced channels. The MTU cannot be reduced.
+func (l *L2CAP) Reconfigure(ctx context.Context, mtu uint16, mps uint16, channels ...*L2CreditConnection) error {
+	if len(channels) < 1 || len(channels) > enhancedMaxChannels {
+		return ErrorL2InvalidChannelCount
+	}
+	if mtu < enhancedMinMTU || mps < enhancedMinMPS || mps > creditMaxMPS {
+		return ErrorL2UnacceptableParameters
+	}
+
+	params := []uint16{mtu, mps}
+	for _, m := range channels {
+		if !m.enhanced || m.l != l {
+			return ErrorL2NotEnhanced
+		}
+		if mtu < m.localMTU {
+			return ErrorL2MTUReduction
+		}
+		params = append(params, m.localCID)
+	}
+
+	var result [1]uint16
+	code, rsp, err := l.SendCommandUint16(ctx, SigCreditBasedReconfigureReq, result[:0], params...)
+	if err != nil {
+		return err
+	}
+	if code != SigCreditBasedReconfigureRsp || len(rsp) != 1 {
+		return ErrorL2ReconfigureRefused
+	}
+	if rsp[0] != reconfigureResultSuccess {
+		err = reconfigureResultErrors[rsp[0]]
+		if err == nil {
+			err = ErrorL2ReconfigureRefused
+		}
+		return err
+	}
+
+	for _, m := range channels {
+		m.rxMutex.Lock()
+		m.localMTU = mtu
+		m.localMPS = mps
+		m.rxMutex.Unlock()
+	}
+
+	return nil
+}
+
+func (s *signalling) creditHandleReconfigureReq(payload *pdu.PDU, cid uint16, id uint8, params []uint16) (error, bool) {
+	mtu, mps := params[0], params[1]
+	cids := params[2:]
+
+	respond := func(result uint16) (error, bool) {
+		return s.signallingCommandUint16(payload, cid, id, SigCreditBasedReconfigureRsp, result)
+	}
+
+	var channels []*L2CreditConnection
+	s.l.RLock()
+	for _, m := range cids {
+		for _, c := range s.l.creditConns {
+			if c.enhanced && c.remoteCID == m {
+				channels = append(channels, c)
+				break
+			}
+		}
+	}
+	s.l.RUnlock()
+
+	if len(cids) == 0 || len(cids) > enhancedMaxChannels || len(channels) != len(cids) {
+		return respond(reconfigureResultInvalidCID)
+	}
+	if mtu < enhancedMinMTU || mps < enhancedMinMPS || mps > creditMaxMPS {
+		return respond(reconfigureResultUnacceptableParameters)
+	}
+
+	for _, m := range channels {
+		m.txMutex.Lock()
+		mtuReduced := mtu < m.remoteMTU
+		mpsReduced := mps < m.remoteMPS
+		m.txMutex.Unlock()
+
+		if mtuReduced {
+			return respond(reconfigureResultMTUReduction)
+		}
+		if mpsReduced && len(channels) > 1 {
+			return respond(reconfigureResultMPSReduction)
+		}
+	}
+
+	for _, m := range channels {
+		m.txMutex.Lock()
+		m.remoteMTU = mtu
+		m.remoteMPS = mps
+		m.txMutex.Unlock()
+	}
+
+	return respond(reconfigureResultSuccess)
+}
+
+func (s *signalling) creditHandleCredits(cid uint16, credits uint16) {
+	s.l.RLock()
+	var c *L2CreditConnection
+	for _, m := range s.l.creditConns {
+		if m.remoteCID == cid {
+			c = m
+			break
+		}
+	}
+	s.l.RUnlock()
+
+	if c != nil {
+		c.addTxCredits(credits)
+	}
+}
+
+/* Returns true if the channel was found. The channel is closed without sending a request */
+func (s *signalling) creditHandleDisconnection(dcid uint16, scid uint16) bool {
+	s.l.RLock()
+	c := s.l.creditConns[dcid]
+	s.l.RUnlock()
+
+	if c == nil || c.remoteCID != scid {
+		return false
+	}
+
+	c.closeLocal()
+	return true
+}
+
+func (c *L2CreditConnection) logOpened() {
+	if c.l.logger.Logger.IsLevelEnabled(logrus.DebugLevel) {
+		c.l.logger.WithFields(logrus.Fields{
+			"0psm":       c.psm,
+			"1localCID":  c.localCID,
+			"2remoteCID": c.remoteCID,
+			"3remoteMTU": c.remoteMTU,
+			"4remoteMPS": c.remoteMPS,
+		}).Debug("L2CAP credit based channel opened")
+	}
+}
+
+func (c *L2CreditConnection) addTxCredits(credits uint16) {
+	c.txMutex.Lock()
+	c.txCredits += int(credits)
+	overflow := c.txCredits > 0xFFFF
+	c.txMutex.Unlock()
+
+	/* The peer is misbehaving, the specification requires us to disconnect */
+	if overflow {
+		go c.Close()
+		return
+	}
+
+	select {
+	case c.txChan <- struct{}{}:
+	default:
+	}
+}
+
+func (c *L2CreditConnection) takeTxCredit() error {
+	for {
+		c.txMutex.Lock()
+		if c.txCredits > 0 {
+			c.txCredits--
+			c.txMutex.Unlock()
+			return nil
+		}
+		c.txMutex.Unlock()
+
+		select {
+		case <-c.txChan:
+		case <-c.closed.Chan():
+			return ErrorL2ChannelClosed
+		}
+	}
+}
+
+func (c *L2CreditConnection) rxHandler(cid uint16, buf *pdu.PDU) (error, bool) {
+	if buf == nil {
+		c.closeLocal()
+		return nil, false
+	}
+
+	if !c.IsOpen() {
+		return nil, false
+	}
+
+	c.rxMutex.Lock()
+	c.rxCredits--
+	valid := c.rxCredits >= 0 && buf.Len() <= int(c.localMPS)
+
+	if valid && c.rxSDU == nil {
+		header := buf.DropLeft(2)
+		if header == nil {
+			valid = false
+		} else {
+			/* Checked before allocating, the length comes from the peer */
+			c.rxSDULen = int(binary.LittleEndian.Uint16(header))
+			valid = c.rxSDULen <= int(c.localMTU)
+			if valid {
+				c.rxSDU = bleutil.GetBufferCap(0, c.rxSDULen)
+				c.rxSDUFrames = 0
+			}
+		}
+	}
+
+	if valid {
+		c.rxSDU.Append(buf.Buf()...)
+		c.rxSDUFrames++
+		valid = c.rxSDU.Len() <= c.rxSDULen
+	}
+
+	if !valid {
+		c.rxMutex.Unlock()
+
+		/* Protocol violation, the channel must be disconnected */
+		go c.Close()
+		return nil, false
+	}
+
+	if c.rxSDU.Len() == c.rxSDULen {
+		c.rxQueue = append(c.rxQueue, creditSDU{buf: c.rxSDU, frames: c.rxSDUFrames})
+		c.rxFramesQueued += c.rxSDUFrames
+		c.rxSDU = nil
+
+		select {
+		case c.rxChan <- struct{}{}:
+		default:
+		}
+	}
+	c.rxMutex.Unlock()
+
+	/* Frames of SDUs still being received are not returned until the SDU is read */
+	c.returnRxCredits()
+	return nil, false
+}
+
+/* Tops the peer up once less than half of the credits are outstanding */
+func (c *L2CreditConnection) returnRxCredits() {
+	c.rxMutex.Lock()
+	inFlight := c.rxCredits + c.rxFramesQueued
+	if c.rxSDU != nil {
+		inFlight += c.rxSDUFrames
+	}
+
+	credits := 0
+	if inFlight <= c.rxInitial/2 {
+		credits = c.rxInitial - inFlight
+		c.rxCredits += credits
+	}
+	c.rxMutex.Unlock()
+
+	if credits > 0 && c.IsOpen() {
+		c.l.sig.sendIndication(SigFlowControlCreditInd, c.localCID, uint16(credits))
+	}
+}
+
+func (c *L2CreditConnection) IsOpen() bool {
+	return !c.closed.IsClosed()
+}
+
+/* Releases the channel without talking to the peer */
+func (c *L2CreditConnection) closeLocal() bool {
+	if c.closed.Close() != nil {
+		return false
+	}
+
+	c.unregister()
+
+	c.rxMutex.Lock()
+	for _, m := range c.rxQueue {
+		bleutil.ReleaseBuffer(m.buf)
+	}
+	c.rxQueue = nil
+	if c.rxSDU != nil {
+		bleutil.ReleaseBuffer(c.rxSDU)
+		c.rxSDU = nil
+	}
+	c.rxMutex.Unlock()
+
+	return true
+}
+
+func (c *L2CreditConnection) Close() error {
+	if !c.closeLocal() {
+		return nil
+	}
+
+	if !c.l.conn.IsOpen() {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var result [2]uint16
+	_, _, err := c.l.SendCommandUint16(ctx, SigDisconnectionReq, result[:0], c.remoteCID, c.localCID)
+	return err
+}
+
+// ReadBuffer returns the next complete SDU
+func (c *L2CreditConnection) ReadBuffer(ctx context.Context) (*pdu.PDU, error) {
+	for {
+		c.rxMutex.Lock()
+		if len(c.rxQueue) > 0 {
+			sdu := c.rxQueue[0]
+			c.rxQueue = c.rxQueue[1:]
+			c.rxFramesQueued -= sdu.frames
+			c.rxMutex.Unlock()
+
+			c.returnRxCredits()
+			return sdu.buf, nil
+		}
+		c.rxMutex.Unlock()
+
+		select {
+		case <-c.rxChan:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-c.closed.Chan():
+			return nil, ErrorL2ChannelClosed
+		}
+	}
+}
+
+// WriteBuffer sends one SDU, blocking until the peer has granted enough credits
+func (c *L2CreditConnection) WriteBuffer(buf *pdu.PDU) error {
+	defer bleutil.ReleaseBuffer(buf)
+
+	if !c.IsOpen() {
+		return ErrorL2ChannelClosed
+	}
+
+	c.txWriteMutex.Lock()
+	defer c.txWriteMutex.Unlock()
+
+	/* The peer can change these on enhanced channels */
+	c.txMutex.Lock()
+	mtu, mps := int(c.remoteMTU), int(c.remoteMPS)
+	c.txMutex.Unlock()
+
+	if buf.Len() > mtu {
+		return ErrorL2SDUTooLong
+	}
+
+	data := buf.Buf()
+	first := true
+	for first || len(data) > 0 {
+		err := c.takeTxCredit()
+		if err != nil {
+			return err
+		}
+
+		room := mps
+		frame := bleutil.GetBufferCap(0, room)
+		if first {
+			binary.LittleEndian.PutUint16(frame.ExtendRight(2), uint16(buf.Len()))
+			room -= 2
+			first = false
+		}
+		if room > len(data) {
+			room = len(data)
+		}
+		frame.Append(data[:room]...)
+		data = data[room:]
+
+		err = c.l.WriteBufferCID(c.remoteCID, frame)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *L2CreditConnection) GetLogger() *logrus.Entry {
+	return c.l.logger
+}
+
+func (c *L2CreditConnection) UseStart() {
+	c.l.conn.UseStart()
+}
+
+func (c *L2CreditConnection) UseDone() {
+	c.l.conn.UseDone()
+}
+
+func (c *L2CreditConnection) ParentConn() hciconnmgr.BufferConn {
+	return c.l.conn
+}
+
+func (c *L2CreditConnection) GetPSM() uint16 {
+	return c.psm
+}
+
+// GetMTU returns the largest SDU that can be received and sent
+func (c *L2CreditConnection) GetMTU() (uint16, uint16) {
+	c.rxMutex.Lock()
+	local := c.localMTU
+	c.rxMutex.Unlock()
+
+	c.txMutex.Lock()
+	defer c.txMutex.Unlock()
+	return local, c.remoteMTU
+}
+
+// IsEnhanced returns true for channels opened with the enhanced credit based procedure
+func (c *L2CreditConnection) IsEnhanced() bool {
+	return c.enhanced
+}
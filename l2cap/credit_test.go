@@ -0,0 +1,405 @@
+package blel2cap
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	bleutil "github.com/BertoldVdb/go-ble/util"
+	pdu "github.com/BertoldVdb/go-misc/pdubuf"
+)
+
+// makeSignallingCommand builds a signalling command with uint16 parameters.
+func makeSignallingCommand(code uint8, id uint8, params ...uint16) *pdu.PDU {
+	body := &pdu.PDU{}
+	hdr := body.ExtendRight(4)
+	hdr[0] = code
+	hdr[1] = id
+	binary.LittleEndian.PutUint16(hdr[2:4], uint16(2*len(params)))
+	for _, m := range params {
+		binary.LittleEndian.PutUint16(body.ExtendRight(2), m)
+	}
+	return body
+}
+
+// parseSignalling splits a transmitted signalling frame in code, id and parameters.
+func parseSignalling(t *testing.T, tx *pdu.PDU) (uint8, uint8, []uint16) {
+	t.Helper()
+	if tx == nil {
+		t.Fatal("no signalling frame sent")
+	}
+	got := tx.Buf()[4:]
+	var params []uint16
+	for i := 4; i+1 < len(got); i += 2 {
+		params = append(params, binary.LittleEndian.Uint16(got[i:]))
+	}
+	return got[0], got[1], params
+}
+
+func newCreditTestL2CAP(config *L2CAPConfig) (*fakeConn, *L2CAP) {
+	conn := newFakeConn()
+	l := New(conn, config, func(psm PSMType, accept L2CAPConnAccepter) {})
+	return conn, l
+}
+
+// openIncoming lets the peer open a channel to psm with the given MPS and credits.
+func openIncoming(t *testing.T, conn *fakeConn, l *L2CAP, psm uint16, mps uint16, credits uint16) []uint16 {
+	t.Helper()
+	req := makeSignallingCommand(SigLECreditBasedConnectionReq, 3, psm, 0x40, 512, mps, credits)
+	if err, _ := l.sig.signallingHandler(l.getSignallingChannel(), req); err != nil {
+		t.Fatal(err)
+	}
+	code, id, params := parseSignalling(t, conn.lastTx())
+	if code != SigLECreditBasedConnectionRsp || id != 3 || len(params) != 5 {
+		t.Fatalf("unexpected response %#x %d %v", code, id, params)
+	}
+	return params
+}
+
+// An accepted channel reassembles SDUs from K-frames and returns credits
+// once the application has read them.
+func TestCreditChannelAcceptAndReceive(t *testing.T) {
+	conn, l := newCreditTestL2CAP(&L2CAPConfig{CreditChannel: CreditChannelConfig{InitialCredits: 4}})
+	ln, err := l.Listen(0x80)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rsp := openIncoming(t, conn, l, 0x80, 64, 10)
+	if rsp[4] != creditResultSuccess || rsp[0] < creditCIDFirst || rsp[3] != 4 {
+		t.Fatalf("unexpected response %v", rsp)
+	}
+
+	c, err := ln.Accept(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if local, remote := c.GetMTU(); local != 1024 || remote != 512 {
+		t.Fatalf("MTU %d/%d", local, remote)
+	}
+
+	/* SDU of 5 bytes split over two K-frames, the first carries the length */
+	l.processInput(makeL2CAPFrame(rsp[0], []byte{5, 0, 'h', 'e'}))
+	l.processInput(makeL2CAPFrame(rsp[0], []byte{'l', 'l', 'o'}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	sdu, err := c.ReadBuffer(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(sdu.Buf()) != "hello" {
+		t.Fatalf("got SDU %q", sdu.Buf())
+	}
+
+	code, _, params := parseSignalling(t, conn.lastTx())
+	if code != SigFlowControlCreditInd || params[0] != rsp[0] || params[1] != 2 {
+		t.Fatalf("expected credit indication, got %#x %v", code, params)
+	}
+}
+
+// Incoming requests are refused for unknown PSMs and insufficient security.
+func TestCreditChannelRefused(t *testing.T) {
+	conn, l := newCreditTestL2CAP(&L2CAPConfig{CreditChannel: CreditChannelConfig{
+		PSMSecurity: map[uint16]SecurityLevel{0x81: SecurityEncrypted, 0x82: SecurityAuthenticated},
+	}})
+
+	if rsp := openIncoming(t, conn, l, 0x80, 64, 1); rsp[4] != creditResultPSMNotSupported {
+		t.Errorf("unknown PSM: result %d", rsp[4])
+	}
+
+	l.Listen(0x81)
+	l.Listen(0x82)
+	l.ListenSecurity(0x83, SecurityEncrypted)
+	if rsp := openIncoming(t, conn, l, 0x81, 64, 1); rsp[4] != creditResultInsufficientEncryption {
+		t.Errorf("unencrypted link: result %d", rsp[4])
+	}
+	if rsp := openIncoming(t, conn, l, 0x83, 64, 1); rsp[4] != creditResultInsufficientEncryption {
+		t.Errorf("unencrypted link, listener security: result %d", rsp[4])
+	}
+
+	l.SetSecurity(fakeSecurity{encrypted: true, keySize: 7})
+	if rsp := openIncoming(t, conn, l, 0x81, 64, 1); rsp[4] != creditResultInsufficientKeySize {
+		t.Errorf("short key: result %d", rsp[4])
+	}
+
+	l.SetSecurity(fakeSecurity{encrypted: true})
+	if rsp := openIncoming(t, conn, l, 0x82, 64, 1); rsp[4] != creditResultInsufficientAuthentication {
+		t.Errorf("unauthenticated link: result %d", rsp[4])
+	}
+	if rsp := openIncoming(t, conn, l, 0x81, 10, 1); rsp[4] != creditResultUnacceptableParameters {
+		t.Errorf("small MPS: result %d", rsp[4])
+	}
+	if rsp := openIncoming(t, conn, l, 0x83, 10, 1); rsp[4] != creditResultUnacceptableParameters {
+		t.Errorf("encrypted link, listener security: result %d", rsp[4])
+	}
+	if rsp := openIncoming(t, conn, l, 0x81, 64, 1); rsp[4] != creditResultSuccess {
+		t.Errorf("encrypted link: result %d", rsp[4])
+	}
+}
+
+type fakeSecurity struct {
+	encrypted     bool
+	authenticated bool
+	keySize       int
+}
+
+func (f fakeSecurity) GetSecurity() (bool, bool, bool) {
+	return f.encrypted, f.authenticated, false
+}
+
+func (f fakeSecurity) GetKeySize() int {
+	return f.keySize
+}
+
+// Accept only returns a channel after the peer was told it is open.
+func TestCreditChannelResponseBeforeAccept(t *testing.T) {
+	conn, l := newCreditTestL2CAP(nil)
+	ln, _ := l.Listen(0x80)
+
+	sent := make(chan int, 1)
+	go func() {
+		if _, err := ln.Accept(context.Background()); err == nil {
+			conn.mu.Lock()
+			sent <- len(conn.tx)
+			conn.mu.Unlock()
+		}
+	}()
+
+	req := makeSignallingCommand(SigLECreditBasedConnectionReq, 3, 0x80, 0x40, 512, 64, 1)
+	if err, _ := l.sig.signallingHandler(l.getSignallingChannel(), req); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case n := <-sent:
+		if n != 1 {
+			t.Errorf("channel accepted before the response was sent")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("channel not accepted")
+	}
+}
+
+// WriteBuffer segments an SDU in MPS sized K-frames and waits for credits.
+func TestCreditChannelSegmentation(t *testing.T) {
+	conn, l := newCreditTestL2CAP(nil)
+	ln, _ := l.Listen(0x80)
+	openIncoming(t, conn, l, 0x80, 23, 2)
+	c, _ := ln.Accept(context.Background())
+
+	data := make([]byte, 50)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.WriteBuffer(bleutil.CopyBufferFromSlice(data))
+	}()
+
+	/* Two credits are available, the third frame needs a credit indication */
+	time.Sleep(20 * time.Millisecond)
+	select {
+	case <-done:
+		t.Fatal("write completed without credits")
+	default:
+	}
+	l.sig.signallingHandler(l.getSignallingChannel(), makeSignallingCommand(SigFlowControlCreditInd, 4, 0x40, 1))
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	conn.mu.Lock()
+	frames := conn.tx
+	conn.mu.Unlock()
+	if len(frames) != 3 {
+		t.Fatalf("got %d frames, want 3", len(frames))
+	}
+
+	var joined []byte
+	for i, m := range frames {
+		b := m.Buf()
+		if cid := binary.LittleEndian.Uint16(b[2:4]); cid != 0x40 {
+			t.Errorf("frame %d sent to CID %#x", i, cid)
+		}
+		if len(b)-4 > 23 {
+			t.Errorf("frame %d exceeds MPS", i)
+		}
+		joined = append(joined, b[4:]...)
+	}
+	if binary.LittleEndian.Uint16(joined) != 50 || !bytes.Equal(joined[2:], data) {
+		t.Fatalf("segments do not form the SDU: %x", joined)
+	}
+}
+
+// A disconnection request from the peer closes the channel and is answered.
+func TestCreditChannelRemoteDisconnect(t *testing.T) {
+	conn, l := newCreditTestL2CAP(nil)
+	ln, _ := l.Listen(0x80)
+	rsp := openIncoming(t, conn, l, 0x80, 64, 1)
+	c, _ := ln.Accept(context.Background())
+
+	l.sig.signallingHandler(l.getSignallingChannel(), makeSignallingCommand(SigDisconnectionReq, 5, rsp[0], 0x40))
+
+	code, id, params := parseSignalling(t, conn.lastTx())
+	if code != SigDisconnectionRsp || id != 5 || params[0] != rsp[0] || params[1] != 0x40 {
+		t.Fatalf("unexpected response %#x %d %v", code, id, params)
+	}
+	if c.IsOpen() {
+		t.Fatal("channel still open")
+	}
+	if _, err := c.ReadBuffer(context.Background()); err != ErrorL2ChannelClosed {
+		t.Fatalf("got %v", err)
+	}
+}
+
+// DialPSM sends a connection request and uses the parameters of the response.
+func TestCreditChannelDial(t *testing.T) {
+	conn, l := newCreditTestL2CAP(nil)
+	go l.Run()
+	defer l.Close()
+
+	type result struct {
+		c   *L2CreditConnection
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		c, err := l.DialPSM(context.Background(), 0x80)
+		done <- result{c, err}
+	}()
+
+	var req *pdu.PDU
+	for i := 0; i < 100 && req == nil; i++ {
+		time.Sleep(5 * time.Millisecond)
+		req = conn.lastTx()
+	}
+	code, id, params := parseSignalling(t, req)
+	if code != SigLECreditBasedConnectionReq || params[0] != 0x80 || params[1] != creditCIDFirst {
+		t.Fatalf("unexpected request %#x %v", code, params)
+	}
+
+	l.processInput(makeL2CAPFrame(l.getSignallingChannel(), makeSignallingCommand(SigLECreditBasedConnectionRsp, id, 0x55, 100, 50, 3, 0).Buf()))
+
+	r := <-done
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if _, remote := r.c.GetMTU(); remote != 100 || r.c.remoteCID != 0x55 || r.c.txCredits != 3 {
+		t.Fatalf("unexpected channel %+v", r.c)
+	}
+}
+
+// An enhanced request opens every acceptable channel and refuses the rest.
+func TestEnhancedChannelAccept(t *testing.T) {
+	conn, l := newCreditTestL2CAP(nil)
+	ln, _ := l.Listen(0x27)
+
+	req := makeSignallingCommand(SigCreditBasedConnectionReq, 9, 0x27, 512, 100, 5, 0x40, 0x41, 0x20, 0x40)
+	if err, _ := l.sig.signallingHandler(l.getSignallingChannel(), req); err != nil {
+		t.Fatal(err)
+	}
+	code, id, params := parseSignalling(t, conn.lastTx())
+	if code != SigCreditBasedConnectionRsp || id != 9 || len(params) != 8 {
+		t.Fatalf("unexpected response %#x %d %v", code, id, params)
+	}
+	if params[4] == 0 || params[5] == 0 || params[6] != 0 || params[7] != 0 {
+		t.Fatalf("unexpected DCIDs %v", params[4:])
+	}
+	if params[3] != creditResultSourceCIDInUse {
+		t.Errorf("result %d", params[3])
+	}
+
+	for i := 0; i < 2; i++ {
+		c, err := ln.Accept(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !c.IsEnhanced() {
+			t.Error("channel is not enhanced")
+		}
+	}
+}
+
+// The peer may grow the MTU of enhanced channels, but never shrink it.
+func TestEnhancedChannelReconfigure(t *testing.T) {
+	conn, l := newCreditTestL2CAP(nil)
+	ln, _ := l.Listen(0x27)
+	l.sig.signallingHandler(l.getSignallingChannel(), makeSignallingCommand(SigCreditBasedConnectionReq, 1, 0x27, 100, 100, 5, 0x40))
+	conn.lastTx()
+	c, _ := ln.Accept(context.Background())
+
+	reconfigure := func(mtu uint16, mps uint16, cid uint16) uint16 {
+		l.sig.signallingHandler(l.getSignallingChannel(), makeSignallingCommand(SigCreditBasedReconfigureReq, 2, mtu, mps, cid))
+		code, _, params := parseSignalling(t, conn.lastTx())
+		if code != SigCreditBasedReconfigureRsp || len(params) != 1 {
+			t.Fatalf("unexpected response %#x %v", code, params)
+		}
+		return params[0]
+	}
+
+	if result := reconfigure(200, 80, 0x40); result != reconfigureResultSuccess {
+		t.Fatalf("result %d", result)
+	}
+	if _, remote := c.GetMTU(); remote != 200 {
+		t.Fatalf("remote MTU %d", remote)
+	}
+	if result := reconfigure(150, 80, 0x40); result != reconfigureResultMTUReduction {
+		t.Errorf("MTU reduction: result %d", result)
+	}
+	if result := reconfigure(300, 80, 0x41); result != reconfigureResultInvalidCID {
+		t.Errorf("unknown CID: result %d", result)
+	}
+}
+
+// DialEnhanced returns the channels that the peer accepted.
+func TestEnhancedChannelDial(t *testing.T) {
+	conn, l := newCreditTestL2CAP(nil)
+	go l.Run()
+	defer l.Close()
+
+	type result struct {
+		c   []*L2CreditConnection
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		c, err := l.DialEnhanced(context.Background(), 0x27, 3)
+		done <- result{c, err}
+	}()
+
+	var req *pdu.PDU
+	for i := 0; i < 100 && req == nil; i++ {
+		time.Sleep(5 * time.Millisecond)
+		req = conn.lastTx()
+	}
+	code, id, params := parseSignalling(t, req)
+	if code != SigCreditBasedConnectionReq || len(params) != 7 || params[0] != 0x27 {
+		t.Fatalf("unexpected request %#x %v", code, params)
+	}
+
+	rsp := makeSignallingCommand(SigCreditBasedConnectionRsp, id, 300, 100, 4, creditResultNoResources, 0x60, 0, 0x61)
+	l.processInput(makeL2CAPFrame(l.getSignallingChannel(), rsp.Buf()))
+
+	r := <-done
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if len(r.c) != 2 || r.c[0].remoteCID != 0x60 || r.c[1].remoteCID != 0x61 {
+		t.Fatalf("unexpected channels %+v", r.c)
+	}
+	if _, remote := r.c[1].GetMTU(); remote != 300 {
+		t.Fatalf("remote MTU %d", remote)
+	}
+
+	/* The refused channel released its CID */
+	l.RLock()
+	_, ok := l.creditConns[params[5]]
+	l.RUnlock()
+	if ok {
+		t.Fatal("refused channel is still registered")
+	}
+}
@@ -39,6 +39,10 @@ type L2CAP struct {
 	sig    *signalling
 	config *L2CAPConfig
 
+	listeners   map[uint16]*L2Listener
+	creditConns map[uint16]*L2CreditConnection
+	security    SecurityInfo
+
 	closeMu  sync.Mutex
 	closed   bool
 	closeErr error
@@ -46,6 +50,8 @@ type L2CAP struct {
 
 type L2CAPConfig struct {
 	BLEUpdateParametersVerify func(c *bleconnecter.BLEConnection, intervalMin uint16, intervalMax uint16, latency uint16, timeout uint16) bool
+
+	CreditChannel CreditChannelConfig
 }
 
 type L2CAPConnAccepter func() hciconnmgr.BufferConn
@@ -55,9 +61,11 @@ func New(conn hciconnmgr.BufferConn, config *L2CAPConfig, newConnCb L2CAPConnCB)
 	l := &L2CAP{
 		conn: conn,
 
-		cidMap: make(map[uint16]*l2cid),
-		logger: bleutil.LogWithPrefix(conn.GetLogger(), "l2"),
-		config: config,
+		cidMap:      make(map[uint16]*l2cid),
+		listeners:   make(map[uint16]*L2Listener),
+		creditConns: make(map[uint16]*L2CreditConnection),
+		logger:      bleutil.LogWithPrefix(conn.GetLogger(), "l2"),
+		config:      config,
 
 		newConnCb: newConnCb,
 	}
@@ -213,12 +221,20 @@ func (l *L2CAP) Close() error {
 	l.closeMu.Unlock()
 
 	var conn []*l2cid
+	var listeners []*L2Listener
 	l.Lock()
 	for _, m := range l.cidMap {
 		conn = append(conn, m)
 	}
+	for _, m := range l.listeners {
+		listeners = append(listeners, m)
+	}
 	l.Unlock()
 
+	for _, m := range listeners {
+		m.Close()
+	}
+
 	for _, m := range conn {
 		if m.rxHandler != nil {
 			m.rxHandler(0, nil)
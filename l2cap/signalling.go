@@ -121,6 +121,13 @@ const (
 	SigInformationRsp                = 0xb
 	SigConnectionParametereUpdateReq = 0x12
 	SigConnectionParametereUpdateRsp = 0x13
+	SigLECreditBasedConnectionReq    = 0x14
+	SigLECreditBasedConnectionRsp    = 0x15
+	SigFlowControlCreditInd          = 0x16
+	SigCreditBasedConnectionReq      = 0x17
+	SigCreditBasedConnectionRsp      = 0x18
+	SigCreditBasedReconfigureReq     = 0x19
+	SigCreditBasedReconfigureRsp     = 0x1A
 )
 
 func (s *signalling) signallingProcess(cid uint16, code uint8, id uint8, payload *pdu.PDU) (error, bool) {
@@ -184,6 +191,33 @@ func (s *signalling) signallingProcess(cid uint16, code uint8, id uint8, payload
 				return s.signallingCommandUint16(payload, cid, id, SigConfigurationRsp, 0, 0, 2)
 			}
 
+		case SigDisconnectionReq:
+			if len(params) == 2 && s.creditHandleDisconnection(params[0], params[1]) {
+				return s.signallingCommandUint16(payload, cid, id, SigDisconnectionRsp, params[0], params[1])
+			}
+
+		case SigLECreditBasedConnectionReq:
+			if len(params) == 5 {
+				return s.creditHandleConnectionReq(payload, cid, id, params)
+			}
+
+		case SigCreditBasedConnectionReq:
+			if len(params) >= 4 {
+				return s.creditHandleEnhancedReq(payload, cid, id, params)
+			}
+
+		case SigCreditBasedReconfigureReq:
+			if len(params) >= 2 {
+				return s.creditHandleReconfigureReq(payload, cid, id, params)
+			}
+
+		case SigFlowControlCreditInd:
+			if len(params) == 2 {
+				/* Indications are not answered */
+				s.creditHandleCredits(params[0], params[1])
+				return nil, false
+			}
+
 		case SigEchoReq:
 			return s.signallingWriteResponse(cid, SigEchoRsp, id, payload), true
 
@@ -316,6 +350,27 @@ func (s *signalling) handleTokenTx(t tokenqueue.Token) {
 	}
 }
 
+/* Sends a command that is not answered by the peer, without waiting for the command queue */
+func (s *signalling) sendIndication(code uint8, params ...uint16) error {
+	s.mu.Lock()
+	id := s.currentOutgoing
+	if s.activeToken != nil {
+		/* Don't reuse the identifier of the outstanding request */
+		id++
+		if id == 0 {
+			id = 1
+		}
+	}
+	s.mu.Unlock()
+
+	payload := bleutil.GetBuffer(2 * len(params))
+	for i, m := range params {
+		binary.LittleEndian.PutUint16(payload.Buf()[2*i:], m)
+	}
+
+	return s.signallingWriteResponse(s.l.getSignallingChannel(), code, id, payload)
+}
+
 func (s *signalling) tokenTimeoutChan() <-chan (struct{}) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
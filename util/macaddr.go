@@ -127,3 +127,9 @@ func (a BLEAddr) IsLess(b BLEAddr) bool {
 func (a BLEAddr) Network() string {
 	return "BLE"
 }
+
+// IsResolvablePrivate reports whether the address is a resolvable private
+// address: a random address whose two most significant bits are 01.
+func (a BLEAddr) IsResolvablePrivate() bool {
+	return a.MacAddrType == MacAddrRandom && a.MacAddr>>46 == 1
+}
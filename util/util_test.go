@@ -97,6 +97,18 @@ func TestBLEAddrIsLessAndUint64(t *testing.T) {
 	}
 }
 
+func TestBLEAddrIsResolvablePrivate(t *testing.T) {
+	if !(BLEAddr{MacAddr: 0x4a1122334455, MacAddrType: MacAddrRandom}).IsResolvablePrivate() {
+		t.Error("RPA not detected")
+	}
+	if (BLEAddr{MacAddr: 0xca1122334455, MacAddrType: MacAddrRandom}).IsResolvablePrivate() {
+		t.Error("static random address detected as RPA")
+	}
+	if (BLEAddr{MacAddr: 0x4a1122334455, MacAddrType: MacAddrPublic}).IsResolvablePrivate() {
+		t.Error("public address detected as RPA")
+	}
+}
+
 func TestMacAddrTypeString(t *testing.T) {
 	cases := []struct {
 		t    MacAddrType